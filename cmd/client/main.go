@@ -2,19 +2,31 @@ package main
 
 import (
 	"bufio"
+	"cmp"
+	"context"
 	"crypto/x509"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
+	"maps"
 	"os"
+	"slices"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/omochice/toy-socket-chat/internal/client"
+	"github.com/omochice/toy-socket-chat/pkg/protocol"
 )
 
 func main() {
 	// Parse command-line flags
-	serverAddr := flag.String("server", "localhost:8080", "Server address (e.g., localhost:8080)")
+	serverAddr := flag.String(
+		"server",
+		"localhost:8080",
+		"Server address (e.g., localhost:8080 or unix:/run/chat.sock)",
+	)
 	username := flag.String("username", "", "Username for chat")
 	protocol := flag.String("protocol", "tcp", "Protocol to use (tcp, ws, or wt)")
 	caPath := flag.String(
@@ -22,6 +34,8 @@ func main() {
 		"",
 		"Path to a PEM CA certificate to trust (only used with -protocol wt)",
 	)
+	receipts := flag.Bool("receipts", true, "Let other users see what you have read")
+	password := flag.String("password", "", "Operator password, if -username is an operator")
 	flag.Parse()
 
 	if *username == "" {
@@ -34,7 +48,12 @@ func main() {
 	}
 
 	// Create client
-	c := client.New(*serverAddr, *username, *protocol, buildOptions(*protocol, *caPath)...)
+	opts := append(
+		buildOptions(*protocol, *caPath),
+		client.WithReadReceipts(*receipts),
+		client.WithPassword(*password),
+	)
+	c := client.New(*serverAddr, *username, *protocol, opts...)
 
 	// Connect to server
 	if err := c.Connect(); err != nil {
@@ -48,23 +67,74 @@ func main() {
 	if err := c.Join(); err != nil {
 		log.Fatalf("Failed to join chat: %v", err)
 	}
+	showUnread(c)
+
+	reads := newReadTracker()
+	go reportReads(c, reads)
 
 	// Start goroutine to receive and display messages
 	go func() {
+		// highlighted holds the IDs of messages already shown as mentioning
+		// the user, whose MENTION notifications need not be shown again.
+		highlighted := make(map[string]bool)
+		// typing holds when each user last said they are typing.
+		typing := make(map[string]time.Time)
 		for msg := range c.Messages() {
 			switch msg.Type {
 			case 0: // MessageTypeText
-				fmt.Printf("[%s]: %s\n", msg.Sender, msg.Content)
+				delete(typing, msg.Sender)
+				if printText(msg, *username) {
+					highlighted[msg.ID] = true
+				}
+				reads.saw(msg.ID)
 			case 1: // MessageTypeJoin
 				fmt.Printf("*** %s joined the chat ***\n", msg.Sender)
 			case 2: // MessageTypeLeave
+				delete(typing, msg.Sender)
 				fmt.Printf("*** %s left the chat ***\n", msg.Sender)
+			case 3: // MessageTypeReconnect
+				fmt.Printf("*** %s ***\n", msg.Content)
+				// Reconnect waits for this loop to drain the old connection's
+				// messages, so it cannot run here.
+				go reconnect(c)
+			case 7: // MessageTypeEdit
+				fmt.Printf("[%s]: %s (edited)\n", msg.Sender, msg.Content)
+			case 8: // MessageTypeDelete
+				fmt.Printf("[%s]: [message deleted]\n", msg.Sender)
+			case 9: // MessageTypeReaction
+				fmt.Printf("    #%s %s\n", msg.ID, formatReactions(msg.Reactions))
+			case 11: // MessageTypeMention
+				// Mentions made while the user was offline arrive after
+				// joining; others were already highlighted.
+				if !highlighted[msg.ID] {
+					fmt.Printf(
+						"%s*** %s mentioned you: %s  #%s ***%s\n",
+						highlightStart, msg.Sender, msg.Content, msg.ID, highlightEnd,
+					)
+				}
+			case 12: // MessageTypeTyping
+				if startedTyping(typing, msg) {
+					fmt.Printf("*** %s is typing... ***\n", msg.Sender)
+				}
+			case 13: // MessageTypeRead
+				if reads.isOwn(msg.ID) {
+					fmt.Printf("    #%s read by %s\n", msg.ID, msg.Sender)
+				}
+			case 14: // MessageTypeDirect
+				delete(typing, msg.Sender)
+				fmt.Printf("[%s → you]: %s\n", msg.Sender, msg.Content)
 			}
 		}
 	}()
 
 	// Read from stdin and send messages
 	fmt.Println("Type your messages (or 'quit' to exit):")
+	fmt.Println("'/edit <text>' and '/delete' change your last message.")
+	fmt.Println("'/react <id> <emoji>' and '/unreact <id> <emoji>' react to a message.")
+	fmt.Println("'/reply <id> <text>' replies in a thread; '/thread <id>' shows its replies.")
+	fmt.Println("'/msg <user> <text>' sends a message to that user only.")
+	// lastSent is the ID of the user's most recent message.
+	var lastSent string
 	scanner := bufio.NewScanner(os.Stdin)
 	for scanner.Scan() {
 		text := strings.TrimSpace(scanner.Text())
@@ -76,9 +146,12 @@ func main() {
 			break
 		}
 
-		if err := c.SendMessage(text); err != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), ackTimeout)
+		if err := handleInput(ctx, c, *username, text, &lastSent); err != nil {
 			log.Printf("Failed to send message: %v", err)
 		}
+		cancel()
+		reads.sent(lastSent)
 	}
 
 	if err := scanner.Err(); err != nil {
@@ -93,6 +166,270 @@ func main() {
 	log.Println("Disconnected from server")
 }
 
+// handleInput sends a line typed by the user: a command, or else a new
+// message, whose ID it stores in *lastSent for /edit and /delete.
+func handleInput(
+	ctx context.Context, c *client.Client, username, text string, lastSent *string,
+) error {
+	command, args, _ := strings.Cut(text, " ")
+	switch command {
+	case "/edit", "/delete":
+		if *lastSent == "" {
+			return errors.New("no message of yours to change")
+		}
+		if command == "/delete" {
+			if err := c.DeleteMessage(ctx, *lastSent); err != nil {
+				return err
+			}
+			fmt.Printf("[%s]: [message deleted]\n", username)
+			*lastSent = ""
+			return nil
+		}
+		if args == "" {
+			return errors.New("usage: /edit <text>")
+		}
+		if err := c.EditMessage(ctx, *lastSent, args); err != nil {
+			return err
+		}
+		fmt.Printf("[%s]: %s (edited)\n", username, args)
+		return nil
+	case "/reply":
+		parentID, content, ok := strings.Cut(args, " ")
+		if !ok || content == "" {
+			return errors.New("usage: /reply <id> <text>")
+		}
+		id, err := c.Reply(ctx, strings.TrimPrefix(parentID, "#"), content)
+		if err != nil {
+			return err
+		}
+		*lastSent = id
+		return nil
+	case "/thread":
+		if args == "" {
+			return errors.New("usage: /thread <id>")
+		}
+		replies, count, err := c.Thread(ctx, strings.TrimPrefix(args, "#"))
+		if err != nil {
+			return err
+		}
+		fmt.Printf("*** %d replies ***\n", count)
+		if len(replies) < count {
+			fmt.Printf("    (%d older replies not shown)\n", count-len(replies))
+		}
+		for _, reply := range replies {
+			printText(reply, username)
+		}
+		return nil
+	case "/msg":
+		to, content, ok := strings.Cut(args, " ")
+		if !ok || content == "" {
+			return errors.New("usage: /msg <user> <text>")
+		}
+		_, queued, err := c.SendDirect(ctx, to, content)
+		if err != nil {
+			return err
+		}
+		if queued {
+			fmt.Printf("*** %s is offline; they will get your message when they join ***\n", to)
+		}
+		return nil
+	case "/react", "/unreact":
+		id, emoji, ok := strings.Cut(args, " ")
+		if !ok || emoji == "" {
+			return fmt.Errorf("usage: %s <id> <emoji>", command)
+		}
+		id = strings.TrimPrefix(id, "#")
+		if command == "/unreact" {
+			return c.RemoveReaction(ctx, id, emoji)
+		}
+		return c.AddReaction(ctx, id, emoji)
+	}
+
+	id, err := c.SendMessageContext(ctx, text)
+	if err != nil {
+		return err
+	}
+	*lastSent = id
+	return nil
+}
+
+// startedTyping records a TYPING message in typing and reports whether it
+// says its sender started typing, rather than that they still are or have
+// stopped. A user who sends no TYPING for protocol.TypingTimeout has stopped.
+func startedTyping(typing map[string]time.Time, msg protocol.Message) bool {
+	if msg.Remove {
+		delete(typing, msg.Sender)
+		return false
+	}
+	last, ok := typing[msg.Sender]
+	typing[msg.Sender] = time.Now()
+	return !ok || time.Since(last) >= protocol.TypingTimeout
+}
+
+// highlightStart and highlightEnd surround lines that mention the user: the
+// terminal bell, then bold text.
+const (
+	highlightStart = "\a\x1b[1m"
+	highlightEnd   = "\x1b[0m"
+)
+
+// printText prints a text message with its ID, which commands such as /react
+// refer to. Replies are indented under the ID of the thread they belong to,
+// and messages mentioning username are highlighted, which it reports.
+func printText(msg protocol.Message, username string) bool {
+	var line string
+	switch {
+	case msg.ParentID != "":
+		line = fmt.Sprintf("    ↳ #%s [%s]: %s  #%s",
+			msg.ParentID, msg.Sender, msg.Content, msg.ID)
+	case msg.ID != "":
+		line = fmt.Sprintf("[%s]: %s  #%s", msg.Sender, msg.Content, msg.ID)
+	default:
+		line = fmt.Sprintf("[%s]: %s", msg.Sender, msg.Content)
+	}
+	mentioned := slices.Contains(msg.Mentions, username)
+	if mentioned {
+		line = highlightStart + line + highlightEnd
+	}
+	fmt.Println(line)
+	return mentioned
+}
+
+// formatReactions renders reaction counts compactly, e.g. "👍 2  🎉 1", most
+// popular first.
+func formatReactions(reactions map[string]int) string {
+	if len(reactions) == 0 {
+		return "no reactions"
+	}
+	emojis := slices.Collect(maps.Keys(reactions))
+	slices.SortFunc(emojis, func(a, b string) int {
+		if n := cmp.Compare(reactions[b], reactions[a]); n != 0 {
+			return n
+		}
+		return strings.Compare(a, b)
+	})
+	parts := make([]string, len(emojis))
+	for i, emoji := range emojis {
+		parts[i] = fmt.Sprintf("%s %d", emoji, reactions[emoji])
+	}
+	return strings.Join(parts, "  ")
+}
+
+// ackTimeout is how long the client waits for the server to accept a message
+// before reporting it as not delivered.
+const ackTimeout = 5 * time.Second
+
+// readInterval is how often the client moves the user's read marker on the
+// server to the newest message shown, if there is a newer one.
+const readInterval = 2 * time.Second
+
+// readTracker remembers the newest message shown to the user, for
+// reportReads, and the messages the user sent, whose read receipts are shown.
+type readTracker struct {
+	mu     sync.Mutex
+	latest string
+	own    map[string]bool
+}
+
+func newReadTracker() *readTracker {
+	return &readTracker{own: make(map[string]bool)}
+}
+
+// saw records that the message with the given ID was shown to the user.
+func (r *readTracker) saw(id string) {
+	if id == "" {
+		return
+	}
+	r.mu.Lock()
+	r.latest = id
+	r.mu.Unlock()
+}
+
+// sent records that the user sent the message with the given ID.
+func (r *readTracker) sent(id string) {
+	if id == "" {
+		return
+	}
+	r.mu.Lock()
+	r.own[id] = true
+	r.mu.Unlock()
+}
+
+// isOwn reports whether the user sent the message with the given ID.
+func (r *readTracker) isOwn(id string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.own[id]
+}
+
+// newest returns the ID of the newest message shown to the user.
+func (r *readTracker) newest() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.latest
+}
+
+// reportReads moves the user's read marker every readInterval, so that the
+// server does not hear about every message shown. A failed move is retried.
+func reportReads(c *client.Client, reads *readTracker) {
+	var reported string
+	ticker := time.NewTicker(readInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		latest := reads.newest()
+		if latest == reported {
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), ackTimeout)
+		err := c.MarkRead(ctx, latest)
+		cancel()
+		if err != nil {
+			log.Printf("Failed to mark messages read: %v", err)
+			continue
+		}
+		reported = latest
+	}
+}
+
+// showUnread draws a divider telling the user how many messages arrived
+// since they last read, if they have read any before and new ones arrived.
+func showUnread(c *client.Client) {
+	ctx, cancel := context.WithTimeout(context.Background(), ackTimeout)
+	defer cancel()
+	marker, count, err := c.Unread(ctx)
+	if err != nil {
+		log.Printf("Failed to count unread messages: %v", err)
+		return
+	}
+	if marker != "" && count > 0 {
+		fmt.Printf("----- %d new messages since #%s -----\n", count, marker)
+	}
+}
+
+// reconnectAttempts and reconnectDelay bound how long the client retries after
+// a RECONNECT message while the new server process takes over.
+const (
+	reconnectAttempts = 5
+	reconnectDelay    = 500 * time.Millisecond
+)
+
+// reconnect follows the server's request to reconnect, retrying a few times.
+func reconnect(c *client.Client) {
+	for attempt := 1; ; attempt++ {
+		err := c.Reconnect()
+		if err == nil {
+			log.Println("Reconnected to server")
+			showUnread(c)
+			return
+		}
+		if attempt == reconnectAttempts {
+			log.Printf("Failed to reconnect: %v", err)
+			return
+		}
+		time.Sleep(reconnectDelay)
+	}
+}
+
 // buildOptions translates the CA flag into client options. The CA only affects
 // TLS verification for WebTransport, so it is ignored (with a notice) for the
 // plaintext tcp and ws protocols rather than failing the whole invocation.
@@ -3,58 +3,513 @@ package main
 import (
 	"crypto/tls"
 	"flag"
+	"fmt"
 	"log"
+	"log/slog"
+	"net"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
+	"time"
 
+	"github.com/omochice/toy-socket-chat/internal/cluster"
+	"github.com/omochice/toy-socket-chat/internal/config"
+	"github.com/omochice/toy-socket-chat/internal/devcert"
 	"github.com/omochice/toy-socket-chat/internal/server"
+	"github.com/omochice/toy-socket-chat/internal/systemd"
+	"github.com/omochice/toy-socket-chat/internal/upgrade"
 )
 
+// upgradeTimeout is how long SIGUSR2 waits for the new process to start
+// serving before giving up and keeping the current one.
+const upgradeTimeout = 30 * time.Second
+
 func main() {
 	// Parse command-line flags
+	configPath := flag.String(
+		"config",
+		"",
+		"Path to a JSON configuration file (reloaded on SIGHUP)",
+	)
 	port := flag.String("port", ":8080", "Port to listen on (e.g., :8080)")
 	certFile := flag.String("cert", "", "Path to TLS certificate PEM file (enables WebTransport)")
 	keyFile := flag.String("key", "", "Path to TLS private key PEM file (enables WebTransport)")
+	devTLS := flag.Bool(
+		"dev-tls",
+		false,
+		"Generate a short-lived self-signed certificate for local WebTransport testing",
+	)
+	devTLSCert := flag.String(
+		"dev-tls-cert",
+		"dev-cert.pem",
+		"Where -dev-tls writes the generated certificate, for use with the client's -ca",
+	)
+	allowedOrigins := flag.String(
+		"allowed-origins",
+		"",
+		"Comma-separated browser origins allowed to connect (e.g., https://*.example.com)",
+	)
+	allowedHosts := flag.String(
+		"allowed-hosts",
+		"",
+		"Comma-separated Host names browsers may connect to (e.g., chat.example.com)",
+	)
+	trustedProxies := flag.String(
+		"trusted-proxies",
+		"",
+		"Comma-separated IPs or CIDR prefixes of load balancers whose PROXY protocol and "+
+			"X-Forwarded-For headers are trusted",
+	)
+	adminAddr := flag.String(
+		"admin",
+		"",
+		"Address for the admin HTTP API (e.g., 127.0.0.1:9090); disabled when empty",
+	)
+	metricsAddr := flag.String(
+		"metrics",
+		"",
+		"Address for the Prometheus /metrics endpoint (e.g., 127.0.0.1:9091); disabled when empty",
+	)
+	node := flag.String("node", "", "Name of this server in a cluster (default: the host name)")
+	clusterListen := flag.String(
+		"cluster-listen",
+		"",
+		"Address other cluster nodes connect to (e.g., 10.0.0.1:7946); empty disables clustering",
+	)
+	clusterSecret := flag.String(
+		"cluster-secret",
+		"",
+		"Secret shared by the cluster nodes; required with -cluster-listen",
+	)
+	clusterPeers := flag.String(
+		"cluster-peers",
+		"",
+		"Comma-separated addresses of the other cluster nodes",
+	)
+	federationName := flag.String(
+		"federation-name",
+		"",
+		"Name shown after this server's users on federated servers (default: the host name)",
+	)
+	federationSecret := flag.String(
+		"federation-secret",
+		"",
+		"Shared secret for federation links; accepts incoming links when set",
+	)
+	federationPeers := flag.String(
+		"federation-peers",
+		"",
+		"Comma-separated chat addresses of servers to federate with",
+	)
+	federationRelay := flag.String(
+		"federation-relay",
+		"",
+		"What links to the named servers relay, e.g. serverB=messages+reactions,serverC=presence",
+	)
+	drainTimeout := flag.Duration(
+		"drain-timeout",
+		30*time.Second,
+		"How long the old process waits for clients to reconnect after a SIGUSR2 upgrade",
+	)
+	logFormat := flag.String("log-format", "text", "Log output format (text or json)")
+	logLevel := flag.String("log-level", "info", "Minimum log level (debug, info, warn, or error)")
 	flag.Parse()
 
-	// Both cert and key are required to enable WebTransport; a single one is a
-	// misconfiguration rather than a valid TCP/WebSocket-only setup.
-	var opts []server.Option
-	switch {
-	case *certFile != "" && *keyFile != "":
-		cert, err := tls.LoadX509KeyPair(*certFile, *keyFile)
-		if err != nil {
-			log.Fatalf("Failed to load TLS key pair: %v", err)
+	// Flags given explicitly on the command line override the config file, both
+	// at startup and on every reload.
+	applyFlags := func(cfg *config.Config) {
+		flag.Visit(func(f *flag.Flag) {
+			switch f.Name {
+			case "port":
+				cfg.Listen = *port
+			case "cert":
+				cfg.TLS.Cert = *certFile
+			case "key":
+				cfg.TLS.Key = *keyFile
+			case "allowed-origins":
+				cfg.AllowedOrigins = strings.Split(*allowedOrigins, ",")
+			case "allowed-hosts":
+				cfg.AllowedHosts = strings.Split(*allowedHosts, ",")
+			case "trusted-proxies":
+				cfg.TrustedProxies = strings.Split(*trustedProxies, ",")
+			case "admin":
+				cfg.Admin = *adminAddr
+			case "metrics":
+				cfg.Metrics = *metricsAddr
+			case "log-format":
+				cfg.Log.Format = *logFormat
+			case "log-level":
+				cfg.Log.Level = *logLevel
+			case "node":
+				cfg.Cluster.Node = *node
+			case "cluster-listen":
+				cfg.Cluster.Listen = *clusterListen
+			case "cluster-secret":
+				cfg.Cluster.Secret = *clusterSecret
+			case "cluster-peers":
+				cfg.Cluster.Peers = strings.Split(*clusterPeers, ",")
+			case "federation-name":
+				cfg.Federation.Name = *federationName
+			case "federation-secret":
+				cfg.Federation.Secret = *federationSecret
+			case "federation-peers":
+				cfg.Federation.Peers = strings.Split(*federationPeers, ",")
+			case "federation-relay":
+				cfg.Federation.Relay = parseRelay(*federationRelay)
+			}
+		})
+	}
+
+	cfg, err := loadConfig(*configPath, applyFlags)
+	if err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+
+	// The level lives in a LevelVar so a reload can change it in place.
+	level := new(slog.LevelVar)
+	level.Set(cfg.LogLevel())
+	logger := newLogger(cfg.Log.Format, level)
+	// Route anything still using the default logger through the same handler.
+	slog.SetDefault(logger)
+
+	// Under systemd socket activation the sockets are already bound and
+	// replace the configured listeners.
+	sockets, err := systemd.Sockets()
+	if err != nil {
+		fatal(logger, "Failed to use sockets from systemd", "error", err)
+	}
+	// After a SIGUSR2 upgrade the previous process's sockets replace them
+	// the same way.
+	handoff, err := upgrade.Inherited()
+	if err != nil {
+		fatal(logger, "Failed to take over sockets from previous process", "error", err)
+	}
+	serverCfg := *cfg
+	if handoff != nil {
+		logger.Info(
+			"Taking over sockets from previous process",
+			"count", len(handoff.Listeners),
+		)
+		serverCfg.Listen = ""
+		serverCfg.Listeners = nil
+	} else if len(sockets) > 0 {
+		logger.Info(
+			"Using sockets from systemd, ignoring configured listeners",
+			"count", len(sockets),
+		)
+		serverCfg.Listen = ""
+		serverCfg.Listeners = nil
+	}
+
+	opts, err := serverCfg.ServerOptions()
+	if err != nil {
+		fatal(logger, "Invalid configuration", "error", err)
+	}
+	opts = append(opts, server.WithLogger(logger))
+	// Cluster settings only take effect on restart, so the address is fixed
+	// for the life of the process.
+	var mesh *cluster.Mesh
+	clusterAddr := cfg.Cluster.Listen
+	if clusterAddr != "" {
+		meshOpts := []cluster.Option{
+			cluster.WithLogger(logger),
+			cluster.WithSecret(cfg.Cluster.Secret),
+		}
+		if handoff != nil {
+			if ln, ok := handoff.Sockets[clusterAddr]; ok {
+				meshOpts = append(meshOpts, cluster.WithListener(ln))
+			}
+		}
+		mesh = cluster.New(cfg.Cluster.NodeName(), clusterAddr, cfg.Cluster.Peers, meshOpts...)
+		opts = append(opts, server.WithBroker(mesh))
+	}
+	if handoff != nil {
+		opts = append(opts, handoff.Options()...)
+	} else if len(sockets) > 0 {
+		opts = append(opts, server.WithListeners(inheritedListeners(sockets)...))
+	}
+	if *devTLS {
+		if cfg.TLS.Cert != "" {
+			fatal(logger, "-dev-tls cannot be combined with a TLS certificate and key")
+		}
+		// After a SIGUSR2 upgrade keep the previous process's certificate, so
+		// the written file and any pinned hash stay valid.
+		var cert tls.Certificate
+		if handoff != nil && handoff.Certificate != nil {
+			cert = *handoff.Certificate
+		} else if cert, err = devCertificate(*devTLSCert); err != nil {
+			fatal(logger, "Failed to set up development certificate", "error", err)
 		}
+		logger.Warn(
+			"Using a self-signed development certificate; do not use it in production",
+			"cert_file", *devTLSCert,
+		)
 		opts = append(opts, server.WithTLS(cert))
-	case *certFile != "" || *keyFile != "":
-		log.Fatal("Both -cert and -key must be provided to enable WebTransport")
 	}
 
 	// Create and start server
-	srv := server.New(*port, opts...)
+	srv := server.New(serverCfg.Listen, opts...)
 
 	// Handle graceful shutdown
 	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
+	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGUSR2)
 
 	errChan := make(chan error, 1)
 	go func() {
-		log.Printf("Starting server on %s...", *port)
+		logger.Info("Starting server", "addr", serverCfg.Listen)
 		errChan <- srv.Start()
 	}()
 
-	// Wait for either error or shutdown signal
-	select {
-	case err := <-errChan:
+	// When run as a Type=notify service, tell systemd when the server is ready
+	// and keep its watchdog fed from this loop.
+	ready := srv.Ready()
+	var watchdog <-chan time.Time
+	if interval, err := systemd.WatchdogInterval(); err != nil {
+		logger.Warn("Ignoring systemd watchdog", "error", err)
+	} else if interval > 0 {
+		ticker := time.NewTicker(interval / 2)
+		defer ticker.Stop()
+		watchdog = ticker.C
+	}
+
+	// Wait for either error or shutdown signal; SIGHUP reloads and keeps going.
+	for running := true; running; {
+		select {
+		case <-ready:
+			ready = nil
+			notify(logger, systemd.Ready)
+			if handoff != nil {
+				if err := handoff.Ready(); err != nil {
+					logger.Warn("Failed to notify previous process", "error", err)
+				}
+			}
+		case <-watchdog:
+			notify(logger, systemd.Watchdog)
+		case err := <-errChan:
+			if err != nil {
+				fatal(logger, "Server error", "error", err)
+			}
+			running = false
+		case sig := <-sigChan:
+			if sig == syscall.SIGHUP {
+				cfg = reload(logger, srv, level, cfg, *configPath, applyFlags)
+				continue
+			}
+			if sig == syscall.SIGUSR2 {
+				var extra map[string]net.Listener
+				if mesh != nil {
+					extra = map[string]net.Listener{clusterAddr: mesh.Listener()}
+				}
+				// Starting the new process and draining block this loop, so
+				// the watchdog is fed meanwhile.
+				stop := feedWatchdog(logger, watchdog)
+				running = !handOver(logger, srv, extra, *drainTimeout)
+				stop()
+				continue
+			}
+			logger.Info("Received signal, shutting down", "signal", sig.String())
+			notify(logger, systemd.Stopping)
+			srv.Stop()
+			running = false
+		}
+	}
+
+	logger.Info("Server stopped")
+}
+
+// loadConfig reads the config file at path, or starts from the defaults when
+// path is empty, and applies command-line overrides.
+func loadConfig(path string, applyFlags func(*config.Config)) (*config.Config, error) {
+	cfg := config.Default()
+	if path != "" {
+		var err error
+		if cfg, err = config.Load(path); err != nil {
+			return nil, err
+		}
+	}
+	applyFlags(cfg)
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// reload re-reads the config file and applies the settings that can change on
+// a running server: limits, bans, MOTD, log level and the TLS certificate.
+// Connections are left untouched except for clients matched by new bans. On
+// error the current configuration stays in effect and is returned.
+func reload(
+	logger *slog.Logger,
+	srv *server.Server,
+	level *slog.LevelVar,
+	current *config.Config,
+	path string,
+	applyFlags func(*config.Config),
+) *config.Config {
+	if path == "" {
+		logger.Warn("Received SIGHUP but no -config file was given; nothing to reload")
+		return current
+	}
+	logger.Info("Reloading configuration", "path", path)
+
+	next, err := loadConfig(path, applyFlags)
+	if err != nil {
+		logger.Error("Reload failed, keeping current configuration", "error", err)
+		return current
+	}
+	bans, err := next.ServerBans()
+	if err != nil {
+		logger.Error("Reload failed, keeping current configuration", "error", err)
+		return current
+	}
+
+	srv.SetLimits(next.ServerLimits())
+	srv.SetBans(bans)
+	srv.SetOperators(next.Auth.Operators)
+	srv.SetMOTD(next.MOTD)
+	level.Set(next.LogLevel())
+	// The server already reloads its certificate files when they change; a
+	// reload just makes that happen immediately.
+	if next.TLS.Cert != "" && next.TLS == current.TLS {
+		cert, err := next.LoadCertificate()
 		if err != nil {
-			log.Fatalf("Server error: %v", err)
+			logger.Error("Failed to reload TLS certificate, keeping current one", "error", err)
+		} else {
+			srv.SetTLSCertificate(cert)
+		}
+	}
+
+	if changed := current.RestartRequired(next); len(changed) > 0 {
+		logger.Warn("Some settings only take effect after a restart", "settings", changed)
+	}
+	return next
+}
+
+// feedWatchdog pings the systemd watchdog on every tick until the returned
+// function is called, for while the main loop is busy.
+func feedWatchdog(logger *slog.Logger, ticks <-chan time.Time) (stop func()) {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		for {
+			select {
+			case <-ticks:
+				notify(logger, systemd.Watchdog)
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
+
+// handOver starts a new copy of the server binary on this process's sockets,
+// plus extra ones such as the cluster node's, and, once it is serving, drains
+// this server's clients. It reports whether the new process took over, in
+// which case this one should exit.
+func handOver(
+	logger *slog.Logger,
+	srv *server.Server,
+	extra map[string]net.Listener,
+	drainTimeout time.Duration,
+) bool {
+	logger.Info("Received SIGUSR2, starting new server process")
+	proc, err := upgrade.Exec(srv, extra, upgradeTimeout)
+	if err != nil {
+		logger.Error("Upgrade failed, continuing to serve", "error", err)
+		return false
+	}
+	logger.Info("New server process ready, draining clients", "pid", proc.Pid)
+	notify(logger, systemd.MainPID(proc.Pid))
+	srv.Drain(drainTimeout)
+	return true
+}
+
+// inheritedListeners describes the sockets passed by systemd as server
+// listeners accepting every transport their socket type can carry.
+func inheritedListeners(sockets []systemd.Socket) []server.Listener {
+	listeners := make([]server.Listener, 0, len(sockets))
+	for _, socket := range sockets {
+		if socket.PacketConn != nil {
+			listeners = append(listeners, server.Listener{
+				Network:      "udp",
+				Address:      socket.PacketConn.LocalAddr().String(),
+				PacketSocket: socket.PacketConn,
+			})
+			continue
+		}
+		network := "tcp"
+		if socket.Listener.Addr().Network() == "unix" {
+			network = "unix"
 		}
-	case sig := <-sigChan:
-		log.Printf("Received signal %v, shutting down...", sig)
-		srv.Stop()
+		listeners = append(listeners, server.Listener{
+			Network:      network,
+			Address:      socket.Listener.Addr().String(),
+			StreamSocket: socket.Listener,
+		})
 	}
+	return listeners
+}
+
+// parseRelay parses the -federation-relay flag, a comma-separated list of
+// server=scope+scope entries. An entry without scopes is kept empty for
+// validation to reject.
+func parseRelay(value string) map[string][]string {
+	relay := make(map[string][]string)
+	for entry := range strings.SplitSeq(value, ",") {
+		peer, scopes, _ := strings.Cut(entry, "=")
+		relay[peer] = nil
+		if scopes != "" {
+			relay[peer] = strings.Split(scopes, "+")
+		}
+	}
+	return relay
+}
+
+// notify sends state to systemd, logging rather than failing on errors since
+// the server works the same without a service manager.
+func notify(logger *slog.Logger, state string) {
+	if _, err := systemd.Notify(state); err != nil {
+		logger.Warn("Failed to notify systemd", "state", state, "error", err)
+	}
+}
+
+// devCertificate generates a development certificate for this host, writes
+// it to certPath so clients can trust it, and prints its SHA-256 hash for
+// browsers that pin it through serverCertificateHashes.
+func devCertificate(certPath string) (tls.Certificate, error) {
+	hosts := []string{"localhost", "127.0.0.1", "::1"}
+	if hostname, err := os.Hostname(); err == nil && hostname != "localhost" {
+		hosts = append(hosts, hostname)
+	}
+	cert, certPEM, err := devcert.Generate(hosts)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	if err := os.WriteFile(certPath, certPEM, 0o644); err != nil {
+		return tls.Certificate{}, fmt.Errorf("failed to write certificate: %w", err)
+	}
+	fmt.Printf("Development certificate SHA-256: %s\n", devcert.Fingerprint(cert))
+	return cert, nil
+}
+
+// newLogger builds the process logger. Logs go to stderr so they never mix
+// with anything written to stdout. format must already be validated.
+func newLogger(format string, level slog.Leveler) *slog.Logger {
+	opts := &slog.HandlerOptions{Level: level}
+	if format == "json" {
+		return slog.New(slog.NewJSONHandler(os.Stderr, opts))
+	}
+	return slog.New(slog.NewTextHandler(os.Stderr, opts))
+}
 
-	log.Println("Server stopped")
+// fatal logs msg at error level and exits, mirroring log.Fatal for slog.
+func fatal(logger *slog.Logger, msg string, args ...any) {
+	logger.Error(msg, args...)
+	os.Exit(1)
 }
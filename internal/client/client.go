@@ -4,11 +4,15 @@ import (
 	"context"
 	"crypto/tls"
 	"crypto/x509"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 
 	"github.com/gobwas/ws"
 	"github.com/omochice/toy-socket-chat/pkg/protocol"
@@ -21,11 +25,35 @@ type Client struct {
 	username string
 	protocol string
 	rootCAs  *x509.CertPool
+	logger   *slog.Logger
+	receipts bool
+	password string
 	conn     ClientConnection
 	messages chan protocol.Message
 	mu       sync.RWMutex
 	done     chan struct{}
 	wg       sync.WaitGroup
+
+	// writeMu serializes writes to conn, since messages may be sent from
+	// several goroutines and a connection may write one in several pieces.
+	writeMu sync.Mutex
+
+	// pending maps the correlation IDs of messages sent by request to the
+	// channel their ACK or NACK is passed on. nextID numbers them.
+	pendingMu sync.Mutex
+	pending   map[string]chan protocol.Message
+	nextID    atomic.Uint64
+}
+
+// RejectedError is returned by SendMessageContext and the other methods that
+// wait for the server when it refuses a message.
+type RejectedError struct {
+	// Reason is the server's explanation, such as "message too long".
+	Reason string
+}
+
+func (e *RejectedError) Error() string {
+	return "server rejected message: " + e.Reason
 }
 
 // Option configures optional Client behavior.
@@ -41,7 +69,37 @@ func WithRootCAs(pool *x509.CertPool) Option {
 	}
 }
 
-// New creates a new Client instance
+// WithLogger sets the logger used for connection errors. Defaults to
+// slog.Default().
+func WithLogger(logger *slog.Logger) Option {
+	return func(c *Client) {
+		c.logger = logger
+	}
+}
+
+// WithReadReceipts sets whether MarkRead lets the other users know what this
+// one has read. Defaults to true; with false the server still keeps the read
+// marker, but only for this user.
+func WithReadReceipts(enabled bool) Option {
+	return func(c *Client) {
+		c.receipts = enabled
+	}
+}
+
+// WithPassword sets the password sent when joining, which the server requires
+// of operators and ignores for everyone else.
+func WithPassword(password string) Option {
+	return func(c *Client) {
+		c.password = password
+	}
+}
+
+// unixScheme prefixes an address that names a Unix socket path rather than a
+// host and port, e.g. "unix:/run/chat.sock".
+const unixScheme = "unix:"
+
+// New creates a new Client instance. address is a host:port, or a Unix socket
+// path prefixed with "unix:" for the tcp and ws protocols.
 func New(address, username, proto string, opts ...Option) *Client {
 	c := &Client{
 		address:  address,
@@ -49,6 +107,9 @@ func New(address, username, proto string, opts ...Option) *Client {
 		protocol: proto,
 		messages: make(chan protocol.Message, 10),
 		done:     make(chan struct{}),
+		logger:   slog.Default(),
+		receipts: true,
+		pending:  make(map[string]chan protocol.Message),
 	}
 	for _, opt := range opts {
 		opt(c)
@@ -81,14 +142,24 @@ func (c *Client) Connect() error {
 	c.mu.Unlock()
 
 	// Start receiving messages
-	c.wg.Add(1)
+	c.wg.Add(2)
 	go c.receiveMessages()
+	go c.receiveDatagrams(conn)
 
 	return nil
 }
 
+// dialTarget splits c.address into the network and address to dial.
+func (c *Client) dialTarget() (network, address string) {
+	if path, ok := strings.CutPrefix(c.address, unixScheme); ok {
+		return "unix", path
+	}
+	return "tcp", c.address
+}
+
 func (c *Client) connectTCP() (ClientConnection, error) {
-	conn, err := net.Dial("tcp", c.address)
+	network, address := c.dialTarget()
+	conn, err := net.Dial(network, address)
 	if err != nil {
 		return nil, fmt.Errorf("failed to connect via TCP: %w", err)
 	}
@@ -96,9 +167,21 @@ func (c *Client) connectTCP() (ClientConnection, error) {
 }
 
 func (c *Client) connectWebSocket() (ClientConnection, error) {
-	// Use ws.Dial to establish WebSocket connection
-	// ws.Dial returns (net.Conn, *bufio.Reader, Handshake, error)
-	wsConn, _, _, err := ws.Dial(context.Background(), fmt.Sprintf("ws://%s/", c.address))
+	network, address := c.dialTarget()
+	url := fmt.Sprintf("ws://%s/", address)
+	var dialer ws.Dialer
+	if network == "unix" {
+		// The URL only supplies the Host header; the socket path is dialed
+		// directly.
+		url = "ws://localhost/"
+		dialer.NetDial = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, address)
+		}
+	}
+
+	// Dial returns (net.Conn, *bufio.Reader, Handshake, error)
+	wsConn, _, _, err := dialer.Dial(context.Background(), url)
 	if err != nil {
 		return nil, fmt.Errorf("failed to connect via WebSocket: %w", err)
 	}
@@ -107,6 +190,9 @@ func (c *Client) connectWebSocket() (ClientConnection, error) {
 }
 
 func (c *Client) connectWebTransport() (ClientConnection, error) {
+	if network, _ := c.dialTarget(); network == "unix" {
+		return nil, fmt.Errorf("WebTransport is not available over a Unix socket")
+	}
 	d := &webtransport.Dialer{
 		TLSClientConfig: &tls.Config{RootCAs: c.rootCAs},
 	}
@@ -116,9 +202,9 @@ func (c *Client) connectWebTransport() (ClientConnection, error) {
 		return nil, fmt.Errorf("failed to connect via WebTransport: %w", err)
 	}
 
-	// A single bidirectional stream carries the whole chat session. QUIC opens
-	// streams lazily, so the server only observes it once the JOIN message that
-	// follows Connect is written.
+	// The first bidirectional stream carries the chat session; a bulk stream
+	// is opened later if needed. QUIC opens streams lazily, so the server only
+	// observes it once the JOIN message that follows Connect is written.
 	stream, err := session.OpenStreamSync(context.Background())
 	if err != nil {
 		_ = session.CloseWithError(0, "")
@@ -133,7 +219,7 @@ func (c *Client) Disconnect() {
 	c.mu.Lock()
 	if c.conn != nil {
 		if err := c.conn.Close(); err != nil {
-			log.Printf("Error closing connection: %v", err)
+			c.logger.Debug("Error closing connection", "error", err)
 		}
 		c.conn = nil
 	}
@@ -143,6 +229,29 @@ func (c *Client) Disconnect() {
 	c.wg.Wait()
 }
 
+// Reconnect replaces the connection to the server with a new one and joins
+// again, as the server asks with a RECONNECT message before handing over to a
+// new process. Messages keep arriving on the same Messages channel, which must
+// keep being drained meanwhile, so do not call Reconnect from the goroutine
+// receiving from it.
+func (c *Client) Reconnect() error {
+	c.mu.Lock()
+	if c.conn != nil {
+		if err := c.conn.Close(); err != nil {
+			c.logger.Debug("Error closing connection", "error", err)
+		}
+		c.conn = nil
+	}
+	c.mu.Unlock()
+	// Wait for the old receiver to exit so only one goroutine reads at a time.
+	c.wg.Wait()
+
+	if err := c.Connect(); err != nil {
+		return err
+	}
+	return c.Join()
+}
+
 // IsConnected returns whether the client is connected
 func (c *Client) IsConnected() bool {
 	c.mu.RLock()
@@ -150,7 +259,8 @@ func (c *Client) IsConnected() bool {
 	return c.conn != nil
 }
 
-// SendMessage sends a text message to the server
+// SendMessage sends a text message to the server. It returns once the message
+// is written; use SendMessageContext to wait until the server accepts it.
 func (c *Client) SendMessage(content string) error {
 	msg := protocol.Message{
 		Type:    protocol.MessageTypeText,
@@ -160,11 +270,198 @@ func (c *Client) SendMessage(content string) error {
 	return c.send(msg)
 }
 
+// SendMessageContext sends a text message to the server and waits until the
+// server acknowledges it, returning the ID the server gave the message for
+// EditMessage and DeleteMessage. It returns a *RejectedError if the server
+// refuses the message, and ctx's error, wrapped, if ctx ends first; a message
+// the server cannot decode is never acknowledged, so pass a ctx with a
+// deadline.
+func (c *Client) SendMessageContext(ctx context.Context, content string) (string, error) {
+	ack, err := c.request(ctx, protocol.Message{
+		Type:    protocol.MessageTypeText,
+		Sender:  c.username,
+		Content: content,
+	})
+	if err != nil {
+		return "", err
+	}
+	return ack.ID, nil
+}
+
+// SendDirect sends a text message to the user named to only and waits until
+// the server acknowledges it, like SendMessageContext. queued reports that the
+// user is offline and gets the message when they next join.
+func (c *Client) SendDirect(
+	ctx context.Context, to, content string,
+) (id string, queued bool, err error) {
+	ack, err := c.request(ctx, protocol.Message{
+		Type:      protocol.MessageTypeDirect,
+		Sender:    c.username,
+		Content:   content,
+		Recipient: to,
+	})
+	if err != nil {
+		return "", false, err
+	}
+	return ack.ID, ack.Content == "queued", nil
+}
+
+// Reply sends a text message in reply to the message with the given ID and
+// waits until the server acknowledges it, like SendMessageContext. Replies to
+// a reply join the thread of the message that started it.
+func (c *Client) Reply(ctx context.Context, parentID, content string) (string, error) {
+	ack, err := c.request(ctx, protocol.Message{
+		Type:     protocol.MessageTypeText,
+		Sender:   c.username,
+		Content:  content,
+		ParentID: parentID,
+	})
+	if err != nil {
+		return "", err
+	}
+	return ack.ID, nil
+}
+
+// Thread fetches the replies in the thread of the message with the given ID.
+// It returns the most recent replies the server remembers, oldest first, and
+// the number of replies in the thread, which is larger if older ones were
+// left out.
+func (c *Client) Thread(ctx context.Context, id string) ([]protocol.Message, int, error) {
+	ack, err := c.request(ctx, protocol.Message{
+		Type:   protocol.MessageTypeThread,
+		Sender: c.username,
+		ID:     id,
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	return ack.Replies, ack.ReplyCount, nil
+}
+
+// EditMessage replaces the content of the message with the given ID and waits
+// until the server acknowledges it. Only the message's sender or an operator
+// may edit it; errors are reported as by SendMessageContext.
+func (c *Client) EditMessage(ctx context.Context, id, content string) error {
+	_, err := c.request(ctx, protocol.Message{
+		Type:    protocol.MessageTypeEdit,
+		Sender:  c.username,
+		Content: content,
+		ID:      id,
+	})
+	return err
+}
+
+// DeleteMessage removes the message with the given ID and waits until the
+// server acknowledges it. Only the message's sender or an operator may delete
+// it; errors are reported as by SendMessageContext.
+func (c *Client) DeleteMessage(ctx context.Context, id string) error {
+	_, err := c.request(ctx, protocol.Message{
+		Type:   protocol.MessageTypeDelete,
+		Sender: c.username,
+		ID:     id,
+	})
+	return err
+}
+
+// AddReaction reacts to the message with the given ID with emoji and waits
+// until the server acknowledges it. Errors are reported as by
+// SendMessageContext.
+func (c *Client) AddReaction(ctx context.Context, id, emoji string) error {
+	_, err := c.request(ctx, protocol.Message{
+		Type:    protocol.MessageTypeReaction,
+		Sender:  c.username,
+		Content: emoji,
+		ID:      id,
+	})
+	return err
+}
+
+// RemoveReaction takes back a reaction made with AddReaction.
+func (c *Client) RemoveReaction(ctx context.Context, id, emoji string) error {
+	_, err := c.request(ctx, protocol.Message{
+		Type:    protocol.MessageTypeReaction,
+		Sender:  c.username,
+		Content: emoji,
+		ID:      id,
+		Remove:  true,
+	})
+	return err
+}
+
+// SetTyping tells the other users whether this one is typing. While typing,
+// call it again at least every half protocol.TypingTimeout, or the others
+// will take the user as stopped. It is not acknowledged.
+func (c *Client) SetTyping(typing bool) error {
+	return c.send(protocol.Message{
+		Type:   protocol.MessageTypeTyping,
+		Sender: c.username,
+		Remove: !typing,
+	})
+}
+
+// MarkRead moves this user's read marker to the message with the given ID and
+// waits until the server acknowledges it. The marker never moves back to an
+// older message. Unless read receipts were turned off with WithReadReceipts,
+// the other users are sent a receipt.
+func (c *Client) MarkRead(ctx context.Context, id string) error {
+	_, err := c.request(ctx, protocol.Message{
+		Type:    protocol.MessageTypeRead,
+		Sender:  c.username,
+		ID:      id,
+		Private: !c.receipts,
+	})
+	return err
+}
+
+// Unread asks the server for this user's read marker and the number of
+// messages from other users after it, which counts every message the server
+// remembers if the marker is empty or too old to be remembered.
+func (c *Client) Unread(ctx context.Context) (string, int, error) {
+	ack, err := c.request(ctx, protocol.Message{
+		Type:   protocol.MessageTypeRead,
+		Sender: c.username,
+	})
+	if err != nil {
+		return "", 0, err
+	}
+	return ack.ID, ack.Unread, nil
+}
+
+// request sends msg with a new correlation ID and returns the server's ACK.
+func (c *Client) request(ctx context.Context, msg protocol.Message) (protocol.Message, error) {
+	id := strconv.FormatUint(c.nextID.Add(1), 10)
+	acks := make(chan protocol.Message, 1)
+	c.pendingMu.Lock()
+	c.pending[id] = acks
+	c.pendingMu.Unlock()
+	defer func() {
+		c.pendingMu.Lock()
+		delete(c.pending, id)
+		c.pendingMu.Unlock()
+	}()
+
+	msg.CorrelationID = id
+	if err := c.send(msg); err != nil {
+		return protocol.Message{}, err
+	}
+
+	select {
+	case ack := <-acks:
+		if ack.Type == protocol.MessageTypeNack {
+			return protocol.Message{}, &RejectedError{Reason: ack.Content}
+		}
+		return ack, nil
+	case <-ctx.Done():
+		return protocol.Message{}, fmt.Errorf("no acknowledgement from server: %w", ctx.Err())
+	}
+}
+
 // Join sends a join message to the server
 func (c *Client) Join() error {
 	msg := protocol.Message{
-		Type:   protocol.MessageTypeJoin,
-		Sender: c.username,
+		Type:    protocol.MessageTypeJoin,
+		Sender:  c.username,
+		Content: c.password,
 	}
 	return c.send(msg)
 }
@@ -198,6 +495,18 @@ func (c *Client) send(msg protocol.Message) error {
 		return fmt.Errorf("failed to encode message: %w", err)
 	}
 
+	if msg.Type.Ephemeral() {
+		// Sent as a datagram where the transport has them.
+		err := conn.WriteDatagram(data)
+		if err == nil {
+			return nil
+		}
+		if !errors.Is(err, ErrNoDatagrams) {
+			return fmt.Errorf("failed to send datagram: %w", err)
+		}
+	}
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
 	if _, err := conn.Write(data); err != nil {
 		return fmt.Errorf("failed to send message: %w", err)
 	}
@@ -209,7 +518,6 @@ func (c *Client) send(msg protocol.Message) error {
 func (c *Client) receiveMessages() {
 	defer c.wg.Done()
 
-	buf := make([]byte, 4096)
 	for {
 		select {
 		case <-c.done:
@@ -223,27 +531,76 @@ func (c *Client) receiveMessages() {
 				return
 			}
 
-			n, err := conn.Read(buf)
+			data, err := conn.ReadMessage()
 			if err != nil {
-				if err != io.EOF {
-					log.Printf("Error reading from server: %v", err)
+				// net.ErrClosed means Disconnect or Reconnect closed conn.
+				if err != io.EOF && !errors.Is(err, net.ErrClosed) {
+					c.logger.Warn("Error reading from server", "error", err)
 				}
 				return
 			}
 
-			if n > 0 {
-				var msg protocol.Message
-				if err := msg.Decode(buf[:n]); err != nil {
-					log.Printf("Failed to decode message: %v", err)
-					continue
-				}
+			var msg protocol.Message
+			if err := msg.Decode(data); err != nil {
+				c.logger.Warn("Failed to decode message", "error", err)
+				continue
+			}
+			if msg.Type == protocol.MessageTypeAck || msg.Type == protocol.MessageTypeNack {
+				c.acknowledged(msg)
+				continue
+			}
 
-				select {
-				case c.messages <- msg:
-				case <-c.done:
-					return
-				}
+			select {
+			case c.messages <- msg:
+			case <-c.done:
+				return
+			}
+		}
+	}
+}
+
+// receiveDatagrams receives the ephemeral messages the server sends as
+// datagrams on conn until it closes. Transports without datagrams return at
+// once.
+func (c *Client) receiveDatagrams(conn ClientConnection) {
+	defer c.wg.Done()
+
+	for {
+		data, err := conn.ReadDatagram()
+		if err != nil {
+			if !errors.Is(err, ErrNoDatagrams) {
+				c.logger.Debug("Stopped reading datagrams", "error", err)
 			}
+			return
+		}
+
+		var msg protocol.Message
+		if err := msg.Decode(data); err != nil {
+			c.logger.Warn("Failed to decode datagram", "error", err)
+			continue
+		}
+		if !msg.Type.Ephemeral() {
+			c.logger.Warn("Dropping message sent as datagram", "type", msg.Type)
+			continue
+		}
+		select {
+		case c.messages <- msg:
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// acknowledged passes an ACK or NACK to the request call waiting for it.
+// Acknowledgements nobody waits for any more are dropped.
+func (c *Client) acknowledged(ack protocol.Message) {
+	c.pendingMu.Lock()
+	acks, ok := c.pending[ack.CorrelationID]
+	c.pendingMu.Unlock()
+	if ok {
+		select {
+		case acks <- ack:
+		default:
 		}
 	}
 }
@@ -0,0 +1,53 @@
+package client
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingConn is a ClientConnection that keeps what is written to it. Like
+// a WebSocket connection, it is not safe for concurrent writes, so the race
+// detector reports any.
+type recordingConn struct {
+	written [][]byte
+}
+
+func (r *recordingConn) Write(data []byte) (int, error) {
+	r.written = append(r.written, data)
+	return len(data), nil
+}
+
+func (r *recordingConn) ReadMessage() ([]byte, error)    { return nil, net.ErrClosed }
+func (r *recordingConn) Close() error                    { return nil }
+func (r *recordingConn) RemoteAddr() net.Addr            { return &net.TCPAddr{} }
+func (r *recordingConn) SetReadDeadline(time.Time) error { return nil }
+func (r *recordingConn) WriteDatagram([]byte) error      { return ErrNoDatagrams }
+func (r *recordingConn) ReadDatagram() ([]byte, error)   { return nil, ErrNoDatagrams }
+
+func TestClient_ConcurrentSends(t *testing.T) {
+	conn := &recordingConn{}
+	c := New("", "alice", "tcp")
+	c.conn = conn
+
+	// The terminal client sends from its input loop, its read receipts and
+	// its reconnect loop at once.
+	var wg sync.WaitGroup
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 10 {
+				if err := c.SendMessage("hi"); err != nil {
+					t.Errorf("SendMessage() error = %v", err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if len(conn.written) != 80 {
+		t.Errorf("Wrote %d messages, want 80", len(conn.written))
+	}
+}
@@ -1,11 +1,14 @@
 package client_test
 
 import (
+	"context"
+	"errors"
 	"net"
 	"testing"
 	"time"
 
 	"github.com/omochice/toy-socket-chat/internal/client"
+	"github.com/omochice/toy-socket-chat/pkg/protocol"
 )
 
 // mockServer creates a simple mock TCP server for testing
@@ -165,3 +168,165 @@ func TestClient_Leave(t *testing.T) {
 
 	c.Disconnect()
 }
+
+func TestClient_SetTyping(t *testing.T) {
+	addr, cleanup := startMockServer(t)
+	defer cleanup()
+
+	c := client.New(addr, "testuser", "tcp")
+	if err := c.Connect(); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer c.Disconnect()
+
+	if err := c.SetTyping(true); err != nil {
+		t.Fatalf("Failed to send typing message: %v", err)
+	}
+
+	// The mock server echoes the message back
+	select {
+	case msg := <-c.Messages():
+		if msg.Type != protocol.MessageTypeTyping || msg.Sender != "testuser" || msg.Remove {
+			t.Errorf("Echoed %s from %q (remove %v), want TYPING from testuser",
+				msg.Type, msg.Sender, msg.Remove)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Timeout waiting for echoed message")
+	}
+}
+
+func TestClient_Reconnect(t *testing.T) {
+	addr, cleanup := startMockServer(t)
+	defer cleanup()
+
+	c := client.New(addr, "testuser", "tcp")
+	if err := c.Connect(); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer c.Disconnect()
+
+	if err := c.Reconnect(); err != nil {
+		t.Fatalf("Failed to reconnect: %v", err)
+	}
+
+	// The mock server echoes the JOIN sent on the new connection, and later
+	// messages arrive on the same channel.
+	for _, want := range []string{"", "after reconnect"} {
+		if want != "" {
+			if err := c.SendMessage(want); err != nil {
+				t.Fatalf("Failed to send message: %v", err)
+			}
+		}
+		select {
+		case msg := <-c.Messages():
+			if msg.Content != want {
+				t.Errorf("Expected message %q, got %q", want, msg.Content)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("Timeout waiting for message")
+		}
+	}
+}
+
+// startAckServer starts a mock server that acknowledges every message with a
+// correlation ID, refusing those whose content is reason.
+func startAckServer(t *testing.T, reason string) string {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to start mock server: %v", err)
+	}
+	t.Cleanup(func() {
+		_ = listener.Close()
+	})
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer func() {
+			_ = conn.Close()
+		}()
+		for {
+			data, err := protocol.ReadFrame(conn)
+			if err != nil {
+				return
+			}
+			var msg protocol.Message
+			if err := msg.Decode(data); err != nil || msg.CorrelationID == "" {
+				continue
+			}
+			ack := protocol.Message{
+				Type:          protocol.MessageTypeAck,
+				CorrelationID: msg.CorrelationID,
+				ID:            "id-" + msg.CorrelationID,
+			}
+			if msg.Content == reason {
+				ack.Type = protocol.MessageTypeNack
+				ack.Content = reason
+			}
+			data, _ = ack.Encode()
+			_ = protocol.WriteFrame(conn, data)
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func TestClient_SendMessageContext(t *testing.T) {
+	c := client.New(startAckServer(t, "too rude"), "testuser", "tcp")
+	if err := c.Connect(); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer c.Disconnect()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	id, err := c.SendMessageContext(ctx, "hello")
+	if err != nil || id == "" {
+		t.Errorf("SendMessageContext() = %q, %v, want the message acknowledged with an ID", id, err)
+	}
+	if err := c.EditMessage(ctx, id, "hello again"); err != nil {
+		t.Errorf("EditMessage() error = %v, want the edit acknowledged", err)
+	}
+	if err := c.AddReaction(ctx, id, "👍"); err != nil {
+		t.Errorf("AddReaction() error = %v, want the reaction acknowledged", err)
+	}
+	if _, err := c.Reply(ctx, id, "me too"); err != nil {
+		t.Errorf("Reply() error = %v, want the reply acknowledged", err)
+	}
+	if _, queued, err := c.SendDirect(ctx, "bob", "psst"); err != nil || queued {
+		t.Errorf("SendDirect() = %v, %v, want the message acknowledged as delivered", queued, err)
+	}
+	if err := c.MarkRead(ctx, id); err != nil {
+		t.Errorf("MarkRead() error = %v, want the marker acknowledged", err)
+	}
+	if marker, _, err := c.Unread(ctx); err != nil || marker == "" {
+		t.Errorf("Unread() = %q, %v, want the marker from the acknowledgement", marker, err)
+	}
+
+	_, err = c.SendMessageContext(ctx, "too rude")
+	var rejected *client.RejectedError
+	if !errors.As(err, &rejected) || rejected.Reason != "too rude" {
+		t.Errorf("SendMessageContext() error = %v, want a rejection with its reason", err)
+	}
+}
+
+func TestClient_SendMessageContext_NoAck(t *testing.T) {
+	// The echo server never acknowledges anything.
+	addr, cleanup := startMockServer(t)
+	defer cleanup()
+
+	c := client.New(addr, "testuser", "tcp")
+	if err := c.Connect(); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer c.Disconnect()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := c.SendMessageContext(ctx, "hello"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("SendMessageContext() error = %v, want the deadline to pass", err)
+	}
+}
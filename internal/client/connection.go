@@ -7,22 +7,38 @@ import (
 
 	"github.com/gobwas/ws"
 	"github.com/gobwas/ws/wsutil"
+	"github.com/omochice/toy-socket-chat/pkg/protocol"
+	"github.com/quic-go/quic-go"
 	"github.com/quic-go/webtransport-go"
 )
 
+// ErrNoDatagrams is returned by ClientConnection.WriteDatagram and
+// ReadDatagram on transports without datagrams.
+var ErrNoDatagrams = errors.New("datagrams not supported")
+
 // ClientConnection represents a connection to the server
 type ClientConnection interface {
-	// Write sends data to the server
+	// Write sends data, one whole message, to the server
 	Write(data []byte) (int, error)
 
-	// Read receives data from the server
-	Read(buf []byte) (int, error)
+	// ReadMessage receives the next whole message from the server
+	ReadMessage() ([]byte, error)
 
 	// Close closes the connection
 	Close() error
 
 	// RemoteAddr returns the server address
 	RemoteAddr() net.Addr
+
+	// WriteDatagram sends data, one whole message, as an unreliable datagram
+	// that is not held up behind the data sent with Write. It returns
+	// ErrNoDatagrams if the transport has none or data does not fit in one,
+	// and the caller sends it with Write instead.
+	WriteDatagram(data []byte) error
+
+	// ReadDatagram receives the next datagram from the server, or returns
+	// ErrNoDatagrams at once if the transport has none.
+	ReadDatagram() ([]byte, error)
 }
 
 // TCPClientConnection wraps net.Conn for TCP connections
@@ -35,12 +51,17 @@ func NewTCPClientConnection(conn net.Conn) *TCPClientConnection {
 	return &TCPClientConnection{conn: conn}
 }
 
+// Write sends data as one frame, so the server can tell it apart from the
+// messages written before and after it.
 func (tc *TCPClientConnection) Write(data []byte) (int, error) {
-	return tc.conn.Write(data)
+	if err := protocol.WriteFrame(tc.conn, data); err != nil {
+		return 0, err
+	}
+	return len(data), nil
 }
 
-func (tc *TCPClientConnection) Read(buf []byte) (int, error) {
-	return tc.conn.Read(buf)
+func (tc *TCPClientConnection) ReadMessage() ([]byte, error) {
+	return protocol.ReadFrame(tc.conn)
 }
 
 func (tc *TCPClientConnection) Close() error {
@@ -51,12 +72,17 @@ func (tc *TCPClientConnection) RemoteAddr() net.Addr {
 	return tc.conn.RemoteAddr()
 }
 
+func (tc *TCPClientConnection) WriteDatagram([]byte) error {
+	return ErrNoDatagrams
+}
+
+func (tc *TCPClientConnection) ReadDatagram() ([]byte, error) {
+	return nil, ErrNoDatagrams
+}
+
 // WebSocketClientConnection wraps net.Conn for WebSocket connections using gobwas/ws
 type WebSocketClientConnection struct {
-	conn          net.Conn
-	readBuffer    []byte
-	readBufferPos int
-	mu            sync.Mutex
+	conn net.Conn
 }
 
 // NewWebSocketClientConnection creates a new WebSocket connection wrapper
@@ -73,36 +99,10 @@ func (wc *WebSocketClientConnection) Write(data []byte) (int, error) {
 	return len(data), nil
 }
 
-func (wc *WebSocketClientConnection) Read(buf []byte) (int, error) {
-	wc.mu.Lock()
-	defer wc.mu.Unlock()
-
-	// Return buffered data if available
-	if wc.readBufferPos < len(wc.readBuffer) {
-		n := copy(buf, wc.readBuffer[wc.readBufferPos:])
-		wc.readBufferPos += n
-		if wc.readBufferPos >= len(wc.readBuffer) {
-			wc.readBuffer = nil
-			wc.readBufferPos = 0
-		}
-		return n, nil
-	}
-
-	// Read next WebSocket message using gobwas/ws (server messages)
-	data, err := wsutil.ReadServerBinary(wc.conn)
-	if err != nil {
-		return 0, err
-	}
-
-	// Copy to output buffer
-	n := copy(buf, data)
-	if n < len(data) {
-		// Buffer remaining data
-		wc.readBuffer = data[n:]
-		wc.readBufferPos = 0
-	}
-
-	return n, nil
+// ReadMessage returns the next WebSocket message, which already carries its
+// own framing.
+func (wc *WebSocketClientConnection) ReadMessage() ([]byte, error) {
+	return wsutil.ReadServerBinary(wc.conn)
 }
 
 func (wc *WebSocketClientConnection) Close() error {
@@ -115,29 +115,165 @@ func (wc *WebSocketClientConnection) RemoteAddr() net.Addr {
 	return wc.conn.RemoteAddr()
 }
 
-// WebTransportClientConnection wraps a WebTransport session and its single
-// bidirectional stream. The chat protocol is treated as an unframed byte stream
-// over that stream, matching the framing assumption used for TCP.
+func (wc *WebSocketClientConnection) WriteDatagram([]byte) error {
+	return ErrNoDatagrams
+}
+
+func (wc *WebSocketClientConnection) ReadDatagram() ([]byte, error) {
+	return nil, ErrNoDatagrams
+}
+
+// bulkMessageSize is the size above which a message is written to a second,
+// bulk stream, so it does not hold up the chat stream. It matches the
+// server's.
+const bulkMessageSize = 1024
+
+// streamErrorUnknownPurpose refuses a stream opened for a purpose the client
+// does not know. It matches the server's.
+const streamErrorUnknownPurpose webtransport.StreamErrorCode = 2
+
+// WebTransportClientConnection wraps a WebTransport session and its
+// bidirectional streams. Messages on streams are framed as on TCP. Messages
+// larger than bulkMessageSize go on a bulk stream, opened when first needed
+// and announced with a protocol.StreamPurposeBulk frame. The server sends its
+// own large messages on a bulk stream it opens; ReadMessage returns what
+// arrives on it or the chat stream. Ephemeral messages may also travel as
+// session datagrams, one message each.
 type WebTransportClientConnection struct {
 	session *webtransport.Session
 	stream  *webtransport.Stream
+
+	// reads carries the messages readStream reads from each stream, so
+	// ReadMessage can return them in arrival order.
+	reads chan streamRead
+
+	mu   sync.Mutex
+	bulk *webtransport.Stream
+}
+
+// streamRead is one message read from a stream of a WebTransport session, or
+// the error that ended the stream.
+type streamRead struct {
+	data []byte
+	err  error
 }
 
 // NewWebTransportClientConnection creates a new WebTransport connection wrapper
-// over an established session and its bidirectional stream.
+// over an established session and its chat stream.
 func NewWebTransportClientConnection(
 	session *webtransport.Session,
 	stream *webtransport.Stream,
 ) *WebTransportClientConnection {
-	return &WebTransportClientConnection{session: session, stream: stream}
+	wtc := &WebTransportClientConnection{
+		session: session,
+		stream:  stream,
+		reads:   make(chan streamRead),
+	}
+	go wtc.readStream(stream)
+	go wtc.acceptStreams()
+	return wtc
+}
+
+// acceptStreams reads the bulk streams the server opens until the session
+// ends. Streams for any other purpose are refused.
+func (wtc *WebTransportClientConnection) acceptStreams() {
+	for {
+		stream, err := wtc.session.AcceptStream(wtc.session.Context())
+		if err != nil {
+			return
+		}
+		go func() {
+			purpose, err := protocol.ReadFrame(stream)
+			if err != nil || string(purpose) != protocol.StreamPurposeBulk {
+				stream.CancelRead(streamErrorUnknownPurpose)
+				stream.CancelWrite(streamErrorUnknownPurpose)
+				return
+			}
+			wtc.readStream(stream)
+		}()
+	}
+}
+
+// readStream passes the messages read from stream to ReadMessage until the
+// stream or the session ends. Only the chat stream ending ends the
+// connection; a bulk stream ending is dropped, and the next large message
+// opens a new one.
+func (wtc *WebTransportClientConnection) readStream(stream *webtransport.Stream) {
+	for {
+		data, err := protocol.ReadFrame(stream)
+		if err != nil && stream != wtc.stream {
+			wtc.dropBulk(stream)
+			return
+		}
+		select {
+		case wtc.reads <- streamRead{data: data, err: err}:
+		case <-wtc.session.Context().Done():
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
 }
 
+// Write writes data to the chat stream, or to the bulk stream if data is
+// larger than bulkMessageSize. If the bulk stream cannot be opened or
+// written to, it is dropped and data goes on the chat stream.
 func (wtc *WebTransportClientConnection) Write(data []byte) (int, error) {
-	return wtc.stream.Write(data)
+	if len(data) > bulkMessageSize {
+		if err := wtc.writeBulk(data); err == nil {
+			return len(data), nil
+		}
+	}
+	if err := protocol.WriteFrame(wtc.stream, data); err != nil {
+		return 0, err
+	}
+	return len(data), nil
 }
 
-func (wtc *WebTransportClientConnection) Read(buf []byte) (int, error) {
-	return wtc.stream.Read(buf)
+// writeBulk writes data to the bulk stream, opening it first if needed.
+func (wtc *WebTransportClientConnection) writeBulk(data []byte) error {
+	wtc.mu.Lock()
+	defer wtc.mu.Unlock()
+	if wtc.bulk == nil {
+		bulk, err := wtc.session.OpenStream()
+		if err != nil {
+			return err
+		}
+		purpose := []byte(protocol.StreamPurposeBulk)
+		if err := protocol.WriteFrame(bulk, purpose); err != nil {
+			bulk.CancelRead(0)
+			bulk.CancelWrite(0)
+			return err
+		}
+		wtc.bulk = bulk
+		go wtc.readStream(bulk)
+	}
+	if err := protocol.WriteFrame(wtc.bulk, data); err != nil {
+		wtc.bulk = nil
+		return err
+	}
+	return nil
+}
+
+// dropBulk stops writing to stream, a bulk stream that has failed.
+func (wtc *WebTransportClientConnection) dropBulk(stream *webtransport.Stream) {
+	wtc.mu.Lock()
+	defer wtc.mu.Unlock()
+	if wtc.bulk == stream {
+		wtc.bulk = nil
+	}
+}
+
+// ReadMessage returns the message next read from the chat stream or the
+// server's bulk stream.
+func (wtc *WebTransportClientConnection) ReadMessage() ([]byte, error) {
+	select {
+	case r := <-wtc.reads:
+		return r.data, r.err
+	case <-wtc.session.Context().Done():
+		return nil, net.ErrClosed
+	}
 }
 
 func (wtc *WebTransportClientConnection) Close() error {
@@ -151,3 +287,20 @@ func (wtc *WebTransportClientConnection) Close() error {
 func (wtc *WebTransportClientConnection) RemoteAddr() net.Addr {
 	return wtc.session.RemoteAddr()
 }
+
+// WriteDatagram sends data as a session datagram. Datagrams must fit in one
+// QUIC packet; larger messages get ErrNoDatagrams.
+func (wtc *WebTransportClientConnection) WriteDatagram(data []byte) error {
+	err := wtc.session.SendDatagram(data)
+	var tooLarge *quic.DatagramTooLargeError
+	if errors.As(err, &tooLarge) {
+		return ErrNoDatagrams
+	}
+	return err
+}
+
+// ReadDatagram receives the next session datagram. It fails once the session
+// is closed.
+func (wtc *WebTransportClientConnection) ReadDatagram() ([]byte, error) {
+	return wtc.session.ReceiveDatagram(wtc.session.Context())
+}
@@ -0,0 +1,521 @@
+// Package cluster implements a server.Broker that connects chat servers
+// directly to each other over TCP, so users connected to different servers
+// share one chat.
+package cluster
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/omochice/toy-socket-chat/internal/server"
+)
+
+var _ server.Broker = (*Mesh)(nil)
+
+// Frame kinds exchanged between nodes.
+const (
+	// kindHello is the first frame on every connection, naming the sender and
+	// carrying a random nonce.
+	kindHello = "hello"
+	// kindAuth is the second frame, proving the sender knows the shared
+	// secret by its HMAC over the other node's nonce.
+	kindAuth = "auth"
+	// kindMessage carries an encoded chat message.
+	kindMessage = "message"
+	// kindPresence carries the users joined on the sending node.
+	kindPresence = "presence"
+)
+
+// linkQueueSize is how many frames may wait for a slow peer before further
+// ones are dropped, like a chat client's outgoing queue.
+const linkQueueSize = 256
+
+// defaultRetryInterval is how long a node waits before redialing a peer.
+const defaultRetryInterval = 2 * time.Second
+
+// writeTimeout bounds how long one frame may take to reach a peer.
+const writeTimeout = 10 * time.Second
+
+// maxHandshakeSize bounds what a peer may send before it has authenticated,
+// far more than a hello and an auth frame take.
+const maxHandshakeSize = 4096
+
+// seenWindow is how many sequence numbers below an origin's highest one are
+// remembered. A message further behind than that is taken for a duplicate;
+// a link's queue holds far fewer, so a real one never is.
+const seenWindow = 4 * linkQueueSize
+
+// frame is the unit sent between nodes, one JSON document per frame.
+type frame struct {
+	Kind string `json:"kind"`
+	// Node and Incarnation identify the sending process; the incarnation is
+	// random per start so a restarted node's sequence numbers start afresh.
+	Node        string `json:"node"`
+	Incarnation uint64 `json:"incarnation"`
+	// Seq numbers the sender's messages, starting at 1.
+	Seq   uint64   `json:"seq,omitempty"`
+	Data  []byte   `json:"data,omitempty"`
+	Users []string `json:"users,omitempty"`
+	Nonce []byte   `json:"nonce,omitempty"`
+	Proof []byte   `json:"proof,omitempty"`
+}
+
+// origin identifies one run of a node.
+type origin struct {
+	node        string
+	incarnation uint64
+}
+
+// Mesh is a server.Broker in which every node holds a TCP connection to every
+// other node. Each node listens for peers on its own address and dials the
+// peers it is configured with, so a pair of nodes is connected as long as
+// either lists the other. Messages are sent straight to every connected node
+// and never forwarded, so a message cannot travel in a loop; a node that is
+// connected to another twice (both dialed) discards the second copy of each
+// message by its sequence number, and ignores a connection to itself. Nodes
+// only accept peers that share their secret.
+type Mesh struct {
+	node          string
+	incarnation   uint64
+	address       string
+	peers         []string
+	secret        string
+	retryInterval time.Duration
+	logger        *slog.Logger
+
+	listener net.Listener
+	deliver  func([]byte)
+	seq      atomic.Uint64
+	quit     chan struct{}
+	stop     sync.Once
+	wg       sync.WaitGroup
+
+	// mu guards the fields below.
+	mu    sync.Mutex
+	users []string
+	links map[*link]bool
+	// seen is the sequence numbers recently delivered from each origin, and
+	// presence the users it last reported. Both are dropped when its last
+	// link closes.
+	seen     map[origin]*seqWindow
+	presence map[origin][]string
+}
+
+// Option configures a Mesh created by New.
+type Option func(*Mesh)
+
+// WithLogger sets the logger used for peer connection events. Defaults to
+// slog.Default().
+func WithLogger(logger *slog.Logger) Option {
+	return func(m *Mesh) {
+		m.logger = logger
+	}
+}
+
+// WithSecret sets the secret shared by the nodes of the cluster. It is
+// required: Start fails without one. Nodes prove they know it without sending
+// it, but their traffic is not encrypted.
+func WithSecret(secret string) Option {
+	return func(m *Mesh) {
+		m.secret = secret
+	}
+}
+
+// WithRetryInterval sets how long the node waits before redialing a peer it
+// cannot reach or has lost. Defaults to two seconds.
+func WithRetryInterval(d time.Duration) Option {
+	return func(m *Mesh) {
+		m.retryInterval = d
+	}
+}
+
+// WithListener makes the node accept peers on ln, an already-bound socket,
+// instead of binding its address; for example one handed over by a previous
+// process during a binary upgrade.
+func WithListener(ln net.Listener) Option {
+	return func(m *Mesh) {
+		m.listener = ln
+	}
+}
+
+// New creates a mesh node named node that accepts peers on address and dials
+// peers, a list of other nodes' addresses. Node names must be unique within
+// the cluster.
+func New(node, address string, peers []string, opts ...Option) *Mesh {
+	var b [8]byte
+	_, _ = rand.Read(b[:])
+	m := &Mesh{
+		node:          node,
+		incarnation:   binary.BigEndian.Uint64(b[:]),
+		address:       address,
+		peers:         peers,
+		retryInterval: defaultRetryInterval,
+		logger:        slog.Default(),
+		quit:          make(chan struct{}),
+		links:         make(map[*link]bool),
+		seen:          make(map[origin]*seqWindow),
+		presence:      make(map[origin][]string),
+	}
+	for _, opt := range opts {
+		opt(m)
+	}
+	return m
+}
+
+// Start listens for peers and starts dialing the configured ones.
+func (m *Mesh) Start(deliver func([]byte)) error {
+	if m.secret == "" {
+		return errors.New("cluster secret must be set")
+	}
+	m.deliver = deliver
+	if m.listener == nil {
+		ln, err := net.Listen("tcp", m.address)
+		if err != nil {
+			return fmt.Errorf("failed to listen for cluster peers on %s: %w", m.address, err)
+		}
+		m.listener = ln
+	}
+	m.logger.Info("Cluster node started", "node", m.node, "addr", m.listener.Addr().String())
+
+	m.wg.Add(1)
+	go m.acceptLoop()
+	for _, peer := range m.peers {
+		m.wg.Add(1)
+		go m.dialLoop(peer)
+	}
+	return nil
+}
+
+// Addr returns the address the node accepts peers on, or "" before Start.
+func (m *Mesh) Addr() string {
+	if m.listener == nil {
+		return ""
+	}
+	return m.listener.Addr().String()
+}
+
+// Listener returns the socket the node accepts peers on, or nil before Start.
+func (m *Mesh) Listener() net.Listener {
+	return m.listener
+}
+
+// Publish sends data to every connected node.
+func (m *Mesh) Publish(data []byte) error {
+	m.sendAll(frame{
+		Kind:        kindMessage,
+		Node:        m.node,
+		Incarnation: m.incarnation,
+		Seq:         m.seq.Add(1),
+		Data:        data,
+	})
+	return nil
+}
+
+// SetPresence records the users joined on this node and sends the list to
+// every connected node.
+func (m *Mesh) SetPresence(users []string) {
+	m.mu.Lock()
+	m.users = users
+	m.mu.Unlock()
+	m.sendAll(m.presenceFrame())
+}
+
+// Presence returns the users joined on each node currently connected,
+// including this one. A node connected twice appears once; a node that was
+// restarted appears with the users of both runs until the old run's links
+// close.
+func (m *Mesh) Presence() map[string][]string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	presence := map[string][]string{m.node: slices.Clone(m.users)}
+	for o, users := range m.presence {
+		merged := append(presence[o.node], users...)
+		slices.Sort(merged)
+		presence[o.node] = slices.Compact(merged)
+	}
+	return presence
+}
+
+// Close disconnects from every peer and stops listening. Calls after the
+// first do nothing.
+func (m *Mesh) Close() error {
+	var err error
+	m.stop.Do(func() {
+		close(m.quit)
+		if m.listener != nil {
+			err = m.listener.Close()
+		}
+		m.mu.Lock()
+		for l := range m.links {
+			_ = l.conn.Close()
+		}
+		m.mu.Unlock()
+		m.wg.Wait()
+	})
+	if errors.Is(err, net.ErrClosed) {
+		return nil
+	}
+	return err
+}
+
+// presenceFrame returns a frame announcing this node's users.
+func (m *Mesh) presenceFrame() frame {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return frame{
+		Kind:        kindPresence,
+		Node:        m.node,
+		Incarnation: m.incarnation,
+		Users:       m.users,
+	}
+}
+
+// sendAll queues f for every connected node.
+func (m *Mesh) sendAll(f frame) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for l := range m.links {
+		l.send(f, m.logger)
+	}
+}
+
+// acceptLoop serves peers dialing this node until Close.
+func (m *Mesh) acceptLoop() {
+	defer m.wg.Done()
+	for {
+		conn, err := m.listener.Accept()
+		if err != nil {
+			select {
+			case <-m.quit:
+				return
+			default:
+				if errors.Is(err, net.ErrClosed) {
+					return
+				}
+				m.logger.Error("Failed to accept cluster peer", "error", err)
+				continue
+			}
+		}
+		m.wg.Add(1)
+		go func() {
+			defer m.wg.Done()
+			m.serve(conn)
+		}()
+	}
+}
+
+// dialLoop keeps a connection to the peer at addr open until Close.
+func (m *Mesh) dialLoop(addr string) {
+	defer m.wg.Done()
+	for {
+		conn, err := net.DialTimeout("tcp", addr, m.retryInterval)
+		if err != nil {
+			m.logger.Debug("Failed to reach cluster peer", "addr", addr, "error", err)
+		} else {
+			m.serve(conn)
+		}
+
+		select {
+		case <-m.quit:
+			return
+		case <-time.After(m.retryInterval):
+		}
+	}
+}
+
+// link is one connection to another node.
+type link struct {
+	conn net.Conn
+	out  chan frame
+	// origin is the remote node, known once its hello arrives.
+	origin origin
+}
+
+// send queues f, dropping it if the peer is not keeping up. Callers hold
+// Mesh.mu, which serializes send with the close of out.
+func (l *link) send(f frame, logger *slog.Logger) {
+	select {
+	case l.out <- f:
+	default:
+		logger.Warn("Cluster peer queue full, dropping frame", "node", l.origin.node)
+	}
+}
+
+// serve exchanges frames with the node on conn until either side closes it.
+func (m *Mesh) serve(conn net.Conn) {
+	defer func() { _ = conn.Close() }()
+	l := &link{conn: conn, out: make(chan frame, linkQueueSize)}
+	logger := m.logger.With("peer_addr", conn.RemoteAddr().String())
+
+	writerDone := make(chan struct{})
+	go func() {
+		defer close(writerDone)
+		enc := json.NewEncoder(conn)
+		for f := range l.out {
+			_ = conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+			if err := enc.Encode(f); err != nil {
+				logger.Debug("Failed to send to cluster peer", "error", err)
+				_ = conn.Close()
+				return
+			}
+		}
+	}()
+	defer func() {
+		close(l.out)
+		<-writerDone
+	}()
+
+	nonce := make([]byte, 32)
+	_, _ = rand.Read(nonce)
+	l.out <- frame{Kind: kindHello, Node: m.node, Incarnation: m.incarnation, Nonce: nonce}
+	// Until the peer has authenticated, it may only send so much.
+	handshake := &io.LimitedReader{R: conn, N: maxHandshakeSize}
+	dec := json.NewDecoder(handshake)
+	var hello, auth frame
+	_ = conn.SetReadDeadline(time.Now().Add(writeTimeout))
+	if err := dec.Decode(&hello); err != nil || hello.Kind != kindHello {
+		logger.Warn("Cluster peer did not say hello", "error", err)
+		return
+	}
+	l.out <- frame{Kind: kindAuth, Proof: m.proof(hello.Nonce, m.node)}
+	if err := dec.Decode(&auth); err != nil || auth.Kind != kindAuth {
+		logger.Warn("Cluster peer did not authenticate", "error", err)
+		return
+	}
+	_ = conn.SetReadDeadline(time.Time{})
+	if !hmac.Equal(auth.Proof, m.proof(nonce, hello.Node)) {
+		logger.Warn("Rejecting cluster peer with the wrong secret", "node", hello.Node)
+		return
+	}
+	handshake.N = math.MaxInt64
+	if hello.Node == m.node {
+		// Dialing our own address, or a misconfigured peer sharing our name,
+		// would otherwise echo our messages back to us.
+		logger.Warn("Ignoring cluster peer with this node's name", "node", hello.Node)
+		return
+	}
+	l.origin = origin{node: hello.Node, incarnation: hello.Incarnation}
+	logger = logger.With("node", hello.Node)
+
+	m.mu.Lock()
+	select {
+	case <-m.quit:
+		// Close has already closed the links it knew about.
+		m.mu.Unlock()
+		return
+	default:
+	}
+	m.links[l] = true
+	m.mu.Unlock()
+	l.out <- m.presenceFrame()
+	logger.Info("Cluster peer connected")
+	defer m.removeLink(l, logger)
+
+	for {
+		var f frame
+		if err := dec.Decode(&f); err != nil {
+			select {
+			case <-m.quit:
+			default:
+				logger.Info("Cluster peer disconnected", "error", err)
+			}
+			return
+		}
+		// Frames are only ever sent by the node at the other end; anything
+		// else would be forwarded and could loop.
+		if f.Node != l.origin.node || f.Incarnation != l.origin.incarnation {
+			logger.Warn("Ignoring frame from another node", "from", f.Node)
+			continue
+		}
+		switch f.Kind {
+		case kindMessage:
+			if m.firstDelivery(f) {
+				m.deliver(f.Data)
+			}
+		case kindPresence:
+			m.mu.Lock()
+			m.presence[l.origin] = f.Users
+			m.mu.Unlock()
+		}
+	}
+}
+
+// proof returns the HMAC by which node shows it knows the secret, over nonce
+// sent by the other end. Including the prover's name keeps a peer from
+// getting a proof for a nonce of its own and passing it back: a node never
+// accepts a peer with its own name.
+func (m *Mesh) proof(nonce []byte, node string) []byte {
+	mac := hmac.New(sha256.New, []byte(m.secret))
+	mac.Write(nonce)
+	mac.Write([]byte(node))
+	return mac.Sum(nil)
+}
+
+// firstDelivery reports whether f has not been delivered before, recording
+// it. The links to an origin may each drop different frames when the peer
+// falls behind, so a later link can bring an earlier sequence number that
+// was never delivered.
+func (m *Mesh) firstDelivery(f frame) bool {
+	o := origin{node: f.Node, incarnation: f.Incarnation}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	w := m.seen[o]
+	if w == nil {
+		w = &seqWindow{}
+		m.seen[o] = w
+	}
+	return w.add(f.Seq)
+}
+
+// seqWindow records which of the last seenWindow sequence numbers up to the
+// highest one were delivered.
+type seqWindow struct {
+	highest uint64
+	seen    [seenWindow]bool
+}
+
+// add records seq and reports whether it was new.
+func (w *seqWindow) add(seq uint64) bool {
+	switch {
+	case seq > w.highest:
+		// Forget the numbers that fall out of the window.
+		for n := max(w.highest+1, seq-min(seq, seenWindow)); n < seq; n++ {
+			w.seen[n%seenWindow] = false
+		}
+		w.highest = seq
+	case w.highest-seq >= seenWindow || w.seen[seq%seenWindow]:
+		return false
+	}
+	w.seen[seq%seenWindow] = true
+	return true
+}
+
+// removeLink forgets l, and its origin's state if no other link carries it.
+// It is called before l.out is closed, under the lock that send holds.
+func (m *Mesh) removeLink(l *link, logger *slog.Logger) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.links, l)
+	for other := range m.links {
+		if other.origin == l.origin {
+			return
+		}
+	}
+	delete(m.seen, l.origin)
+	delete(m.presence, l.origin)
+	logger.Debug("Forgot cluster peer state")
+}
@@ -0,0 +1,328 @@
+package cluster_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/omochice/toy-socket-chat/internal/cluster"
+	"github.com/omochice/toy-socket-chat/internal/server"
+	"github.com/omochice/toy-socket-chat/pkg/protocol"
+)
+
+// listen binds a free local port for a node, so nodes can be given each
+// other's addresses before any of them starts.
+func listen(t *testing.T) net.Listener {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	return ln
+}
+
+// testSecret is the cluster secret shared by the nodes in these tests.
+const testSecret = "test-secret"
+
+// startMesh starts a node accepting peers on ln, sending what it delivers to
+// the returned channel.
+func startMesh(t *testing.T, node string, ln net.Listener, peers ...string) (
+	*cluster.Mesh,
+	chan []byte,
+) {
+	t.Helper()
+
+	return startMeshWithSecret(t, node, testSecret, ln, peers...)
+}
+
+// startMeshWithSecret is startMesh for a node with the given cluster secret.
+func startMeshWithSecret(
+	t *testing.T,
+	node, secret string,
+	ln net.Listener,
+	peers ...string,
+) (*cluster.Mesh, chan []byte) {
+	t.Helper()
+
+	delivered := make(chan []byte, 16)
+	m := cluster.New(
+		node,
+		ln.Addr().String(),
+		peers,
+		cluster.WithListener(ln),
+		cluster.WithSecret(secret),
+		cluster.WithRetryInterval(50*time.Millisecond),
+	)
+	if err := m.Start(func(data []byte) { delivered <- data }); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	t.Cleanup(func() {
+		_ = m.Close()
+	})
+	return m, delivered
+}
+
+// waitFor polls cond until it holds, failing after two seconds.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// sees returns a condition that holds once m has heard from node.
+func sees(m *cluster.Mesh, node string) func() bool {
+	return func() bool {
+		_, ok := m.Presence()[node]
+		return ok
+	}
+}
+
+// expectDelivery fails unless want arrives on delivered.
+func expectDelivery(t *testing.T, name string, delivered chan []byte, want string) {
+	t.Helper()
+
+	select {
+	case data := <-delivered:
+		if string(data) != want {
+			t.Errorf("%s delivered %q, want %q", name, data, want)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("%s did not deliver %q", name, want)
+	}
+}
+
+// expectNone fails if anything arrives on delivered within a short while.
+func expectNone(t *testing.T, name string, delivered chan []byte) {
+	t.Helper()
+
+	select {
+	case data := <-delivered:
+		t.Errorf("%s unexpectedly delivered %q", name, data)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestMesh_DeliversEachMessageOnce(t *testing.T) {
+	lnA, lnB, lnC := listen(t), listen(t), listen(t)
+	addrA, addrB, addrC := lnA.Addr().String(), lnB.Addr().String(), lnC.Addr().String()
+	// Every node dials every other, so each pair is connected twice.
+	a, fromA := startMesh(t, "a", lnA, addrB, addrC)
+	b, fromB := startMesh(t, "b", lnB, addrA, addrC)
+	c, fromC := startMesh(t, "c", lnC, addrA, addrB)
+	waitFor(t, "the nodes to connect", func() bool {
+		return sees(a, "b")() && sees(a, "c")() && sees(b, "c")() &&
+			sees(b, "a")() && sees(c, "a")() && sees(c, "b")()
+	})
+
+	for _, msg := range []string{"first", "second"} {
+		if err := c.Publish([]byte(msg)); err != nil {
+			t.Fatalf("Publish() error = %v", err)
+		}
+	}
+	for _, msg := range []string{"first", "second"} {
+		expectDelivery(t, "a", fromA, msg)
+		expectDelivery(t, "b", fromB, msg)
+	}
+	// Nodes do not forward what they receive, and c never hears itself.
+	expectNone(t, "a", fromA)
+	expectNone(t, "b", fromB)
+	expectNone(t, "c", fromC)
+}
+
+func TestMesh_IgnoresItself(t *testing.T) {
+	ln := listen(t)
+	m, delivered := startMesh(t, "a", ln, ln.Addr().String())
+
+	// Give the node time to dial itself.
+	time.Sleep(200 * time.Millisecond)
+	if err := m.Publish([]byte("echo")); err != nil {
+		t.Fatalf("Publish() error = %v", err)
+	}
+	expectNone(t, "a", delivered)
+	if presence := m.Presence(); len(presence) != 1 {
+		t.Errorf("Presence() = %v, want only this node", presence)
+	}
+}
+
+func TestMesh_Presence(t *testing.T) {
+	lnA, lnB := listen(t), listen(t)
+	a, _ := startMesh(t, "a", lnA)
+	b, _ := startMesh(t, "b", lnB, lnA.Addr().String())
+	a.SetPresence([]string{"alice"})
+	b.SetPresence([]string{"bob", "carol"})
+
+	waitFor(t, "a to hear b's users", func() bool {
+		return slices.Equal(a.Presence()["b"], []string{"bob", "carol"})
+	})
+	waitFor(t, "b to hear a's users", func() bool {
+		return slices.Equal(b.Presence()["a"], []string{"alice"})
+	})
+	if got := a.Presence()["a"]; !slices.Equal(got, []string{"alice"}) {
+		t.Errorf("Presence()[a] = %v, want [alice]", got)
+	}
+
+	if err := b.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	waitFor(t, "a to forget b", func() bool { return !sees(a, "b")() })
+}
+
+func TestMesh_RejectsWrongSecret(t *testing.T) {
+	lnA, lnB := listen(t), listen(t)
+	a, fromA := startMesh(t, "a", lnA)
+	b, _ := startMeshWithSecret(t, "b", "other-secret", lnB, lnA.Addr().String())
+
+	// Give b time to dial a a few times.
+	time.Sleep(200 * time.Millisecond)
+	if sees(a, "b")() || sees(b, "a")() {
+		t.Errorf("Nodes with different secrets connected: %v, %v", a.Presence(), b.Presence())
+	}
+	if err := b.Publish([]byte("forged")); err != nil {
+		t.Fatalf("Publish() error = %v", err)
+	}
+	expectNone(t, "a", fromA)
+}
+
+func TestMesh_LimitsUnauthenticatedPeers(t *testing.T) {
+	ln := listen(t)
+	startMesh(t, "a", ln)
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer func() { _ = conn.Close() }()
+
+	// A hello that never ends is cut off long before the handshake times
+	// out.
+	go func() {
+		_, _ = conn.Write([]byte(`{"kind":"hello","node":"`))
+		_, _ = conn.Write(bytes.Repeat([]byte("x"), 1<<20))
+	}()
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	// Closing with unread data may reset the connection rather than end it.
+	if _, err := io.Copy(io.Discard, conn); errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Error("Connection was not closed after an oversized hello")
+	}
+}
+
+func TestMesh_RequiresSecret(t *testing.T) {
+	m := cluster.New("a", "127.0.0.1:0", nil)
+	if err := m.Start(func([]byte) {}); err == nil {
+		_ = m.Close()
+		t.Fatal("Start() without a secret succeeded, want an error")
+	}
+}
+
+func TestMesh_ConnectsServers(t *testing.T) {
+	lnA, lnB := listen(t), listen(t)
+	meshA := cluster.New(
+		"a",
+		lnA.Addr().String(),
+		nil,
+		cluster.WithListener(lnA),
+		cluster.WithSecret(testSecret),
+	)
+	meshB := cluster.New(
+		"b",
+		lnB.Addr().String(),
+		[]string{lnA.Addr().String()},
+		cluster.WithListener(lnB),
+		cluster.WithSecret(testSecret),
+		cluster.WithRetryInterval(50*time.Millisecond),
+	)
+	srvA := server.New("127.0.0.1:0", server.WithBroker(meshA))
+	srvB := server.New("127.0.0.1:0", server.WithBroker(meshB))
+	for _, srv := range []*server.Server{srvA, srvB} {
+		go func() {
+			_ = srv.Start()
+		}()
+		<-srv.Ready()
+		defer srv.Stop()
+	}
+	waitFor(t, "the servers to connect", func() bool {
+		return sees(meshA, "b")() && sees(meshB, "a")()
+	})
+
+	alice := dialAndJoin(t, srvA.Addr(), "alice")
+	// Alice's JOIN is sent to b ahead of her presence; bob must not get it.
+	waitFor(t, "b to hear of alice", func() bool {
+		return slices.Equal(meshB.Presence()["a"], []string{"alice"})
+	})
+	bob := dialAndJoin(t, srvB.Addr(), "bob")
+	// Bob joined after alice, so alice hears of it across the cluster.
+	if msg := readMessage(t, alice); msg.Type != protocol.MessageTypeJoin || msg.Sender != "bob" {
+		t.Fatalf("alice received %s from %q, want bob's JOIN", msg.Type, msg.Sender)
+	}
+
+	send(t, alice, protocol.Message{
+		Type:    protocol.MessageTypeText,
+		Sender:  "alice",
+		Content: "hi from a",
+	})
+	if msg := readMessage(t, bob); msg.Sender != "alice" || msg.Content != "hi from a" {
+		t.Errorf("bob received %q from %q, want alice's message", msg.Content, msg.Sender)
+	}
+
+	waitFor(t, "both servers' users to be listed", func() bool {
+		presence := meshA.Presence()
+		return slices.Equal(presence["a"], []string{"alice"}) &&
+			slices.Equal(presence["b"], []string{"bob"})
+	})
+}
+
+// dialAndJoin connects to a server over TCP and sends a JOIN as username.
+func dialAndJoin(t *testing.T, addr, username string) net.Conn {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	t.Cleanup(func() {
+		_ = conn.Close()
+	})
+	send(t, conn, protocol.Message{Type: protocol.MessageTypeJoin, Sender: username})
+	return conn
+}
+
+// send encodes msg and writes it to conn.
+func send(t *testing.T, conn net.Conn, msg protocol.Message) {
+	t.Helper()
+
+	data, err := msg.Encode()
+	if err != nil {
+		t.Fatalf("Failed to encode message: %v", err)
+	}
+	if err := protocol.WriteFrame(conn, data); err != nil {
+		t.Fatalf("Failed to send message: %v", err)
+	}
+}
+
+// readMessage reads and decodes one message from conn, failing after a second.
+func readMessage(t *testing.T, conn net.Conn) protocol.Message {
+	t.Helper()
+
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	data, err := protocol.ReadFrame(conn)
+	if err != nil {
+		t.Fatalf("Failed to read message: %v", err)
+	}
+	var msg protocol.Message
+	if err := msg.Decode(data); err != nil {
+		t.Fatalf("Failed to decode message: %v", err)
+	}
+	return msg
+}
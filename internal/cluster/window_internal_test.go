@@ -0,0 +1,32 @@
+package cluster
+
+import "testing"
+
+func TestSeqWindow(t *testing.T) {
+	var w seqWindow
+	steps := []struct {
+		seq  uint64
+		want bool
+	}{
+		{seq: 1, want: true},
+		{seq: 3, want: true},
+		{seq: 1, want: false},
+		// A second link brings the number the first one dropped.
+		{seq: 2, want: true},
+		{seq: 2, want: false},
+		{seq: 3, want: false},
+		{seq: 3 + seenWindow, want: true},
+		// Out of the window now, so taken for a duplicate.
+		{seq: 3, want: false},
+		{seq: 4, want: true},
+		{seq: 4, want: false},
+		{seq: 5 + 3*seenWindow, want: true},
+		{seq: 4 + 3*seenWindow, want: true},
+		{seq: 4 + 2*seenWindow, want: false},
+	}
+	for i, step := range steps {
+		if got := w.add(step.seq); got != step.want {
+			t.Errorf("step %d: add(%d) = %v, want %v", i, step.seq, got, step.want)
+		}
+	}
+}
@@ -0,0 +1,478 @@
+// Package config loads the chat server's JSON configuration file and maps it
+// onto server options.
+package config
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net/netip"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/omochice/toy-socket-chat/internal/server"
+)
+
+// Config is the on-disk server configuration. Every field is optional; the
+// zero value matches the server's defaults. The server has a single chat, so
+// there are no rooms to configure.
+type Config struct {
+	// Listen is the chat listener address, e.g. ":8080". It may be empty when
+	// Listeners are given.
+	Listen string `json:"listen"`
+	// Listeners are additional chat listeners, each with its own transports.
+	Listeners []Listener `json:"listeners"`
+	// Admin and Metrics are the admin API and metrics endpoint addresses.
+	Admin   string `json:"admin"`
+	Metrics string `json:"metrics"`
+	// AllowedOrigins are browser origin patterns (see server.WithAllowedOrigins).
+	AllowedOrigins []string `json:"allowedOrigins"`
+	// AllowedHosts are the Host headers browser sessions may be opened with
+	// (see server.WithAllowedHosts).
+	AllowedHosts []string `json:"allowedHosts"`
+	// TrustedProxies are the IPs or CIDR prefixes of load balancers whose
+	// PROXY protocol and X-Forwarded-For headers are believed.
+	TrustedProxies []string `json:"trustedProxies"`
+
+	TLS    TLS    `json:"tls"`
+	Limits Limits `json:"limits"`
+	Bans   Bans   `json:"bans"`
+	Auth   Auth   `json:"auth"`
+	// HistorySize is how many recent messages can be edited or deleted.
+	// Zero means server.DefaultHistorySize.
+	HistorySize int `json:"historySize"`
+	// MOTD is sent to each client after it joins.
+	MOTD string `json:"motd"`
+	Log  Log    `json:"log"`
+	// Cluster connects this server to others so their users share one chat.
+	Cluster Cluster `json:"cluster"`
+	// Federation links this server's chat with other teams' servers.
+	Federation Federation `json:"federation"`
+}
+
+// Listener mirrors server.Listener. Mode is an octal permission string such as
+// "0660", since JSON has no octal numbers.
+type Listener struct {
+	Network    string   `json:"network"`
+	Address    string   `json:"address"`
+	Transports []string `json:"transports"`
+	TLS        bool     `json:"tls"`
+	Mode       string   `json:"mode"`
+}
+
+// TLS names the certificate and key files that enable WebTransport.
+type TLS struct {
+	Cert string `json:"cert"`
+	Key  string `json:"key"`
+}
+
+// Limits mirrors server.Limits.
+type Limits struct {
+	MaxClients       int `json:"maxClients"`
+	MaxMessageLength int `json:"maxMessageLength"`
+}
+
+// Bans lists banned usernames and client addresses. Addresses may be single
+// IPs or CIDR prefixes.
+type Bans struct {
+	Usernames []string `json:"usernames"`
+	Addresses []string `json:"addresses"`
+}
+
+// Cluster configures the node-to-node mesh (see cluster.Mesh). Clustering is
+// enabled by setting Listen, which requires Secret.
+type Cluster struct {
+	// Node names this server within the cluster. Defaults to the host name.
+	Node string `json:"node"`
+	// Listen is the address other nodes connect to, e.g. "10.0.0.1:7946".
+	Listen string `json:"listen"`
+	// Secret is shared by every node of the cluster.
+	Secret string `json:"secret"`
+	// Peers are the other nodes' Listen addresses.
+	Peers []string `json:"peers"`
+}
+
+// Federation configures links to other teams' servers (see
+// server.Federation). Incoming links are accepted once Secret is set.
+type Federation struct {
+	// Name is the server name shown after this server's users on the other
+	// side, as in alice@serverA. Defaults to the host name.
+	Name string `json:"name"`
+	// Secret is shared with the linked servers.
+	Secret string `json:"secret"`
+	// Peers are the chat addresses of servers to link to.
+	Peers []string `json:"peers"`
+	// Relay limits the links to the named servers to the listed scopes:
+	// "messages", "presence" and "reactions". Other links carry all three.
+	Relay map[string][]string `json:"relay"`
+}
+
+// Auth configures the users who prove who they are. Other users are known by
+// the name they join with.
+type Auth struct {
+	// Operators maps the usernames that may edit and delete anyone's
+	// messages to the passwords they join with.
+	Operators map[string]string `json:"operators"`
+}
+
+// Log selects the log format ("text" or "json") and minimum level ("debug",
+// "info", "warn" or "error").
+type Log struct {
+	Format string `json:"format"`
+	Level  string `json:"level"`
+}
+
+// Default returns the configuration used when no file is given.
+func Default() *Config {
+	return &Config{
+		Listen: ":8080",
+		Log:    Log{Format: "text", Level: "info"},
+	}
+}
+
+// Load reads and validates the configuration file at path. Fields absent from
+// the file keep their Default values. Unknown fields are rejected so typos do
+// not silently fall back to defaults.
+func Load(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config: %w", err)
+	}
+
+	cfg := Default()
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse config %s: %w", path, err)
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid config %s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+// Validate checks the configuration for values that cannot be mapped onto
+// server options.
+func (c *Config) Validate() error {
+	if (c.TLS.Cert == "") != (c.TLS.Key == "") {
+		return fmt.Errorf("tls.cert and tls.key must be set together")
+	}
+	if c.Listen == "" && len(c.Listeners) == 0 {
+		return fmt.Errorf("listen or listeners must be set")
+	}
+	for _, l := range c.Listeners {
+		if _, err := l.mode(); err != nil {
+			return err
+		}
+	}
+	for _, l := range c.ServerListeners() {
+		// Whether a certificate is available is only known once command-line
+		// flags such as -dev-tls are applied, so the server checks that itself.
+		if err := l.Validate(); err != nil {
+			return err
+		}
+	}
+	if c.Limits.MaxClients < 0 || c.Limits.MaxMessageLength < 0 {
+		return fmt.Errorf("limits must not be negative")
+	}
+	if c.HistorySize < 0 {
+		return fmt.Errorf("historySize must not be negative")
+	}
+	if _, err := c.Bans.networks(); err != nil {
+		return err
+	}
+	if _, err := parseNetworks(c.TrustedProxies, "trusted proxy"); err != nil {
+		return err
+	}
+	if _, err := c.Log.level(); err != nil {
+		return err
+	}
+	if c.Log.Format != "text" && c.Log.Format != "json" {
+		return fmt.Errorf("unknown log format %q", c.Log.Format)
+	}
+	for username, password := range c.Auth.Operators {
+		if password == "" {
+			return fmt.Errorf("auth.operators.%s must have a password", username)
+		}
+	}
+	if c.Cluster.Listen == "" && (c.Cluster.Node != "" || len(c.Cluster.Peers) > 0) {
+		return fmt.Errorf("cluster.listen must be set to join a cluster")
+	}
+	if c.Cluster.Listen != "" && c.Cluster.Secret == "" {
+		return fmt.Errorf("cluster.secret must be set to join a cluster")
+	}
+	if c.Federation.Secret == "" && len(c.Federation.Peers) > 0 {
+		return fmt.Errorf("federation.secret must be set to link servers")
+	}
+	if strings.Contains(c.Federation.Name, "@") {
+		return fmt.Errorf("federation.name %q must not contain @", c.Federation.Name)
+	}
+	for peer, scopes := range c.Federation.Relay {
+		if len(scopes) == 0 {
+			return fmt.Errorf("federation.relay.%s must list what to relay", peer)
+		}
+		for _, scope := range scopes {
+			if !server.RelayScope(scope).Valid() {
+				return fmt.Errorf("unknown relay scope %q for %s", scope, peer)
+			}
+		}
+	}
+	return nil
+}
+
+// ServerOptions maps the configuration onto server options. The TLS files are
+// passed to server.WithTLSFiles, so the server loads them when it starts and
+// reloads them whenever they change on disk.
+func (c *Config) ServerOptions() ([]server.Option, error) {
+	opts := []server.Option{
+		server.WithLimits(c.ServerLimits()),
+		server.WithMOTD(c.MOTD),
+		server.WithOperators(c.Auth.Operators),
+	}
+	if c.HistorySize > 0 {
+		opts = append(opts, server.WithHistorySize(c.HistorySize))
+	}
+
+	bans, err := c.ServerBans()
+	if err != nil {
+		return nil, err
+	}
+	opts = append(opts, server.WithBans(bans))
+
+	if c.TLS.Cert != "" {
+		opts = append(opts, server.WithTLSFiles(c.TLS.Cert, c.TLS.Key))
+	}
+	if len(c.Listeners) > 0 {
+		opts = append(opts, server.WithListeners(c.ServerListeners()...))
+	}
+	if len(c.AllowedOrigins) > 0 {
+		opts = append(opts, server.WithAllowedOrigins(c.AllowedOrigins...))
+	}
+	if len(c.AllowedHosts) > 0 {
+		opts = append(opts, server.WithAllowedHosts(c.AllowedHosts...))
+	}
+	if len(c.TrustedProxies) > 0 {
+		proxies, err := parseNetworks(c.TrustedProxies, "trusted proxy")
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, server.WithTrustedProxies(proxies...))
+	}
+	if c.Admin != "" {
+		opts = append(opts, server.WithAdmin(c.Admin))
+	}
+	if c.Metrics != "" {
+		opts = append(opts, server.WithMetrics(c.Metrics))
+	}
+	if c.Federation.Secret != "" {
+		opts = append(opts, server.WithFederation(server.Federation{
+			Name:   c.Federation.ServerName(),
+			Secret: c.Federation.Secret,
+			Peers:  c.Federation.Peers,
+			Relay:  c.Federation.relayScopes(),
+		}))
+	}
+	return opts, nil
+}
+
+// ServerListeners returns the configured listeners as server.Listener values.
+func (c *Config) ServerListeners() []server.Listener {
+	listeners := make([]server.Listener, 0, len(c.Listeners))
+	for _, l := range c.Listeners {
+		transports := make([]server.Transport, 0, len(l.Transports))
+		for _, t := range l.Transports {
+			transports = append(transports, server.Transport(t))
+		}
+		// Validate has already rejected unparsable modes.
+		mode, _ := l.mode()
+		listeners = append(listeners, server.Listener{
+			Network:    l.Network,
+			Address:    l.Address,
+			Transports: transports,
+			TLS:        l.TLS,
+			Mode:       mode,
+		})
+	}
+	return listeners
+}
+
+// ServerLimits returns the configured limits as server.Limits.
+func (c *Config) ServerLimits() server.Limits {
+	return server.Limits{
+		MaxClients:       c.Limits.MaxClients,
+		MaxMessageLength: c.Limits.MaxMessageLength,
+	}
+}
+
+// ServerBans returns the configured bans as server.Bans.
+func (c *Config) ServerBans() (server.Bans, error) {
+	networks, err := c.Bans.networks()
+	if err != nil {
+		return server.Bans{}, err
+	}
+	return server.Bans{Usernames: c.Bans.Usernames, Networks: networks}, nil
+}
+
+// LoadCertificate loads the configured TLS key pair.
+func (c *Config) LoadCertificate() (tls.Certificate, error) {
+	cert, err := tls.LoadX509KeyPair(c.TLS.Cert, c.TLS.Key)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("failed to load TLS key pair: %w", err)
+	}
+	return cert, nil
+}
+
+// LogLevel returns the configured minimum log level.
+func (c *Config) LogLevel() slog.Level {
+	// Validate has already rejected unparsable levels.
+	lvl, _ := c.Log.level()
+	return lvl
+}
+
+// RestartRequired lists the settings that differ between c and next but can
+// only take effect after a restart, because they are bound at startup.
+func (c *Config) RestartRequired(next *Config) []string {
+	var changed []string
+	if c.Listen != next.Listen {
+		changed = append(changed, "listen")
+	}
+	if !slices.EqualFunc(c.Listeners, next.Listeners, Listener.equal) {
+		changed = append(changed, "listeners")
+	}
+	if c.Admin != next.Admin {
+		changed = append(changed, "admin")
+	}
+	if c.Metrics != next.Metrics {
+		changed = append(changed, "metrics")
+	}
+	if strings.Join(c.AllowedOrigins, ",") != strings.Join(next.AllowedOrigins, ",") {
+		changed = append(changed, "allowedOrigins")
+	}
+	if strings.Join(c.AllowedHosts, ",") != strings.Join(next.AllowedHosts, ",") {
+		changed = append(changed, "allowedHosts")
+	}
+	if strings.Join(c.TrustedProxies, ",") != strings.Join(next.TrustedProxies, ",") {
+		changed = append(changed, "trustedProxies")
+	}
+	if c.TLS != next.TLS {
+		// The server watches the files it was started with; renewing them in
+		// place needs no restart, but pointing at different files does.
+		changed = append(changed, "tls")
+	}
+	if c.HistorySize != next.HistorySize {
+		changed = append(changed, "historySize")
+	}
+	if c.Log.Format != next.Log.Format {
+		changed = append(changed, "log.format")
+	}
+	if c.Cluster.Node != next.Cluster.Node ||
+		c.Cluster.Listen != next.Cluster.Listen ||
+		c.Cluster.Secret != next.Cluster.Secret ||
+		!slices.Equal(c.Cluster.Peers, next.Cluster.Peers) {
+		changed = append(changed, "cluster")
+	}
+	if c.Federation.Name != next.Federation.Name ||
+		c.Federation.Secret != next.Federation.Secret ||
+		!slices.Equal(c.Federation.Peers, next.Federation.Peers) ||
+		!maps.EqualFunc(c.Federation.Relay, next.Federation.Relay, slices.Equal) {
+		changed = append(changed, "federation")
+	}
+	return changed
+}
+
+// NodeName returns the configured node name, or the host name if none is set.
+func (c Cluster) NodeName() string {
+	if c.Node != "" {
+		return c.Node
+	}
+	return hostname()
+}
+
+// ServerName returns the configured server name, or the host name if none is
+// set.
+func (f Federation) ServerName() string {
+	if f.Name != "" {
+		return f.Name
+	}
+	return hostname()
+}
+
+// relayScopes returns Relay as server relay scopes, or nil if it is empty.
+func (f Federation) relayScopes() map[string][]server.RelayScope {
+	if len(f.Relay) == 0 {
+		return nil
+	}
+	relay := make(map[string][]server.RelayScope, len(f.Relay))
+	for peer, scopes := range f.Relay {
+		for _, scope := range scopes {
+			relay[peer] = append(relay[peer], server.RelayScope(scope))
+		}
+	}
+	return relay
+}
+
+// hostname returns the host name, or "localhost" if it cannot be read.
+func hostname() string {
+	if host, err := os.Hostname(); err == nil {
+		return host
+	}
+	return "localhost"
+}
+
+func (l Listener) equal(other Listener) bool {
+	return l.Network == other.Network &&
+		l.Address == other.Address &&
+		l.TLS == other.TLS &&
+		l.Mode == other.Mode &&
+		slices.Equal(l.Transports, other.Transports)
+}
+
+func (l Listener) mode() (os.FileMode, error) {
+	if l.Mode == "" {
+		return 0, nil
+	}
+	mode, err := strconv.ParseUint(l.Mode, 8, 32)
+	if err != nil || mode > 0o777 {
+		return 0, fmt.Errorf("invalid mode %q for listener %s", l.Mode, l.Address)
+	}
+	return os.FileMode(mode), nil
+}
+
+func (b Bans) networks() ([]netip.Prefix, error) {
+	return parseNetworks(b.Addresses, "banned")
+}
+
+// parseNetworks parses IPs and CIDR prefixes into prefixes, a single IP
+// becoming a /32 or /128. kind describes the list in error messages.
+func parseNetworks(addrs []string, kind string) ([]netip.Prefix, error) {
+	networks := make([]netip.Prefix, 0, len(addrs))
+	for _, addr := range addrs {
+		if strings.Contains(addr, "/") {
+			prefix, err := netip.ParsePrefix(addr)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s network %q: %w", kind, addr, err)
+			}
+			networks = append(networks, prefix.Masked())
+			continue
+		}
+		ip, err := netip.ParseAddr(addr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s address %q: %w", kind, addr, err)
+		}
+		networks = append(networks, netip.PrefixFrom(ip, ip.BitLen()))
+	}
+	return networks, nil
+}
+
+func (l Log) level() (slog.Level, error) {
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(l.Level)); err != nil {
+		return 0, fmt.Errorf("unknown log level %q", l.Level)
+	}
+	return lvl, nil
+}
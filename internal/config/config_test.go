@@ -0,0 +1,185 @@
+package config_test
+
+import (
+	"log/slog"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/omochice/toy-socket-chat/internal/config"
+	"github.com/omochice/toy-socket-chat/internal/server"
+)
+
+// writeConfig writes content to a config file in a temporary directory and
+// returns its path.
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "server.json")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+	return path
+}
+
+func TestLoad(t *testing.T) {
+	path := writeConfig(t, `{
+		"listen": ":9000",
+		"limits": {"maxClients": 50, "maxMessageLength": 500},
+		"bans": {"usernames": ["mallory"], "addresses": ["192.0.2.1", "10.0.0.0/8"]},
+		"motd": "Welcome!",
+		"auth": {"operators": {"oscar": "pa55"}},
+		"log": {"level": "debug"}
+	}`)
+
+	cfg, err := config.Load(path)
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+
+	if cfg.Listen != ":9000" {
+		t.Errorf("Listen = %q, want %q", cfg.Listen, ":9000")
+	}
+	if got := cfg.Auth.Operators["oscar"]; got != "pa55" {
+		t.Errorf("Auth.Operators[oscar] = %q, want %q", got, "pa55")
+	}
+	if cfg.Log.Format != "text" {
+		t.Errorf("Log.Format = %q, want default %q", cfg.Log.Format, "text")
+	}
+	if cfg.LogLevel() != slog.LevelDebug {
+		t.Errorf("LogLevel() = %v, want %v", cfg.LogLevel(), slog.LevelDebug)
+	}
+	if limits := cfg.ServerLimits(); limits.MaxClients != 50 || limits.MaxMessageLength != 500 {
+		t.Errorf("ServerLimits() = %+v, want MaxClients 50 and MaxMessageLength 500", limits)
+	}
+
+	bans, err := cfg.ServerBans()
+	if err != nil {
+		t.Fatalf("ServerBans() error = %v", err)
+	}
+	wantNetworks := []netip.Prefix{
+		netip.MustParsePrefix("192.0.2.1/32"),
+		netip.MustParsePrefix("10.0.0.0/8"),
+	}
+	if !slices.Equal(bans.Networks, wantNetworks) {
+		t.Errorf("ServerBans().Networks = %v, want %v", bans.Networks, wantNetworks)
+	}
+}
+
+func TestLoad_Invalid(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+	}{
+		{name: "unknown field", content: `{"lisen": ":9000"}`},
+		{name: "cert without key", content: `{"tls": {"cert": "server.pem"}}`},
+		{name: "negative limit", content: `{"limits": {"maxClients": -1}}`},
+		{name: "negative history size", content: `{"historySize": -1}`},
+		{name: "bad banned address", content: `{"bans": {"addresses": ["not-an-ip"]}}`},
+		{name: "bad trusted proxy", content: `{"trustedProxies": ["10.0.0.0/33"]}`},
+		{name: "bad log level", content: `{"log": {"level": "loud"}}`},
+		{name: "bad log format", content: `{"log": {"format": "xml"}}`},
+		{name: "malformed JSON", content: `{"listen":`},
+		{name: "no listeners", content: `{"listen": ""}`},
+		{
+			name:    "cluster peers without listen",
+			content: `{"cluster": {"peers": ["10.0.0.2:7946"]}}`,
+		},
+		{
+			name:    "cluster listen without secret",
+			content: `{"cluster": {"listen": "10.0.0.1:7946"}}`,
+		},
+		{
+			name:    "federation peers without secret",
+			content: `{"federation": {"peers": ["chat.example.org:8080"]}}`,
+		},
+		{
+			name:    "operator without password",
+			content: `{"auth": {"operators": {"oscar": ""}}}`,
+		},
+		{name: "federation name with @", content: `{"federation": {"name": "a@b"}}`},
+		{
+			name:    "unknown relay scope",
+			content: `{"federation": {"relay": {"serverB": ["rooms"]}}}`,
+		},
+		{name: "empty relay scopes", content: `{"federation": {"relay": {"serverB": []}}}`},
+		{
+			name:    "bad socket mode",
+			content: `{"listeners": [{"network": "unix", "address": "/s", "mode": "rw"}]}`,
+		},
+		{
+			name: "transport not available on network",
+			content: `{"listeners": [
+				{"network": "udp", "address": ":8443", "transports": ["tcp"]}
+			]}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := config.Load(writeConfig(t, tt.content)); err == nil {
+				t.Error("Load() error = nil, want an error")
+			}
+		})
+	}
+}
+
+func TestLoad_Listeners(t *testing.T) {
+	path := writeConfig(t, `{
+		"listen": "",
+		"listeners": [
+			{"address": "127.0.0.1:8080", "transports": ["tcp"]},
+			{"network": "tcp6", "address": "[::]:443", "tls": true},
+			{"network": "unix", "address": "/run/chat.sock", "mode": "0660"}
+		]
+	}`)
+
+	cfg, err := config.Load(path)
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+
+	listeners := cfg.ServerListeners()
+	if len(listeners) != 3 {
+		t.Fatalf("ServerListeners() = %+v, want 3 listeners", listeners)
+	}
+	if got := listeners[0].Transports; !slices.Equal(got, []server.Transport{server.TransportTCP}) {
+		t.Errorf("listeners[0].Transports = %v, want [tcp]", got)
+	}
+	if !listeners[1].TLS || listeners[1].Network != "tcp6" {
+		t.Errorf("listeners[1] = %+v, want a TLS tcp6 listener", listeners[1])
+	}
+	if listeners[2].Mode != 0o660 {
+		t.Errorf("listeners[2].Mode = %o, want 660", listeners[2].Mode)
+	}
+}
+
+func TestConfig_RestartRequired(t *testing.T) {
+	current := config.Default()
+
+	next := config.Default()
+	next.MOTD = "hello"
+	next.Auth.Operators = map[string]string{"alice": "secret"}
+	next.Limits.MaxClients = 10
+	next.Log.Level = "debug"
+	if changed := current.RestartRequired(next); len(changed) != 0 {
+		t.Errorf("RestartRequired() = %v, want none for reloadable settings", changed)
+	}
+
+	next.Listen = ":9999"
+	next.Admin = "127.0.0.1:9090"
+	next.Listeners = []config.Listener{{Address: ":8443", TLS: true}}
+	next.Cluster.Peers = []string{"10.0.0.2:7946"}
+	next.Federation.Secret = "s3cret"
+	next.HistorySize = 50
+	changed := current.RestartRequired(next)
+	for _, want := range []string{
+		"listen", "listeners", "admin", "cluster", "federation", "historySize",
+	} {
+		if !slices.Contains(changed, want) {
+			t.Errorf("RestartRequired() = %v, want it to include %s", changed, want)
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package devcert_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/x509"
+	"encoding/pem"
+	"testing"
+	"time"
+
+	"github.com/omochice/toy-socket-chat/internal/devcert"
+)
+
+func TestGenerate(t *testing.T) {
+	cert, certPEM, err := devcert.Generate([]string{"localhost", "127.0.0.1", "::1"})
+	if err != nil {
+		t.Fatalf("Generate() error = %v", err)
+	}
+
+	leaf := cert.Leaf
+	if _, ok := leaf.PublicKey.(*ecdsa.PublicKey); !ok {
+		t.Errorf("Public key type = %T, want *ecdsa.PublicKey", leaf.PublicKey)
+	}
+	if validity := leaf.NotAfter.Sub(leaf.NotBefore); validity > 14*24*time.Hour {
+		t.Errorf("Validity = %v, want at most 14 days for serverCertificateHashes", validity)
+	}
+	if len(leaf.DNSNames) != 1 || len(leaf.IPAddresses) != 2 {
+		t.Errorf(
+			"SANs = %v / %v, want localhost and two IP addresses",
+			leaf.DNSNames,
+			leaf.IPAddresses,
+		)
+	}
+
+	// The PEM output must work as a client trust root for the certificate.
+	block, _ := pem.Decode(certPEM)
+	if block == nil {
+		t.Fatal("Failed to decode certificate PEM")
+	}
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(certPEM)
+	if _, err := leaf.Verify(x509.VerifyOptions{
+		DNSName: "localhost",
+		Roots:   pool,
+	}); err != nil {
+		t.Errorf("Certificate does not verify against its own PEM: %v", err)
+	}
+}
+
+func TestFingerprint(t *testing.T) {
+	cert, _, err := devcert.Generate([]string{"localhost"})
+	if err != nil {
+		t.Fatalf("Generate() error = %v", err)
+	}
+
+	fp := devcert.Fingerprint(cert)
+	if len(fp) != 64 {
+		t.Errorf("Fingerprint() length = %d, want 64 hex characters", len(fp))
+	}
+	if devcert.Fingerprint(cert) != fp {
+		t.Error("Fingerprint() is not deterministic")
+	}
+}
@@ -0,0 +1,200 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/omochice/toy-socket-chat/pkg/protocol"
+)
+
+// WithAdmin enables the admin HTTP API on addr, a listener separate from the
+// chat port so it can be bound to a private interface. The API exposes
+// /healthz, /readyz, GET /clients, GET /presence, POST /broadcast and
+// POST /clients/{id}/disconnect.
+func WithAdmin(addr string) Option {
+	return func(s *Server) {
+		s.adminAddress = addr
+	}
+}
+
+// clientInfo is the JSON representation of a connected client returned by
+// GET /clients.
+type clientInfo struct {
+	ID             uint64    `json:"id"`
+	Username       string    `json:"username"`
+	Transport      string    `json:"transport"`
+	RemoteAddr     string    `json:"remoteAddr"`
+	ConnectedSince time.Time `json:"connectedSince"`
+	QueueDepth     int       `json:"queueDepth"`
+	// Peer is set instead of Username for a federation link.
+	Peer string `json:"peer,omitempty"`
+}
+
+// broadcastRequest is the JSON body accepted by POST /broadcast.
+type broadcastRequest struct {
+	Content string `json:"content"`
+}
+
+// broadcastBodyOverhead is how much larger than its content a
+// broadcastRequest may be, for the JSON around it.
+const broadcastBodyOverhead = 1024
+
+// startHTTP binds addr, or takes its socket from WithHTTPSockets, and serves
+// handler on it in a background goroutine tracked by s.wg. The server is
+// closed by Stop. name is only used in logs.
+func (s *Server) startHTTP(name, addr string, handler http.Handler) (net.Listener, error) {
+	listener := s.httpSockets[addr]
+	if listener == nil {
+		var err error
+		if listener, err = net.Listen("tcp", addr); err != nil {
+			return nil, fmt.Errorf("failed to listen on %s: %w", addr, err)
+		}
+	}
+	srv := &http.Server{
+		Handler:           handler,
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+	s.mu.Lock()
+	s.httpServers = append(s.httpServers, srv)
+	s.mu.Unlock()
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		if err := srv.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			s.logger.Error("HTTP server error", "name", name, "error", err)
+		}
+	}()
+
+	s.logger.Info("HTTP listener started", "name", name, "addr", listener.Addr().String())
+	return listener, nil
+}
+
+// AdminAddr returns the admin API's listening address, or "" when the admin
+// API is disabled or not yet started.
+func (s *Server) AdminAddr() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.adminListener != nil {
+		return s.adminListener.Addr().String()
+	}
+	return ""
+}
+
+// adminHandler returns the HTTP handler for the admin API.
+func (s *Server) adminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /healthz", func(w http.ResponseWriter, _ *http.Request) {
+		writeText(w, http.StatusOK, "ok")
+	})
+	mux.HandleFunc("GET /readyz", func(w http.ResponseWriter, _ *http.Request) {
+		if !s.ready.Load() {
+			writeText(w, http.StatusServiceUnavailable, "not ready")
+			return
+		}
+		writeText(w, http.StatusOK, "ready")
+	})
+	mux.HandleFunc("GET /clients", s.handleListClients)
+	mux.HandleFunc("GET /presence", s.handlePresence)
+	mux.HandleFunc("POST /broadcast", s.handleAdminBroadcast)
+	mux.HandleFunc("POST /clients/{id}/disconnect", s.handleDisconnectClient)
+	return mux
+}
+
+func (s *Server) handleListClients(w http.ResponseWriter, _ *http.Request) {
+	s.mu.RLock()
+	infos := make([]clientInfo, 0, len(s.clients))
+	for client := range s.clients {
+		infos = append(infos, clientInfo{
+			ID:             client.id,
+			Username:       client.name(),
+			Transport:      string(client.transport),
+			RemoteAddr:     client.conn.RemoteAddr().String(),
+			ConnectedSince: client.connectedAt,
+			QueueDepth:     len(client.outgoing),
+			Peer:           client.peerName(),
+		})
+	}
+	s.mu.RUnlock()
+
+	sort.Slice(infos, func(i, j int) bool { return infos[i].ID < infos[j].ID })
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(infos)
+}
+
+func (s *Server) handleAdminBroadcast(w http.ResponseWriter, r *http.Request) {
+	// JSON may escape each byte of the content as six, as in \u0000.
+	r.Body = http.MaxBytesReader(w, r.Body, int64(6*s.contentLimit()+broadcastBodyOverhead))
+	var req broadcastRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) || err == nil && s.tooLong(req.Content) {
+		writeText(w, http.StatusRequestEntityTooLarge, "content too long")
+		return
+	}
+	if err != nil || req.Content == "" {
+		writeText(w, http.StatusBadRequest, "body must be JSON with a non-empty \"content\"")
+		return
+	}
+
+	msg := protocol.Message{
+		Type:    protocol.MessageTypeText,
+		Sender:  serverSender,
+		Content: req.Content,
+	}
+	data, err := msg.Encode()
+	if err != nil {
+		writeText(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	s.logger.Info("Admin notice broadcast", "content", req.Content)
+	s.publish(data, msg, nil)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) handleDisconnectClient(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseUint(r.PathValue("id"), 10, 64)
+	if err != nil {
+		writeText(w, http.StatusBadRequest, "invalid client id")
+		return
+	}
+
+	client := s.clientByID(id)
+	if client == nil {
+		writeText(w, http.StatusNotFound, "no such client")
+		return
+	}
+
+	// Closing the connection makes handleClient's read fail, which runs the
+	// usual cleanup and removes the client from s.clients.
+	client.log().Info("Admin disconnecting client")
+	if err := client.conn.Close(); err != nil {
+		client.log().Debug("Error closing client connection", "error", err)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// clientByID returns the connected client with the given id, or nil.
+func (s *Server) clientByID(id uint64) *Client {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for client := range s.clients {
+		if client.id == id {
+			return client
+		}
+	}
+	return nil
+}
+
+// writeText writes a plain-text response with the given status.
+func writeText(w http.ResponseWriter, status int, body string) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(status)
+	_, _ = fmt.Fprintln(w, body)
+}
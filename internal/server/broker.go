@@ -0,0 +1,145 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+	"sort"
+	"sync"
+
+	"github.com/omochice/toy-socket-chat/pkg/protocol"
+)
+
+// Broker carries chat messages and presence between the servers of a cluster,
+// so that users connected to different servers share one chat. The server
+// publishes every message its clients send (JOIN, LEAVE, TEXT, EDIT, DELETE,
+// REACTION, TYPING, READ and DIRECT) and admin notices; messages published by
+// other servers are passed to the deliver function given to Start and reach
+// this server's clients as if sent locally.
+//
+// A Broker must never deliver a message back to the server that published it,
+// nor deliver one message twice, however its servers are connected.
+type Broker interface {
+	// Start begins delivering other servers' messages to deliver, which may
+	// be called from any goroutine. It is called once, from Server.Start.
+	Start(deliver func(data []byte)) error
+	// Publish sends an encoded message to every other server.
+	Publish(data []byte) error
+	// SetPresence replaces the list of users joined on this server.
+	SetPresence(users []string)
+	// Presence returns the users joined on each server, keyed by node name,
+	// including this one.
+	Presence() map[string][]string
+	// Close stops the broker. It is called from Server.Stop.
+	Close() error
+}
+
+// LocalNode is the node name under which the default broker reports this
+// server's users.
+const LocalNode = "local"
+
+// WithBroker connects the server to a cluster through b. Without it the
+// server runs standalone: messages only reach its own clients.
+func WithBroker(b Broker) Option {
+	return func(s *Server) {
+		s.broker = b
+	}
+}
+
+// localBroker is the default Broker for a server that is not part of a
+// cluster. There are no other servers to publish to or hear from.
+type localBroker struct {
+	mu    sync.RWMutex
+	users []string
+}
+
+func (b *localBroker) Start(func([]byte)) error { return nil }
+
+func (b *localBroker) Publish([]byte) error { return nil }
+
+func (b *localBroker) SetPresence(users []string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.users = users
+}
+
+func (b *localBroker) Presence() map[string][]string {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return map[string][]string{LocalNode: slices.Clone(b.users)}
+}
+
+func (b *localBroker) Close() error { return nil }
+
+// publish delivers a message, data encoded, to this server's clients other
+// than sender and hands it to the broker for the rest of the cluster and to
+// the federation links. A private READ only updates the history of each
+// server, and a DIRECT only reaches its recipient.
+func (s *Server) publish(data []byte, msg protocol.Message, sender *Client) {
+	s.history.apply(msg)
+	if !msg.Private && msg.Type != protocol.MessageTypeDirect {
+		s.broadcast(data, msg.Type, sender)
+	}
+	s.notifyMentions(msg)
+	s.deliverDirect(msg)
+	if err := s.broker.Publish(data); err != nil {
+		s.logger.Warn("Failed to publish message to cluster", "error", err)
+	}
+	s.relay(data, msg, sender)
+}
+
+// deliverRemote broadcasts a message published by another server to every
+// client of this one, and relays it to this server's federation links.
+func (s *Server) deliverRemote(data []byte) {
+	var msg protocol.Message
+	if err := msg.Decode(data); err != nil {
+		s.metrics.decodeFailures.Add(1)
+		s.logger.Warn("Failed to decode message from cluster", "error", err)
+		return
+	}
+	s.history.apply(msg)
+	if !msg.Private && msg.Type != protocol.MessageTypeDirect {
+		s.broadcast(data, msg.Type, nil)
+	}
+	s.notifyMentions(msg)
+	s.deliverDirect(msg)
+	s.relay(data, msg, nil)
+}
+
+// updatePresence reports the usernames of this server's joined clients to the
+// broker.
+func (s *Server) updatePresence() {
+	s.mu.RLock()
+	users := make([]string, 0, len(s.clients))
+	for client := range s.clients {
+		if name := client.name(); name != "" {
+			users = append(users, name)
+		}
+	}
+	s.mu.RUnlock()
+
+	sort.Strings(users)
+	s.broker.SetPresence(users)
+}
+
+// nodePresence is the JSON representation of one server's users returned by
+// GET /presence.
+type nodePresence struct {
+	Node  string   `json:"node"`
+	Users []string `json:"users"`
+}
+
+func (s *Server) handlePresence(w http.ResponseWriter, _ *http.Request) {
+	presence := s.broker.Presence()
+	nodes := make([]nodePresence, 0, len(presence))
+	for node, users := range presence {
+		if users == nil {
+			users = []string{}
+		}
+		nodes = append(nodes, nodePresence{Node: node, Users: users})
+	}
+
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].Node < nodes[j].Node })
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(nodes)
+}
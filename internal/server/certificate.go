@@ -0,0 +1,193 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"time"
+)
+
+const (
+	// defaultCertReloadInterval is how often the certificate files given to
+	// WithTLSFiles are checked for changes.
+	defaultCertReloadInterval = 30 * time.Second
+	// certExpiryWarning is how close to expiry a certificate must be before a
+	// warning is logged. It is shorter than devcert.Validity, so a freshly
+	// generated development certificate is not reported as expiring.
+	certExpiryWarning = 7 * 24 * time.Hour
+	// certExpiryWarningRepeat limits how often the expiry warning is repeated
+	// for the same certificate.
+	certExpiryWarningRepeat = 24 * time.Hour
+	// maxPinnableValidity is the longest validity browsers accept for a
+	// certificate pinned through WebTransport's serverCertificateHashes.
+	maxPinnableValidity = 14 * 24 * time.Hour
+)
+
+// WithTLSFiles enables WebTransport using the PEM certificate and key at the
+// given paths. Unlike WithTLS, the files are watched while the server runs:
+// when either changes (for example after a renewal), the new pair is loaded and
+// presented to new handshakes, while established QUIC sessions carry on with
+// the certificate they negotiated.
+func WithTLSFiles(certFile, keyFile string) Option {
+	return func(s *Server) {
+		s.certFile = certFile
+		s.keyFile = keyFile
+	}
+}
+
+// certFileState identifies a version of the certificate and key files by
+// modification time and size, which is enough to notice a renewal without
+// reading the files on every check.
+type certFileState struct {
+	certMod, keyMod   time.Time
+	certSize, keySize int64
+}
+
+func statCertFiles(certFile, keyFile string) (certFileState, error) {
+	certInfo, err := os.Stat(certFile)
+	if err != nil {
+		return certFileState{}, err
+	}
+	keyInfo, err := os.Stat(keyFile)
+	if err != nil {
+		return certFileState{}, err
+	}
+	return certFileState{
+		certMod:  certInfo.ModTime(),
+		keyMod:   keyInfo.ModTime(),
+		certSize: certInfo.Size(),
+		keySize:  keyInfo.Size(),
+	}, nil
+}
+
+// loadCertificateFiles loads the key pair from s.certFile and s.keyFile and
+// makes it the current certificate.
+func (s *Server) loadCertificateFiles() error {
+	cert, err := tls.LoadX509KeyPair(s.certFile, s.keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load TLS key pair: %w", err)
+	}
+	s.tlsCert.Store(&cert)
+	s.logCertificate(&cert)
+	return nil
+}
+
+// watchCertificateFiles polls the certificate files until the server stops,
+// reloading them when they change and repeating the expiry warning daily. A
+// failed reload (for example when the certificate has been replaced but the key
+// not yet) keeps the current certificate and is retried on the next change.
+func (s *Server) watchCertificateFiles(last certFileState) {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(s.certReloadInterval)
+	defer ticker.Stop()
+	lastWarning := time.Now()
+
+	for {
+		select {
+		case <-s.quit:
+			return
+		case <-ticker.C:
+		}
+
+		state, err := statCertFiles(s.certFile, s.keyFile)
+		if err != nil {
+			s.logger.Warn("Failed to check TLS certificate files", "error", err)
+			continue
+		}
+		if state != last {
+			last = state
+			if err := s.loadCertificateFiles(); err != nil {
+				s.logger.Error(
+					"Failed to reload TLS certificate, keeping current one",
+					"error",
+					err,
+				)
+			} else {
+				s.logger.Info("TLS certificate reloaded from disk", "cert_file", s.certFile)
+				lastWarning = time.Now()
+			}
+			continue
+		}
+
+		if time.Since(lastWarning) >= certExpiryWarningRepeat {
+			if s.warnIfExpiring(s.tlsCert.Load()) {
+				lastWarning = time.Now()
+			}
+		}
+	}
+}
+
+// logCertificate logs the validity of cert and warns if it is close to expiry.
+func (s *Server) logCertificate(cert *tls.Certificate) {
+	leaf, err := certificateLeaf(cert)
+	if err != nil {
+		s.logger.Warn("Failed to parse TLS certificate", "error", err)
+		return
+	}
+	s.logger.Info(
+		"TLS certificate in use",
+		"subject", leaf.Subject.String(),
+		"not_after", leaf.NotAfter,
+	)
+	s.warnIfExpiring(cert)
+}
+
+// warnIfExpiring logs a warning if cert expires within certExpiryWarning (or
+// already has) and reports whether it did.
+func (s *Server) warnIfExpiring(cert *tls.Certificate) bool {
+	leaf, err := certificateLeaf(cert)
+	if err != nil {
+		return false
+	}
+	remaining := time.Until(leaf.NotAfter)
+	if remaining > certExpiryWarning {
+		return false
+	}
+	if remaining <= 0 {
+		s.logger.Error("TLS certificate has expired", "not_after", leaf.NotAfter)
+	} else {
+		s.logger.Warn(
+			"TLS certificate expires soon",
+			"not_after", leaf.NotAfter,
+			"remaining", remaining.Round(time.Hour).String(),
+		)
+	}
+	return true
+}
+
+// certificateLeaf returns the parsed leaf certificate of cert.
+func certificateLeaf(cert *tls.Certificate) (*x509.Certificate, error) {
+	if cert == nil || len(cert.Certificate) == 0 {
+		return nil, fmt.Errorf("no certificate")
+	}
+	if cert.Leaf != nil {
+		return cert.Leaf, nil
+	}
+	return x509.ParseCertificate(cert.Certificate[0])
+}
+
+// pinnableCertificateHash returns the hex SHA-256 hash of the current
+// certificate if browsers would accept it through serverCertificateHashes: an
+// ECDSA certificate valid for at most 14 days, such as the ones cmd/server
+// generates with -dev-tls. Otherwise it returns "", and browsers validate the
+// certificate against their trust store as usual.
+func (s *Server) pinnableCertificateHash() string {
+	cert := s.tlsCert.Load()
+	leaf, err := certificateLeaf(cert)
+	if err != nil {
+		return ""
+	}
+	if _, ok := leaf.PublicKey.(*ecdsa.PublicKey); !ok {
+		return ""
+	}
+	if leaf.NotAfter.Sub(leaf.NotBefore) > maxPinnableValidity {
+		return ""
+	}
+	sum := sha256.Sum256(cert.Certificate[0])
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,172 @@
+package server
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"log/slog"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/omochice/toy-socket-chat/internal/devcert"
+)
+
+// writeCertificateFiles writes a self-signed certificate for commonName,
+// expiring at notAfter, and its key as PEM files under dir.
+func writeCertificateFiles(
+	t *testing.T,
+	dir, commonName string,
+	notAfter time.Time,
+) (string, string) {
+	t.Helper()
+
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate private key: %v", err)
+	}
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		DNSNames:     []string{"localhost"},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &priv.PublicKey, priv)
+	if err != nil {
+		t.Fatalf("Failed to create certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(priv)
+	if err != nil {
+		t.Fatalf("Failed to marshal key: %v", err)
+	}
+
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	if err := os.WriteFile(certFile, certPEM, 0o600); err != nil {
+		t.Fatalf("Failed to write certificate: %v", err)
+	}
+	if err := os.WriteFile(keyFile, keyPEM, 0o600); err != nil {
+		t.Fatalf("Failed to write key: %v", err)
+	}
+	return certFile, keyFile
+}
+
+// currentCommonName returns the common name of the certificate the server
+// would present to a new handshake.
+func currentCommonName(t *testing.T, s *Server) string {
+	t.Helper()
+
+	cert, err := s.getCertificate(nil)
+	if err != nil {
+		t.Fatalf("getCertificate() error = %v", err)
+	}
+	leaf, err := certificateLeaf(cert)
+	if err != nil {
+		t.Fatalf("Failed to parse certificate: %v", err)
+	}
+	return leaf.Subject.CommonName
+}
+
+func TestServer_WithTLSFiles_ReloadsChangedCertificate(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeCertificateFiles(t, dir, "first", time.Now().Add(90*24*time.Hour))
+
+	s := New(":0", WithTLSFiles(certFile, keyFile))
+	s.certReloadInterval = 20 * time.Millisecond
+	go func() {
+		_ = s.Start()
+	}()
+	defer s.Stop()
+
+	time.Sleep(100 * time.Millisecond)
+
+	if name := currentCommonName(t, s); name != "first" {
+		t.Fatalf("Initial certificate CN = %q, want %q", name, "first")
+	}
+
+	writeCertificateFiles(t, dir, "second", time.Now().Add(90*24*time.Hour))
+	time.Sleep(200 * time.Millisecond)
+
+	if name := currentCommonName(t, s); name != "second" {
+		t.Errorf("Certificate CN after renewal = %q, want %q", name, "second")
+	}
+}
+
+// lockedBuffer is a bytes.Buffer safe for concurrent log writes.
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestServer_LogCertificate_WarnsNearExpiry(t *testing.T) {
+	tests := []struct {
+		name     string
+		notAfter time.Time
+		wantWarn bool
+	}{
+		{
+			name:     "far from expiry",
+			notAfter: time.Now().Add(90 * 24 * time.Hour),
+			wantWarn: false,
+		},
+		{
+			name:     "fresh development certificate",
+			notAfter: time.Now().Add(devcert.Validity),
+			wantWarn: false,
+		},
+		{
+			name:     "close to expiry",
+			notAfter: time.Now().Add(3 * 24 * time.Hour),
+			wantWarn: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			certFile, keyFile := writeCertificateFiles(t, t.TempDir(), "localhost", tt.notAfter)
+
+			var out lockedBuffer
+			s := New(
+				":0",
+				WithTLSFiles(certFile, keyFile),
+				WithLogger(slog.New(slog.NewTextHandler(&out, nil))),
+			)
+			if err := s.loadCertificateFiles(); err != nil {
+				t.Fatalf("loadCertificateFiles() error = %v", err)
+			}
+
+			logs := out.String()
+			if !strings.Contains(logs, "not_after=") {
+				t.Errorf("Expected expiry date in logs, got:\n%s", logs)
+			}
+			if got := strings.Contains(logs, "expires soon"); got != tt.wantWarn {
+				t.Errorf("expiry warning logged = %v, want %v\n%s", got, tt.wantWarn, logs)
+			}
+		})
+	}
+}
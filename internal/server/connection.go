@@ -2,34 +2,50 @@ package server
 
 import (
 	"bufio"
+	"errors"
 	"io"
 	"net"
-	"sync"
 	"time"
 
 	"github.com/gobwas/ws"
 	"github.com/gobwas/ws/wsutil"
+	"github.com/omochice/toy-socket-chat/pkg/protocol"
 )
 
-// Connection represents a client connection (TCP or WebSocket)
+// ErrNoDatagrams is returned by Connection.WriteDatagram and ReadDatagram on
+// transports without datagrams.
+var ErrNoDatagrams = errors.New("datagrams not supported")
+
+// Connection represents a client connection (TCP, WebSocket or WebTransport)
 type Connection interface {
 	// RemoteAddr returns the remote address
 	RemoteAddr() net.Addr
 
-	// Write sends binary data to the client
+	// Write sends data, one whole message, to the client
 	Write(data []byte) (int, error)
 
-	// Read receives binary data from the client
-	Read(buf []byte) (int, error)
+	// ReadMessage receives the next whole message from the client
+	ReadMessage() ([]byte, error)
 
 	// Close closes the connection
 	Close() error
 
 	// SetReadDeadline sets the read deadline
 	SetReadDeadline(t time.Time) error
+
+	// WriteDatagram sends data, one whole message, as an unreliable datagram
+	// that is not held up behind the data sent with Write. It returns
+	// ErrNoDatagrams if the transport has none or data does not fit in one,
+	// and the caller sends it with Write instead.
+	WriteDatagram(data []byte) error
+
+	// ReadDatagram receives the next datagram from the client, or returns
+	// ErrNoDatagrams at once if the transport has none.
+	ReadDatagram() ([]byte, error)
 }
 
-// TCPConnection wraps a net.Conn for TCP connections
+// TCPConnection wraps a net.Conn for TCP connections. Messages are framed
+// with protocol.WriteFrame, since TCP does not keep them apart.
 type TCPConnection struct {
 	conn   net.Conn
 	reader io.Reader
@@ -57,11 +73,14 @@ func (tc *TCPConnection) RemoteAddr() net.Addr {
 }
 
 func (tc *TCPConnection) Write(data []byte) (int, error) {
-	return tc.conn.Write(data)
+	if err := protocol.WriteFrame(tc.conn, data); err != nil {
+		return 0, err
+	}
+	return len(data), nil
 }
 
-func (tc *TCPConnection) Read(buf []byte) (int, error) {
-	return tc.reader.Read(buf)
+func (tc *TCPConnection) ReadMessage() ([]byte, error) {
+	return protocol.ReadFrame(tc.reader)
 }
 
 func (tc *TCPConnection) Close() error {
@@ -72,12 +91,18 @@ func (tc *TCPConnection) SetReadDeadline(t time.Time) error {
 	return tc.conn.SetReadDeadline(t)
 }
 
-// WebSocketConnection wraps a net.Conn for WebSocket connections using gobwas/ws
+func (tc *TCPConnection) WriteDatagram([]byte) error {
+	return ErrNoDatagrams
+}
+
+func (tc *TCPConnection) ReadDatagram() ([]byte, error) {
+	return nil, ErrNoDatagrams
+}
+
+// WebSocketConnection wraps a net.Conn for WebSocket connections using
+// gobwas/ws. Each message is one WebSocket message.
 type WebSocketConnection struct {
-	conn          net.Conn
-	readBuffer    []byte
-	readBufferPos int
-	mu            sync.Mutex
+	conn net.Conn
 }
 
 // NewWebSocketConnection creates a new WebSocketConnection
@@ -98,36 +123,8 @@ func (wc *WebSocketConnection) Write(data []byte) (int, error) {
 	return len(data), nil
 }
 
-func (wc *WebSocketConnection) Read(buf []byte) (int, error) {
-	wc.mu.Lock()
-	defer wc.mu.Unlock()
-
-	// Return buffered data if available
-	if wc.readBufferPos < len(wc.readBuffer) {
-		n := copy(buf, wc.readBuffer[wc.readBufferPos:])
-		wc.readBufferPos += n
-		if wc.readBufferPos >= len(wc.readBuffer) {
-			wc.readBuffer = nil
-			wc.readBufferPos = 0
-		}
-		return n, nil
-	}
-
-	// Read next WebSocket message using gobwas/ws
-	data, err := wsutil.ReadClientBinary(wc.conn)
-	if err != nil {
-		return 0, err
-	}
-
-	// Copy to output buffer
-	n := copy(buf, data)
-	if n < len(data) {
-		// Buffer remaining data
-		wc.readBuffer = data[n:]
-		wc.readBufferPos = 0
-	}
-
-	return n, nil
+func (wc *WebSocketConnection) ReadMessage() ([]byte, error) {
+	return wsutil.ReadClientBinary(wc.conn)
 }
 
 func (wc *WebSocketConnection) Close() error {
@@ -139,3 +136,11 @@ func (wc *WebSocketConnection) Close() error {
 func (wc *WebSocketConnection) SetReadDeadline(t time.Time) error {
 	return wc.conn.SetReadDeadline(t)
 }
+
+func (wc *WebSocketConnection) WriteDatagram([]byte) error {
+	return ErrNoDatagrams
+}
+
+func (wc *WebSocketConnection) ReadDatagram() ([]byte, error) {
+	return nil, ErrNoDatagrams
+}
@@ -0,0 +1,57 @@
+package server
+
+import (
+	"errors"
+
+	"github.com/omochice/toy-socket-chat/pkg/protocol"
+)
+
+// writeDatagram sends data, an ephemeral message queued on client.datagrams,
+// as a datagram. It reports false if the transport has no datagrams for it,
+// in which case the caller writes it to the stream like any other message.
+// A datagram that fails to send is dropped, as it may be lost anyway.
+func (s *Server) writeDatagram(client *Client, data []byte) bool {
+	err := client.conn.WriteDatagram(data)
+	if errors.Is(err, ErrNoDatagrams) {
+		return false
+	}
+	if err != nil {
+		s.metrics.droppedMessages.Add(1)
+		client.log().Debug("Failed to send datagram to client", "error", err)
+		return true
+	}
+	s.metrics.bytesSent.Add(uint64(len(data)))
+	return true
+}
+
+// readDatagrams handles the messages client sends as datagrams until its
+// connection closes. Only ephemeral messages may come this way; the others
+// need the reliable stream, so they are dropped.
+func (s *Server) readDatagrams(client *Client) {
+	defer s.wg.Done()
+	for {
+		data, err := client.conn.ReadDatagram()
+		if err != nil {
+			if !errors.Is(err, ErrNoDatagrams) {
+				client.log().Debug("Stopped reading datagrams", "error", err)
+			}
+			return
+		}
+		s.metrics.bytesReceived.Add(uint64(len(data)))
+
+		var msg protocol.Message
+		if err := msg.Decode(data); err != nil {
+			s.metrics.decodeFailures.Add(1)
+			client.log().Warn("Failed to decode datagram", "error", err)
+			continue
+		}
+		s.metrics.messagesReceived.inc(msg.Type.String())
+
+		switch {
+		case client.peerName() != "" || !msg.Type.Ephemeral():
+			client.log().Warn("Dropping message sent as datagram", "type", msg.Type)
+		case msg.Type == protocol.MessageTypeTyping:
+			s.handleTyping(client, msg)
+		}
+	}
+}
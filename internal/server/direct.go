@@ -0,0 +1,146 @@
+package server
+
+import (
+	"sync"
+	"time"
+
+	"github.com/omochice/toy-socket-chat/pkg/protocol"
+)
+
+// maxQueuedDirects bounds the direct messages kept for a user who is offline,
+// and directExpiry how long each is kept; the oldest are dropped first.
+const (
+	maxQueuedDirects = 100
+	directExpiry     = 7 * 24 * time.Hour
+)
+
+// queuedDirect is a direct message waiting for its recipient.
+type queuedDirect struct {
+	msg protocol.Message
+	at  time.Time
+}
+
+// directStore holds the direct messages waiting for users who are offline.
+type directStore struct {
+	mu     sync.Mutex
+	queued userQueues[queuedDirect]
+}
+
+// newDirectStore returns a directStore that drops the messages of users known
+// forgets.
+func newDirectStore(known *knownUsers) *directStore {
+	d := &directStore{
+		queued: newUserQueues(maxQueuedDirects, func(q queuedDirect) int {
+			return messageSize(q.msg)
+		}),
+	}
+	known.onForget(d.drop)
+	return d
+}
+
+// drop forgets the messages queued for username.
+func (d *directStore) drop(username string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.queued.take(username)
+}
+
+// queue keeps msg for username until take is called or it expires.
+func (d *directStore) queue(username string, msg protocol.Message, now time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	queued := unexpired(d.queued.take(username), now)
+	d.queued.set(username, append(queued, queuedDirect{msg: msg, at: now}))
+}
+
+// take returns and forgets the unexpired messages queued for username, oldest
+// first. There is no authentication, so they go to whoever joins under that
+// name.
+func (d *directStore) take(username string, now time.Time) []protocol.Message {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	queued := unexpired(d.queued.take(username), now)
+	msgs := make([]protocol.Message, len(queued))
+	for i, q := range queued {
+		msgs[i] = q.msg
+	}
+	return msgs
+}
+
+// unexpired returns the messages of queued, oldest first, that were queued
+// less than directExpiry before now.
+func unexpired(queued []queuedDirect, now time.Time) []queuedDirect {
+	for i, q := range queued {
+		if now.Sub(q.at) < directExpiry {
+			return queued[i:]
+		}
+	}
+	return nil
+}
+
+// handleDirect handles a DIRECT message from client: it is given an ID and
+// delivered to the recipient only, or queued until they join if they are
+// offline. The ACK has Content "queued" in that case.
+func (s *Server) handleDirect(client *Client, msg protocol.Message) {
+	name := client.name()
+	switch {
+	case name == "":
+		s.acknowledge(client, msg, "not joined")
+		return
+	case s.tooLong(msg.Content):
+		client.log().Warn("Message too long, dropping", "length", len(msg.Content))
+		s.acknowledge(client, msg, "message too long")
+		return
+	case msg.Recipient == "" || federatedSender(msg.Recipient) ||
+		(!s.known.has(msg.Recipient, time.Now()) && !s.online(msg.Recipient)):
+		// Direct messages are not relayed to federated servers, and a user
+		// online since before knownExpiry is still known.
+		s.acknowledge(client, msg, "unknown user")
+		return
+	}
+
+	out := protocol.Message{
+		Type:      protocol.MessageTypeDirect,
+		Sender:    name,
+		Content:   msg.Content,
+		ID:        newMessageID(),
+		Recipient: msg.Recipient,
+	}
+	data, err := out.Encode()
+	if err != nil {
+		client.log().Error("Failed to encode message", "error", err)
+		return
+	}
+	queued := !s.online(msg.Recipient)
+	client.log().Debug("Direct message received", "recipient", msg.Recipient, "queued", queued)
+	s.publish(data, out, client)
+
+	if msg.CorrelationID == "" {
+		return
+	}
+	ack := protocol.Message{
+		Type:          protocol.MessageTypeAck,
+		CorrelationID: msg.CorrelationID,
+		ID:            out.ID,
+	}
+	if queued {
+		ack.Content = "queued"
+	}
+	s.sendTo(client, ack)
+}
+
+// deliverDirect sends a DIRECT message to this server's clients joined as its
+// recipient. If the recipient is not joined anywhere in the cluster, it is
+// queued until they join; a JOIN drops what was queued for the user on the
+// servers they did not join.
+func (s *Server) deliverDirect(msg protocol.Message) {
+	switch msg.Type {
+	case protocol.MessageTypeJoin:
+		s.directs.drop(msg.Sender)
+	case protocol.MessageTypeDirect:
+		if s.sendToUser(msg.Recipient, msg) || s.online(msg.Recipient) {
+			return
+		}
+		s.directs.queue(msg.Recipient, msg, time.Now())
+	}
+}
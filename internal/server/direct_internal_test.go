@@ -0,0 +1,50 @@
+package server
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/omochice/toy-socket-chat/pkg/protocol"
+)
+
+func TestDirectStore(t *testing.T) {
+	start := time.Now()
+	known := newKnownUsers()
+	d := newDirectStore(known)
+	for i := range maxQueuedDirects + 2 {
+		msg := protocol.Message{Type: protocol.MessageTypeDirect, ID: strconv.Itoa(i)}
+		d.queue("bob", msg, start.Add(time.Duration(i)*time.Hour))
+	}
+
+	// The two oldest were dropped for the cap; by the time the third expires,
+	// the rest are still fresh.
+	now := start.Add(directExpiry + 2*time.Hour)
+	got := d.take("bob", now)
+	if len(got) != maxQueuedDirects-1 {
+		t.Fatalf("take() returned %d messages, want %d", len(got), maxQueuedDirects-1)
+	}
+	if got[0].ID != "3" {
+		t.Errorf("take() returned messages from %q, want from \"3\"", got[0].ID)
+	}
+	if got := d.take("bob", now); len(got) != 0 {
+		t.Errorf("second take() returned %d messages, want none", len(got))
+	}
+
+	// A JOIN anywhere drops what was queued here.
+	d.queue("carol", protocol.Message{}, start)
+	d.drop("carol")
+	if got := d.take("carol", start); len(got) != 0 {
+		t.Errorf("take() after drop returned %d messages, want none", len(got))
+	}
+
+	// So does the user being forgotten.
+	d.queue("dave", protocol.Message{}, start)
+	known.add("dave", start)
+	for i := range maxKnownUsers {
+		known.add(strconv.Itoa(i), start.Add(time.Second))
+	}
+	if got := d.take("dave", start); len(got) != 0 {
+		t.Errorf("take() after the user was forgotten returned %d messages, want none", len(got))
+	}
+}
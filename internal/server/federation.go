@@ -0,0 +1,509 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/omochice/toy-socket-chat/pkg/protocol"
+)
+
+// defaultFederationRetryInterval is how long a server waits before redialing
+// a federation peer.
+const defaultFederationRetryInterval = 2 * time.Second
+
+// errAlreadyLinked is returned when a link is given up because the server
+// already has one to the same peer.
+var errAlreadyLinked = errors.New("already linked")
+
+// federationHandshakeTimeout bounds how long a peer may take to answer each
+// FEDERATE message of the handshake.
+const federationHandshakeTimeout = 10 * time.Second
+
+// Federation links this server's chat with the chats of servers run by other
+// teams. A link is a connection from one server to another's chat port that
+// opens with FEDERATE messages instead of a JOIN, by which each server proves
+// it knows the shared secret without sending it (see federate). From then on
+// each side relays the messages of its own users to the other, which shows
+// them with the sender rewritten as user@server. The server has a single chat
+// rather than rooms, so what a link carries is chosen by kind of message
+// instead, with Relay.
+type Federation struct {
+	// Name is how this server's users appear on the other side: alice on a
+	// server named serverA is shown as alice@serverA.
+	Name string
+	// Secret must match the other server's. Servers with an empty secret
+	// reject incoming links.
+	Secret string
+	// Peers are the chat addresses of servers to dial. Links are redialed
+	// whenever they drop; a link dialed by either side carries both
+	// directions, so only one of two servers needs to list the other. If
+	// both do, only one link is kept (see claimLinkLocked).
+	Peers []string
+	// RetryInterval is how long to wait before redialing a peer. Defaults to
+	// two seconds.
+	RetryInterval time.Duration
+	// Relay limits the links to the servers it names, by the name they
+	// federate as, to the listed scopes, in both directions. Links to other
+	// servers carry every scope.
+	Relay map[string][]RelayScope
+}
+
+// RelayScope is a kind of message a federation link can carry.
+type RelayScope string
+
+// Relay scopes.
+const (
+	// RelayMessages carries chat messages, with their edits and deletions.
+	RelayMessages RelayScope = "messages"
+	// RelayPresence carries joins and leaves.
+	RelayPresence RelayScope = "presence"
+	// RelayReactions carries reactions.
+	RelayReactions RelayScope = "reactions"
+)
+
+// relayScopes maps each message type carried over federation links to its
+// scope.
+var relayScopes = map[protocol.MessageType]RelayScope{
+	protocol.MessageTypeText:     RelayMessages,
+	protocol.MessageTypeEdit:     RelayMessages,
+	protocol.MessageTypeDelete:   RelayMessages,
+	protocol.MessageTypeJoin:     RelayPresence,
+	protocol.MessageTypeLeave:    RelayPresence,
+	protocol.MessageTypeReaction: RelayReactions,
+}
+
+// Valid reports whether r is one of the relay scopes.
+func (r RelayScope) Valid() bool {
+	return r == RelayMessages || r == RelayPresence || r == RelayReactions
+}
+
+// relays reports whether the link to peer carries messages of type mt.
+func (f *Federation) relays(peer string, mt protocol.MessageType) bool {
+	scope, ok := relayScopes[mt]
+	if !ok {
+		return false
+	}
+	scopes, limited := f.Relay[peer]
+	return !limited || slices.Contains(scopes, scope)
+}
+
+// WithFederation enables federation links as described by f.
+func WithFederation(f Federation) Option {
+	return func(s *Server) {
+		if f.RetryInterval <= 0 {
+			f.RetryInterval = defaultFederationRetryInterval
+		}
+		s.federation = f
+	}
+}
+
+// federatedSender reports whether sender names a user of another server,
+// which is never relayed again so messages cannot travel in a loop.
+func federatedSender(sender string) bool {
+	return strings.Contains(sender, "@")
+}
+
+// relay queues a message published on this server (by one of its clients or
+// another node of its cluster) for every federation peer except from whose
+// link carries its scope. Only chat messages of this server's own users are
+// relayed; an edit or deletion is relayed when the message it changes was sent
+// by one of them, and a reaction when one of them reacted.
+func (s *Server) relay(data []byte, msg protocol.Message, from *Client) {
+	if _, ok := relayScopes[msg.Type]; !ok {
+		return
+	}
+	if msg.Sender == "" || msg.Sender == serverSender || federatedSender(msg.Sender) {
+		return
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for client := range s.clients {
+		peer := client.peerName()
+		if client == from || peer == "" || !s.federation.relays(peer, msg.Type) {
+			continue
+		}
+		select {
+		case client.outgoing <- data:
+		default:
+			s.metrics.droppedMessages.Add(1)
+			client.log().Warn("Federation peer channel full, skipping")
+		}
+	}
+}
+
+// newNonce returns a random challenge for a federation handshake.
+func newNonce() string {
+	var b [32]byte
+	_, _ = rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// proof returns the HMAC by which the server named name shows it knows the
+// secret, over nonce sent by the other end. As in the cluster's handshake,
+// including the prover's name keeps a peer from getting a proof for a nonce of
+// its own and passing it back, since a server never links to one with its own
+// name.
+func (f *Federation) proof(nonce, name string) string {
+	mac := hmac.New(sha256.New, []byte(f.Secret))
+	mac.Write([]byte(nonce))
+	mac.Write([]byte{0})
+	mac.Write([]byte(name))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// validPeerName reports whether name may name a federation peer.
+func (f *Federation) validPeerName(name string) bool {
+	return name != "" && !federatedSender(name) && name != f.Name
+}
+
+// acceptPeer handles a FEDERATE message from client, which carries the
+// dialing server's nonce, and completes the handshake described at federate,
+// turning client into a federation link if the peer proves it knows the
+// secret. It reports whether the link was accepted; otherwise the client
+// should be disconnected.
+func (s *Server) acceptPeer(client *Client, msg protocol.Message) bool {
+	reject := func(reason string) bool {
+		client.log().Warn("Federation link rejected", "peer", msg.Sender, "reason", reason)
+		return false
+	}
+	switch {
+	case s.federation.Secret == "":
+		return reject("federation disabled")
+	case client.name() != "" || client.peerName() != "":
+		return reject("already joined")
+	case !s.federation.validPeerName(msg.Sender):
+		return reject("invalid server name")
+	case msg.Content == "":
+		return reject("no challenge")
+	}
+
+	nonce := newNonce()
+	if !s.sendFederate(client, protocol.Message{
+		Content: nonce,
+		ID:      s.federation.proof(msg.Content, s.federation.Name),
+	}) {
+		return reject("channel full")
+	}
+	_ = client.conn.SetReadDeadline(time.Now().Add(federationHandshakeTimeout))
+	data, err := client.conn.ReadMessage()
+	if err != nil {
+		return reject("no proof")
+	}
+	_ = client.conn.SetReadDeadline(time.Time{})
+	var auth protocol.Message
+	if err := auth.Decode(data); err != nil || auth.Type != protocol.MessageTypeFederate ||
+		auth.Sender != msg.Sender {
+		return reject("no proof")
+	}
+	if !hmac.Equal([]byte(auth.ID), []byte(s.federation.proof(nonce, msg.Sender))) {
+		return reject("wrong secret")
+	}
+
+	// relay holds mu too, so the confirmation goes before any relayed
+	// message.
+	s.mu.Lock()
+	claimed := s.claimLinkLocked(client, msg.Sender, false)
+	confirmed := claimed && s.sendFederate(client, protocol.Message{})
+	if confirmed {
+		client.setPeer(msg.Sender, false)
+	}
+	s.mu.Unlock()
+	if !claimed {
+		// Tell the peer, so it waits quietly rather than suspect the secret.
+		s.sendTo(client, protocol.Message{
+			Type:    protocol.MessageTypeNack,
+			Content: errAlreadyLinked.Error(),
+		})
+		return reject(errAlreadyLinked.Error())
+	}
+	if !confirmed {
+		return reject("channel full")
+	}
+	client.log().Info("Federation link accepted")
+	return true
+}
+
+// claimLinkLocked reports whether client, a new link to peer dialed by this
+// server or by the peer, is to be kept, closing any other link to peer it
+// replaces; the caller holds s.mu. Two links to one peer would relay every
+// message twice, which happens when two servers each list the other. Both
+// ends then keep the link dialed by the server whose name sorts first. Of two
+// links the peer dialed, the new one is kept, since the peer gave up on the
+// old; of two this server dialed, the old one is.
+func (s *Server) claimLinkLocked(client *Client, peer string, dialed bool) bool {
+	for other := range s.clients {
+		if other == client || other.peerName() != peer {
+			continue
+		}
+		keepNew := !dialed
+		if other.peerDialed() != dialed {
+			keepNew = dialed == (s.federation.Name < peer)
+		}
+		if !keepNew {
+			return false
+		}
+		other.log().Info("Federation link replaced")
+		if err := other.conn.Close(); err != nil {
+			other.log().Debug("Error closing federation link", "error", err)
+		}
+	}
+	return true
+}
+
+// sendFederate queues msg for client as a FEDERATE message from this server,
+// reporting whether it could.
+func (s *Server) sendFederate(client *Client, msg protocol.Message) bool {
+	msg.Type = protocol.MessageTypeFederate
+	msg.Sender = s.federation.Name
+	data, err := msg.Encode()
+	if err != nil {
+		client.log().Error("Failed to encode federation reply", "error", err)
+		return false
+	}
+	select {
+	case client.outgoing <- data:
+		return true
+	default:
+		return false
+	}
+}
+
+// handlePeerMessage shows a message relayed by a federation peer to this
+// server's users, with the sender rewritten as user@peer, and hands it on to
+// the rest of the cluster. Messages outside the link's scopes are dropped. It
+// reports whether the link should stay open.
+func (s *Server) handlePeerMessage(client *Client, msg protocol.Message) bool {
+	switch {
+	case s.federation.relays(client.peerName(), msg.Type):
+	case msg.Type == protocol.MessageTypeReconnect:
+		// The peer is handing over to a new process; redial it there.
+		client.log().Info("Federation peer restarting")
+		return false
+	default:
+		return true
+	}
+	if msg.Sender == "" || federatedSender(msg.Sender) {
+		client.log().Warn("Dropping relayed message with invalid sender", "sender", msg.Sender)
+		return true
+	}
+	if (msg.Type == protocol.MessageTypeText || msg.Type == protocol.MessageTypeEdit) &&
+		s.tooLong(msg.Content) {
+		client.log().Warn("Relayed message too long, dropping", "length", len(msg.Content))
+		return true
+	}
+
+	msg.Sender += "@" + client.peerName()
+	if !s.peerMayRelay(msg) {
+		client.log().Warn(
+			"Dropping relayed message with invalid ID",
+			"type", msg.Type,
+			"id", msg.ID,
+		)
+		return true
+	}
+	if msg.Type == protocol.MessageTypeReaction {
+		// The peer's counts include reactions this server may not have seen;
+		// pass on this server's own.
+		msg.Reactions, _ = s.history.react(msg.ID, msg.Sender, msg.Content, msg.Remove)
+	}
+	if msg.Type == protocol.MessageTypeText && msg.ParentID != "" && !s.attachReply(&msg) {
+		// This server has not seen the thread; show the reply on its own.
+		msg.ParentID = ""
+		msg.ReplyCount = 0
+	}
+	if msg.Type == protocol.MessageTypeText {
+		msg.Mentions = s.resolveMentions(msg.Content, client.peerName())
+	}
+	// Acknowledgements only go to a message's own sender.
+	msg.CorrelationID = ""
+	data, err := msg.Encode()
+	if err != nil {
+		client.log().Error("Failed to encode relayed message", "error", err)
+		return true
+	}
+	client.log().Debug("Message relayed", "sender", msg.Sender, "content", msg.Content)
+	s.publish(data, msg, client)
+	return true
+}
+
+// peerMayRelay checks the ID of a relayed message whose sender has been
+// rewritten: a TEXT message needs a new one, a peer may only edit or delete
+// messages of its own users, and reactions need a message to react to.
+func (s *Server) peerMayRelay(msg protocol.Message) bool {
+	entry, known := s.history.get(msg.ID)
+	switch msg.Type {
+	case protocol.MessageTypeText:
+		return msg.ID != "" && !known
+	case protocol.MessageTypeEdit, protocol.MessageTypeDelete:
+		return known && entry.sender == msg.Sender
+	case protocol.MessageTypeReaction:
+		return known && !entry.deleted && validReaction(msg.Content)
+	}
+	return true
+}
+
+// closePeers disconnects every federation link, for Drain.
+func (s *Server) closePeers() {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for client := range s.clients {
+		if client.peerName() != "" {
+			if err := client.conn.Close(); err != nil {
+				client.log().Debug("Error closing federation link", "error", err)
+			}
+		}
+	}
+}
+
+// federationLoop keeps a federation link to the server at addr open until
+// the server stops or drains.
+func (s *Server) federationLoop(addr string) {
+	defer s.wg.Done()
+	for {
+		err := s.linkPeer(addr)
+		switch {
+		case errors.Is(err, errAlreadyLinked):
+			// Both servers dial each other, and the other's link is kept.
+			s.logger.Debug("Federation peer already linked", "peer_addr", addr)
+		case err != nil:
+			s.logger.Warn("Federation link failed", "peer_addr", addr, "error", err)
+		}
+
+		select {
+		case <-s.quit:
+			return
+		case <-s.draining:
+			return
+		case <-time.After(s.federation.RetryInterval):
+		}
+	}
+}
+
+// linkPeer dials the server at addr, opens a federation link, and serves it
+// until it closes.
+func (s *Server) linkPeer(addr string) error {
+	rawConn, err := net.DialTimeout("tcp", addr, federationHandshakeTimeout)
+	if err != nil {
+		return fmt.Errorf("failed to connect: %w", err)
+	}
+	conn := NewTCPConnection(rawConn)
+	peer, err := s.federate(conn)
+	if err != nil {
+		_ = conn.Close()
+		return err
+	}
+
+	client := s.newClient(conn, TransportTCP)
+	s.mu.Lock()
+	select {
+	case <-s.quit:
+		// Stop has already closed the clients it knew about.
+		s.mu.Unlock()
+		_ = conn.Close()
+		return nil
+	default:
+	}
+	if !s.claimLinkLocked(client, peer, true) {
+		s.mu.Unlock()
+		_ = conn.Close()
+		return errAlreadyLinked
+	}
+	client.setPeer(peer, true)
+	s.clients[client] = true
+	s.mu.Unlock()
+	client.log().Info("Federation link established")
+
+	s.wg.Add(1)
+	s.handleClient(client)
+	return nil
+}
+
+// federate opens a federation link on conn and returns the name the peer
+// answers with. The secret itself is never sent; instead each server proves it
+// knows the secret by its proof over a nonce of the other's:
+//
+//  1. This server sends a FEDERATE with its name and a nonce as Content.
+//  2. The peer answers with its name, its own nonce as Content, and its
+//     proof over this server's nonce as ID.
+//  3. This server checks that proof and sends its proof over the peer's
+//     nonce as ID.
+//  4. The peer checks it and confirms the link with an empty FEDERATE, or
+//     closes the connection.
+func (s *Server) federate(conn *TCPConnection) (string, error) {
+	nonce := newNonce()
+	err := s.writeFederate(conn, protocol.Message{Content: nonce})
+	if err != nil {
+		return "", err
+	}
+	challenge, err := readFederate(conn)
+	if err != nil {
+		return "", err
+	}
+	if !s.federation.validPeerName(challenge.Sender) {
+		return "", errors.New("peer replied with an invalid server name")
+	}
+	want := s.federation.proof(nonce, challenge.Sender)
+	if !hmac.Equal([]byte(challenge.ID), []byte(want)) {
+		return "", errors.New("peer does not know the shared secret")
+	}
+
+	err = s.writeFederate(conn, protocol.Message{
+		ID: s.federation.proof(challenge.Content, s.federation.Name),
+	})
+	if err != nil {
+		return "", err
+	}
+	if _, err := readFederate(conn); err != nil {
+		return "", err
+	}
+	return challenge.Sender, nil
+}
+
+// writeFederate sends msg on conn as a FEDERATE message from this server.
+func (s *Server) writeFederate(conn *TCPConnection, msg protocol.Message) error {
+	msg.Type = protocol.MessageTypeFederate
+	msg.Sender = s.federation.Name
+	data, err := msg.Encode()
+	if err != nil {
+		return fmt.Errorf("failed to encode federation request: %w", err)
+	}
+	if _, err := conn.Write(data); err != nil {
+		return fmt.Errorf("failed to send federation request: %w", err)
+	}
+	return nil
+}
+
+// readFederate reads the peer's next FEDERATE message from conn. Until the
+// link is made, the peer takes conn for a chat user's and may send it chat
+// messages, which are skipped.
+func readFederate(conn *TCPConnection) (protocol.Message, error) {
+	_ = conn.SetReadDeadline(time.Now().Add(federationHandshakeTimeout))
+	defer func() { _ = conn.SetReadDeadline(time.Time{}) }()
+	for {
+		data, err := conn.ReadMessage()
+		if err != nil {
+			// The peer closes the connection when it rejects the link.
+			return protocol.Message{}, fmt.Errorf(
+				"no federation reply, check the shared secret: %w", err)
+		}
+		var reply protocol.Message
+		if err := reply.Decode(data); err != nil {
+			return protocol.Message{}, fmt.Errorf("invalid federation reply: %w", err)
+		}
+		switch {
+		case reply.Type == protocol.MessageTypeFederate:
+			return reply, nil
+		case reply.Type == protocol.MessageTypeNack && reply.Content == errAlreadyLinked.Error():
+			return protocol.Message{}, errAlreadyLinked
+		}
+	}
+}
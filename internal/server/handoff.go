@@ -0,0 +1,186 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"github.com/omochice/toy-socket-chat/pkg/protocol"
+)
+
+// reconnectNotice is the content of the RECONNECT message sent by Drain, for
+// clients that display it.
+const reconnectNotice = "Server restarting, please reconnect"
+
+// drainPollInterval is how often Drain checks whether clients have left.
+const drainPollInterval = 100 * time.Millisecond
+
+// webTransportDrainGrace bounds how long Drain keeps reading from the UDP
+// sockets it shares with the new process, for WebTransport clients to receive
+// the RECONNECT message and leave.
+const webTransportDrainGrace = 2 * time.Second
+
+// ListenerFiles returns every bound listener, with Address set to its bound
+// address, together with a duplicate of its socket for handing to another
+// process that passes them back to New as StreamSocket or PacketSocket. The
+// duplicates stay open when this server stops; the caller closes them. Unix
+// socket files are no longer removed when this server's listeners close, since
+// the other process keeps accepting on them.
+func (s *Server) ListenerFiles() ([]Listener, []*os.File, error) {
+	type filer interface {
+		File() (*os.File, error)
+	}
+
+	listeners := make([]Listener, 0, len(s.listeners))
+	files := make([]*os.File, 0, len(s.listeners))
+	closeFiles := func() {
+		for _, f := range files {
+			_ = f.Close()
+		}
+	}
+	for _, l := range s.listeners {
+		var socket any = l.stream
+		if l.packet != nil {
+			socket = l.packet
+		}
+		f, ok := socket.(filer)
+		if !ok {
+			closeFiles()
+			return nil, nil, fmt.Errorf("listener %s cannot be handed over: %T", l.addr(), socket)
+		}
+		file, err := f.File()
+		if err != nil {
+			closeFiles()
+			return nil, nil, fmt.Errorf("failed to duplicate listener %s: %w", l.addr(), err)
+		}
+		if ul, ok := socket.(*net.UnixListener); ok {
+			ul.SetUnlinkOnClose(false)
+		}
+
+		cfg := l.Listener
+		cfg.Network = l.network()
+		cfg.Address = l.addr().String()
+		cfg.StreamSocket = nil
+		cfg.PacketSocket = nil
+		listeners = append(listeners, cfg)
+		files = append(files, file)
+	}
+	return listeners, files, nil
+}
+
+// WithHTTPSockets supplies already-bound sockets for the admin API and metrics
+// endpoint, keyed by the address passed to WithAdmin or WithMetrics, for
+// example from another process's HTTPListenerFiles. An address without a
+// socket is bound as usual.
+func WithHTTPSockets(sockets map[string]net.Listener) Option {
+	return func(s *Server) {
+		s.httpSockets = sockets
+	}
+}
+
+// HTTPListenerFiles returns duplicates of the admin API and metrics sockets,
+// keyed by their configured address, for passing to WithHTTPSockets in
+// another process. The caller closes the files.
+func (s *Server) HTTPListenerFiles() (map[string]*os.File, error) {
+	files := make(map[string]*os.File)
+	for addr, ln := range map[string]net.Listener{
+		s.adminAddress:   s.adminListener,
+		s.metricsAddress: s.metricsListener,
+	} {
+		tcpListener, ok := ln.(*net.TCPListener)
+		if !ok {
+			continue
+		}
+		f, err := tcpListener.File()
+		if err != nil {
+			for _, f := range files {
+				_ = f.Close()
+			}
+			return nil, fmt.Errorf("failed to duplicate listener %s: %w", addr, err)
+		}
+		files[addr] = f
+	}
+	return files, nil
+}
+
+// Drain winds the server down after another process has taken over its
+// sockets (see ListenerFiles). It stops accepting stream connections, asks
+// every client to reconnect with a RECONNECT message, so they reach the new
+// process, and waits up to timeout for them to leave before calling Stop,
+// which disconnects any that remain.
+//
+// The UDP sockets of WebTransport listeners are shared with the new process,
+// and a QUIC packet read by the wrong process is lost. So Drain refuses new
+// WebTransport sessions, and once the WebTransport clients have left, or
+// after webTransportDrainGrace, stops reading from those sockets, ending the
+// sessions of any that remain.
+func (s *Server) Drain(timeout time.Duration) {
+	s.ready.Store(false)
+	for _, l := range s.listeners {
+		if l.stream != nil {
+			if err := l.stream.Close(); err != nil {
+				s.logger.Error("Error closing listener", "addr", l.addr().String(), "error", err)
+			}
+		}
+	}
+
+	msg := protocol.Message{
+		Type:    protocol.MessageTypeReconnect,
+		Sender:  serverSender,
+		Content: reconnectNotice,
+	}
+	data, err := msg.Encode()
+	if err != nil {
+		s.logger.Error("Failed to encode reconnect message", "error", err)
+	} else {
+		s.broadcast(data, msg.Type, nil)
+	}
+	// Federation links are redialed by whichever side dialed them, landing on
+	// the new process.
+	close(s.draining)
+	s.closePeers()
+	s.logger.Info("Draining clients", "clients", s.ClientCount(), "timeout", timeout)
+
+	deadline := time.After(timeout)
+	wtDeadline := time.After(min(timeout, webTransportDrainGrace))
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+	for waiting := true; waiting && s.ClientCount() > 0; {
+		if wtDeadline != nil && s.transportCount(TransportWebTransport) == 0 {
+			s.closeWebTransport()
+			wtDeadline = nil
+		}
+		select {
+		case <-ticker.C:
+		case <-wtDeadline:
+			s.logger.Info(
+				"Stopped reading WebTransport sockets, disconnecting remaining sessions",
+				"clients", s.transportCount(TransportWebTransport),
+			)
+			s.closeWebTransport()
+			wtDeadline = nil
+		case <-deadline:
+			s.logger.Warn(
+				"Drain timed out, disconnecting remaining clients",
+				"clients", s.ClientCount(),
+			)
+			waiting = false
+		}
+	}
+
+	s.Stop()
+}
+
+// transportCount returns the number of connected clients using transport.
+func (s *Server) transportCount(transport Transport) int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	n := 0
+	for client := range s.clients {
+		if client.transport == transport {
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,333 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+
+	"github.com/omochice/toy-socket-chat/pkg/protocol"
+)
+
+// DefaultHistorySize is how many recent TEXT messages a server remembers when
+// WithHistorySize is not given.
+const DefaultHistorySize = 1000
+
+// WithHistorySize sets how many recent TEXT messages the server remembers.
+// Only remembered messages can be edited or deleted, since the history is what
+// records who sent each one.
+func WithHistorySize(size int) Option {
+	return func(s *Server) {
+		s.history = newHistory(size)
+	}
+}
+
+// historyEntry is a remembered TEXT message.
+type historyEntry struct {
+	sender  string
+	content string
+	edited  bool
+	deleted bool
+	// reactions holds the users who reacted with each emoji.
+	reactions map[string]map[string]struct{}
+	// parent is the ID of the first message of the thread this message
+	// replies to, and replies the IDs of the replies to this one.
+	parent  string
+	replies []string
+	// readers holds the users whose read marker is this message.
+	readers map[string]struct{}
+}
+
+// counts returns the number of users who reacted with each emoji.
+func (e *historyEntry) counts() map[string]int {
+	counts := make(map[string]int, len(e.reactions))
+	for emoji, users := range e.reactions {
+		counts[emoji] = len(users)
+	}
+	return counts
+}
+
+// history is a bounded in-memory log of recent TEXT messages, keyed by ID.
+// Every server of a cluster keeps its own, fed by publish and deliverRemote,
+// so each can authorize edits of messages sent through the others.
+type history struct {
+	mu      sync.Mutex
+	size    int
+	order   []string // IDs, oldest first
+	entries map[string]*historyEntry
+	// read holds each user's read marker, the ID of the last message they
+	// have seen. Markers are only kept on remembered messages, and for at
+	// most maxKnownUsers users.
+	read map[string]string
+}
+
+func newHistory(size int) *history {
+	return &history{
+		size:    size,
+		entries: make(map[string]*historyEntry),
+		read:    make(map[string]string),
+	}
+}
+
+// newMessageID returns a random ID for a TEXT message, unique across the
+// servers of a cluster and federation.
+func newMessageID() string {
+	var b [8]byte
+	_, _ = rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// get returns the entry for the message with the given ID.
+func (h *history) get(id string) (historyEntry, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	e, ok := h.entries[id]
+	if !ok {
+		return historyEntry{}, false
+	}
+	return *e, true
+}
+
+// apply records a published TEXT message, the EDIT, DELETE or REACTION of a
+// remembered one, or a READ marker. Other messages are ignored.
+func (h *history) apply(msg protocol.Message) {
+	if msg.ID == "" || h.size <= 0 {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	switch msg.Type {
+	case protocol.MessageTypeText:
+		if _, ok := h.entries[msg.ID]; ok {
+			return
+		}
+		h.entries[msg.ID] = &historyEntry{
+			sender:  msg.Sender,
+			content: msg.Content,
+			parent:  msg.ParentID,
+		}
+		if parent, ok := h.entries[msg.ParentID]; ok {
+			parent.replies = append(parent.replies, msg.ID)
+		}
+		h.order = append(h.order, msg.ID)
+		if len(h.order) > h.size {
+			// A marker on a forgotten message counts as no marker, so
+			// it need not be kept.
+			for user := range h.entries[h.order[0]].readers {
+				delete(h.read, user)
+			}
+			delete(h.entries, h.order[0])
+			h.order = h.order[1:]
+		}
+	case protocol.MessageTypeEdit:
+		if e, ok := h.entries[msg.ID]; ok && !e.deleted {
+			e.content = msg.Content
+			e.edited = true
+		}
+	case protocol.MessageTypeDelete:
+		if e, ok := h.entries[msg.ID]; ok {
+			e.content = ""
+			e.deleted = true
+			e.reactions = nil
+		}
+	case protocol.MessageTypeReaction:
+		h.reactLocked(msg.ID, msg.Sender, msg.Content, msg.Remove)
+	case protocol.MessageTypeRead:
+		h.markReadLocked(msg.Sender, msg.ID)
+	}
+}
+
+// indexLocked returns the position of the message with the given ID in
+// h.order, or -1 if it is not remembered.
+func (h *history) indexLocked(id string) int {
+	if _, ok := h.entries[id]; !ok {
+		return -1
+	}
+	for i := len(h.order) - 1; i >= 0; i-- {
+		if h.order[i] == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// markRead moves user's read marker to the message with the given ID and
+// reports whether it moved. Markers only move forward, to remembered
+// messages.
+func (h *history) markRead(user, id string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.markReadLocked(user, id)
+}
+
+func (h *history) markReadLocked(user, id string) bool {
+	next := h.indexLocked(id)
+	if next < 0 || next <= h.indexLocked(h.read[user]) {
+		return false
+	}
+	if prev, ok := h.entries[h.read[user]]; ok {
+		delete(prev.readers, user)
+	}
+	e := h.entries[id]
+	if e.readers == nil {
+		e.readers = make(map[string]struct{})
+	}
+	e.readers[user] = struct{}{}
+	h.read[user] = id
+	if len(h.read) > maxKnownUsers {
+		h.dropOldestMarkerLocked(user)
+	}
+	return true
+}
+
+// dropOldestMarkerLocked forgets the read marker furthest behind, other than
+// keep's.
+func (h *history) dropOldestMarkerLocked(keep string) {
+	for _, id := range h.order {
+		for user := range h.entries[id].readers {
+			if user != keep {
+				delete(h.entries[id].readers, user)
+				delete(h.read, user)
+				return
+			}
+		}
+	}
+}
+
+// unread returns user's read marker and the number of remembered messages
+// after it that others sent and are not deleted. If the marked message has
+// been forgotten, or there is no marker, every remembered message counts.
+func (h *history) unread(user string) (marker string, count int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	marker = h.read[user]
+	for _, id := range h.order[h.indexLocked(marker)+1:] {
+		if e := h.entries[id]; e.sender != user && !e.deleted {
+			count++
+		}
+	}
+	return marker, count
+}
+
+// threadOf returns the ID of the first message of the thread the message with
+// the given ID belongs to, or its own ID if it is not a reply, and the number
+// of replies in the thread. It reports false if either message is forgotten.
+func (h *history) threadOf(id string) (root string, replies int, ok bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	e, ok := h.entries[id]
+	if !ok {
+		return "", 0, false
+	}
+	root = id
+	if e.parent != "" {
+		root = e.parent
+		if e, ok = h.entries[root]; !ok {
+			return "", 0, false
+		}
+	}
+	return root, len(e.replies), true
+}
+
+// thread returns the remembered replies to the message with the given ID,
+// oldest first and without deleted ones.
+func (h *history) thread(root string) []protocol.Message {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	e, ok := h.entries[root]
+	if !ok {
+		return nil
+	}
+	var replies []protocol.Message
+	for _, id := range e.replies {
+		if r, ok := h.entries[id]; ok && !r.deleted {
+			replies = append(replies, protocol.Message{
+				Sender:   r.sender,
+				Content:  r.content,
+				ID:       id,
+				ParentID: root,
+			})
+		}
+	}
+	return replies
+}
+
+// react adds user's reaction emoji to the message with the given ID, or takes
+// it back if remove is set. It returns the message's reaction counts and
+// whether they changed; reacting twice with one emoji counts once.
+func (h *history) react(id, user, emoji string, remove bool) (map[string]int, bool) {
+	if h.size <= 0 {
+		return nil, false
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.reactLocked(id, user, emoji, remove)
+}
+
+func (h *history) reactLocked(id, user, emoji string, remove bool) (map[string]int, bool) {
+	e, ok := h.entries[id]
+	if !ok || e.deleted {
+		return nil, false
+	}
+	users := e.reactions[emoji]
+	if _, reacted := users[user]; reacted != remove {
+		return e.counts(), false
+	}
+	if remove {
+		delete(users, user)
+		if len(users) == 0 {
+			delete(e.reactions, emoji)
+		}
+		return e.counts(), true
+	}
+	if users == nil {
+		if e.reactions == nil {
+			e.reactions = make(map[string]map[string]struct{})
+		}
+		users = make(map[string]struct{})
+		e.reactions[emoji] = users
+	}
+	users[user] = struct{}{}
+	return e.counts(), true
+}
+
+// handleModify handles an EDIT or DELETE message from client. Only the sender
+// of the original message or an operator may change it; the published message
+// names the original sender, not client.
+func (s *Server) handleModify(client *Client, msg protocol.Message) {
+	if client.name() == "" {
+		s.acknowledge(client, msg, "not joined")
+		return
+	}
+	if msg.Type == protocol.MessageTypeEdit && s.tooLong(msg.Content) {
+		client.log().Warn("Edit too long, dropping", "length", len(msg.Content))
+		s.acknowledge(client, msg, "message too long")
+		return
+	}
+	entry, ok := s.history.get(msg.ID)
+	switch {
+	case !ok:
+		s.acknowledge(client, msg, "unknown message")
+		return
+	case entry.deleted:
+		s.acknowledge(client, msg, "message deleted")
+		return
+	case entry.sender != client.name() && !s.isOperator(client):
+		client.log().Warn("Not allowed to modify message", "type", msg.Type, "id", msg.ID)
+		s.acknowledge(client, msg, "not allowed")
+		return
+	}
+
+	out := protocol.Message{Type: msg.Type, Sender: entry.sender, ID: msg.ID}
+	if msg.Type == protocol.MessageTypeEdit {
+		out.Content = msg.Content
+	}
+	data, err := out.Encode()
+	if err != nil {
+		client.log().Error("Failed to encode message", "error", err)
+		return
+	}
+	client.log().Info("Message modified", "type", msg.Type, "id", msg.ID, "sender", entry.sender)
+	s.publish(data, out, client)
+	s.acknowledge(client, msg, "")
+}
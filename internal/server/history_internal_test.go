@@ -0,0 +1,42 @@
+package server
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/omochice/toy-socket-chat/pkg/protocol"
+)
+
+func TestHistory_ReadMarkersBounded(t *testing.T) {
+	h := newHistory(2)
+	text := func(id string) {
+		h.apply(protocol.Message{Type: protocol.MessageTypeText, Sender: "alice", ID: id})
+	}
+	text("a")
+	text("b")
+	for i := range maxKnownUsers {
+		h.markRead(strconv.Itoa(i), "b")
+	}
+	h.markRead("bob", "a")
+
+	// Past the cap, the marker furthest behind is dropped, not the new one.
+	if len(h.read) != maxKnownUsers {
+		t.Errorf("len(read) = %d, want %d", len(h.read), maxKnownUsers)
+	}
+	if _, ok := h.read["bob"]; !ok {
+		t.Error("The marker just moved was dropped")
+	}
+
+	// A marker is dropped with its message.
+	text("c")
+	if marker, _ := h.unread("bob"); marker != "" {
+		t.Errorf("unread() marker = %q after its message was forgotten, want none", marker)
+	}
+	if len(h.read) != maxKnownUsers-1 {
+		t.Errorf("len(read) = %d, want %d", len(h.read), maxKnownUsers-1)
+	}
+	text("d")
+	if len(h.read) != 0 {
+		t.Errorf("len(read) = %d after every marked message was forgotten, want 0", len(h.read))
+	}
+}
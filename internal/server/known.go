@@ -0,0 +1,169 @@
+package server
+
+import (
+	"sync"
+	"time"
+
+	"github.com/omochice/toy-socket-chat/pkg/protocol"
+)
+
+// maxKnownUsers bounds the users remembered as known, and knownExpiry how long
+// one is remembered after last joining; the least recently seen are forgotten
+// first.
+const (
+	maxKnownUsers = 10000
+	knownExpiry   = 30 * 24 * time.Hour
+)
+
+// maxQueuedBytes bounds the content of the messages each store keeps for
+// users who are offline, in all; past it, the oldest messages of the user with
+// the most queued are dropped.
+const maxQueuedBytes = 16 << 20
+
+// knownUsers remembers the users seen joining anywhere in the chat, including
+// other nodes of the cluster and federated servers, and when they last did.
+// Mentions and direct messages are only accepted for them or for users who
+// are online. The mention and direct stores share one, and drop what they
+// queued for a user it forgets.
+type knownUsers struct {
+	mu       sync.Mutex
+	lastSeen map[string]time.Time
+	forget   []func(username string)
+}
+
+func newKnownUsers() *knownUsers {
+	return &knownUsers{lastSeen: make(map[string]time.Time)}
+}
+
+// onForget registers f to be called with each user forgotten to keep within
+// maxKnownUsers.
+func (k *knownUsers) onForget(f func(username string)) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.forget = append(k.forget, f)
+}
+
+// add records that username joined at now. If that makes more than
+// maxKnownUsers, the expired users are forgotten, then the least recently
+// seen.
+func (k *knownUsers) add(username string, now time.Time) {
+	k.mu.Lock()
+	forgotten := k.addLocked(username, now)
+	hooks := k.forget
+	k.mu.Unlock()
+
+	for _, name := range forgotten {
+		for _, f := range hooks {
+			f(name)
+		}
+	}
+}
+
+func (k *knownUsers) addLocked(username string, now time.Time) []string {
+	k.lastSeen[username] = now
+	if len(k.lastSeen) <= maxKnownUsers {
+		return nil
+	}
+	var forgotten []string
+	oldest := ""
+	for name, at := range k.lastSeen {
+		switch {
+		case now.Sub(at) >= knownExpiry:
+			delete(k.lastSeen, name)
+			forgotten = append(forgotten, name)
+		case name != username && (oldest == "" || at.Before(k.lastSeen[oldest])):
+			oldest = name
+		}
+	}
+	if len(k.lastSeen) > maxKnownUsers {
+		delete(k.lastSeen, oldest)
+		forgotten = append(forgotten, oldest)
+	}
+	return forgotten
+}
+
+// has reports whether username joined less than knownExpiry before now.
+func (k *knownUsers) has(username string, now time.Time) bool {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	at, ok := k.lastSeen[username]
+	return ok && now.Sub(at) < knownExpiry
+}
+
+// userQueues holds messages waiting for users who are offline, at most
+// perUser for each and maxQueuedBytes of them in all. It is not safe for
+// concurrent use; its owner guards it.
+type userQueues[T any] struct {
+	perUser int
+	// size returns what a message counts toward maxQueuedBytes.
+	size   func(T) int
+	queued map[string]*userQueue[T]
+	bytes  int
+}
+
+// userQueue is the queue of one user, oldest first.
+type userQueue[T any] struct {
+	msgs  []T
+	bytes int
+}
+
+func newUserQueues[T any](perUser int, size func(T) int) userQueues[T] {
+	return userQueues[T]{
+		perUser: perUser,
+		size:    size,
+		queued:  make(map[string]*userQueue[T]),
+	}
+}
+
+// take returns and forgets the messages queued for username, oldest first.
+func (q *userQueues[T]) take(username string) []T {
+	queue, ok := q.queued[username]
+	if !ok {
+		return nil
+	}
+	delete(q.queued, username)
+	q.bytes -= queue.bytes
+	return queue.msgs
+}
+
+// set queues msgs, oldest first, for username in place of anything queued
+// for them, keeping the newest perUser. If that makes more than
+// maxQueuedBytes in all, the oldest messages of the users with the most bytes
+// queued are dropped until it does not.
+func (q *userQueues[T]) set(username string, msgs []T) {
+	q.take(username)
+	if len(msgs) > q.perUser {
+		msgs = msgs[len(msgs)-q.perUser:]
+	}
+	if len(msgs) == 0 {
+		return
+	}
+	queue := &userQueue[T]{msgs: msgs}
+	for _, msg := range msgs {
+		queue.bytes += q.size(msg)
+	}
+	q.queued[username] = queue
+	q.bytes += queue.bytes
+
+	for q.bytes > maxQueuedBytes {
+		var largest *userQueue[T]
+		name := ""
+		for n, queue := range q.queued {
+			if largest == nil || queue.bytes > largest.bytes {
+				largest, name = queue, n
+			}
+		}
+		dropped := q.size(largest.msgs[0])
+		largest.msgs = largest.msgs[1:]
+		largest.bytes -= dropped
+		q.bytes -= dropped
+		if len(largest.msgs) == 0 {
+			delete(q.queued, name)
+		}
+	}
+}
+
+// messageSize is what a queued message counts toward maxQueuedBytes.
+func messageSize(msg protocol.Message) int {
+	return len(msg.Sender) + len(msg.Content) + len(msg.ID) + len(msg.Recipient)
+}
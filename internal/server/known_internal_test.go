@@ -0,0 +1,80 @@
+package server
+
+import (
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/omochice/toy-socket-chat/pkg/protocol"
+)
+
+func TestKnownUsers(t *testing.T) {
+	start := time.Now()
+	k := newKnownUsers()
+	var forgotten []string
+	k.onForget(func(username string) { forgotten = append(forgotten, username) })
+	for i := range maxKnownUsers + 1 {
+		k.add(strconv.Itoa(i), start.Add(time.Duration(i)*time.Second))
+	}
+	now := start.Add(maxKnownUsers * time.Second)
+
+	// The least recently seen was forgotten for the cap.
+	if k.has("0", now) {
+		t.Error("has() reports the least recently seen user past the cap")
+	}
+	if !slices.Equal(forgotten, []string{"0"}) {
+		t.Errorf("Forgot %q, want [\"0\"]", forgotten)
+	}
+	if !k.has("1", now) || !k.has(strconv.Itoa(maxKnownUsers), now) {
+		t.Error("has() does not report users within the cap")
+	}
+
+	// Joining again keeps a user known past knownExpiry of the first JOIN.
+	k.add("1", now)
+	later := start.Add(knownExpiry + 2*time.Second)
+	if !k.has("1", later) {
+		t.Error("has() does not report a user seen joining again")
+	}
+	if k.has("2", later) {
+		t.Error("has() reports a user last seen longer than knownExpiry ago")
+	}
+}
+
+func TestUserQueues(t *testing.T) {
+	q := newUserQueues(3, messageSize)
+	msg := func(id string, size int) protocol.Message {
+		return protocol.Message{ID: id, Content: strings.Repeat("x", size-len(id))}
+	}
+	push := func(username string, m protocol.Message) {
+		q.set(username, append(q.take(username), m))
+	}
+
+	// Each user keeps the newest perUser.
+	for _, id := range []string{"1", "2", "3", "4"} {
+		push("alice", msg(id, 10))
+	}
+	if got := q.take("alice"); len(got) != 3 || got[0].ID != "2" {
+		t.Errorf("take() = %v, want 2, 3 and 4", got)
+	}
+	if q.bytes != 0 {
+		t.Errorf("bytes = %d with nothing queued, want 0", q.bytes)
+	}
+
+	// Past maxQueuedBytes, the oldest of the user with the most queued go.
+	third := maxQueuedBytes / 3
+	push("bob", msg("b1", third))
+	push("bob", msg("b2", third))
+	push("carol", msg("c1", third))
+	push("carol", msg("c2", 10))
+	if q.bytes > maxQueuedBytes {
+		t.Errorf("bytes = %d, over maxQueuedBytes", q.bytes)
+	}
+	if got := q.take("bob"); len(got) != 1 || got[0].ID != "b2" {
+		t.Errorf("take(bob) = %v, want only b2", got)
+	}
+	if got := q.take("carol"); len(got) != 2 {
+		t.Errorf("take(carol) = %d messages, want 2", len(got))
+	}
+}
@@ -0,0 +1,320 @@
+package server
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Transport identifies how a client is connected to the server.
+type Transport string
+
+// Transports a Listener can accept.
+const (
+	TransportTCP          Transport = "tcp"
+	TransportWebSocket    Transport = "websocket"
+	TransportWebTransport Transport = "webtransport"
+)
+
+// Listener describes one address the server accepts chat connections on. All
+// listeners share the same client registry, so clients connected through any
+// of them chat with each other.
+type Listener struct {
+	// Network is "tcp", "tcp4", "tcp6" or "unix" for a stream listener
+	// carrying raw TCP and WebSocket clients (and the browser client), or
+	// "udp", "udp4" or "udp6" for a WebTransport endpoint. Defaults to "tcp".
+	Network string
+	// Address is the host:port to bind, e.g. "127.0.0.1:8080" or "[::]:443",
+	// or the socket path for a Unix listener.
+	Address string
+	// Transports lists the transports accepted on this listener. Empty means
+	// every transport its network can carry. Plain HTTP requests for the
+	// browser client are served wherever WebSocket is accepted.
+	Transports []Transport
+	// TLS terminates TLS on a stream listener with the server's certificate,
+	// for wss:// and https:// clients. WebTransport listeners always use TLS.
+	TLS bool
+	// Mode sets the permissions of a Unix listener's socket file. Zero leaves
+	// them to the process umask.
+	Mode os.FileMode
+
+	// StreamSocket or PacketSocket, when set, is an already-bound socket (for
+	// example one passed in by systemd socket activation) used instead of
+	// binding Address. Set the one matching Network; Address may then be
+	// empty.
+	StreamSocket net.Listener
+	PacketSocket net.PacketConn
+}
+
+// WithListeners adds listeners to the one created for the address passed to
+// New. Pass an empty address to New to use only these listeners.
+func WithListeners(listeners ...Listener) Option {
+	return func(s *Server) {
+		s.listenerConfigs = append(s.listenerConfigs, listeners...)
+	}
+}
+
+// Validate checks that the listener's network and transports fit together.
+// It does not check the address, which is only resolved when binding.
+func (l Listener) Validate() error {
+	if l.Address == "" && l.StreamSocket == nil && l.PacketSocket == nil {
+		return errors.New("listener address is required")
+	}
+	if (l.isPacket() && l.StreamSocket != nil) || (!l.isPacket() && l.PacketSocket != nil) {
+		return fmt.Errorf("listener %s: socket does not match network %q", l.Address, l.network())
+	}
+	switch l.network() {
+	case "tcp", "tcp4", "tcp6", "unix":
+		for _, t := range l.Transports {
+			if t != TransportTCP && t != TransportWebSocket {
+				return fmt.Errorf(
+					"listener %s: transport %q is not available on a stream listener",
+					l.Address,
+					t,
+				)
+			}
+		}
+	case "udp", "udp4", "udp6":
+		for _, t := range l.Transports {
+			if t != TransportWebTransport {
+				return fmt.Errorf(
+					"listener %s: transport %q is not available on a UDP listener",
+					l.Address,
+					t,
+				)
+			}
+		}
+	default:
+		return fmt.Errorf("listener %s: unknown network %q", l.Address, l.Network)
+	}
+	return nil
+}
+
+// network returns l.Network, defaulting to "tcp".
+func (l Listener) network() string {
+	if l.Network == "" {
+		return "tcp"
+	}
+	return l.Network
+}
+
+// isPacket reports whether l is a WebTransport (UDP) listener.
+func (l Listener) isPacket() bool {
+	return strings.HasPrefix(l.network(), "udp")
+}
+
+// allows reports whether l accepts clients over transport t.
+func (l Listener) allows(t Transport) bool {
+	return len(l.Transports) == 0 || slices.Contains(l.Transports, t)
+}
+
+// boundListener is a Listener together with its open socket: stream for TCP
+// networks, packet for UDP ones. stream accepts plain connections even for a
+// TLS listener; handleConnection starts TLS with tlsConfig once any PROXY
+// header, which a load balancer sends ahead of the TLS handshake, is read.
+type boundListener struct {
+	Listener
+	stream    net.Listener
+	packet    net.PacketConn
+	tlsConfig *tls.Config
+}
+
+func (l *boundListener) addr() net.Addr {
+	if l.packet != nil {
+		return l.packet.LocalAddr()
+	}
+	return l.stream.Addr()
+}
+
+// listen binds the listener for s.address, if any, and every listener added by
+// WithListeners. Without an explicit WebTransport listener, a certificate
+// enables WebTransport on the UDP port with the same number as the address
+// listener, as it did before listeners were configurable.
+func (s *Server) listen() error {
+	configs := s.listenerConfigs
+	if s.address != "" {
+		primary := Listener{
+			Address:    s.address,
+			Transports: []Transport{TransportTCP, TransportWebSocket},
+		}
+		configs = append([]Listener{primary}, configs...)
+	}
+	if len(configs) == 0 {
+		return errors.New("no listeners configured")
+	}
+
+	for _, cfg := range configs {
+		l, err := s.bind(cfg)
+		if err != nil {
+			return err
+		}
+		s.addListener(l)
+	}
+
+	hasWebTransport := slices.ContainsFunc(s.listeners, func(l *boundListener) bool {
+		return l.isPacket()
+	})
+	if s.address != "" && !hasWebTransport && s.tlsCert.Load() != nil {
+		// The primary listener may have been created with a wildcard port
+		// (":0"), so the UDP port is taken from its bound address.
+		tcpAddr, ok := s.listeners[0].stream.Addr().(*net.TCPAddr)
+		if !ok {
+			return fmt.Errorf("listener address is not TCP: %T", s.listeners[0].stream.Addr())
+		}
+		l, err := s.bind(Listener{
+			Network: "udp",
+			Address: net.JoinHostPort(tcpAddr.IP.String(), strconv.Itoa(tcpAddr.Port)),
+		})
+		if err != nil {
+			return err
+		}
+		s.addListener(l)
+	}
+	return nil
+}
+
+// addListener records l as bound. Addr and Addrs may be called from other
+// goroutines while Start binds the listeners, so s.listeners is guarded by
+// s.mu.
+func (s *Server) addListener(l *boundListener) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.listeners = append(s.listeners, l)
+}
+
+// bind validates cfg and opens its socket.
+func (s *Server) bind(cfg Listener) (*boundListener, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	l := &boundListener{Listener: cfg}
+
+	if cfg.isPacket() {
+		if s.tlsCert.Load() == nil {
+			return nil, fmt.Errorf(
+				"listener %s: WebTransport requires a TLS certificate",
+				cfg.Address,
+			)
+		}
+		conn := cfg.PacketSocket
+		if conn == nil {
+			var err error
+			conn, err = net.ListenPacket(cfg.network(), cfg.Address)
+			if err != nil {
+				return nil, fmt.Errorf(
+					"failed to listen on %s %s: %w",
+					cfg.network(),
+					cfg.Address,
+					err,
+				)
+			}
+		}
+		l.packet = conn
+		return l, nil
+	}
+
+	if cfg.TLS && s.tlsCert.Load() == nil {
+		return nil, fmt.Errorf("listener %s: TLS requires a certificate", cfg.Address)
+	}
+	ln := cfg.StreamSocket
+	var err error
+	switch {
+	case ln != nil:
+	case cfg.network() == "unix":
+		ln, err = listenUnix(cfg.Address, cfg.Mode)
+	default:
+		ln, err = net.Listen(cfg.network(), cfg.Address)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to start server: %w", err)
+	}
+	l.stream = ln
+	if cfg.TLS {
+		l.tlsConfig = &tls.Config{GetCertificate: s.getCertificate}
+	}
+	s.logger.Info("Server started", "addr", ln.Addr().String(), "tls", cfg.TLS)
+	return l, nil
+}
+
+// listenUnix listens on the Unix socket at path, first removing a stale socket
+// file left behind by a server that did not shut down cleanly. The file is
+// removed again when the listener is closed.
+func listenUnix(path string, mode os.FileMode) (net.Listener, error) {
+	if err := removeStaleSocket(path); err != nil {
+		return nil, err
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if mode != 0 {
+		if err := os.Chmod(path, mode); err != nil {
+			_ = ln.Close()
+			return nil, fmt.Errorf("failed to set permissions on %s: %w", path, err)
+		}
+	}
+	return ln, nil
+}
+
+// removeStaleSocket deletes the socket file at path if nothing is listening on
+// it. A live socket, or a path that is not a socket at all, is left alone and
+// reported as an error rather than silently replaced.
+func removeStaleSocket(path string) error {
+	info, err := os.Lstat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.Mode().Type() != fs.ModeSocket {
+		return fmt.Errorf("%s exists and is not a socket", path)
+	}
+	conn, err := net.DialTimeout("unix", path, time.Second)
+	if err == nil {
+		_ = conn.Close()
+		return fmt.Errorf("%s is in use by another server", path)
+	}
+	if err := os.Remove(path); err != nil {
+		return fmt.Errorf("failed to remove stale socket: %w", err)
+	}
+	return nil
+}
+
+// closeListeners closes every bound socket. Closing one twice is harmless, so
+// it is safe to call after a failed Start and again from Stop.
+func (s *Server) closeListeners() {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, l := range s.listeners {
+		var err error
+		if l.stream != nil {
+			err = l.stream.Close()
+		} else {
+			err = l.packet.Close()
+		}
+		if err != nil && !errors.Is(err, net.ErrClosed) {
+			s.logger.Error("Error closing listener", "addr", l.addr().String(), "error", err)
+		}
+	}
+}
+
+// Addrs returns the bound address of every listener in the order they were
+// configured, starting with the one for the address passed to New. The
+// implicit WebTransport listener, if any, comes last.
+func (s *Server) Addrs() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	addrs := make([]string, 0, len(s.listeners))
+	for _, l := range s.listeners {
+		addrs = append(addrs, l.addr().String())
+	}
+	return addrs
+}
@@ -0,0 +1,145 @@
+package server
+
+import (
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/omochice/toy-socket-chat/pkg/protocol"
+)
+
+// maxQueuedMentions bounds the mentions kept for a user who is offline; the
+// oldest are dropped first.
+const maxQueuedMentions = 50
+
+// mentionStore holds the mentions waiting for users who are offline.
+type mentionStore struct {
+	mu     sync.Mutex
+	queued userQueues[protocol.Message]
+}
+
+// newMentionStore returns a mentionStore that drops the mentions of users
+// known forgets.
+func newMentionStore(known *knownUsers) *mentionStore {
+	m := &mentionStore{queued: newUserQueues(maxQueuedMentions, messageSize)}
+	known.onForget(m.drop)
+	return m
+}
+
+// drop forgets the mentions queued for username.
+func (m *mentionStore) drop(username string) {
+	m.take(username)
+}
+
+// queue keeps a MENTION for username until take is called.
+func (m *mentionStore) queue(username string, msg protocol.Message) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.queued.set(username, append(m.queued.take(username), msg))
+}
+
+// take returns and forgets the mentions queued for username. There is no
+// authentication, so they go to whoever joins under that name.
+func (m *mentionStore) take(username string) []protocol.Message {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.queued.take(username)
+}
+
+// parseMentions returns the names written as @name in content, in order and
+// without duplicates. Trailing punctuation is not part of a name.
+func parseMentions(content string) []string {
+	var names []string
+	for _, word := range strings.Fields(content) {
+		name, ok := strings.CutPrefix(strings.TrimLeft(word, "(\"'"), "@")
+		if !ok {
+			continue
+		}
+		name = strings.TrimRight(name, ".,:;!?)\"'")
+		if name != "" && !slices.Contains(names, name) {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// resolveMentions returns the users mentioned in content who are known or
+// online, the latter covering users joined since before knownExpiry. home is
+// the federated server the message comes from, whose users are mentioned by
+// bare name there, or "" for this server; this server's users may be
+// mentioned as user@name from elsewhere.
+func (s *Server) resolveMentions(content, home string) []string {
+	var users []string
+	for _, name := range parseMentions(content) {
+		switch {
+		case s.federation.Name != "" && strings.HasSuffix(name, "@"+s.federation.Name):
+			name = strings.TrimSuffix(name, "@"+s.federation.Name)
+		case home != "" && !federatedSender(name):
+			name += "@" + home
+		}
+		known := s.known.has(name, time.Now()) || s.online(name)
+		if known && !slices.Contains(users, name) {
+			users = append(users, name)
+		}
+	}
+	return users
+}
+
+// notifyMentions tracks who joined the chat, and sends a MENTION to this
+// server's clients mentioned in a TEXT message. If a mentioned user of this
+// server is not joined anywhere in the cluster, the MENTION is queued until
+// they join.
+func (s *Server) notifyMentions(msg protocol.Message) {
+	if msg.Type == protocol.MessageTypeJoin {
+		// A user who joined elsewhere gets mentions from there, so any
+		// queued here are dropped.
+		s.known.add(msg.Sender, time.Now())
+		s.mentions.drop(msg.Sender)
+		return
+	}
+	if msg.Type != protocol.MessageTypeText {
+		return
+	}
+
+	for _, user := range msg.Mentions {
+		if user == msg.Sender {
+			continue
+		}
+		note := protocol.Message{
+			Type:    protocol.MessageTypeMention,
+			Sender:  msg.Sender,
+			Content: msg.Content,
+			ID:      msg.ID,
+		}
+		if s.sendToUser(user, note) || federatedSender(user) || s.online(user) {
+			continue
+		}
+		s.mentions.queue(user, note)
+	}
+}
+
+// sendToUser queues msg for every client joined as username and reports
+// whether there were any.
+func (s *Server) sendToUser(username string, msg protocol.Message) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	found := false
+	for client := range s.clients {
+		if client.name() == username && client.peerName() == "" {
+			s.sendTo(client, msg)
+			found = true
+		}
+	}
+	return found
+}
+
+// online reports whether username is joined on any server of the cluster.
+func (s *Server) online(username string) bool {
+	for _, users := range s.broker.Presence() {
+		if slices.Contains(users, username) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,28 @@
+package server
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestParseMentions(t *testing.T) {
+	tests := []struct {
+		content string
+		want    []string
+	}{
+		{content: "hello", want: nil},
+		{content: "@alice hi", want: []string{"alice"}},
+		{content: "hi @alice, @bob!", want: []string{"alice", "bob"}},
+		{content: "(@alice) and @alice again", want: []string{"alice"}},
+		{content: "ask @bob@serverB.", want: []string{"bob@serverB"}},
+		{content: "mail me at me@example.org or @ alone", want: nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.content, func(t *testing.T) {
+			if got := parseMentions(tt.content); !slices.Equal(got, tt.want) {
+				t.Errorf("parseMentions(%q) = %q, want %q", tt.content, got, tt.want)
+			}
+		})
+	}
+}
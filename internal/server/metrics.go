@@ -0,0 +1,199 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// WithMetrics enables a Prometheus text-format endpoint at /metrics on addr.
+// Metrics are always collected; this only controls whether they are exported.
+func WithMetrics(addr string) Option {
+	return func(s *Server) {
+		s.metricsAddress = addr
+	}
+}
+
+// MetricsAddr returns the metrics endpoint's listening address, or "" when it
+// is disabled or not yet started.
+func (s *Server) MetricsAddr() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.metricsListener != nil {
+		return s.metricsListener.Addr().String()
+	}
+	return ""
+}
+
+// broadcastLatencyBuckets are the upper bounds, in seconds, of the broadcast
+// latency histogram. Broadcast only enqueues onto buffered channels, so the
+// interesting range is microseconds to a few milliseconds.
+var broadcastLatencyBuckets = []float64{
+	0.00001, 0.00005, 0.0001, 0.0005, 0.001, 0.005, 0.01, 0.05, 0.1,
+}
+
+// metrics holds the server's counters. It is a small hand-rolled subset of the
+// Prometheus data model so the server needs no client library.
+type metrics struct {
+	connections       *counterVec
+	messagesReceived  *counterVec
+	messagesBroadcast *counterVec
+	bytesReceived     atomic.Uint64
+	bytesSent         atomic.Uint64
+	decodeFailures    atomic.Uint64
+	droppedMessages   atomic.Uint64
+	broadcastLatency  *histogram
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		connections:       newCounterVec("transport"),
+		messagesReceived:  newCounterVec("type"),
+		messagesBroadcast: newCounterVec("type"),
+		broadcastLatency:  newHistogram(broadcastLatencyBuckets),
+	}
+}
+
+// handleMetrics serves the metrics in the Prometheus text exposition format.
+func (s *Server) handleMetrics(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m := s.metrics
+
+	writeGauge(w, "chat_clients", "Currently connected clients.", uint64(s.ClientCount()))
+	m.connections.write(w, "chat_connections_total", "Connections accepted, by transport.")
+	m.messagesReceived.write(
+		w,
+		"chat_messages_received_total",
+		"Messages received from clients, by message type.",
+	)
+	m.messagesBroadcast.write(
+		w,
+		"chat_messages_broadcast_total",
+		"Messages broadcast to other clients, by message type.",
+	)
+	writeCounter(
+		w,
+		"chat_received_bytes_total",
+		"Bytes read from client connections.",
+		m.bytesReceived.Load(),
+	)
+	writeCounter(
+		w,
+		"chat_sent_bytes_total",
+		"Bytes written to client connections.",
+		m.bytesSent.Load(),
+	)
+	writeCounter(
+		w,
+		"chat_decode_failures_total",
+		"Messages from clients that could not be decoded.",
+		m.decodeFailures.Load(),
+	)
+	writeCounter(
+		w,
+		"chat_dropped_messages_total",
+		"Messages dropped because a client's outgoing queue was full.",
+		m.droppedMessages.Load(),
+	)
+	m.broadcastLatency.write(
+		w,
+		"chat_broadcast_duration_seconds",
+		"Time taken to fan a message out to all clients' queues.",
+	)
+}
+
+func writeCounter(w io.Writer, name, help string, value uint64) {
+	_, _ = fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n%s %d\n", name, help, name, name, value)
+}
+
+func writeGauge(w io.Writer, name, help string, value uint64) {
+	_, _ = fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %d\n", name, help, name, name, value)
+}
+
+// counterVec is a set of counters partitioned by the value of a single label.
+type counterVec struct {
+	label  string
+	mu     sync.Mutex
+	values map[string]uint64
+}
+
+func newCounterVec(label string) *counterVec {
+	return &counterVec{label: label, values: make(map[string]uint64)}
+}
+
+func (cv *counterVec) inc(value string) {
+	cv.mu.Lock()
+	defer cv.mu.Unlock()
+	cv.values[value]++
+}
+
+func (cv *counterVec) write(w io.Writer, name, help string) {
+	cv.mu.Lock()
+	keys := make([]string, 0, len(cv.values))
+	for k := range cv.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	values := make([]uint64, len(keys))
+	for i, k := range keys {
+		values[i] = cv.values[k]
+	}
+	cv.mu.Unlock()
+
+	_, _ = fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", name, help, name)
+	for i, k := range keys {
+		_, _ = fmt.Fprintf(w, "%s{%s=%q} %d\n", name, cv.label, k, values[i])
+	}
+}
+
+// histogram is a cumulative Prometheus histogram with fixed buckets.
+type histogram struct {
+	buckets []float64
+	mu      sync.Mutex
+	counts  []uint64
+	sum     float64
+	count   uint64
+}
+
+func newHistogram(buckets []float64) *histogram {
+	return &histogram{buckets: buckets, counts: make([]uint64, len(buckets))}
+}
+
+func (h *histogram) observe(d time.Duration) {
+	v := d.Seconds()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i, upper := range h.buckets {
+		if v <= upper {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+func (h *histogram) write(w io.Writer, name, help string) {
+	h.mu.Lock()
+	counts := append([]uint64(nil), h.counts...)
+	sum, count := h.sum, h.count
+	h.mu.Unlock()
+
+	_, _ = fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", name, help, name)
+	for i, upper := range h.buckets {
+		_, _ = fmt.Fprintf(
+			w,
+			"%s_bucket{le=%q} %d\n",
+			name,
+			strconv.FormatFloat(upper, 'g', -1, 64),
+			counts[i],
+		)
+	}
+	_, _ = fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", name, count)
+	_, _ = fmt.Fprintf(w, "%s_sum %s\n", name, strconv.FormatFloat(sum, 'g', -1, 64))
+	_, _ = fmt.Fprintf(w, "%s_count %d\n", name, count)
+}
@@ -0,0 +1,166 @@
+package server
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+)
+
+// WithAllowedOrigins restricts which browser origins may open a chat session
+// over WebSocket or WebTransport. Each pattern is either an exact origin such
+// as "https://chat.example.com", a wildcard subdomain origin such as
+// "https://*.example.com" (which matches any subdomain but not the apex), or
+// "*" to allow every origin. Requests without an Origin header come from
+// non-browser clients and are always allowed.
+func WithAllowedOrigins(patterns ...string) Option {
+	allowed := make([]string, 0, len(patterns))
+	for _, p := range patterns {
+		allowed = append(allowed, strings.ToLower(strings.TrimSpace(p)))
+	}
+	return func(s *Server) {
+		s.checkOrigin = func(r *http.Request) bool {
+			origin := r.Header.Get("Origin")
+			if origin == "" {
+				return true
+			}
+			for _, p := range allowed {
+				if matchOrigin(p, origin) {
+					return true
+				}
+			}
+			return false
+		}
+	}
+}
+
+// WithAllowedHosts restricts the Host header of WebSocket and WebTransport
+// requests, which defeats DNS rebinding: a page on a domain that an attacker
+// points at this server still names that domain as Host. Each pattern is a
+// host name such as "chat.example.com", optionally with a port, or a wildcard
+// such as "*.example.com" that matches any subdomain but not the apex. A
+// pattern without a port matches any port, and the default ports 80 and 443
+// may be given or left out on either side. Without this option any Host is
+// accepted.
+func WithAllowedHosts(patterns ...string) Option {
+	allowed := make([]string, 0, len(patterns))
+	for _, p := range patterns {
+		allowed = append(allowed, strings.ToLower(strings.TrimSpace(p)))
+	}
+	return func(s *Server) {
+		s.allowedHosts = allowed
+	}
+}
+
+// WithOriginCheck installs a callback that decides whether a browser request
+// may open a chat session. It replaces any policy set by WithAllowedOrigins and
+// is consulted even when the request carries no Origin header.
+func WithOriginCheck(check func(r *http.Request) bool) Option {
+	return func(s *Server) {
+		s.checkOrigin = check
+	}
+}
+
+// originAllowed applies the configured host allowlist and origin policy to r.
+// Without an origin policy the same-origin rule is used: a request carrying an
+// Origin header is only accepted when that origin names the host the request
+// was sent to, so an arbitrary web page cannot open a chat session from a
+// visitor's browser.
+func (s *Server) originAllowed(r *http.Request) bool {
+	if r.Host == "" {
+		return false
+	}
+	if len(s.allowedHosts) > 0 && !slices.ContainsFunc(s.allowedHosts, func(p string) bool {
+		return matchHost(p, r.Host)
+	}) {
+		return false
+	}
+	if s.checkOrigin != nil {
+		return s.checkOrigin(r)
+	}
+	return sameOrigin(r)
+}
+
+// sameOrigin reports whether the request's Origin host matches its Host
+// header. The default port of the origin's scheme may be given on one side
+// and left out on the other.
+func sameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	port := defaultPorts[u.Scheme]
+	return strings.EqualFold(trimPort(u.Host, port), trimPort(r.Host, port))
+}
+
+// defaultPorts maps URL schemes to the port used when a URL gives none.
+var defaultPorts = map[string]string{
+	"http":  "80",
+	"ws":    "80",
+	"https": "443",
+	"wss":   "443",
+}
+
+// trimPort removes port from the end of host, if host ends with it.
+func trimPort(host, port string) string {
+	if port == "" {
+		return host
+	}
+	return strings.TrimSuffix(host, ":"+port)
+}
+
+// matchHost reports whether host, a Host header, satisfies pattern, which
+// must already be lower-cased.
+func matchHost(pattern, host string) bool {
+	pattern = trimPort(trimPort(pattern, "80"), "443")
+	host = trimPort(trimPort(strings.ToLower(host), "80"), "443")
+	name, port := host, ""
+	if h, p, err := net.SplitHostPort(host); err == nil {
+		name, port = h, p
+	}
+	want, wantPort := pattern, ""
+	if h, p, err := net.SplitHostPort(pattern); err == nil {
+		want, wantPort = h, p
+	}
+	if wantPort != "" && port != wantPort {
+		return false
+	}
+	if suffix, ok := strings.CutPrefix(want, "*."); ok {
+		return strings.HasSuffix(name, "."+suffix) && net.ParseIP(name) == nil
+	}
+	return strings.Trim(name, "[]") == strings.Trim(want, "[]")
+}
+
+// matchOrigin reports whether origin satisfies pattern. Both are compared
+// case-insensitively; pattern must already be lower-cased.
+func matchOrigin(pattern, origin string) bool {
+	if pattern == "*" {
+		return true
+	}
+	origin = strings.ToLower(origin)
+	if pattern == origin {
+		return true
+	}
+
+	scheme, host, ok := strings.Cut(pattern, "://*.")
+	if !ok {
+		return false
+	}
+	u, err := url.Parse(origin)
+	if err != nil || u.Scheme != scheme {
+		return false
+	}
+	// The wildcard covers the hostname only; a port, if the pattern has one,
+	// must match exactly.
+	suffix, port, hasPort := strings.Cut(host, ":")
+	if (hasPort && u.Port() != port) || (!hasPort && u.Port() != "") {
+		return false
+	}
+	name := u.Hostname()
+	return strings.HasSuffix(name, "."+suffix) && net.ParseIP(name) == nil
+}
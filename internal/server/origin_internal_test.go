@@ -0,0 +1,29 @@
+package server
+
+import "testing"
+
+func TestMatchHost(t *testing.T) {
+	tests := []struct {
+		pattern string
+		host    string
+		want    bool
+	}{
+		{pattern: "chat.example.com", host: "chat.example.com", want: true},
+		{pattern: "chat.example.com", host: "Chat.Example.com:8080", want: true},
+		{pattern: "chat.example.com:443", host: "chat.example.com", want: true},
+		{pattern: "chat.example.com", host: "chat.example.com:443", want: true},
+		{pattern: "chat.example.com:8443", host: "chat.example.com", want: false},
+		{pattern: "chat.example.com", host: "evil.example.net", want: false},
+		{pattern: "*.example.com", host: "chat.example.com:8080", want: true},
+		{pattern: "*.example.com", host: "example.com", want: false},
+		{pattern: "[::1]", host: "[::1]:8080", want: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.pattern+" "+tt.host, func(t *testing.T) {
+			if got := matchHost(tt.pattern, tt.host); got != tt.want {
+				t.Errorf("matchHost(%q, %q) = %v, want %v", tt.pattern, tt.host, got, tt.want)
+			}
+		})
+	}
+}
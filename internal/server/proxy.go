@@ -0,0 +1,208 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+// proxyV2Signature starts every PROXY protocol v2 header.
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyV1MaxLength is the longest v1 header line the specification allows,
+// including the trailing CRLF.
+const proxyV1MaxLength = 107
+
+// WithTrustedProxies names the load balancers and reverse proxies the server
+// sits behind. Connections from these networks may start with a PROXY protocol
+// v1 or v2 header, and WebSocket upgrades from them may carry X-Forwarded-For;
+// either way the client address they report replaces the proxy's own address
+// for bans, logs and the admin API. Both are ignored from any other address,
+// so clients cannot spoof their address by sending them directly.
+func WithTrustedProxies(networks ...netip.Prefix) Option {
+	return func(s *Server) {
+		s.trustedProxies = networks
+	}
+}
+
+// trustedProxy reports whether addr belongs to a trusted proxy.
+func (s *Server) trustedProxy(addr net.Addr) bool {
+	return addrInNetworks(addr, s.trustedProxies)
+}
+
+// proxiedConn is a connection whose RemoteAddr is the client address reported
+// by a trusted proxy rather than the proxy's own address. When reader is set,
+// reads go through it so bytes buffered while parsing a PROXY header are not
+// lost.
+type proxiedConn struct {
+	net.Conn
+	remote net.Addr
+	reader io.Reader
+}
+
+func (c *proxiedConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func (c *proxiedConn) Read(buf []byte) (int, error) {
+	if c.reader != nil {
+		return c.reader.Read(buf)
+	}
+	return c.Conn.Read(buf)
+}
+
+// acceptProxyHeader reads a PROXY protocol header from conn, if it starts with
+// one, and returns a connection reporting the client address it carries. The
+// header is optional so a trusted proxy's own health checks still work; a
+// connection without one, or a header that names no address (v1 UNKNOWN, v2
+// LOCAL), keeps the proxy's address.
+func acceptProxyHeader(conn net.Conn) (net.Conn, error) {
+	reader := bufio.NewReader(conn)
+	remote, err := readProxyHeader(reader)
+	if err != nil {
+		return nil, err
+	}
+	if remote == nil {
+		remote = conn.RemoteAddr()
+	}
+	return &proxiedConn{Conn: conn, remote: remote, reader: reader}, nil
+}
+
+// readProxyHeader consumes a PROXY protocol v1 or v2 header from r and returns
+// the source address it reports. It returns nil, nil if r does not start with
+// a header or the header carries no address.
+func readProxyHeader(r *bufio.Reader) (net.Addr, error) {
+	// Look at the first byte before peeking further: a short protobuf message
+	// would otherwise leave Peek waiting for bytes the client never sends.
+	first, err := r.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	var signature []byte
+	switch first[0] {
+	case proxyV2Signature[0]:
+		signature = proxyV2Signature
+	case 'P':
+		signature = []byte("PROXY ")
+	default:
+		return nil, nil
+	}
+
+	peek, err := r.Peek(len(signature))
+	if err != nil || !bytes.Equal(peek, signature) {
+		// Not a header after all; an HTTP POST or PUT also starts with 'P'.
+		return nil, nil
+	}
+	if signature[0] == 'P' {
+		return readProxyV1(r)
+	}
+	return readProxyV2(r)
+}
+
+// readProxyV1 parses a human-readable header such as
+// "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n".
+func readProxyV1(r *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) >= proxyV1MaxLength {
+			return nil, errors.New("PROXY v1 header too long")
+		}
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read PROXY v1 header: %w", err)
+		}
+		line = append(line, b)
+	}
+
+	fields := strings.Fields(string(line))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("malformed PROXY v1 header %q", strings.TrimSpace(string(line)))
+	}
+	ip, err := netip.ParseAddr(fields[2])
+	if err != nil {
+		return nil, fmt.Errorf("invalid PROXY v1 source address: %w", err)
+	}
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid PROXY v1 source port: %w", err)
+	}
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(ip, uint16(port))), nil
+}
+
+// readProxyV2 parses a binary header: the signature, a version/command byte,
+// an address family byte, a big-endian payload length and the payload, which
+// starts with the addresses and may be followed by TLVs that are skipped.
+func readProxyV2(r *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, len(proxyV2Signature)+4)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, fmt.Errorf("failed to read PROXY v2 header: %w", err)
+	}
+	verCmd, family := header[12], header[13]
+	payload := make([]byte, binary.BigEndian.Uint16(header[14:]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, fmt.Errorf("failed to read PROXY v2 addresses: %w", err)
+	}
+
+	if verCmd>>4 != 2 {
+		return nil, fmt.Errorf("unsupported PROXY protocol version %d", verCmd>>4)
+	}
+	if verCmd&0x0f == 0 {
+		// LOCAL: the proxy's own connection, e.g. a health check.
+		return nil, nil
+	}
+
+	var ipLen int
+	switch family {
+	case 0x11: // TCP over IPv4
+		ipLen = 4
+	case 0x21: // TCP over IPv6
+		ipLen = 16
+	default:
+		// UDP or Unix socket sources have no meaningful TCP address.
+		return nil, nil
+	}
+	if len(payload) < 2*ipLen+4 {
+		return nil, errors.New("PROXY v2 address block too short")
+	}
+	ip, _ := netip.AddrFromSlice(payload[:ipLen])
+	port := binary.BigEndian.Uint16(payload[2*ipLen:])
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(ip, port)), nil
+}
+
+// forwardedFor returns the client address from req's X-Forwarded-For header:
+// the rightmost entry that is not itself a trusted proxy, since entries to its
+// left were supplied by the client and cannot be trusted. It returns nil if
+// the header is absent or unparsable.
+func (s *Server) forwardedFor(req *http.Request) net.Addr {
+	var hops []string
+	for _, value := range req.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(value, ",")...)
+	}
+
+	var client netip.Addr
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+		if err != nil {
+			return nil
+		}
+		client = ip
+		if !s.trustedProxy(net.TCPAddrFromAddrPort(netip.AddrPortFrom(ip, 0))) {
+			break
+		}
+	}
+	if !client.IsValid() {
+		return nil
+	}
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(client, 0))
+}
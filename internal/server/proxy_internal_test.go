@@ -0,0 +1,168 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net/http"
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+// proxyV2Header builds a PROXY v2 PROXY-command header for a TCP connection
+// from src to dst.
+func proxyV2Header(src, dst netip.AddrPort) []byte {
+	family := byte(0x11)
+	if src.Addr().Is6() {
+		family = 0x21
+	}
+	var addrs bytes.Buffer
+	addrs.Write(src.Addr().AsSlice())
+	addrs.Write(dst.Addr().AsSlice())
+	_ = binary.Write(&addrs, binary.BigEndian, src.Port())
+	_ = binary.Write(&addrs, binary.BigEndian, dst.Port())
+
+	header := append([]byte(nil), proxyV2Signature...)
+	header = append(header, 0x21, family)
+	header = binary.BigEndian.AppendUint16(header, uint16(addrs.Len()))
+	return append(header, addrs.Bytes()...)
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	local := append([]byte(nil), proxyV2Signature...)
+	local = append(local, 0x20, 0x00, 0x00, 0x00)
+
+	tests := []struct {
+		name     string
+		input    []byte
+		wantAddr string
+		wantErr  bool
+	}{
+		{
+			name:     "v1 TCP4",
+			input:    []byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n"),
+			wantAddr: "192.0.2.1:56324",
+		},
+		{
+			name:     "v1 TCP6",
+			input:    []byte("PROXY TCP6 2001:db8::1 2001:db8::2 4000 443\r\n"),
+			wantAddr: "[2001:db8::1]:4000",
+		},
+		{
+			name:  "v1 UNKNOWN",
+			input: []byte("PROXY UNKNOWN\r\n"),
+		},
+		{
+			name: "v2 TCP4",
+			input: proxyV2Header(
+				netip.MustParseAddrPort("192.0.2.7:1234"),
+				netip.MustParseAddrPort("198.51.100.1:443"),
+			),
+			wantAddr: "192.0.2.7:1234",
+		},
+		{
+			name: "v2 TCP6",
+			input: proxyV2Header(
+				netip.MustParseAddrPort("[2001:db8::7]:1234"),
+				netip.MustParseAddrPort("[2001:db8::1]:443"),
+			),
+			wantAddr: "[2001:db8::7]:1234",
+		},
+		{
+			name:  "v2 LOCAL",
+			input: local,
+		},
+		{
+			name:  "HTTP request",
+			input: []byte("POST / HTTP/1.1\r\n"),
+		},
+		{
+			name:  "short protobuf message",
+			input: []byte{0x08, 0x01},
+		},
+		{
+			name:    "malformed v1",
+			input:   []byte("PROXY TCP4 not-an-ip\r\n"),
+			wantErr: true,
+		},
+		{
+			name:    "unterminated v1",
+			input:   []byte("PROXY " + strings.Repeat("x", 200)),
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			payload := []byte("rest")
+			input := append(append([]byte(nil), tt.input...), payload...)
+			r := bufio.NewReader(bytes.NewReader(input))
+
+			addr, err := readProxyHeader(r)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("readProxyHeader() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+
+			gotAddr := ""
+			if addr != nil {
+				gotAddr = addr.String()
+			}
+			if gotAddr != tt.wantAddr {
+				t.Errorf("readProxyHeader() addr = %q, want %q", gotAddr, tt.wantAddr)
+			}
+
+			// Whatever follows the header must be left for protocol detection.
+			rest, _ := io.ReadAll(r)
+			if tt.wantAddr != "" && !bytes.Equal(rest, payload) {
+				t.Errorf("Bytes after header = %q, want %q", rest, payload)
+			}
+		})
+	}
+}
+
+func TestServer_ForwardedFor(t *testing.T) {
+	s := New(":0", WithTrustedProxies(netip.MustParsePrefix("10.0.0.0/8")))
+
+	tests := []struct {
+		name   string
+		values []string
+		want   string
+	}{
+		{name: "absent", want: ""},
+		{name: "single hop", values: []string{"203.0.113.9"}, want: "203.0.113.9:0"},
+		{
+			// The leftmost entry is whatever the client sent; only the entry
+			// added by the first trusted proxy is believed.
+			name:   "spoofed prefix",
+			values: []string{"198.51.100.66, 203.0.113.9, 10.1.2.3"},
+			want:   "203.0.113.9:0",
+		},
+		{
+			name:   "repeated headers",
+			values: []string{"198.51.100.66", "203.0.113.9"},
+			want:   "203.0.113.9:0",
+		},
+		{name: "garbage", values: []string{"not-an-ip"}, want: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := &http.Request{Header: make(http.Header)}
+			for _, v := range tt.values {
+				req.Header.Add("X-Forwarded-For", v)
+			}
+			got := ""
+			if addr := s.forwardedFor(req); addr != nil {
+				got = addr.String()
+			}
+			if got != tt.want {
+				t.Errorf("forwardedFor() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,63 @@
+package server
+
+import (
+	"strings"
+	"unicode"
+
+	"github.com/omochice/toy-socket-chat/pkg/protocol"
+)
+
+// maxReactionLength bounds the bytes of a reaction, which is meant to be a
+// single emoji (some take several code points) rather than text.
+const maxReactionLength = 32
+
+// validReaction reports whether emoji may be used as a reaction.
+func validReaction(emoji string) bool {
+	return emoji != "" && len(emoji) <= maxReactionLength &&
+		!strings.ContainsFunc(emoji, unicode.IsSpace)
+}
+
+// handleReaction handles a REACTION message from client, updating the
+// reaction counts of the message it names and passing the change on with the
+// new counts. Reacting twice with one emoji is acknowledged but changes
+// nothing, so it is not passed on.
+func (s *Server) handleReaction(client *Client, msg protocol.Message) {
+	name := client.name()
+	switch {
+	case name == "":
+		s.acknowledge(client, msg, "not joined")
+		return
+	case !validReaction(msg.Content):
+		s.acknowledge(client, msg, "invalid reaction")
+		return
+	}
+	entry, ok := s.history.get(msg.ID)
+	switch {
+	case !ok:
+		s.acknowledge(client, msg, "unknown message")
+		return
+	case entry.deleted:
+		s.acknowledge(client, msg, "message deleted")
+		return
+	}
+
+	counts, changed := s.history.react(msg.ID, name, msg.Content, msg.Remove)
+	if changed {
+		out := protocol.Message{
+			Type:      protocol.MessageTypeReaction,
+			Sender:    name,
+			Content:   msg.Content,
+			ID:        msg.ID,
+			Remove:    msg.Remove,
+			Reactions: counts,
+		}
+		data, err := out.Encode()
+		if err != nil {
+			client.log().Error("Failed to encode message", "error", err)
+			return
+		}
+		client.log().Debug("Reaction received", "id", msg.ID, "emoji", msg.Content)
+		s.publish(data, out, client)
+	}
+	s.acknowledge(client, msg, "")
+}
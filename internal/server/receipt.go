@@ -0,0 +1,48 @@
+package server
+
+import "github.com/omochice/toy-socket-chat/pkg/protocol"
+
+// handleRead handles a READ message from client: it moves the user's read
+// marker to the message named by ID and passes the move on as a read receipt,
+// which other users are not shown if Private is set. It answers with an ACK
+// carrying the marker and the number of messages after it, which is all a
+// READ without an ID asks for.
+func (s *Server) handleRead(client *Client, msg protocol.Message) {
+	name := client.name()
+	if name == "" {
+		s.acknowledge(client, msg, "not joined")
+		return
+	}
+	if msg.ID != "" {
+		if _, ok := s.history.get(msg.ID); !ok {
+			s.acknowledge(client, msg, "unknown message")
+			return
+		}
+		if s.history.markRead(name, msg.ID) {
+			out := protocol.Message{
+				Type:    protocol.MessageTypeRead,
+				Sender:  name,
+				ID:      msg.ID,
+				Private: msg.Private,
+			}
+			data, err := out.Encode()
+			if err != nil {
+				client.log().Error("Failed to encode message", "error", err)
+				return
+			}
+			client.log().Debug("Read marker moved", "id", msg.ID)
+			s.publish(data, out, client)
+		}
+	}
+
+	if msg.CorrelationID == "" {
+		return
+	}
+	marker, unread := s.history.unread(name)
+	s.sendTo(client, protocol.Message{
+		Type:          protocol.MessageTypeAck,
+		CorrelationID: msg.CorrelationID,
+		ID:            marker,
+		Unread:        unread,
+	})
+}
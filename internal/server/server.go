@@ -2,37 +2,219 @@ package server
 
 import (
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net"
+	"net/http"
+	"net/netip"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/omochice/toy-socket-chat/pkg/protocol"
 	"github.com/quic-go/webtransport-go"
 )
 
+// flushTimeout bounds how long a disconnecting client's queued messages may
+// take to send before its connection is closed.
+const flushTimeout = time.Second
+
+// serverSender is the sender name used for messages originated by the server
+// itself, such as admin notices and the message of the day.
+const serverSender = "server"
+
 // Client represents a connected client
 type Client struct {
-	conn     Connection
+	id          uint64
+	conn        Connection
+	transport   Transport
+	connectedAt time.Time
+	outgoing    chan []byte
+	// datagrams queues ephemeral messages, which are sent as datagrams if
+	// the transport has them (see datagram.go).
+	datagrams chan []byte
+
+	// username is set by the client's own handler goroutine but read by others
+	// (for example the admin API), so it and the logger carrying it as an
+	// attribute are guarded by mu.
+	mu       sync.RWMutex
 	username string
-	outgoing chan []byte
+	logger   *slog.Logger
+	// peer is the name of the server at the other end of a federation link,
+	// or "" for a chat user, and dialed records whether this server dialed
+	// the link (see federation.go).
+	peer   string
+	dialed bool
+	// operator records that the client joined with an operator's password
+	// (see settings.go).
+	operator bool
+	// typing and typingAt record whether the client last said it is typing
+	// and when that was passed on (see typing.go).
+	typing   bool
+	typingAt time.Time
+}
+
+// name returns the client's username, or "" before it has joined.
+func (c *Client) name() string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.username
+}
+
+// setName records the username announced in the client's JOIN message and
+// adds it to the client's log attributes.
+func (c *Client) setName(username string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.username = username
+	c.logger = c.logger.With("username", username)
+}
+
+// joinedAsOperator reports whether the client joined with an operator's
+// password.
+func (c *Client) joinedAsOperator() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.operator
+}
+
+// setOperator records whether the client joined with an operator's password.
+func (c *Client) setOperator(operator bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.operator = operator
+}
+
+// peerName returns the name of the federated server this client links to, or
+// "" if it is a chat user.
+func (c *Client) peerName() string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.peer
+}
+
+// peerDialed reports whether this server dialed the federation link.
+func (c *Client) peerDialed() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.dialed
+}
+
+// setPeer marks the client as a federation link to the server named peer,
+// dialed by this server or by the peer.
+func (c *Client) setPeer(peer string, dialed bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.peer = peer
+	c.dialed = dialed
+	c.logger = c.logger.With("peer", peer)
+}
+
+// log returns the client's logger, which carries its id, transport, remote
+// address and, once joined, username.
+func (c *Client) log() *slog.Logger {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.logger
 }
 
 // Server represents a TCP chat server
 type Server struct {
-	address  string
-	listener net.Listener
-	clients  map[*Client]bool
-	mu       sync.RWMutex
-	quit     chan struct{}
-	wg       sync.WaitGroup
-
-	// tlsCert, when non-nil, enables the WebTransport endpoint. WebTransport
-	// runs over HTTP/3 (QUIC) which mandates TLS, so it is only started when a
-	// certificate is configured.
-	tlsCert  *tls.Certificate
+	address string
+	clients map[*Client]bool
+	mu      sync.RWMutex
+	quit    chan struct{}
+	wg      sync.WaitGroup
+	// stop lets Stop run once, whether Start already called it on failure or
+	// not.
+	stop sync.Once
+
+	// listenerConfigs are the listeners added by WithListeners; listeners are
+	// all bound listeners, including the one for address, once started.
+	listenerConfigs []Listener
+	listeners       []*boundListener
+
+	// nextID numbers clients in registration order.
+	nextID atomic.Uint64
+	// ready is true while the server is accepting connections; started is
+	// closed the first time it becomes true.
+	ready   atomic.Bool
+	started chan struct{}
+
+	// tlsCert, when set at startup, enables the WebTransport endpoint.
+	// WebTransport runs over HTTP/3 (QUIC) which mandates TLS, so it is only
+	// started when a certificate is configured. It is an atomic pointer so
+	// SetTLSCertificate can swap it for new handshakes while running.
+	tlsCert  atomic.Pointer[tls.Certificate]
 	wtServer *webtransport.Server
+	// wtClose closes wtServer once, whether Drain or Stop gets there first.
+	wtClose sync.Once
+
+	// certFile and keyFile, when set by WithTLSFiles, are loaded into tlsCert
+	// at startup and polled every certReloadInterval for changes.
+	certFile           string
+	keyFile            string
+	certReloadInterval time.Duration
+
+	// limits, bans, operators and motd are adjustable at runtime (see
+	// settings.go).
+	limits    atomic.Pointer[Limits]
+	bans      atomic.Pointer[Bans]
+	operators atomic.Pointer[map[string]string]
+	motd      atomic.Pointer[string]
+
+	// history remembers recent messages so they can be edited and deleted
+	// (see history.go).
+	history *history
+	// known remembers who joined the chat, so mentions and direct messages
+	// for them are accepted (see known.go).
+	known *knownUsers
+	// mentions holds mentions for users who are offline (see mention.go).
+	mentions *mentionStore
+	// directs holds direct messages for users who are offline (see
+	// direct.go).
+	directs *directStore
+
+	// web serves the embedded browser client to plain HTTP requests.
+	web http.Handler
+
+	// adminAddress and metricsAddress, when non-empty, enable the admin API
+	// and the metrics endpoint on listeners separate from the chat port.
+	adminAddress    string
+	adminListener   net.Listener
+	metricsAddress  string
+	metricsListener net.Listener
+	// httpServers is appended to by Start and read by Stop, so it is guarded
+	// by mu.
+	httpServers []*http.Server
+	// httpSockets are already-bound sockets for the HTTP listeners, keyed by
+	// address (see WithHTTPSockets).
+	httpSockets map[string]net.Listener
+
+	metrics *metrics
+	logger  *slog.Logger
+
+	// broker carries messages and presence to and from the other servers of
+	// a cluster (see broker.go).
+	broker Broker
+
+	// federation describes links to other teams' servers; draining is closed
+	// by Drain so links are not redialed (see federation.go).
+	federation Federation
+	draining   chan struct{}
+
+	// trustedProxies are the networks whose PROXY protocol headers and
+	// X-Forwarded-For headers are believed (see proxy.go).
+	trustedProxies []netip.Prefix
+
+	// checkOrigin, when non-nil, replaces the default same-origin rule applied
+	// to WebSocket and WebTransport upgrade requests.
+	checkOrigin func(r *http.Request) bool
+	// allowedHosts, when non-empty, are the only Host headers upgrade
+	// requests may carry (see origin.go).
+	allowedHosts []string
 }
 
 // Option configures a Server created by New.
@@ -43,101 +225,209 @@ type Option func(*Server)
 // TCP and WebSocket.
 func WithTLS(cert tls.Certificate) Option {
 	return func(s *Server) {
-		s.tlsCert = &cert
+		s.tlsCert.Store(&cert)
+	}
+}
+
+// WithLogger sets the logger used for all server output. Chat message content
+// is only logged at debug level. Defaults to slog.Default().
+func WithLogger(logger *slog.Logger) Option {
+	return func(s *Server) {
+		s.logger = logger
 	}
 }
 
 // New creates a new Server instance
 func New(address string, opts ...Option) *Server {
+	known := newKnownUsers()
 	s := &Server{
-		address: address,
-		clients: make(map[*Client]bool),
-		quit:    make(chan struct{}),
+		address:  address,
+		clients:  make(map[*Client]bool),
+		quit:     make(chan struct{}),
+		started:  make(chan struct{}),
+		draining: make(chan struct{}),
+		metrics:  newMetrics(),
+		logger:   slog.Default(),
+		history:  newHistory(DefaultHistorySize),
+		known:    known,
+		mentions: newMentionStore(known),
+		directs:  newDirectStore(known),
+
+		certReloadInterval: defaultCertReloadInterval,
 	}
 	for _, opt := range opts {
 		opt(s)
 	}
+	if s.broker == nil {
+		s.broker = &localBroker{}
+	}
+	s.web = s.webHandler()
 	return s
 }
 
-// Start starts the TCP server
+// Start binds every listener and serves clients until Stop is called.
 func (s *Server) Start() error {
-	listener, err := net.Listen("tcp", s.address)
-	if err != nil {
-		return fmt.Errorf("failed to start server: %w", err)
+	var certState certFileState
+	if s.certFile != "" {
+		// Stat before loading so a change racing with the load is picked up by
+		// the first poll rather than missed.
+		var err error
+		if certState, err = statCertFiles(s.certFile, s.keyFile); err != nil {
+			return fmt.Errorf("failed to read TLS certificate files: %w", err)
+		}
+		if err := s.loadCertificateFiles(); err != nil {
+			return err
+		}
+	} else if cert := s.tlsCert.Load(); cert != nil {
+		s.logCertificate(cert)
+	}
+
+	if err := s.listen(); err != nil {
+		s.closeListeners()
+		return err
+	}
+	if err := s.startServices(certState); err != nil {
+		// Stop closes whatever was started before the failure.
+		s.Stop()
+		return err
+	}
+
+	s.ready.Store(true)
+	close(s.started)
+	<-s.quit
+	return fmt.Errorf("server stopped")
+}
+
+// startServices starts everything that runs on the bound listeners: the
+// certificate watcher, WebTransport, the broker, the admin API, the metrics
+// endpoint, the accept loops and the federation links.
+func (s *Server) startServices(certState certFileState) error {
+	if s.certFile != "" {
+		s.wg.Add(1)
+		go s.watchCertificateFiles(certState)
 	}
-	s.listener = listener
+	s.startWebTransport()
 
-	log.Printf("Server started on %s", listener.Addr().String())
+	if err := s.broker.Start(s.deliverRemote); err != nil {
+		return fmt.Errorf("failed to start broker: %w", err)
+	}
 
-	if s.tlsCert != nil {
-		if err := s.startWebTransport(); err != nil {
-			return fmt.Errorf("failed to start WebTransport: %w", err)
+	if s.adminAddress != "" {
+		listener, err := s.startHTTP("Admin API", s.adminAddress, s.adminHandler())
+		if err != nil {
+			return fmt.Errorf("failed to start admin API: %w", err)
 		}
-	} else {
-		log.Printf("WebTransport disabled (no TLS certificate configured)")
+		// AdminAddr may be called from other goroutines while Start runs.
+		s.mu.Lock()
+		s.adminListener = listener
+		s.mu.Unlock()
 	}
 
-	return s.acceptLoop()
+	if s.metricsAddress != "" {
+		mux := http.NewServeMux()
+		mux.HandleFunc("GET /metrics", s.handleMetrics)
+		listener, err := s.startHTTP("Metrics", s.metricsAddress, mux)
+		if err != nil {
+			return fmt.Errorf("failed to start metrics endpoint: %w", err)
+		}
+		s.mu.Lock()
+		s.metricsListener = listener
+		s.mu.Unlock()
+	}
+
+	for _, l := range s.listeners {
+		if l.stream != nil {
+			s.wg.Add(1)
+			go s.acceptLoop(l)
+		}
+	}
+	for _, peer := range s.federation.Peers {
+		s.wg.Add(1)
+		go s.federationLoop(peer)
+	}
+	return nil
 }
 
-// acceptLoop accepts incoming connections on s.listener until the server is stopped
-func (s *Server) acceptLoop() error {
+// acceptLoop accepts incoming connections on l until the server is stopped
+func (s *Server) acceptLoop(l *boundListener) {
+	defer s.wg.Done()
 	for {
-		select {
-		case <-s.quit:
-			return fmt.Errorf("server stopped")
-		default:
-			conn, err := s.listener.Accept()
-			if err != nil {
-				select {
-				case <-s.quit:
-					return fmt.Errorf("server stopped")
-				default:
-					log.Printf("Failed to accept connection: %v", err)
-					continue
+		conn, err := l.stream.Accept()
+		if err != nil {
+			select {
+			case <-s.quit:
+				return
+			default:
+				// Drain closes the listeners before Stop is called.
+				if errors.Is(err, net.ErrClosed) {
+					return
 				}
+				s.logger.Error("Failed to accept connection", "error", err)
+				continue
 			}
-
-			// Handle connection in goroutine with protocol detection
-			go s.handleConnection(conn)
 		}
+
+		// Handle connection in goroutine with protocol detection
+		go s.handleConnection(conn, l)
 	}
 }
 
-// Stop stops the server
+// Ready returns a channel that is closed once Start has bound every listener
+// and the server accepts connections. It is never closed if Start fails.
+func (s *Server) Ready() <-chan struct{} {
+	return s.started
+}
+
+// Stop stops the server. Calling it again has no effect.
 func (s *Server) Stop() {
+	s.stop.Do(s.shutdown)
+}
+
+// shutdown closes the listeners, the clients' connections and everything
+// Start started, and waits for their goroutines to return.
+func (s *Server) shutdown() {
+	s.ready.Store(false)
 	close(s.quit)
-	if s.listener != nil {
-		if err := s.listener.Close(); err != nil {
-			log.Printf("Error closing listener: %v", err)
-		}
-	}
+	s.closeListeners()
 
 	s.mu.Lock()
 	for client := range s.clients {
 		if err := client.conn.Close(); err != nil {
-			log.Printf("Error closing client connection: %v", err)
+			client.log().Debug("Error closing client connection", "error", err)
 		}
 	}
 	s.mu.Unlock()
 
-	// Close the WebTransport server so its Serve goroutine (blocked on
-	// accepting QUIC connections) returns; otherwise wg.Wait below would hang.
-	// Closing the server also closes the UDP socket it owns.
-	if s.wtServer != nil {
-		if err := s.wtServer.Close(); err != nil {
-			log.Printf("Error closing WebTransport server: %v", err)
+	// Close the WebTransport server so its Serve goroutines (blocked on
+	// accepting QUIC connections) return; otherwise wg.Wait below would hang.
+	s.closeWebTransport()
+
+	s.mu.RLock()
+	httpServers := s.httpServers
+	s.mu.RUnlock()
+	for _, srv := range httpServers {
+		if err := srv.Close(); err != nil {
+			s.logger.Error("Error closing HTTP server", "error", err)
 		}
 	}
 
+	if err := s.broker.Close(); err != nil {
+		s.logger.Error("Error closing broker", "error", err)
+	}
+
 	s.wg.Wait()
 }
 
-// Addr returns the server's listening address
+// Addr returns the listening address of the first TCP listener, which is the
+// one for the address passed to New unless that was empty. See Addrs for all
+// listeners.
 func (s *Server) Addr() string {
-	if s.listener != nil {
-		return s.listener.Addr().String()
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, l := range s.listeners {
+		if l.stream != nil {
+			return l.stream.Addr().String()
+		}
 	}
 	return ""
 }
@@ -149,14 +439,47 @@ func (s *Server) ClientCount() int {
 	return len(s.clients)
 }
 
-// handleConnection detects protocol and creates appropriate Connection
-func (s *Server) handleConnection(rawConn net.Conn) {
+// handleConnection detects protocol and creates appropriate Connection.
+// Transports that l does not allow are closed straight after detection.
+func (s *Server) handleConnection(rawConn net.Conn, l *boundListener) {
+	if s.trustedProxy(rawConn.RemoteAddr()) {
+		conn, err := acceptProxyHeader(rawConn)
+		if err != nil {
+			s.logger.Warn(
+				"Invalid PROXY protocol header",
+				"proxy_addr", rawConn.RemoteAddr().String(),
+				"error", err,
+			)
+			if closeErr := rawConn.Close(); closeErr != nil {
+				s.logger.Debug("Error closing connection", "error", closeErr)
+			}
+			return
+		}
+		rawConn = conn
+	}
+	if l.tlsConfig != nil {
+		rawConn = tls.Server(rawConn, l.tlsConfig)
+	}
+	logger := s.logger.With("remote_addr", rawConn.RemoteAddr().String())
+
 	// Detect protocol
 	protocol, reader, err := detectProtocol(rawConn)
 	if err != nil {
-		log.Printf("Protocol detection failed: %v", err)
+		logger.Warn("Protocol detection failed", "error", err)
+		if closeErr := rawConn.Close(); closeErr != nil {
+			logger.Debug("Error closing connection", "error", closeErr)
+		}
+		return
+	}
+
+	transport := TransportTCP
+	if protocol == protocolHTTP {
+		transport = TransportWebSocket
+	}
+	if !l.allows(transport) {
+		logger.Info("Transport not allowed on listener", "transport", transport)
 		if closeErr := rawConn.Close(); closeErr != nil {
-			log.Printf("Error closing connection: %v", closeErr)
+			logger.Debug("Error closing connection", "error", closeErr)
 		}
 		return
 	}
@@ -165,34 +488,74 @@ func (s *Server) handleConnection(rawConn net.Conn) {
 
 	switch protocol {
 	case protocolHTTP:
+		req, err := http.ReadRequest(reader)
+		if err != nil {
+			logger.Warn("Failed to read HTTP request", "error", err)
+			if closeErr := rawConn.Close(); closeErr != nil {
+				logger.Debug("Error closing connection", "error", closeErr)
+			}
+			return
+		}
+
+		// Anything other than a WebSocket upgrade is a browser fetching the
+		// web client, which is answered and then closed.
+		if !isWebSocketUpgrade(req) {
+			if err := s.serveHTTP(rawConn, req); err != nil {
+				logger.Warn("Failed to serve HTTP request", "error", err)
+			}
+			if closeErr := rawConn.Close(); closeErr != nil {
+				logger.Debug("Error closing connection", "error", closeErr)
+			}
+			return
+		}
+
+		// A trusted proxy that terminates HTTP itself reports the client in
+		// X-Forwarded-For instead of a PROXY header.
+		if s.trustedProxy(rawConn.RemoteAddr()) {
+			if client := s.forwardedFor(req); client != nil {
+				rawConn = &proxiedConn{Conn: rawConn, remote: client}
+			}
+		}
+
 		// WebSocket upgrade
-		conn, err = s.upgradeWebSocket(rawConn, reader)
+		conn, err = s.upgradeWebSocket(rawConn, req)
 		if err != nil {
-			log.Printf("WebSocket upgrade failed: %v", err)
+			logger.Warn("WebSocket upgrade failed", "error", err)
 			if closeErr := rawConn.Close(); closeErr != nil {
-				log.Printf("Error closing connection: %v", closeErr)
+				logger.Debug("Error closing connection", "error", closeErr)
 			}
 			return
 		}
-		log.Printf("WebSocket connection from %s", conn.RemoteAddr())
+		s.register(conn, TransportWebSocket)
 
 	case protocolTCP:
 		// Wrap as TCP connection with buffered reader
 		// Since we peeked at the data, we need to use the buffered reader
 		conn = NewTCPConnectionWithReader(rawConn, reader)
-		log.Printf("TCP connection from %s", conn.RemoteAddr())
+		s.register(conn, TransportTCP)
 	}
-
-	s.register(conn)
 }
 
-// register creates a Client for conn, adds it to the client set, and starts handling it
-func (s *Server) register(conn Connection) {
-	client := &Client{
-		conn:     conn,
-		outgoing: make(chan []byte, 10),
+// register creates a Client for conn, adds it to the client set, and starts
+// handling it. Connections from banned networks, or beyond Limits.MaxClients,
+// are closed instead.
+func (s *Server) register(conn Connection, transport Transport) {
+	if reason := s.admissionError(conn); reason != "" {
+		s.logger.Info(
+			"Connection rejected",
+			"transport", transport,
+			"remote_addr", conn.RemoteAddr().String(),
+			"reason", reason,
+		)
+		if err := conn.Close(); err != nil {
+			s.logger.Debug("Error closing connection", "error", err)
+		}
+		return
 	}
 
+	client := s.newClient(conn, transport)
+	client.logger.Info("Client connected")
+
 	s.mu.Lock()
 	s.clients[client] = true
 	s.mu.Unlock()
@@ -201,80 +564,297 @@ func (s *Server) register(conn Connection) {
 	go s.handleClient(client)
 }
 
+// newClient creates a Client for conn, counting the connection in the
+// metrics. The caller adds it to the client set.
+func (s *Server) newClient(conn Connection, transport Transport) *Client {
+	client := &Client{
+		id:          s.nextID.Add(1),
+		conn:        conn,
+		transport:   transport,
+		connectedAt: time.Now(),
+		outgoing:    make(chan []byte, 10),
+		datagrams:   make(chan []byte, 10),
+	}
+	client.logger = s.logger.With(
+		"client_id", client.id,
+		"transport", transport,
+		"remote_addr", conn.RemoteAddr().String(),
+	)
+	s.metrics.connections.inc(string(transport))
+	return client
+}
+
+// admissionError returns why conn may not join, or "" if it may.
+func (s *Server) admissionError(conn Connection) string {
+	if s.currentBans().matchesAddr(conn.RemoteAddr()) {
+		return "banned address"
+	}
+	if limit := s.currentLimits().MaxClients; limit > 0 && s.ClientCount() >= limit {
+		return "server full"
+	}
+	return ""
+}
+
+// sendServerMessage queues a TEXT message from serverSender for client alone.
+func (s *Server) sendServerMessage(client *Client, content string) {
+	s.sendTo(client, protocol.Message{
+		Type:    protocol.MessageTypeText,
+		Sender:  serverSender,
+		Content: content,
+	})
+}
+
+// sendTo queues msg for client alone.
+func (s *Server) sendTo(client *Client, msg protocol.Message) {
+	data, err := msg.Encode()
+	if err != nil {
+		client.log().Error("Failed to encode message", "type", msg.Type, "error", err)
+		return
+	}
+	select {
+	case client.outgoing <- data:
+	default:
+		s.metrics.droppedMessages.Add(1)
+		client.log().Warn("Client channel full, skipping")
+	}
+}
+
+// acknowledge tells client whether msg was accepted: an ACK carrying msg's ID
+// if reason is empty, otherwise a NACK carrying the reason. Messages without a
+// CorrelationID are not acknowledged.
+func (s *Server) acknowledge(client *Client, msg protocol.Message, reason string) {
+	if msg.CorrelationID == "" {
+		return
+	}
+	ack := protocol.Message{
+		Type:          protocol.MessageTypeAck,
+		CorrelationID: msg.CorrelationID,
+		ID:            msg.ID,
+	}
+	if reason != "" {
+		ack.Type = protocol.MessageTypeNack
+		ack.Content = reason
+	}
+	s.sendTo(client, ack)
+}
+
 // handleClient handles a single client connection
 func (s *Server) handleClient(client *Client) {
+	writerDone := make(chan struct{})
 	defer s.wg.Done()
 	defer func() {
-		close(client.outgoing) // Close channel before removing client
+		// Other goroutines only send to clients they find in s.clients under
+		// s.mu, so once the client is removed, none can send on outgoing
+		// after it is closed.
 		s.mu.Lock()
 		delete(s.clients, client)
 		s.mu.Unlock()
+		close(client.outgoing)
+		if client.name() != "" {
+			s.updatePresence()
+		}
+		// Give the writer a moment to send what is queued, such as a NACK
+		// saying why the client is being disconnected.
+		select {
+		case <-writerDone:
+		case <-time.After(flushTimeout):
+		}
 		if err := client.conn.Close(); err != nil {
-			log.Printf("Error closing client connection: %v", err)
+			client.log().Debug("Error closing client connection", "error", err)
 		}
+		client.log().Info("Client disconnected")
 	}()
 
 	// Start goroutine to send messages to client
 	s.wg.Add(1)
 	go func() {
 		defer s.wg.Done()
-		for data := range client.outgoing {
-			if _, err := client.conn.Write(data); err != nil {
-				log.Printf("Failed to send message to client: %v", err)
+		defer close(writerDone)
+		for {
+			var data []byte
+			select {
+			case queued, ok := <-client.outgoing:
+				if !ok {
+					return
+				}
+				data = queued
+			case data = <-client.datagrams:
+				if s.writeDatagram(client, data) {
+					continue
+				}
+			}
+			n, err := client.conn.Write(data)
+			s.metrics.bytesSent.Add(uint64(n))
+			if err != nil {
+				client.log().Warn("Failed to send message to client", "error", err)
 				return
 			}
 		}
 	}()
 
+	s.wg.Add(1)
+	go s.readDatagrams(client)
+
 	// Read messages from client
-	buf := make([]byte, 4096)
 	for {
-		n, err := client.conn.Read(buf)
+		data, err := client.conn.ReadMessage()
 		if err != nil {
 			if err != io.EOF {
-				log.Printf("Error reading from client: %v", err)
+				client.log().Warn("Error reading from client", "error", err)
 			}
 			return
 		}
 
-		if n > 0 {
-			// Decode message
-			var msg protocol.Message
-			if err := msg.Decode(buf[:n]); err != nil {
-				log.Printf("Failed to decode message: %v", err)
-				continue
+		s.metrics.bytesReceived.Add(uint64(len(data)))
+
+		// Decode message
+		var msg protocol.Message
+		if err := msg.Decode(data); err != nil {
+			s.metrics.decodeFailures.Add(1)
+			client.log().Warn("Failed to decode message", "error", err)
+			continue
+		}
+		s.metrics.messagesReceived.inc(msg.Type.String())
+
+		if client.peerName() != "" {
+			if !s.handlePeerMessage(client, msg) {
+				return
 			}
+			continue
+		}
 
-			// Handle different message types
-			switch msg.Type {
-			case protocol.MessageTypeJoin:
-				client.username = msg.Sender
-				log.Printf("User %s joined", msg.Sender)
-				s.broadcast(buf[:n], client)
-			case protocol.MessageTypeLeave:
-				log.Printf("User %s left", msg.Sender)
-				s.broadcast(buf[:n], client)
+		// Handle different message types
+		switch msg.Type {
+		case protocol.MessageTypeJoin:
+			// A client joins once, so it cannot take on another user's name
+			// and, with it, the right to change their messages.
+			if client.name() != "" {
+				client.log().Warn("Second JOIN, rejecting", "new_username", msg.Sender)
+				s.acknowledge(client, msg, "already joined")
+				continue
+			}
+			if s.currentBans().matchesUsername(msg.Sender) {
+				client.log().Info("Banned user rejected", "username", msg.Sender)
+				s.acknowledge(client, msg, "banned")
+				return
+			}
+			if federatedSender(msg.Sender) {
+				// Names with @ are how users of federated servers appear.
+				client.log().Info("Username reserved for federated users, rejecting",
+					"username", msg.Sender)
+				s.acknowledge(client, msg, "username reserved for federated users")
+				return
+			}
+			operator, ok := s.authenticateOperator(msg.Sender, msg.Content)
+			if !ok {
+				client.log().Warn("Wrong operator password, rejecting", "username", msg.Sender)
+				s.acknowledge(client, msg, "wrong password")
+				return
+			}
+			// The name is only taken once the JOIN is accepted.
+			client.setName(msg.Sender)
+			client.setOperator(operator)
+			if msg.Content != "" {
+				// The password must not reach anyone else.
+				msg.Content = ""
+				if data, err = msg.Encode(); err != nil {
+					client.log().Error("Failed to encode message", "error", err)
+					return
+				}
+			}
+			client.log().Info("User joined", "operator", operator)
+			missed := s.mentions.take(msg.Sender)
+			directs := s.directs.take(msg.Sender, time.Now())
+			s.publish(data, msg, client)
+			s.acknowledge(client, msg, "")
+			s.updatePresence()
+			if motd := s.currentMOTD(); motd != "" {
+				s.sendServerMessage(client, motd)
+			}
+			for _, mention := range missed {
+				s.sendTo(client, mention)
+			}
+			for _, direct := range directs {
+				s.sendTo(client, direct)
+			}
+		case protocol.MessageTypeLeave:
+			client.log().Info("User left")
+			s.publish(data, msg, client)
+			return
+		case protocol.MessageTypeText:
+			if client.name() == "" {
+				s.acknowledge(client, msg, "not joined")
+				continue
+			}
+			if s.tooLong(msg.Content) {
+				client.log().Warn("Message too long, dropping", "length", len(msg.Content))
+				s.acknowledge(client, msg, "message too long")
+				continue
+			}
+			if msg.ParentID != "" && !s.attachReply(&msg) {
+				s.acknowledge(client, msg, "unknown parent")
+				continue
+			}
+			// The ID is assigned here and reaches the sender in the ACK.
+			// Messages are attributed to the joined username, which is who
+			// may later edit or delete them.
+			msg.ID = newMessageID()
+			msg.Sender = client.name()
+			msg.Mentions = s.resolveMentions(msg.Content, "")
+			if data, err = msg.Encode(); err != nil {
+				client.log().Error("Failed to encode message", "error", err)
+				continue
+			}
+			client.log().Debug("Message received", "sender", msg.Sender, "content", msg.Content)
+			// Clients take a message as the end of its sender's typing.
+			client.setTyping(false)
+			s.publish(data, msg, client)
+			s.acknowledge(client, msg, "")
+		case protocol.MessageTypeEdit, protocol.MessageTypeDelete:
+			s.handleModify(client, msg)
+		case protocol.MessageTypeReaction:
+			s.handleReaction(client, msg)
+		case protocol.MessageTypeThread:
+			s.handleThread(client, msg)
+		case protocol.MessageTypeTyping:
+			s.handleTyping(client, msg)
+		case protocol.MessageTypeRead:
+			s.handleRead(client, msg)
+		case protocol.MessageTypeDirect:
+			s.handleDirect(client, msg)
+		case protocol.MessageTypeFederate:
+			if !s.acceptPeer(client, msg) {
 				return
-			case protocol.MessageTypeText:
-				log.Printf("Message from %s: %s", msg.Sender, msg.Content)
-				s.broadcast(buf[:n], client)
 			}
 		}
 	}
 }
 
-// broadcast sends a message to all clients except the sender
-func (s *Server) broadcast(data []byte, sender *Client) {
+// broadcast sends a message of type msgType to all clients except the sender.
+// Federation links are not clients in this sense and only receive what relay
+// sends them.
+func (s *Server) broadcast(data []byte, msgType protocol.MessageType, sender *Client) {
+	start := time.Now()
+	s.metrics.messagesBroadcast.inc(msgType.String())
+	defer func() {
+		s.metrics.broadcastLatency.observe(time.Since(start))
+	}()
+
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
 	for client := range s.clients {
-		if client != sender {
+		if client != sender && client.peerName() == "" {
+			queue := client.outgoing
+			if msgType.Ephemeral() {
+				queue = client.datagrams
+			}
 			select {
-			case client.outgoing <- data:
+			case queue <- data:
 			default:
 				// Channel is full, skip this client
-				log.Printf("Client channel full, skipping")
+				s.metrics.droppedMessages.Add(1)
+				client.log().Warn("Client channel full, skipping")
 			}
 		}
 	}
@@ -1,10 +1,27 @@
 package server_test
 
 import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
 	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/omochice/toy-socket-chat/internal/devcert"
 	"github.com/omochice/toy-socket-chat/internal/server"
 	"github.com/omochice/toy-socket-chat/pkg/protocol"
 )
@@ -71,7 +88,7 @@ func TestServer_ClientConnection(t *testing.T) {
 		t.Fatalf("Failed to encode join message: %v", err)
 	}
 
-	if _, err := conn1.Write(data); err != nil {
+	if err := protocol.WriteFrame(conn1, data); err != nil {
 		t.Fatalf("Failed to send join message: %v", err)
 	}
 
@@ -93,7 +110,7 @@ func TestServer_ClientConnection(t *testing.T) {
 	if err != nil {
 		t.Fatalf("Failed to encode join message for client 2: %v", err)
 	}
-	if _, err := conn2.Write(data2); err != nil {
+	if err := protocol.WriteFrame(conn2, data2); err != nil {
 		t.Fatalf("Failed to send join message from client 2: %v", err)
 	}
 
@@ -145,7 +162,7 @@ func TestServer_MessageBroadcast(t *testing.T) {
 		t.Fatalf("Failed to encode text message: %v", err)
 	}
 
-	if _, err := conn1.Write(data); err != nil {
+	if err := protocol.WriteFrame(conn1, data); err != nil {
 		t.Fatalf("Failed to send text message: %v", err)
 	}
 
@@ -178,3 +195,2016 @@ func TestServer_Stop(t *testing.T) {
 		t.Error("Server did not stop in time")
 	}
 }
+
+// upgradeStatus sends a WebSocket upgrade request carrying origin to addr and
+// returns the HTTP status code of the server's response.
+func upgradeStatus(t *testing.T, addr, origin string) int {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	req, err := http.NewRequest(http.MethodGet, "http://chat.example.com/", nil)
+	if err != nil {
+		t.Fatalf("Failed to build request: %v", err)
+	}
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	if origin != "" {
+		req.Header.Set("Origin", origin)
+	}
+	if err := req.Write(conn); err != nil {
+		t.Fatalf("Failed to write request: %v", err)
+	}
+
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		t.Fatalf("Failed to read response: %v", err)
+	}
+	_ = resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestServer_WebSocketOriginPolicy(t *testing.T) {
+	tests := []struct {
+		name   string
+		opts   []server.Option
+		origin string
+		want   int
+	}{
+		{
+			name: "no origin header is allowed",
+			want: http.StatusSwitchingProtocols,
+		},
+		{
+			name:   "same origin is allowed by default",
+			origin: "http://chat.example.com",
+			want:   http.StatusSwitchingProtocols,
+		},
+		{
+			name:   "same origin with its default port is allowed",
+			origin: "http://chat.example.com:80",
+			want:   http.StatusSwitchingProtocols,
+		},
+		{
+			name:   "foreign origin is rejected by default",
+			origin: "https://evil.example.net",
+			want:   http.StatusForbidden,
+		},
+		{
+			name:   "exact origin match",
+			opts:   []server.Option{server.WithAllowedOrigins("https://app.example.org")},
+			origin: "https://app.example.org",
+			want:   http.StatusSwitchingProtocols,
+		},
+		{
+			name:   "wildcard subdomain match",
+			opts:   []server.Option{server.WithAllowedOrigins("https://*.example.org")},
+			origin: "https://team.example.org",
+			want:   http.StatusSwitchingProtocols,
+		},
+		{
+			name:   "wildcard does not match apex",
+			opts:   []server.Option{server.WithAllowedOrigins("https://*.example.org")},
+			origin: "https://example.org",
+			want:   http.StatusForbidden,
+		},
+		{
+			name: "callback decides",
+			opts: []server.Option{server.WithOriginCheck(func(r *http.Request) bool {
+				return r.Header.Get("Origin") == "null"
+			})},
+			origin: "null",
+			want:   http.StatusSwitchingProtocols,
+		},
+		{
+			name: "allowed host",
+			opts: []server.Option{server.WithAllowedHosts("*.example.com")},
+			want: http.StatusSwitchingProtocols,
+		},
+		{
+			name:   "host not in the allowlist is rejected",
+			opts:   []server.Option{server.WithAllowedHosts("localhost")},
+			origin: "http://chat.example.com",
+			want:   http.StatusForbidden,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := server.New(":0", tt.opts...)
+			go func() {
+				_ = srv.Start()
+			}()
+			defer srv.Stop()
+
+			time.Sleep(100 * time.Millisecond)
+
+			if got := upgradeStatus(t, srv.Addr(), tt.origin); got != tt.want {
+				t.Errorf("upgrade status = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestServer_ServesWebClient(t *testing.T) {
+	srv := server.New(":0")
+	go func() {
+		_ = srv.Start()
+	}()
+	defer srv.Stop()
+
+	time.Sleep(100 * time.Millisecond)
+
+	tests := []struct {
+		path        string
+		wantStatus  int
+		wantContent string
+	}{
+		{path: "/", wantStatus: http.StatusOK, wantContent: "text/html"},
+		{path: "/app.js", wantStatus: http.StatusOK, wantContent: "javascript"},
+		{path: "/config.json", wantStatus: http.StatusOK, wantContent: "application/json"},
+		{path: "/missing", wantStatus: http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			resp, err := http.Get("http://" + srv.Addr() + tt.path)
+			if err != nil {
+				t.Fatalf("GET %s failed: %v", tt.path, err)
+			}
+			_ = resp.Body.Close()
+
+			if resp.StatusCode != tt.wantStatus {
+				t.Errorf("GET %s status = %d, want %d", tt.path, resp.StatusCode, tt.wantStatus)
+			}
+			if ct := resp.Header.Get("Content-Type"); !strings.Contains(ct, tt.wantContent) {
+				t.Errorf(
+					"GET %s Content-Type = %q, want it to contain %q",
+					tt.path,
+					ct,
+					tt.wantContent,
+				)
+			}
+		})
+	}
+}
+
+func TestServer_WebConfig_PinsDevelopmentCertificate(t *testing.T) {
+	cert, _, err := devcert.Generate([]string{"localhost", "127.0.0.1"})
+	if err != nil {
+		t.Fatalf("Failed to generate certificate: %v", err)
+	}
+	srv := server.New(":0", server.WithTLS(cert))
+	go func() {
+		_ = srv.Start()
+	}()
+	defer srv.Stop()
+
+	time.Sleep(100 * time.Millisecond)
+
+	resp, err := http.Get("http://" + srv.Addr() + "/config.json")
+	if err != nil {
+		t.Fatalf("GET /config.json failed: %v", err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	var cfg struct {
+		WebTransport    bool   `json:"webTransport"`
+		CertificateHash string `json:"certificateHash"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&cfg); err != nil {
+		t.Fatalf("Failed to decode config: %v", err)
+	}
+	if !cfg.WebTransport {
+		t.Error("webTransport = false, want true")
+	}
+	if want := devcert.Fingerprint(cert); cfg.CertificateHash != want {
+		t.Errorf("certificateHash = %q, want %q", cfg.CertificateHash, want)
+	}
+}
+
+func TestServer_StartFailureReleasesListeners(t *testing.T) {
+	taken, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer func() { _ = taken.Close() }()
+
+	// The chat port is bound before the admin API fails to bind.
+	srv := server.New("127.0.0.1:0", server.WithAdmin(taken.Addr().String()))
+	if err := srv.Start(); err == nil {
+		t.Fatal("Start() with the admin address in use succeeded, want an error")
+	}
+	addr := srv.Addr()
+	if conn, err := net.Dial("tcp", addr); err == nil {
+		_ = conn.Close()
+		t.Errorf("Chat listener %s still accepts connections after Start failed", addr)
+	}
+	srv.Stop()
+}
+
+func TestServer_AdminBroadcastLimit(t *testing.T) {
+	srv := server.New(
+		"127.0.0.1:0",
+		server.WithAdmin("127.0.0.1:0"),
+		server.WithLimits(server.Limits{MaxMessageLength: 10}),
+	)
+	go func() {
+		_ = srv.Start()
+	}()
+	defer srv.Stop()
+	<-srv.Ready()
+
+	for _, tt := range []struct {
+		content string
+		want    int
+	}{
+		{content: "short", want: http.StatusNoContent},
+		{content: "far too long", want: http.StatusRequestEntityTooLarge},
+		{content: strings.Repeat("x", 1<<20), want: http.StatusRequestEntityTooLarge},
+	} {
+		body, err := json.Marshal(map[string]string{"content": tt.content})
+		if err != nil {
+			t.Fatalf("Failed to encode body: %v", err)
+		}
+		resp, err := http.Post(
+			"http://"+srv.AdminAddr()+"/broadcast",
+			"application/json",
+			bytes.NewReader(body),
+		)
+		if err != nil {
+			t.Fatalf("POST /broadcast failed: %v", err)
+		}
+		_ = resp.Body.Close()
+		if resp.StatusCode != tt.want {
+			t.Errorf("POST /broadcast with %d bytes: status = %d, want %d",
+				len(tt.content), resp.StatusCode, tt.want)
+		}
+	}
+}
+
+func TestServer_AdminAPI(t *testing.T) {
+	srv := server.New(":0", server.WithAdmin("127.0.0.1:0"))
+	go func() {
+		_ = srv.Start()
+	}()
+	defer srv.Stop()
+
+	time.Sleep(100 * time.Millisecond)
+
+	admin := "http://" + srv.AdminAddr()
+	for _, path := range []string{"/healthz", "/readyz"} {
+		resp, err := http.Get(admin + path)
+		if err != nil {
+			t.Fatalf("GET %s failed: %v", path, err)
+		}
+		_ = resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("GET %s status = %d, want %d", path, resp.StatusCode, http.StatusOK)
+		}
+	}
+
+	conn, err := net.Dial("tcp", srv.Addr())
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+	joinMsg := protocol.Message{Type: protocol.MessageTypeJoin, Sender: "alice"}
+	data, err := joinMsg.Encode()
+	if err != nil {
+		t.Fatalf("Failed to encode join message: %v", err)
+	}
+	if err := protocol.WriteFrame(conn, data); err != nil {
+		t.Fatalf("Failed to send join message: %v", err)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+
+	resp, err := http.Get(admin + "/clients")
+	if err != nil {
+		t.Fatalf("GET /clients failed: %v", err)
+	}
+	var clients []struct {
+		ID        uint64 `json:"id"`
+		Username  string `json:"username"`
+		Transport string `json:"transport"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&clients); err != nil {
+		t.Fatalf("Failed to decode /clients: %v", err)
+	}
+	_ = resp.Body.Close()
+	if len(clients) != 1 || clients[0].Username != "alice" || clients[0].Transport != "tcp" {
+		t.Fatalf("GET /clients = %+v, want one tcp client named alice", clients)
+	}
+
+	resp, err = http.Post(
+		admin+"/broadcast",
+		"application/json",
+		strings.NewReader(`{"content":"maintenance soon"}`),
+	)
+	if err != nil {
+		t.Fatalf("POST /broadcast failed: %v", err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Errorf("POST /broadcast status = %d, want %d", resp.StatusCode, http.StatusNoContent)
+	}
+
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	data, err = protocol.ReadFrame(conn)
+	if err != nil {
+		t.Fatalf("Failed to read notice: %v", err)
+	}
+	var notice protocol.Message
+	if err := notice.Decode(data); err != nil {
+		t.Fatalf("Failed to decode notice: %v", err)
+	}
+	if notice.Content != "maintenance soon" {
+		t.Errorf("notice content = %q, want %q", notice.Content, "maintenance soon")
+	}
+
+	resp, err = http.Post(
+		fmt.Sprintf("%s/clients/%d/disconnect", admin, clients[0].ID),
+		"",
+		nil,
+	)
+	if err != nil {
+		t.Fatalf("POST disconnect failed: %v", err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Errorf("POST disconnect status = %d, want %d", resp.StatusCode, http.StatusNoContent)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+
+	if count := srv.ClientCount(); count != 0 {
+		t.Errorf("Expected 0 clients after disconnect, got %d", count)
+	}
+}
+
+func TestServer_AdminPresence(t *testing.T) {
+	srv := server.New(":0", server.WithAdmin("127.0.0.1:0"))
+	go func() {
+		_ = srv.Start()
+	}()
+	defer srv.Stop()
+	<-srv.Ready()
+
+	dialAndJoin(t, srv.Addr(), "bob")
+	dialAndJoin(t, srv.Addr(), "alice")
+	time.Sleep(100 * time.Millisecond)
+
+	resp, err := http.Get("http://" + srv.AdminAddr() + "/presence")
+	if err != nil {
+		t.Fatalf("GET /presence failed: %v", err)
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	var presence []struct {
+		Node  string   `json:"node"`
+		Users []string `json:"users"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&presence); err != nil {
+		t.Fatalf("Failed to decode /presence: %v", err)
+	}
+	if len(presence) != 1 || presence[0].Node != server.LocalNode ||
+		!slices.Equal(presence[0].Users, []string{"alice", "bob"}) {
+		t.Errorf("GET /presence = %+v, want alice and bob on the local node", presence)
+	}
+}
+
+func TestServer_Metrics(t *testing.T) {
+	srv := server.New(":0", server.WithMetrics("127.0.0.1:0"))
+	go func() {
+		_ = srv.Start()
+	}()
+	defer srv.Stop()
+
+	time.Sleep(100 * time.Millisecond)
+
+	conn, err := net.Dial("tcp", srv.Addr())
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+	joinMsg := protocol.Message{Type: protocol.MessageTypeJoin, Sender: "alice"}
+	data, err := joinMsg.Encode()
+	if err != nil {
+		t.Fatalf("Failed to encode join message: %v", err)
+	}
+	if err := protocol.WriteFrame(conn, data); err != nil {
+		t.Fatalf("Failed to send join message: %v", err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if err := protocol.WriteFrame(conn, []byte{0xff, 0xff, 0xff}); err != nil {
+		t.Fatalf("Failed to send garbage: %v", err)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+
+	resp, err := http.Get("http://" + srv.MetricsAddr() + "/metrics")
+	if err != nil {
+		t.Fatalf("GET /metrics failed: %v", err)
+	}
+	body, err := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if err != nil {
+		t.Fatalf("Failed to read /metrics: %v", err)
+	}
+
+	for _, want := range []string{
+		"chat_clients 1\n",
+		`chat_connections_total{transport="tcp"} 1` + "\n",
+		`chat_messages_received_total{type="JOIN"} 1` + "\n",
+		`chat_messages_broadcast_total{type="JOIN"} 1` + "\n",
+		"chat_decode_failures_total 1\n",
+		`chat_broadcast_duration_seconds_bucket{le="+Inf"} 1` + "\n",
+		"chat_broadcast_duration_seconds_count 1\n",
+	} {
+		if !strings.Contains(string(body), want) {
+			t.Errorf("/metrics is missing %q\n%s", want, body)
+		}
+	}
+}
+
+// syncBuffer is a bytes.Buffer safe for the concurrent writes of a logger
+// shared by several server goroutines.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestServer_WithLogger_OmitsContentAboveDebug(t *testing.T) {
+	var out syncBuffer
+	logger := slog.New(slog.NewTextHandler(&out, &slog.HandlerOptions{Level: slog.LevelInfo}))
+
+	srv := server.New(":0", server.WithLogger(logger))
+	go func() {
+		_ = srv.Start()
+	}()
+	defer srv.Stop()
+
+	time.Sleep(100 * time.Millisecond)
+
+	conn, err := net.Dial("tcp", srv.Addr())
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	for _, msg := range []protocol.Message{
+		{Type: protocol.MessageTypeJoin, Sender: "alice"},
+		{Type: protocol.MessageTypeText, Sender: "alice", Content: "top secret"},
+	} {
+		data, err := msg.Encode()
+		if err != nil {
+			t.Fatalf("Failed to encode message: %v", err)
+		}
+		if err := protocol.WriteFrame(conn, data); err != nil {
+			t.Fatalf("Failed to send message: %v", err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	logs := out.String()
+	if !strings.Contains(logs, "client_id=1") || !strings.Contains(logs, "username=alice") {
+		t.Errorf("Expected structured client attributes in logs, got:\n%s", logs)
+	}
+	if strings.Contains(logs, "top secret") {
+		t.Errorf("Message content logged at info level:\n%s", logs)
+	}
+}
+
+// dialAndJoin connects to addr over TCP and sends a JOIN as username.
+func dialAndJoin(t *testing.T, addr, username string) net.Conn {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	t.Cleanup(func() {
+		_ = conn.Close()
+	})
+	join(t, conn, username)
+	return conn
+}
+
+// join sends a JOIN message for username on conn.
+func join(t *testing.T, conn net.Conn, username string) {
+	t.Helper()
+
+	joinMsg := protocol.Message{Type: protocol.MessageTypeJoin, Sender: username}
+	data, err := joinMsg.Encode()
+	if err != nil {
+		t.Fatalf("Failed to encode join message: %v", err)
+	}
+	if err := protocol.WriteFrame(conn, data); err != nil {
+		t.Fatalf("Failed to send join message: %v", err)
+	}
+}
+
+// readMessage reads and decodes one message from conn, failing after a second.
+func readMessage(t *testing.T, conn net.Conn) protocol.Message {
+	t.Helper()
+
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	data, err := protocol.ReadFrame(conn)
+	if err != nil {
+		t.Fatalf("Failed to read message: %v", err)
+	}
+	var msg protocol.Message
+	if err := msg.Decode(data); err != nil {
+		t.Fatalf("Failed to decode message: %v", err)
+	}
+	return msg
+}
+
+func TestServer_MOTDSentAfterJoin(t *testing.T) {
+	srv := server.New(":0", server.WithMOTD("Welcome!"))
+	go func() {
+		_ = srv.Start()
+	}()
+	defer srv.Stop()
+
+	time.Sleep(100 * time.Millisecond)
+
+	conn := dialAndJoin(t, srv.Addr(), "alice")
+	if msg := readMessage(t, conn); msg.Sender != "server" || msg.Content != "Welcome!" {
+		t.Errorf("Received %q from %q, want MOTD from server", msg.Content, msg.Sender)
+	}
+
+	srv.SetMOTD("Changed")
+	conn = dialAndJoin(t, srv.Addr(), "bob")
+	if msg := readMessage(t, conn); msg.Content != "Changed" {
+		t.Errorf("Received %q, want updated MOTD", msg.Content)
+	}
+}
+
+func TestServer_SetBans_DisconnectsOnlyBannedClients(t *testing.T) {
+	srv := server.New(":0")
+	go func() {
+		_ = srv.Start()
+	}()
+	defer srv.Stop()
+
+	time.Sleep(100 * time.Millisecond)
+
+	dialAndJoin(t, srv.Addr(), "alice")
+	dialAndJoin(t, srv.Addr(), "mallory")
+	time.Sleep(100 * time.Millisecond)
+
+	srv.SetBans(server.Bans{Usernames: []string{"mallory"}})
+	time.Sleep(100 * time.Millisecond)
+
+	if count := srv.ClientCount(); count != 1 {
+		t.Fatalf("Expected 1 client after ban, got %d", count)
+	}
+
+	// A banned user that joins later is rejected as well.
+	dialAndJoin(t, srv.Addr(), "mallory")
+	time.Sleep(100 * time.Millisecond)
+	if count := srv.ClientCount(); count != 1 {
+		t.Errorf("Expected banned user to be rejected on join, got %d clients", count)
+	}
+}
+
+func TestServer_Limits_MaxClients(t *testing.T) {
+	srv := server.New(":0", server.WithLimits(server.Limits{MaxClients: 1}))
+	go func() {
+		_ = srv.Start()
+	}()
+	defer srv.Stop()
+
+	time.Sleep(100 * time.Millisecond)
+
+	dialAndJoin(t, srv.Addr(), "alice")
+	time.Sleep(100 * time.Millisecond)
+	dialAndJoin(t, srv.Addr(), "bob")
+	time.Sleep(100 * time.Millisecond)
+
+	if count := srv.ClientCount(); count != 1 {
+		t.Errorf("Expected MaxClients to cap clients at 1, got %d", count)
+	}
+}
+
+func TestServer_MultipleListeners(t *testing.T) {
+	srv := server.New(
+		"",
+		server.WithListeners(
+			server.Listener{
+				Address:    "127.0.0.1:0",
+				Transports: []server.Transport{server.TransportTCP},
+			},
+			server.Listener{
+				Network: "tcp4",
+				Address: "127.0.0.1:0",
+			},
+			server.Listener{
+				Address:    "127.0.0.1:0",
+				Transports: []server.Transport{server.TransportWebSocket},
+			},
+		),
+	)
+	go func() {
+		_ = srv.Start()
+	}()
+	defer srv.Stop()
+
+	time.Sleep(100 * time.Millisecond)
+
+	addrs := srv.Addrs()
+	if len(addrs) != 3 {
+		t.Fatalf("Addrs() = %v, want 3 addresses", addrs)
+	}
+	if srv.Addr() != addrs[0] {
+		t.Errorf("Addr() = %q, want first listener %q", srv.Addr(), addrs[0])
+	}
+
+	// Clients on different listeners share one chat.
+	alice := dialAndJoin(t, addrs[0], "alice")
+	time.Sleep(50 * time.Millisecond)
+	dialAndJoin(t, addrs[1], "bob")
+	if msg := readMessage(t, alice); msg.Type != protocol.MessageTypeJoin || msg.Sender != "bob" {
+		t.Errorf("alice received %+v, want bob's JOIN", msg)
+	}
+
+	// A WebSocket-only listener closes raw TCP clients but serves browsers.
+	carol := dialAndJoin(t, addrs[2], "carol")
+	_ = carol.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := carol.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("Read on WebSocket-only listener error = %v, want EOF", err)
+	}
+	resp, err := http.Get("http://" + addrs[2] + "/")
+	if err != nil {
+		t.Fatalf("GET / on WebSocket-only listener failed: %v", err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("GET / status = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+
+	// A TCP-only listener does not serve the web client.
+	if _, err := http.Get("http://" + addrs[0] + "/"); err == nil {
+		t.Error("GET / on TCP-only listener succeeded, want connection closed")
+	}
+}
+
+func TestListener_Validate(t *testing.T) {
+	tests := []struct {
+		name     string
+		listener server.Listener
+		wantErr  bool
+	}{
+		{
+			name:     "default network",
+			listener: server.Listener{Address: ":8080"},
+		},
+		{
+			name: "WebTransport on UDP",
+			listener: server.Listener{
+				Network:    "udp6",
+				Address:    "[::1]:8443",
+				Transports: []server.Transport{server.TransportWebTransport},
+			},
+		},
+		{
+			name:     "missing address",
+			listener: server.Listener{},
+			wantErr:  true,
+		},
+		{
+			name:     "unknown network",
+			listener: server.Listener{Network: "sctp", Address: ":8080"},
+			wantErr:  true,
+		},
+		{
+			name: "WebTransport on TCP",
+			listener: server.Listener{
+				Address:    ":8080",
+				Transports: []server.Transport{server.TransportWebTransport},
+			},
+			wantErr: true,
+		},
+		{
+			name: "WebSocket on UDP",
+			listener: server.Listener{
+				Network:    "udp",
+				Address:    ":8080",
+				Transports: []server.Transport{server.TransportWebSocket},
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.listener.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestServer_UnixListener(t *testing.T) {
+	socketPath := filepath.Join(t.TempDir(), "chat.sock")
+
+	// Leave a stale socket file behind, as a crashed server would.
+	stale, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Fatalf("Failed to create stale socket: %v", err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	_ = stale.Close()
+
+	unixListener := server.Listener{Network: "unix", Address: socketPath, Mode: 0o600}
+	srv := server.New("", server.WithListeners(unixListener))
+	go func() {
+		_ = srv.Start()
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+
+	info, err := os.Stat(socketPath)
+	if err != nil {
+		t.Fatalf("Socket file missing: %v", err)
+	}
+	if perm := info.Mode().Perm(); perm != 0o600 {
+		t.Errorf("Socket permissions = %o, want 600", perm)
+	}
+
+	// Raw protobuf clients work over the socket just as over TCP.
+	alice, err := net.Dial("unix", socketPath)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer func() { _ = alice.Close() }()
+	join(t, alice, "alice")
+	time.Sleep(50 * time.Millisecond)
+	if count := srv.ClientCount(); count != 1 {
+		t.Errorf("ClientCount() = %d, want 1", count)
+	}
+
+	// A socket that is in use is not treated as stale.
+	second := server.New("", server.WithListeners(unixListener))
+	if err := second.Start(); err == nil {
+		second.Stop()
+		t.Error("Start() on a socket in use succeeded, want an error")
+	}
+
+	srv.Stop()
+	if _, err := os.Stat(socketPath); !os.IsNotExist(err) {
+		t.Errorf("Socket file still exists after Stop: %v", err)
+	}
+}
+
+func TestServer_InheritedSocket(t *testing.T) {
+	// An already-bound socket, as systemd socket activation would pass in.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+
+	srv := server.New("", server.WithListeners(server.Listener{StreamSocket: ln}))
+	select {
+	case <-srv.Ready():
+		t.Fatal("Ready() closed before Start")
+	default:
+	}
+	go func() {
+		_ = srv.Start()
+	}()
+	defer srv.Stop()
+
+	select {
+	case <-srv.Ready():
+	case <-time.After(time.Second):
+		t.Fatal("Ready() not closed after Start")
+	}
+	if got := srv.Addr(); got != ln.Addr().String() {
+		t.Errorf("Addr() = %s, want inherited socket address %s", got, ln.Addr())
+	}
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer func() { _ = conn.Close() }()
+	join(t, conn, "alice")
+	time.Sleep(50 * time.Millisecond)
+	if count := srv.ClientCount(); count != 1 {
+		t.Errorf("ClientCount() = %d, want 1", count)
+	}
+}
+
+func TestServer_DrainHandsOverListeners(t *testing.T) {
+	old := server.New("127.0.0.1:0", server.WithAdmin("127.0.0.1:0"))
+	go func() {
+		_ = old.Start()
+	}()
+	<-old.Ready()
+	addr, adminAddr := old.Addr(), old.AdminAddr()
+	alice := dialAndJoin(t, addr, "alice")
+	time.Sleep(50 * time.Millisecond)
+
+	// Hand the sockets to a second server, as a new process would receive
+	// them.
+	listeners, files, err := old.ListenerFiles()
+	if err != nil {
+		t.Fatalf("ListenerFiles() error = %v", err)
+	}
+	for i, f := range files {
+		ln, err := net.FileListener(f)
+		_ = f.Close()
+		if err != nil {
+			t.Fatalf("Failed to open listener file: %v", err)
+		}
+		listeners[i].StreamSocket = ln
+	}
+	httpFiles, err := old.HTTPListenerFiles()
+	if err != nil {
+		t.Fatalf("HTTPListenerFiles() error = %v", err)
+	}
+	httpSockets := make(map[string]net.Listener)
+	for a, f := range httpFiles {
+		ln, err := net.FileListener(f)
+		_ = f.Close()
+		if err != nil {
+			t.Fatalf("Failed to open listener file: %v", err)
+		}
+		httpSockets[a] = ln
+	}
+	next := server.New(
+		"",
+		server.WithListeners(listeners...),
+		server.WithAdmin("127.0.0.1:0"),
+		server.WithHTTPSockets(httpSockets),
+	)
+	go func() {
+		_ = next.Start()
+	}()
+	defer next.Stop()
+	<-next.Ready()
+
+	drained := make(chan struct{})
+	go func() {
+		old.Drain(2 * time.Second)
+		close(drained)
+	}()
+
+	if msg := readMessage(t, alice); msg.Type != protocol.MessageTypeReconnect {
+		t.Fatalf("Received %v, want RECONNECT", msg.Type)
+	}
+	_ = alice.Close()
+
+	// Reconnecting to the same address reaches the new server, and the old
+	// one finishes draining once its last client has left.
+	dialAndJoin(t, addr, "alice")
+	select {
+	case <-drained:
+	case <-time.After(time.Second):
+		t.Fatal("Drain did not return after the last client left")
+	}
+	time.Sleep(50 * time.Millisecond)
+	if count := next.ClientCount(); count != 1 {
+		t.Errorf("New server ClientCount() = %d, want 1", count)
+	}
+	if got := next.AdminAddr(); got != adminAddr {
+		t.Errorf("New server AdminAddr() = %s, want inherited %s", got, adminAddr)
+	}
+	resp, err := http.Get("http://" + adminAddr + "/healthz")
+	if err != nil {
+		t.Fatalf("Admin API unreachable after handover: %v", err)
+	}
+	_ = resp.Body.Close()
+}
+
+// clientAddrs returns the remote address of each connected client, keyed by
+// transport, as reported by the admin API.
+func clientAddrs(t *testing.T, adminAddr string) map[string]string {
+	t.Helper()
+
+	resp, err := http.Get("http://" + adminAddr + "/clients")
+	if err != nil {
+		t.Fatalf("GET /clients failed: %v", err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	var clients []struct {
+		Transport  string `json:"transport"`
+		RemoteAddr string `json:"remoteAddr"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&clients); err != nil {
+		t.Fatalf("Failed to decode clients: %v", err)
+	}
+	addrs := make(map[string]string)
+	for _, c := range clients {
+		addrs[c.Transport] = c.RemoteAddr
+	}
+	return addrs
+}
+
+func TestServer_TrustedProxies(t *testing.T) {
+	// wantTCP is empty when the TCP client is dropped: from an untrusted
+	// peer, the PROXY header is read as the length of an oversized frame.
+	tests := []struct {
+		name       string
+		opts       []server.Option
+		wantTCP    string
+		wantWSHost string
+	}{
+		{
+			name: "trusted",
+			opts: []server.Option{
+				server.WithTrustedProxies(netip.MustParsePrefix("127.0.0.0/8")),
+			},
+			wantTCP:    "192.0.2.1:56324",
+			wantWSHost: "203.0.113.9",
+		},
+		{
+			name:       "untrusted",
+			wantWSHost: "127.0.0.1",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := append([]server.Option{server.WithAdmin("127.0.0.1:0")}, tt.opts...)
+			srv := server.New("127.0.0.1:0", opts...)
+			go func() {
+				_ = srv.Start()
+			}()
+			defer srv.Stop()
+
+			time.Sleep(100 * time.Millisecond)
+
+			// A TCP client behind a load balancer speaking PROXY protocol v1.
+			conn, err := net.Dial("tcp", srv.Addr())
+			if err != nil {
+				t.Fatalf("Failed to connect: %v", err)
+			}
+			defer func() { _ = conn.Close() }()
+			header := "PROXY TCP4 192.0.2.1 198.51.100.1 56324 8080\r\n"
+			if _, err := conn.Write([]byte(header)); err != nil {
+				t.Fatalf("Failed to send PROXY header: %v", err)
+			}
+			join(t, conn, "alice")
+
+			// A WebSocket client behind an HTTP proxy setting X-Forwarded-For.
+			ws, err := net.Dial("tcp", srv.Addr())
+			if err != nil {
+				t.Fatalf("Failed to connect: %v", err)
+			}
+			defer func() { _ = ws.Close() }()
+			req, err := http.NewRequest(http.MethodGet, "http://"+srv.Addr()+"/", nil)
+			if err != nil {
+				t.Fatalf("Failed to build request: %v", err)
+			}
+			req.Header.Set("Upgrade", "websocket")
+			req.Header.Set("Connection", "Upgrade")
+			req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+			req.Header.Set("Sec-WebSocket-Version", "13")
+			req.Header.Set("X-Forwarded-For", "203.0.113.9")
+			if err := req.Write(ws); err != nil {
+				t.Fatalf("Failed to write request: %v", err)
+			}
+
+			time.Sleep(100 * time.Millisecond)
+
+			addrs := clientAddrs(t, srv.AdminAddr())
+			got, connected := addrs["tcp"]
+			if tt.wantTCP == "" && connected {
+				t.Errorf("TCP client address = %q, want the client dropped", got)
+			}
+			if tt.wantTCP != "" && !strings.HasPrefix(got, tt.wantTCP) {
+				t.Errorf("TCP client address = %q, want %q", got, tt.wantTCP)
+			}
+			if got := addrs["websocket"]; !strings.HasPrefix(got, tt.wantWSHost+":") {
+				t.Errorf("WebSocket client address = %q, want host %q", got, tt.wantWSHost)
+			}
+		})
+	}
+}
+
+func TestServer_TrustedProxies_TLS(t *testing.T) {
+	cert, _, err := devcert.Generate([]string{"localhost", "127.0.0.1"})
+	if err != nil {
+		t.Fatalf("Failed to generate certificate: %v", err)
+	}
+	srv := server.New("",
+		server.WithTLS(cert),
+		server.WithListeners(server.Listener{Address: "127.0.0.1:0", TLS: true}),
+		server.WithTrustedProxies(netip.MustParsePrefix("127.0.0.0/8")),
+		server.WithAdmin("127.0.0.1:0"),
+	)
+	go func() {
+		_ = srv.Start()
+	}()
+	defer srv.Stop()
+	<-srv.Ready()
+
+	// A load balancer passing TLS through sends the PROXY header in the clear,
+	// ahead of the client's ClientHello.
+	raw, err := net.Dial("tcp", srv.Addr())
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer func() { _ = raw.Close() }()
+	header := "PROXY TCP4 192.0.2.1 198.51.100.1 56324 8443\r\n"
+	if _, err := raw.Write([]byte(header)); err != nil {
+		t.Fatalf("Failed to send PROXY header: %v", err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(cert.Leaf)
+	conn := tls.Client(raw, &tls.Config{RootCAs: roots, ServerName: "localhost"})
+	if err := conn.Handshake(); err != nil {
+		t.Fatalf("TLS handshake failed: %v", err)
+	}
+	join(t, conn, "alice")
+
+	time.Sleep(100 * time.Millisecond)
+
+	if got := clientAddrs(t, srv.AdminAddr())["tcp"]; got != "192.0.2.1:56324" {
+		t.Errorf("TCP client address = %q, want %q", got, "192.0.2.1:56324")
+	}
+}
+
+// waitForClients polls until srv has want connections, federation links
+// included, failing after two seconds.
+func waitForClients(t *testing.T, srv *server.Server, want int) {
+	t.Helper()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for srv.ClientCount() != want {
+		if time.Now().After(deadline) {
+			t.Fatalf("ClientCount() = %d, want %d", srv.ClientCount(), want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// startFederated starts a server named name that links to peers.
+func startFederated(t *testing.T, name string, peers ...string) *server.Server {
+	t.Helper()
+
+	return startFederation(t, server.Federation{Name: name, Peers: peers})
+}
+
+// startFederation starts a server federating as f, with the secret and retry
+// interval of these tests and any further options.
+func startFederation(t *testing.T, f server.Federation, opts ...server.Option) *server.Server {
+	t.Helper()
+
+	f.Secret = "s3cret"
+	f.RetryInterval = 50 * time.Millisecond
+	opts = append(opts,
+		server.WithAdmin("127.0.0.1:0"),
+		server.WithFederation(f),
+	)
+	srv := server.New("127.0.0.1:0", opts...)
+	go func() {
+		_ = srv.Start()
+	}()
+	<-srv.Ready()
+	t.Cleanup(srv.Stop)
+	return srv
+}
+
+func TestServer_Federation(t *testing.T) {
+	// Every server links to every other, which must not make messages loop
+	// or arrive twice.
+	a := startFederated(t, "serverA")
+	b := startFederated(t, "serverB", a.Addr())
+	c := startFederated(t, "serverC", a.Addr(), b.Addr())
+	// A server counts a link it dialed once the handshake is done, but one
+	// it accepts as soon as it is dialed, so wait on the dialing side.
+	waitForClients(t, c, 2)
+	waitForClients(t, b, 2)
+
+	alice := dialAndJoin(t, a.Addr(), "alice")
+	carol := dialAndJoin(t, c.Addr(), "carol")
+	if msg := readMessage(t, alice); msg.Type != protocol.MessageTypeJoin ||
+		msg.Sender != "carol@serverC" {
+		t.Fatalf("alice received %s from %q, want JOIN from carol@serverC", msg.Type, msg.Sender)
+	}
+	bob := dialAndJoin(t, b.Addr(), "bob")
+	readMessage(t, alice)
+
+	// A JOIN may cross the federation after a later user has joined, so
+	// bob and carol skip any that arrive late.
+	next := func(conn net.Conn, timeout time.Duration) (protocol.Message, error) {
+		_ = conn.SetReadDeadline(time.Now().Add(timeout))
+		for {
+			data, err := protocol.ReadFrame(conn)
+			if err != nil {
+				return protocol.Message{}, err
+			}
+			var msg protocol.Message
+			if err := msg.Decode(data); err != nil {
+				return protocol.Message{}, err
+			}
+			if msg.Type != protocol.MessageTypeJoin {
+				return msg, nil
+			}
+		}
+	}
+
+	send := protocol.Message{Type: protocol.MessageTypeText, Sender: "alice", Content: "hi"}
+	data, err := send.Encode()
+	if err != nil {
+		t.Fatalf("Failed to encode message: %v", err)
+	}
+	if err := protocol.WriteFrame(alice, data); err != nil {
+		t.Fatalf("Failed to send message: %v", err)
+	}
+	for name, conn := range map[string]net.Conn{"bob": bob, "carol": carol} {
+		msg, err := next(conn, time.Second)
+		if err != nil {
+			t.Fatalf("Failed to read %s's message: %v", name, err)
+		}
+		if msg.Sender != "alice@serverA" || msg.Content != "hi" {
+			t.Errorf(
+				"%s received %q from %q, want hi from alice@serverA",
+				name, msg.Content, msg.Sender,
+			)
+		}
+		if dup, err := next(conn, 200*time.Millisecond); err == nil {
+			t.Errorf("%s received an extra %s from %q", name, dup.Type, dup.Sender)
+		}
+	}
+}
+
+func TestServer_FederationSingleLink(t *testing.T) {
+	// serverA and serverB both dial each other, but keep one link between
+	// them, so nothing is relayed twice.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	a := startFederated(t, "serverA", ln.Addr().String())
+	b := startFederation(t,
+		server.Federation{Name: "serverB", Peers: []string{a.Addr()}},
+		server.WithListeners(server.Listener{StreamSocket: ln}),
+	)
+	waitForClients(t, a, 1)
+	waitForClients(t, b, 1)
+	// Let both ends settle on the link they keep.
+	time.Sleep(200 * time.Millisecond)
+
+	alice := dialAndJoin(t, a.Addr(), "alice")
+	dialAndJoin(t, b.Addr(), "bob")
+	if msg := readMessage(t, alice); msg.Type != protocol.MessageTypeJoin ||
+		msg.Sender != "bob@serverB" {
+		t.Fatalf("alice received %s from %q, want JOIN from bob@serverB", msg.Type, msg.Sender)
+	}
+	_ = alice.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if data, err := protocol.ReadFrame(alice); err == nil {
+		var dup protocol.Message
+		_ = dup.Decode(data)
+		t.Errorf("alice received an extra %s from %q", dup.Type, dup.Sender)
+	}
+}
+
+func TestServer_FederationRelayScopes(t *testing.T) {
+	// serverA only shares chat messages with serverB, in both directions.
+	a := startFederation(t, server.Federation{
+		Name:  "serverA",
+		Relay: map[string][]server.RelayScope{"serverB": {server.RelayMessages}},
+	})
+	b := startFederated(t, "serverB", a.Addr())
+	waitForClients(t, b, 1)
+
+	alice := dialAndJoin(t, a.Addr(), "alice")
+	bob := dialAndJoin(t, b.Addr(), "bob")
+	time.Sleep(100 * time.Millisecond)
+	for name, conn := range map[string]net.Conn{"alice": alice, "bob": bob} {
+		send := protocol.Message{Type: protocol.MessageTypeText, Sender: name, Content: "hi"}
+		data, err := send.Encode()
+		if err != nil {
+			t.Fatalf("Failed to encode message: %v", err)
+		}
+		if err := protocol.WriteFrame(conn, data); err != nil {
+			t.Fatalf("Failed to send message: %v", err)
+		}
+	}
+
+	// Neither side sees the other's JOIN, only its message.
+	if msg := readMessage(t, alice); msg.Type != protocol.MessageTypeText ||
+		msg.Sender != "bob@serverB" {
+		t.Errorf("alice received %s from %q, want TEXT from bob@serverB", msg.Type, msg.Sender)
+	}
+	if msg := readMessage(t, bob); msg.Type != protocol.MessageTypeText ||
+		msg.Sender != "alice@serverA" {
+		t.Errorf("bob received %s from %q, want TEXT from alice@serverA", msg.Type, msg.Sender)
+	}
+}
+
+func TestServer_FederationReconnects(t *testing.T) {
+	a := startFederated(t, "serverA")
+	b := startFederated(t, "serverB", a.Addr())
+	waitForClients(t, b, 1)
+
+	resp, err := http.Get("http://" + a.AdminAddr() + "/clients")
+	if err != nil {
+		t.Fatalf("GET /clients failed: %v", err)
+	}
+	var clients []struct {
+		ID   uint64 `json:"id"`
+		Peer string `json:"peer"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&clients); err != nil {
+		t.Fatalf("Failed to decode /clients: %v", err)
+	}
+	_ = resp.Body.Close()
+	if len(clients) != 1 || clients[0].Peer != "serverB" {
+		t.Fatalf("GET /clients = %+v, want the link from serverB", clients)
+	}
+	resp, err = http.Post(
+		fmt.Sprintf("http://%s/clients/%d/disconnect", a.AdminAddr(), clients[0].ID),
+		"",
+		nil,
+	)
+	if err != nil {
+		t.Fatalf("POST disconnect failed: %v", err)
+	}
+	_ = resp.Body.Close()
+
+	// serverB redials, and messages flow over the new link once serverB,
+	// having dropped the old one, counts it.
+	waitForClients(t, a, 0)
+	waitForClients(t, a, 1)
+	waitForClients(t, b, 1)
+	alice := dialAndJoin(t, a.Addr(), "alice")
+	dialAndJoin(t, b.Addr(), "bob")
+	if msg := readMessage(t, alice); msg.Sender != "bob@serverB" {
+		t.Errorf("alice received %s from %q, want JOIN from bob@serverB", msg.Type, msg.Sender)
+	}
+}
+
+func TestServer_FederationRejects(t *testing.T) {
+	srv := startFederated(t, "serverA")
+
+	tests := []struct {
+		name string
+		msgs []protocol.Message
+	}{
+		{
+			name: "wrong secret",
+			msgs: []protocol.Message{
+				{Type: protocol.MessageTypeFederate, Sender: "serverB", Content: "nonce"},
+				{Type: protocol.MessageTypeFederate, Sender: "serverB", ID: "guess"},
+			},
+		},
+		{
+			name: "own name",
+			msgs: []protocol.Message{
+				{Type: protocol.MessageTypeFederate, Sender: "serverA", Content: "nonce"},
+			},
+		},
+		{
+			name: "joined user",
+			msgs: []protocol.Message{
+				{Type: protocol.MessageTypeJoin, Sender: "mallory"},
+				{Type: protocol.MessageTypeFederate, Sender: "serverB", Content: "nonce"},
+			},
+		},
+		{
+			name: "username reserved for federated users",
+			msgs: []protocol.Message{{Type: protocol.MessageTypeJoin, Sender: "alice@serverB"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, err := net.Dial("tcp", srv.Addr())
+			if err != nil {
+				t.Fatalf("Failed to connect: %v", err)
+			}
+			defer func() {
+				_ = conn.Close()
+			}()
+			for _, msg := range tt.msgs {
+				data, err := msg.Encode()
+				if err != nil {
+					t.Fatalf("Failed to encode message: %v", err)
+				}
+				if err := protocol.WriteFrame(conn, data); err != nil {
+					t.Fatalf("Failed to send message: %v", err)
+				}
+				time.Sleep(50 * time.Millisecond)
+			}
+
+			// The server may have sent its challenge before rejecting.
+			_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+			if _, err := io.Copy(io.Discard, conn); err != nil {
+				t.Errorf("Read() error = %v, want the server to close the connection", err)
+			}
+		})
+	}
+}
+
+func TestServer_FederationHandshake(t *testing.T) {
+	// A stand-in for serverB, which does not know the secret.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer func() {
+		_ = ln.Close()
+	}()
+	startFederated(t, "serverA", ln.Addr().String())
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatalf("Failed to accept: %v", err)
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	_ = conn.SetDeadline(time.Now().Add(time.Second))
+	data, err := protocol.ReadFrame(conn)
+	if err != nil {
+		t.Fatalf("Failed to read the FEDERATE message: %v", err)
+	}
+	if strings.Contains(string(data), "s3cret") {
+		t.Error("The dialing server sent the secret")
+	}
+	var hello protocol.Message
+	if err := hello.Decode(data); err != nil || hello.Type != protocol.MessageTypeFederate ||
+		hello.Content == "" {
+		t.Fatalf("Received %+v, %v, want a FEDERATE message with a nonce", hello, err)
+	}
+
+	// serverA hangs up on a peer that cannot prove it knows the secret.
+	reply := protocol.Message{
+		Type:    protocol.MessageTypeFederate,
+		Sender:  "serverB",
+		Content: "nonce",
+		ID:      "forged",
+	}
+	data, err = reply.Encode()
+	if err != nil {
+		t.Fatalf("Failed to encode message: %v", err)
+	}
+	if err := protocol.WriteFrame(conn, data); err != nil {
+		t.Fatalf("Failed to send message: %v", err)
+	}
+	if _, err := io.Copy(io.Discard, conn); err != nil {
+		t.Errorf("Read() error = %v, want serverA to close the connection", err)
+	}
+}
+
+func TestServer_Acknowledgements(t *testing.T) {
+	srv := server.New("127.0.0.1:0",
+		server.WithLimits(server.Limits{MaxMessageLength: 5}),
+		server.WithBans(server.Bans{Usernames: []string{"mallory"}}),
+	)
+	go func() {
+		_ = srv.Start()
+	}()
+	defer srv.Stop()
+	<-srv.Ready()
+
+	tests := []struct {
+		name       string
+		msg        protocol.Message
+		wantType   protocol.MessageType
+		wantReason string
+	}{
+		{
+			name:     "join",
+			msg:      protocol.Message{Type: protocol.MessageTypeJoin, Sender: "alice"},
+			wantType: protocol.MessageTypeAck,
+		},
+		{
+			name:     "text",
+			msg:      protocol.Message{Type: protocol.MessageTypeText, Content: "hi"},
+			wantType: protocol.MessageTypeAck,
+		},
+		{
+			name:       "text too long",
+			msg:        protocol.Message{Type: protocol.MessageTypeText, Content: "far too long"},
+			wantType:   protocol.MessageTypeNack,
+			wantReason: "message too long",
+		},
+		{
+			name:       "second join",
+			msg:        protocol.Message{Type: protocol.MessageTypeJoin, Sender: "bob"},
+			wantType:   protocol.MessageTypeNack,
+			wantReason: "already joined",
+		},
+	}
+
+	conn, err := net.Dial("tcp", srv.Addr())
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.msg.CorrelationID = fmt.Sprint(i)
+			data, err := tt.msg.Encode()
+			if err != nil {
+				t.Fatalf("Failed to encode message: %v", err)
+			}
+			if err := protocol.WriteFrame(conn, data); err != nil {
+				t.Fatalf("Failed to send message: %v", err)
+			}
+
+			ack := readMessage(t, conn)
+			if ack.Type != tt.wantType || ack.CorrelationID != tt.msg.CorrelationID ||
+				ack.Content != tt.wantReason {
+				t.Errorf(
+					"Received %s %q for %q, want %s %q",
+					ack.Type, ack.Content, ack.CorrelationID, tt.wantType, tt.wantReason,
+				)
+			}
+		})
+	}
+
+	banned, err := net.Dial("tcp", srv.Addr())
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer func() {
+		_ = banned.Close()
+	}()
+	nack := request(t, banned, protocol.Message{Type: protocol.MessageTypeJoin, Sender: "mallory"})
+	if nack.Type != protocol.MessageTypeNack || nack.Content != "banned" {
+		t.Errorf("Banned join received %s %q, want NACK %q", nack.Type, nack.Content, "banned")
+	}
+}
+
+// request sends msg on conn with a correlation ID and returns the ACK or NACK
+// for it, skipping any other messages that arrive first.
+func request(t *testing.T, conn net.Conn, msg protocol.Message) protocol.Message {
+	t.Helper()
+
+	msg.CorrelationID = "1"
+	data, err := msg.Encode()
+	if err != nil {
+		t.Fatalf("Failed to encode message: %v", err)
+	}
+	if err := protocol.WriteFrame(conn, data); err != nil {
+		t.Fatalf("Failed to send message: %v", err)
+	}
+	for {
+		reply := readMessage(t, conn)
+		if reply.Type == protocol.MessageTypeAck || reply.Type == protocol.MessageTypeNack {
+			return reply
+		}
+	}
+}
+
+func TestServer_EditAndDelete(t *testing.T) {
+	srv := server.New("127.0.0.1:0", server.WithOperators(map[string]string{"oscar": "pa55"}))
+	go func() {
+		_ = srv.Start()
+	}()
+	defer srv.Stop()
+	<-srv.Ready()
+
+	alice := dialAndJoin(t, srv.Addr(), "alice")
+	waitForClients(t, srv, 1)
+	bob := dialAndJoin(t, srv.Addr(), "bob")
+	readMessage(t, alice)
+
+	// Nobody else can join under an operator's name.
+	impostor, err := net.Dial("tcp", srv.Addr())
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer func() { _ = impostor.Close() }()
+	nack := request(t, impostor, protocol.Message{Type: protocol.MessageTypeJoin, Sender: "oscar"})
+	if nack.Type != protocol.MessageTypeNack || nack.Content != "wrong password" {
+		t.Errorf("Impostor received %s %q, want NACK %q", nack.Type, nack.Content, "wrong password")
+	}
+
+	// The operator joins with their password, which the others never see.
+	oscar, err := net.Dial("tcp", srv.Addr())
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer func() { _ = oscar.Close() }()
+	joinAck := request(t, oscar, protocol.Message{
+		Type:    protocol.MessageTypeJoin,
+		Sender:  "oscar",
+		Content: "pa55",
+	})
+	if joinAck.Type != protocol.MessageTypeAck {
+		t.Fatalf("oscar received %s %q, want an ACK", joinAck.Type, joinAck.Content)
+	}
+	for name, conn := range map[string]net.Conn{"alice": alice, "bob": bob} {
+		if msg := readMessage(t, conn); msg.Sender != "oscar" || msg.Content != "" {
+			t.Errorf("%s received %s %q from %q, want oscar's JOIN", name, msg.Type,
+				msg.Content, msg.Sender)
+		}
+	}
+
+	ack := request(t, alice, protocol.Message{Type: protocol.MessageTypeText, Content: "hi"})
+	if ack.Type != protocol.MessageTypeAck || ack.ID == "" {
+		t.Fatalf("Received %s with ID %q, want an ACK with the message ID", ack.Type, ack.ID)
+	}
+	id := ack.ID
+	if msg := readMessage(t, bob); msg.ID != id {
+		t.Errorf("bob received %s with ID %q, want the TEXT with ID %q", msg.Type, msg.ID, id)
+	}
+
+	tests := []struct {
+		name       string
+		conn       net.Conn
+		msg        protocol.Message
+		wantReason string
+	}{
+		{
+			name:       "join again as the sender",
+			conn:       bob,
+			msg:        protocol.Message{Type: protocol.MessageTypeJoin, Sender: "alice"},
+			wantReason: "already joined",
+		},
+		{
+			name:       "edit by another user",
+			conn:       bob,
+			msg:        protocol.Message{Type: protocol.MessageTypeEdit, ID: id, Content: "mine"},
+			wantReason: "not allowed",
+		},
+		{
+			name:       "edit of unknown message",
+			conn:       alice,
+			msg:        protocol.Message{Type: protocol.MessageTypeEdit, ID: "nope", Content: "x"},
+			wantReason: "unknown message",
+		},
+		{
+			name: "edit by sender",
+			conn: alice,
+			msg:  protocol.Message{Type: protocol.MessageTypeEdit, ID: id, Content: "hello"},
+		},
+		{
+			name: "delete by operator",
+			conn: oscar,
+			msg:  protocol.Message{Type: protocol.MessageTypeDelete, ID: id},
+		},
+		{
+			name:       "edit of deleted message",
+			conn:       alice,
+			msg:        protocol.Message{Type: protocol.MessageTypeEdit, ID: id, Content: "again"},
+			wantReason: "message deleted",
+		},
+	}
+	for _, tt := range tests {
+		wantType := protocol.MessageTypeAck
+		if tt.wantReason != "" {
+			wantType = protocol.MessageTypeNack
+		}
+		ack := request(t, tt.conn, tt.msg)
+		if ack.Type != wantType || ack.Content != tt.wantReason {
+			t.Errorf(
+				"%s: received %s %q, want %s %q",
+				tt.name, ack.Type, ack.Content, wantType, tt.wantReason,
+			)
+		}
+
+		// Everyone else sees accepted changes attributed to the original sender.
+		if tt.wantReason == "" && tt.conn != bob {
+			msg := readMessage(t, bob)
+			if msg.Type != tt.msg.Type || msg.ID != id || msg.Sender != "alice" ||
+				msg.Content != tt.msg.Content {
+				t.Errorf(
+					"%s: bob received %s %q from %q, want %s %q from alice",
+					tt.name, msg.Type, msg.Content, msg.Sender, tt.msg.Type, tt.msg.Content,
+				)
+			}
+		}
+	}
+}
+
+func TestServer_RequiresJoin(t *testing.T) {
+	srv := server.New("127.0.0.1:0")
+	go func() {
+		_ = srv.Start()
+	}()
+	defer srv.Stop()
+	<-srv.Ready()
+
+	alice := dialAndJoin(t, srv.Addr(), "alice")
+	id := request(t, alice, protocol.Message{Type: protocol.MessageTypeText, Content: "hi"}).ID
+
+	conn, err := net.Dial("tcp", srv.Addr())
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer func() { _ = conn.Close() }()
+	for _, msg := range []protocol.Message{
+		{Type: protocol.MessageTypeText, Sender: "alice", Content: "forged"},
+		{Type: protocol.MessageTypeEdit, Sender: "alice", ID: id, Content: "forged"},
+		{Type: protocol.MessageTypeDelete, Sender: "alice", ID: id},
+	} {
+		ack := request(t, conn, msg)
+		if ack.Type != protocol.MessageTypeNack || ack.Content != "not joined" {
+			t.Errorf("%s before JOIN: received %s %q, want NACK %q",
+				msg.Type, ack.Type, ack.Content, "not joined")
+		}
+	}
+
+	// Alice sees none of it.
+	_ = alice.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if _, err := alice.Read(make([]byte, 4096)); err == nil {
+		t.Error("alice received a message sent before JOIN")
+	}
+}
+
+func TestServer_Reactions(t *testing.T) {
+	srv := server.New("127.0.0.1:0")
+	go func() {
+		_ = srv.Start()
+	}()
+	defer srv.Stop()
+	<-srv.Ready()
+
+	alice := dialAndJoin(t, srv.Addr(), "alice")
+	waitForClients(t, srv, 1)
+	bob := dialAndJoin(t, srv.Addr(), "bob")
+	readMessage(t, alice)
+
+	id := request(t, alice, protocol.Message{Type: protocol.MessageTypeText, Content: "hi"}).ID
+	readMessage(t, bob)
+
+	react := func(conn net.Conn, emoji string, remove bool) protocol.Message {
+		t.Helper()
+		return request(t, conn, protocol.Message{
+			Type:    protocol.MessageTypeReaction,
+			ID:      id,
+			Content: emoji,
+			Remove:  remove,
+		})
+	}
+	expectCounts := func(conn net.Conn, want map[string]int) {
+		t.Helper()
+		msg := readMessage(t, conn)
+		if msg.Type != protocol.MessageTypeReaction || msg.ID != id ||
+			!maps.Equal(msg.Reactions, want) {
+			t.Errorf(
+				"Received %s %v for %q, want REACTION %v",
+				msg.Type, msg.Reactions, msg.ID, want,
+			)
+		}
+	}
+
+	react(bob, "👍", false)
+	expectCounts(alice, map[string]int{"👍": 1})
+	// A repeated reaction counts once and is not passed on.
+	react(bob, "👍", false)
+	react(alice, "👍", false)
+	expectCounts(bob, map[string]int{"👍": 2})
+	react(bob, "🎉", false)
+	expectCounts(alice, map[string]int{"👍": 2, "🎉": 1})
+	react(bob, "👍", true)
+	expectCounts(alice, map[string]int{"👍": 1, "🎉": 1})
+
+	if ack := react(bob, "two words", false); ack.Content != "invalid reaction" {
+		t.Errorf("Received %s %q for a text reaction, want a NACK", ack.Type, ack.Content)
+	}
+	id = "nope"
+	if ack := react(bob, "👍", false); ack.Content != "unknown message" {
+		t.Errorf("Received %s %q for an unknown message, want a NACK", ack.Type, ack.Content)
+	}
+}
+
+func TestServer_Threads(t *testing.T) {
+	srv := server.New("127.0.0.1:0")
+	go func() {
+		_ = srv.Start()
+	}()
+	defer srv.Stop()
+	<-srv.Ready()
+
+	alice := dialAndJoin(t, srv.Addr(), "alice")
+	waitForClients(t, srv, 1)
+	bob := dialAndJoin(t, srv.Addr(), "bob")
+	readMessage(t, alice)
+
+	text := func(conn net.Conn, parentID, content string) protocol.Message {
+		t.Helper()
+		return request(t, conn, protocol.Message{
+			Type:     protocol.MessageTypeText,
+			Content:  content,
+			ParentID: parentID,
+		})
+	}
+	root := text(alice, "", "lunch?").ID
+	readMessage(t, bob)
+
+	first := text(bob, root, "pizza").ID
+	if msg := readMessage(t, alice); msg.ParentID != root || msg.ReplyCount != 1 {
+		t.Errorf("Received reply to %q with count %d, want 1", msg.ParentID, msg.ReplyCount)
+	}
+	// A reply to a reply joins the thread of the message that started it.
+	text(alice, first, "sushi")
+	if msg := readMessage(t, bob); msg.ParentID != root || msg.ReplyCount != 2 {
+		t.Errorf("Received reply to %q with count %d, want 2", msg.ParentID, msg.ReplyCount)
+	}
+	if ack := text(alice, "nope", "hi"); ack.Content != "unknown parent" {
+		t.Errorf("Received %s %q for a reply to nothing, want a NACK", ack.Type, ack.Content)
+	}
+
+	ack := request(t, bob, protocol.Message{Type: protocol.MessageTypeThread, ID: first})
+	var contents []string
+	for _, reply := range ack.Replies {
+		contents = append(contents, reply.Content)
+	}
+	if ack.ID != root || ack.ReplyCount != 2 ||
+		!slices.Equal(contents, []string{"pizza", "sushi"}) {
+		t.Errorf(
+			"THREAD returned %q with %d replies %q, want %q with pizza and sushi",
+			ack.ID, ack.ReplyCount, contents, root,
+		)
+	}
+
+	// Only the most recent replies that fit in one frame are returned.
+	long := text(alice, "", "long thread").ID
+	readMessage(t, bob)
+	for i := range 4 {
+		text(alice, long, fmt.Sprintf("%d%s", i, strings.Repeat("x", 200000)))
+		readMessage(t, bob)
+	}
+	ack = request(t, bob, protocol.Message{Type: protocol.MessageTypeThread, ID: long})
+	if n := len(ack.Replies); ack.ReplyCount != 4 || n == 0 || n == 4 ||
+		!strings.HasPrefix(ack.Replies[n-1].Content, "3") {
+		t.Errorf("THREAD returned %d of %d replies, want the newest few of 4", n, ack.ReplyCount)
+	}
+}
+
+func TestServer_Mentions(t *testing.T) {
+	srv := server.New("127.0.0.1:0")
+	go func() {
+		_ = srv.Start()
+	}()
+	defer srv.Stop()
+	<-srv.Ready()
+
+	// carol has been in the chat before but is offline.
+	carol := dialAndJoin(t, srv.Addr(), "carol")
+	waitForClients(t, srv, 1)
+	_ = carol.Close()
+	waitForClients(t, srv, 0)
+
+	alice := dialAndJoin(t, srv.Addr(), "alice")
+	waitForClients(t, srv, 1)
+	bob := dialAndJoin(t, srv.Addr(), "bob")
+	readMessage(t, alice)
+
+	ack := request(t, alice, protocol.Message{
+		Type:    protocol.MessageTypeText,
+		Content: "@bob and @carol, meet @nobody",
+	})
+	msg := readMessage(t, bob)
+	if msg.Type != protocol.MessageTypeText ||
+		!slices.Equal(msg.Mentions, []string{"bob", "carol"}) {
+		t.Errorf("bob received %s mentioning %q, want a TEXT mentioning bob and carol",
+			msg.Type, msg.Mentions)
+	}
+	msg = readMessage(t, bob)
+	if msg.Type != protocol.MessageTypeMention || msg.ID != ack.ID || msg.Sender != "alice" {
+		t.Errorf("bob received %s %q from %q, want a MENTION from alice",
+			msg.Type, msg.ID, msg.Sender)
+	}
+
+	// More mentions queue up for carol, and she gets them all, in order,
+	// though they are sent back to back when she joins.
+	queued := []string{ack.ID}
+	for _, content := range []string{"@carol are you there?", "ping @carol"} {
+		ack := request(t, alice, protocol.Message{Type: protocol.MessageTypeText, Content: content})
+		queued = append(queued, ack.ID)
+		readMessage(t, bob)
+	}
+
+	carol = dialAndJoin(t, srv.Addr(), "carol")
+	for _, id := range queued {
+		if msg := readMessage(t, carol); msg.Type != protocol.MessageTypeMention || msg.ID != id {
+			t.Errorf("carol received %s %q on joining, want the queued MENTION %q",
+				msg.Type, msg.ID, id)
+		}
+	}
+}
+
+func TestServer_DirectMessages(t *testing.T) {
+	srv := server.New("127.0.0.1:0")
+	go func() {
+		_ = srv.Start()
+	}()
+	defer srv.Stop()
+	<-srv.Ready()
+
+	// carol has been in the chat before but is offline.
+	carol := dialAndJoin(t, srv.Addr(), "carol")
+	waitForClients(t, srv, 1)
+	_ = carol.Close()
+	waitForClients(t, srv, 0)
+
+	alice := dialAndJoin(t, srv.Addr(), "alice")
+	waitForClients(t, srv, 1)
+	bob := dialAndJoin(t, srv.Addr(), "bob")
+	readMessage(t, alice)
+	dave := dialAndJoin(t, srv.Addr(), "dave")
+	readMessage(t, alice)
+	readMessage(t, bob)
+
+	direct := func(to, content string) protocol.Message {
+		t.Helper()
+		return request(t, alice, protocol.Message{
+			Type:      protocol.MessageTypeDirect,
+			Content:   content,
+			Recipient: to,
+		})
+	}
+
+	ack := direct("bob", "psst")
+	if ack.Type != protocol.MessageTypeAck || ack.Content != "" {
+		t.Errorf("DIRECT to bob returned %s %q, want a plain ACK", ack.Type, ack.Content)
+	}
+	if msg := readMessage(t, bob); msg.Type != protocol.MessageTypeDirect ||
+		msg.Sender != "alice" || msg.Content != "psst" || msg.ID != ack.ID {
+		t.Errorf("bob received %s %q from %q, want alice's DIRECT",
+			msg.Type, msg.Content, msg.Sender)
+	}
+	// Several messages queue up for carol, and she gets them all, in order,
+	// though they are sent back to back when she joins.
+	contents := []string{"call me", "it's urgent", "never mind"}
+	var queued []protocol.Message
+	for _, content := range contents {
+		ack := direct("carol", content)
+		if ack.Type != protocol.MessageTypeAck || ack.Content != "queued" {
+			t.Errorf("DIRECT to offline carol returned %s %q, want an ACK saying it was queued",
+				ack.Type, ack.Content)
+		}
+		queued = append(queued, ack)
+	}
+	if ack := direct("nobody", "hello?"); ack.Type != protocol.MessageTypeNack ||
+		ack.Content != "unknown user" {
+		t.Errorf("DIRECT to nobody returned %s %q, want a NACK", ack.Type, ack.Content)
+	}
+
+	// Nobody else sees direct messages.
+	request(t, alice, protocol.Message{Type: protocol.MessageTypeText, Content: "hi all"})
+	if msg := readMessage(t, dave); msg.Type != protocol.MessageTypeText {
+		t.Errorf("dave received %s %q, want only alice's TEXT", msg.Type, msg.Content)
+	}
+
+	carol = dialAndJoin(t, srv.Addr(), "carol")
+	for i, want := range queued {
+		if msg := readMessage(t, carol); msg.Type != protocol.MessageTypeDirect ||
+			msg.ID != want.ID || msg.Content != contents[i] {
+			t.Errorf("carol received %s %q on joining, want the queued DIRECT %q",
+				msg.Type, msg.Content, contents[i])
+		}
+	}
+}
+
+func TestServer_Typing(t *testing.T) {
+	srv := server.New("127.0.0.1:0")
+	go func() {
+		_ = srv.Start()
+	}()
+	defer srv.Stop()
+	<-srv.Ready()
+
+	alice := dialAndJoin(t, srv.Addr(), "alice")
+	waitForClients(t, srv, 1)
+	bob := dialAndJoin(t, srv.Addr(), "bob")
+	readMessage(t, alice)
+
+	typing := func(remove bool) {
+		t.Helper()
+		data, err := (&protocol.Message{Type: protocol.MessageTypeTyping, Remove: remove}).Encode()
+		if err != nil {
+			t.Fatalf("Failed to encode message: %v", err)
+		}
+		if err := protocol.WriteFrame(alice, data); err != nil {
+			t.Fatalf("Failed to send message: %v", err)
+		}
+	}
+	expect := func(remove bool) {
+		t.Helper()
+		msg := readMessage(t, bob)
+		if msg.Type != protocol.MessageTypeTyping || msg.Sender != "alice" || msg.Remove != remove {
+			t.Errorf("bob received %s from %q (remove %v), want TYPING from alice (remove %v)",
+				msg.Type, msg.Sender, msg.Remove, remove)
+		}
+	}
+
+	typing(false)
+	expect(false)
+	// A refresh within the rate limit is not passed on, so the stop comes next.
+	typing(false)
+	typing(true)
+	expect(true)
+	// Stopping twice is passed on once. Stopping does not reset the rate
+	// limit, so a start within it is dropped, and so is the stop after it:
+	// the TEXT comes next.
+	typing(true)
+	typing(false)
+	typing(true)
+	request(t, alice, protocol.Message{Type: protocol.MessageTypeText, Content: "hi"})
+	if msg := readMessage(t, bob); msg.Type != protocol.MessageTypeText {
+		t.Errorf("bob received %s, want the TEXT", msg.Type)
+	}
+	// Once the rate limit has passed, starting again is passed on.
+	time.Sleep(time.Second)
+	typing(false)
+	expect(false)
+}
+
+func TestServer_ReadMarkers(t *testing.T) {
+	srv := server.New("127.0.0.1:0")
+	go func() {
+		_ = srv.Start()
+	}()
+	defer srv.Stop()
+	<-srv.Ready()
+
+	alice := dialAndJoin(t, srv.Addr(), "alice")
+	waitForClients(t, srv, 1)
+	bob := dialAndJoin(t, srv.Addr(), "bob")
+	readMessage(t, alice)
+
+	var ids []string
+	for _, content := range []string{"one", "two", "three"} {
+		ack := request(t, alice, protocol.Message{Type: protocol.MessageTypeText, Content: content})
+		ids = append(ids, ack.ID)
+		readMessage(t, bob)
+	}
+
+	read := func(id string, private bool) protocol.Message {
+		t.Helper()
+		return request(t, bob, protocol.Message{
+			Type:    protocol.MessageTypeRead,
+			ID:      id,
+			Private: private,
+		})
+	}
+	expect := func(ack protocol.Message, marker string, unread int) {
+		t.Helper()
+		if ack.Type != protocol.MessageTypeAck || ack.ID != marker || ack.Unread != unread {
+			t.Errorf("READ returned %s with marker %q and %d unread, want ACK with %q and %d",
+				ack.Type, ack.ID, ack.Unread, marker, unread)
+		}
+	}
+
+	// Without a marker, every message from others is unread.
+	expect(read("", false), "", 3)
+	expect(read(ids[1], false), ids[1], 1)
+	if msg := readMessage(t, alice); msg.Type != protocol.MessageTypeRead ||
+		msg.Sender != "bob" || msg.ID != ids[1] {
+		t.Errorf("alice received %s from %q for %q, want READ from bob for %q",
+			msg.Type, msg.Sender, msg.ID, ids[1])
+	}
+	// The marker never moves back, and no receipt is sent for trying.
+	expect(read(ids[0], false), ids[1], 1)
+	// A private marker is kept but not shown to others.
+	expect(read(ids[2], true), ids[2], 0)
+	if ack := read("nope", false); ack.Type != protocol.MessageTypeNack ||
+		ack.Content != "unknown message" {
+		t.Errorf("READ of nothing returned %s %q, want a NACK", ack.Type, ack.Content)
+	}
+
+	request(t, bob, protocol.Message{Type: protocol.MessageTypeText, Content: "done"})
+	if msg := readMessage(t, alice); msg.Type != protocol.MessageTypeText {
+		t.Errorf("alice received %s from %q, want only bob's TEXT", msg.Type, msg.Sender)
+	}
+	// Bob's own messages are never unread for him, but are for alice.
+	expect(read("", false), ids[2], 0)
+	if ack := request(t, alice, protocol.Message{Type: protocol.MessageTypeRead}); ack.Unread != 1 {
+		t.Errorf("alice has %d unread, want bob's 1", ack.Unread)
+	}
+}
@@ -0,0 +1,233 @@
+package server
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"net"
+	"net/netip"
+	"slices"
+
+	"github.com/omochice/toy-socket-chat/pkg/protocol"
+)
+
+// Limits bounds what clients may do. A zero value for any field means no
+// limit.
+type Limits struct {
+	// MaxClients is the maximum number of simultaneously connected clients.
+	// Connections beyond it are closed as soon as they are accepted.
+	MaxClients int
+	// MaxMessageLength is the maximum length, in bytes, of a text message's
+	// content. Longer messages are dropped rather than broadcast.
+	MaxMessageLength int
+}
+
+// Bans lists usernames and client networks that may not use the chat.
+type Bans struct {
+	// Usernames are rejected when they JOIN.
+	Usernames []string
+	// Networks are rejected when they connect. A single address is
+	// expressed as a /32 (IPv4) or /128 (IPv6) prefix.
+	Networks []netip.Prefix
+}
+
+// WithLimits sets the initial client limits. They can be changed on a running
+// server with SetLimits.
+func WithLimits(limits Limits) Option {
+	return func(s *Server) {
+		s.limits.Store(&limits)
+	}
+}
+
+// WithBans sets the initial bans. They can be changed on a running server with
+// SetBans.
+func WithBans(bans Bans) Option {
+	return func(s *Server) {
+		s.bans.Store(&bans)
+	}
+}
+
+// WithMOTD sets a message of the day sent to each client right after it joins.
+// It can be changed on a running server with SetMOTD.
+func WithMOTD(motd string) Option {
+	return func(s *Server) {
+		s.motd.Store(&motd)
+	}
+}
+
+// SetLimits replaces the client limits. Already connected clients are not
+// disconnected if they now exceed MaxClients; the limit applies to new
+// connections.
+func (s *Server) SetLimits(limits Limits) {
+	s.limits.Store(&limits)
+	s.logger.Info(
+		"Limits updated",
+		"max_clients", limits.MaxClients,
+		"max_message_length", limits.MaxMessageLength,
+	)
+}
+
+// SetBans replaces the bans and disconnects connected clients that the new
+// bans match. Other clients are unaffected.
+func (s *Server) SetBans(bans Bans) {
+	s.bans.Store(&bans)
+	s.logger.Info(
+		"Bans updated",
+		"usernames", len(bans.Usernames),
+		"networks", len(bans.Networks),
+	)
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for client := range s.clients {
+		if bans.matchesUsername(client.name()) || bans.matchesAddr(client.conn.RemoteAddr()) {
+			client.log().Info("Disconnecting banned client")
+			if err := client.conn.Close(); err != nil {
+				client.log().Debug("Error closing client connection", "error", err)
+			}
+		}
+	}
+}
+
+// WithOperators sets the initial operators, users who may edit and delete
+// anyone's messages, as a map from username to password. An operator joins
+// with the password as the JOIN message's Content; a JOIN under an
+// operator's username without it is rejected, so the name cannot be claimed
+// by anyone else. Operators can be changed on a running server with
+// SetOperators.
+func WithOperators(operators map[string]string) Option {
+	return func(s *Server) {
+		s.operators.Store(&operators)
+	}
+}
+
+// SetOperators replaces the operators. Clients joined as an operator who is
+// no longer listed lose their rights; others keep them until they rejoin.
+func (s *Server) SetOperators(operators map[string]string) {
+	s.operators.Store(&operators)
+	s.logger.Info("Operators updated", "operators", len(operators))
+}
+
+// SetMOTD replaces the message of the day sent to newly joined clients. An
+// empty string disables it.
+func (s *Server) SetMOTD(motd string) {
+	s.motd.Store(&motd)
+	s.logger.Info("MOTD updated")
+}
+
+// SetTLSCertificate replaces the certificate presented for new WebTransport
+// handshakes. Established sessions keep the certificate they negotiated. It has
+// no effect if the server was not started with WithTLS, because WebTransport is
+// only enabled at startup.
+func (s *Server) SetTLSCertificate(cert tls.Certificate) {
+	s.tlsCert.Store(&cert)
+	s.logger.Info("TLS certificate updated")
+	s.logCertificate(&cert)
+}
+
+// TLSCertificate returns the certificate currently presented, or nil if the
+// server has none.
+func (s *Server) TLSCertificate() *tls.Certificate {
+	return s.tlsCert.Load()
+}
+
+// currentLimits returns the limits in effect.
+func (s *Server) currentLimits() Limits {
+	if l := s.limits.Load(); l != nil {
+		return *l
+	}
+	return Limits{}
+}
+
+// currentBans returns the bans in effect.
+func (s *Server) currentBans() Bans {
+	if b := s.bans.Load(); b != nil {
+		return *b
+	}
+	return Bans{}
+}
+
+// authenticateOperator checks the password sent in a JOIN as username. It
+// reports whether username is an operator and, if so, whether the password is
+// theirs; anyone else may join with any password, which is ignored.
+func (s *Server) authenticateOperator(username, password string) (operator, ok bool) {
+	ops := s.operators.Load()
+	if ops == nil {
+		return false, true
+	}
+	want, listed := (*ops)[username]
+	if !listed {
+		return false, true
+	}
+	match := subtle.ConstantTimeCompare([]byte(password), []byte(want)) == 1
+	return match, match
+}
+
+// isOperator reports whether client joined as one of the operators.
+func (s *Server) isOperator(client *Client) bool {
+	ops := s.operators.Load()
+	if ops == nil || !client.joinedAsOperator() {
+		return false
+	}
+	_, listed := (*ops)[client.name()]
+	return listed
+}
+
+// currentMOTD returns the message of the day, or "" if none is set.
+func (s *Server) currentMOTD() string {
+	if m := s.motd.Load(); m != nil {
+		return *m
+	}
+	return ""
+}
+
+// maxContentLength bounds a message's content whatever the limits, so the
+// message still fits in one frame once the server adds its ID, the mentions
+// picked out of the content and the like.
+const maxContentLength = protocol.MaxFrameSize / 4
+
+// contentLimit returns the longest content allowed: Limits.MaxMessageLength,
+// or maxContentLength if that is lower or there is no limit.
+func (s *Server) contentLimit() int {
+	if limit := s.currentLimits().MaxMessageLength; limit > 0 && limit < maxContentLength {
+		return limit
+	}
+	return maxContentLength
+}
+
+// tooLong reports whether content is longer than contentLimit.
+func (s *Server) tooLong(content string) bool {
+	return len(content) > s.contentLimit()
+}
+
+// getCertificate serves the current certificate to TLS handshakes so that
+// SetTLSCertificate takes effect without restarting the listener.
+func (s *Server) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return s.tlsCert.Load(), nil
+}
+
+func (b Bans) matchesUsername(username string) bool {
+	return username != "" && slices.Contains(b.Usernames, username)
+}
+
+func (b Bans) matchesAddr(addr net.Addr) bool {
+	return addrInNetworks(addr, b.Networks)
+}
+
+// addrInNetworks reports whether the IP of addr, an IP:port address, lies in
+// any of networks.
+func addrInNetworks(addr net.Addr, networks []netip.Prefix) bool {
+	if len(networks) == 0 || addr == nil {
+		return false
+	}
+	ap, err := netip.ParseAddrPort(addr.String())
+	if err != nil {
+		return false
+	}
+	ip := ap.Addr().Unmap()
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,51 @@
+package server
+
+import "github.com/omochice/toy-socket-chat/pkg/protocol"
+
+// maxThreadBytes bounds the encoded replies in the ACK for a THREAD request,
+// which must fit in one frame, so older replies that would not fit are left
+// out.
+const maxThreadBytes = protocol.MaxFrameSize / 2
+
+// attachReply points msg, a reply, at the first message of its thread, so
+// threads never nest, and sets its ReplyCount to include it. It reports false
+// if the message replied to is not in the history.
+func (s *Server) attachReply(msg *protocol.Message) bool {
+	root, replies, ok := s.history.threadOf(msg.ParentID)
+	if !ok {
+		return false
+	}
+	msg.ParentID = root
+	msg.ReplyCount = replies + 1
+	return true
+}
+
+// handleThread answers a THREAD request with an ACK carrying the thread's
+// most recent replies. Without a CorrelationID there is nothing to answer.
+func (s *Server) handleThread(client *Client, msg protocol.Message) {
+	if msg.CorrelationID == "" {
+		return
+	}
+	root, count, ok := s.history.threadOf(msg.ID)
+	if !ok {
+		s.acknowledge(client, msg, "unknown message")
+		return
+	}
+
+	replies := s.history.thread(root)
+	size, start := 0, len(replies)
+	for ; start > 0; start-- {
+		data, err := replies[start-1].Encode()
+		if err != nil || size+len(data) > maxThreadBytes {
+			break
+		}
+		size += len(data)
+	}
+	s.sendTo(client, protocol.Message{
+		Type:          protocol.MessageTypeAck,
+		CorrelationID: msg.CorrelationID,
+		ID:            root,
+		ReplyCount:    count,
+		Replies:       replies[start:],
+	})
+}
@@ -0,0 +1,54 @@
+package server
+
+import (
+	"time"
+
+	"github.com/omochice/toy-socket-chat/pkg/protocol"
+)
+
+// minTypingInterval is how often a client's TYPING messages saying it is
+// typing are passed on at most, whether or not it stopped in between.
+// Clients refresh them well within protocol.TypingTimeout, so dropping the
+// rest loses nothing.
+const minTypingInterval = time.Second
+
+// handleTyping passes a TYPING message from client on to everyone else in the
+// chat, rate limited to one start per minTypingInterval. A TYPING saying the
+// client stopped is passed on only after a start that was, so a client
+// alternating the two gets at most one of each through per interval. Nothing
+// is stored, acknowledged or relayed to federation peers: a lost TYPING only
+// leaves an indicator up until it expires.
+func (s *Server) handleTyping(client *Client, msg protocol.Message) {
+	name := client.name()
+	if name == "" || !client.setTyping(!msg.Remove) {
+		return
+	}
+
+	out := protocol.Message{Type: protocol.MessageTypeTyping, Sender: name, Remove: msg.Remove}
+	data, err := out.Encode()
+	if err != nil {
+		client.log().Error("Failed to encode message", "error", err)
+		return
+	}
+	s.publish(data, out, client)
+}
+
+// setTyping records whether the client is typing and reports whether to pass
+// that on: a start once per minTypingInterval, and a stop only after a start
+// that was passed on.
+func (c *Client) setTyping(typing bool) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !typing {
+		wasTyping := c.typing
+		c.typing = false
+		return wasTyping
+	}
+	now := time.Now()
+	if now.Sub(c.typingAt) < minTypingInterval {
+		return false
+	}
+	c.typing = true
+	c.typingAt = now
+	return true
+}
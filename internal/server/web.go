@@ -0,0 +1,128 @@
+package server
+
+import (
+	"bytes"
+	"embed"
+	"encoding/json"
+	"io"
+	"io/fs"
+	"net"
+	"net/http"
+	"strconv"
+)
+
+// webFS holds the static browser client served to plain HTTP requests on the
+// chat port. It talks to the server over WebSocket, or over WebTransport when
+// TLS is configured and the browser supports it.
+//
+//go:embed web
+var webFS embed.FS
+
+// webConfig is served at /config.json so the browser client can discover which
+// transports are available without hard-coding ports.
+type webConfig struct {
+	WebTransport     bool `json:"webTransport"`
+	WebTransportPort int  `json:"webTransportPort,omitempty"`
+	// CertificateHash is the hex SHA-256 hash of a short-lived certificate that
+	// the browser may pin instead of validating it against its trust store.
+	CertificateHash string `json:"certificateHash,omitempty"`
+}
+
+// webHandler returns the HTTP handler for the browser client.
+func (s *Server) webHandler() http.Handler {
+	static, err := fs.Sub(webFS, "web")
+	if err != nil {
+		// The embedded directory is fixed at build time, so this cannot fail.
+		panic(err)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("GET /", http.FileServerFS(static))
+	mux.HandleFunc("GET /config.json", s.serveWebConfig)
+	return mux
+}
+
+// serveWebConfig reports the WebTransport endpoint, if any, to the browser.
+func (s *Server) serveWebConfig(w http.ResponseWriter, _ *http.Request) {
+	cfg := webConfig{}
+	if s.wtServer != nil {
+		cfg.WebTransport = true
+		cfg.WebTransportPort = s.webTransportPort()
+		cfg.CertificateHash = s.pinnableCertificateHash()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	_ = json.NewEncoder(w).Encode(cfg)
+}
+
+// webTransportPort returns the port of the first WebTransport listener, which
+// is the one advertised to browsers.
+func (s *Server) webTransportPort() int {
+	for _, l := range s.listeners {
+		if addr, ok := l.addr().(*net.UDPAddr); ok {
+			return addr.Port
+		}
+	}
+	return 0
+}
+
+// serveHTTP answers a single plain (non-upgrade) HTTP request read from a chat
+// port connection. The connection is not kept alive: the response carries
+// "Connection: close" and the caller closes rawConn afterwards, so the browser
+// simply opens a new connection for its next request.
+func (s *Server) serveHTTP(rawConn net.Conn, req *http.Request) error {
+	rw := &bufferedResponse{header: make(http.Header)}
+	s.web.ServeHTTP(rw, req)
+
+	contentLength := int64(rw.body.Len())
+	if req.Method == http.MethodHead {
+		// Handlers skip the body for HEAD but still announce its length.
+		if n, err := strconv.ParseInt(rw.header.Get("Content-Length"), 10, 64); err == nil {
+			contentLength = n
+		}
+	}
+
+	resp := &http.Response{
+		StatusCode:    rw.status(),
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        rw.header,
+		Body:          io.NopCloser(&rw.body),
+		ContentLength: contentLength,
+		Close:         true,
+		Request:       req,
+	}
+	return resp.Write(rawConn)
+}
+
+// bufferedResponse is a minimal http.ResponseWriter that collects a handler's
+// response in memory so it can be written to a raw connection in one go.
+type bufferedResponse struct {
+	header http.Header
+	code   int
+	body   bytes.Buffer
+}
+
+func (br *bufferedResponse) Header() http.Header {
+	return br.header
+}
+
+func (br *bufferedResponse) Write(data []byte) (int, error) {
+	if br.code == 0 {
+		br.code = http.StatusOK
+	}
+	return br.body.Write(data)
+}
+
+func (br *bufferedResponse) WriteHeader(code int) {
+	if br.code == 0 {
+		br.code = code
+	}
+}
+
+func (br *bufferedResponse) status() int {
+	if br.code == 0 {
+		return http.StatusOK
+	}
+	return br.code
+}
@@ -0,0 +1,627 @@
+// Browser client for the chat server. Messages are the same protobuf-encoded
+// Message (proto/message.proto) used by the Go client, hand-encoded here so the
+// page needs no build step or third-party library.
+
+const MessageType = {
+	TEXT: 0,
+	JOIN: 1,
+	LEAVE: 2,
+	RECONNECT: 3,
+	FEDERATE: 4,
+	ACK: 5,
+	NACK: 6,
+	EDIT: 7,
+	DELETE: 8,
+	REACTION: 9,
+	THREAD: 10,
+	MENTION: 11,
+	TYPING: 12,
+	READ: 13,
+	DIRECT: 14,
+};
+
+// TYPING_TIMEOUT_MS matches protocol.TypingTimeout: a user who sends no TYPING
+// for this long has stopped typing.
+const TYPING_TIMEOUT_MS = 5000;
+
+const encoder = new TextEncoder();
+const decoder = new TextDecoder();
+
+function writeVarint(out, value) {
+	while (value > 0x7f) {
+		out.push((value & 0x7f) | 0x80);
+		value >>>= 7;
+	}
+	out.push(value);
+}
+
+function readVarint(buf, pos) {
+	let value = 0;
+	let shift = 0;
+	for (;;) {
+		const b = buf[pos++];
+		value += (b & 0x7f) * 2 ** shift;
+		if (b < 0x80) {
+			return [value, pos];
+		}
+		shift += 7;
+	}
+}
+
+function encodeMessage(msg) {
+	const out = [];
+	if (msg.type) {
+		writeVarint(out, (1 << 3) | 0);
+		writeVarint(out, msg.type);
+	}
+	for (const [field, value] of [
+		[2, msg.sender],
+		[3, msg.content],
+		[4, msg.correlationId],
+		[5, msg.id],
+	]) {
+		if (value) {
+			const bytes = encoder.encode(value);
+			writeVarint(out, (field << 3) | 2);
+			writeVarint(out, bytes.length);
+			out.push(...bytes);
+		}
+	}
+	if (msg.remove) {
+		writeVarint(out, (6 << 3) | 0);
+		writeVarint(out, 1);
+	}
+	return new Uint8Array(out);
+}
+
+// decodeReactionCount decodes one entry of the reactions map, a message with
+// the emoji as field 1 and the count as field 2.
+function decodeReactionCount(buf) {
+	let emoji = "";
+	let count = 0;
+	let pos = 0;
+	while (pos < buf.length) {
+		let key;
+		[key, pos] = readVarint(buf, pos);
+		if ((key & 7) === 0) {
+			let value;
+			[value, pos] = readVarint(buf, pos);
+			if (key >> 3 === 2) {
+				count = value;
+			}
+		} else {
+			let len;
+			[len, pos] = readVarint(buf, pos);
+			if (key >> 3 === 1) {
+				emoji = decoder.decode(buf.subarray(pos, pos + len));
+			}
+			pos += len;
+		}
+	}
+	return [emoji, count];
+}
+
+function decodeMessage(buf) {
+	const msg = {
+		type: MessageType.TEXT,
+		sender: "",
+		content: "",
+		correlationId: "",
+		id: "",
+		remove: false,
+		reactions: {},
+		parentId: "",
+		replyCount: 0,
+		mentions: [],
+	};
+	let pos = 0;
+	while (pos < buf.length) {
+		let key;
+		[key, pos] = readVarint(buf, pos);
+		const field = Math.floor(key / 8);
+		const wire = key & 7;
+		if (wire === 0) {
+			let value;
+			[value, pos] = readVarint(buf, pos);
+			if (field === 1) {
+				msg.type = value;
+			} else if (field === 6) {
+				msg.remove = value !== 0;
+			} else if (field === 9) {
+				msg.replyCount = value;
+			}
+		} else if (wire === 2) {
+			let len;
+			[len, pos] = readVarint(buf, pos);
+			const value = buf.subarray(pos, pos + len);
+			pos += len;
+			if (field === 2) {
+				msg.sender = decoder.decode(value);
+			} else if (field === 3) {
+				msg.content = decoder.decode(value);
+			} else if (field === 4) {
+				msg.correlationId = decoder.decode(value);
+			} else if (field === 5) {
+				msg.id = decoder.decode(value);
+			} else if (field === 7) {
+				const [emoji, count] = decodeReactionCount(value);
+				msg.reactions[emoji] = count;
+			} else if (field === 8) {
+				msg.parentId = decoder.decode(value);
+			} else if (field === 11) {
+				msg.mentions.push(decoder.decode(value));
+			}
+		} else {
+			// Unknown wire types cannot be skipped safely; drop the message.
+			return null;
+		}
+	}
+	return msg;
+}
+
+// connectWebSocket and connectWebTransport both resolve to an object with
+// send(bytes), sendDatagram(bytes), close() and an onmessage(bytes) /
+// onclose() callback pair. sendDatagram is for ephemeral messages, which may
+// be lost; it sends them like any other where there are no datagrams.
+
+function connectWebSocket() {
+	return new Promise((resolve, reject) => {
+		const scheme = location.protocol === "https:" ? "wss" : "ws";
+		const ws = new WebSocket(`${scheme}://${location.host}/`);
+		ws.binaryType = "arraybuffer";
+		const conn = {
+			name: "WebSocket",
+			send: (bytes) => ws.send(bytes),
+			sendDatagram: (bytes) => ws.send(bytes),
+			close: () => ws.close(),
+			onmessage: () => {},
+			onclose: () => {},
+		};
+		ws.onopen = () => resolve(conn);
+		ws.onerror = () => reject(new Error("WebSocket connection failed"));
+		ws.onmessage = (ev) => conn.onmessage(new Uint8Array(ev.data));
+		ws.onclose = () => conn.onclose();
+	});
+}
+
+function hexToBytes(hex) {
+	const bytes = new Uint8Array(hex.length / 2);
+	for (let i = 0; i < bytes.length; i++) {
+		bytes[i] = Number.parseInt(hex.slice(i * 2, i * 2 + 2), 16);
+	}
+	return bytes;
+}
+
+// frame prefixes bytes with their length as a 4-byte big-endian integer, the
+// framing the server expects for each message on a WebTransport stream.
+function frame(bytes) {
+	const framed = new Uint8Array(4 + bytes.length);
+	new DataView(framed.buffer).setUint32(0, bytes.length);
+	framed.set(bytes, 4);
+	return framed;
+}
+
+// unframer returns a function that takes the chunks read from a stream and
+// calls onframe with each whole message they complete, holding partial ones
+// until the rest arrives.
+function unframer(onframe) {
+	let pending = new Uint8Array(0);
+	return (chunk) => {
+		const joined = new Uint8Array(pending.length + chunk.length);
+		joined.set(pending);
+		joined.set(chunk, pending.length);
+		let offset = 0;
+		while (joined.length - offset >= 4) {
+			const view = new DataView(joined.buffer, offset, 4);
+			const length = view.getUint32(0);
+			if (joined.length - offset - 4 < length) {
+				break;
+			}
+			onframe(joined.subarray(offset + 4, offset + 4 + length));
+			offset += 4 + length;
+		}
+		pending = joined.slice(offset);
+	};
+}
+
+// readBulk passes conn the messages on a stream the server opened, after the
+// frame naming its purpose. Streams for anything but bulk transfers are
+// cancelled.
+async function readBulk(stream, conn) {
+	const reader = stream.readable.getReader();
+	let purpose = null;
+	const unframe = unframer((bytes) => {
+		if (purpose === null) {
+			purpose = new TextDecoder().decode(bytes);
+			if (purpose !== "bulk") {
+				reader.cancel();
+			}
+		} else if (purpose === "bulk") {
+			conn.onmessage(bytes);
+		}
+	});
+	try {
+		for (;;) {
+			const { value, done } = await reader.read();
+			if (done) {
+				break;
+			}
+			unframe(value);
+		}
+	} catch {
+		// The stream or session ended; only the chat stream ending matters.
+	}
+}
+
+async function connectWebTransport(port, certificateHash) {
+	// A short-lived development certificate is pinned by hash, since the
+	// browser does not trust it otherwise.
+	const options = certificateHash
+		? {
+				serverCertificateHashes: [
+					{ algorithm: "sha-256", value: hexToBytes(certificateHash) },
+				],
+			}
+		: {};
+	const wt = new WebTransport(`https://${location.hostname}:${port}/`, options);
+	await wt.ready;
+	// One bidirectional stream carries what this client sends, apart from
+	// ephemeral messages that fit in a datagram. The server also opens a bulk
+	// stream for its large messages, read below. Messages on streams are
+	// framed; datagrams hold one message each.
+	const stream = await wt.createBidirectionalStream();
+	const writer = stream.writable.getWriter();
+	const datagrams = wt.datagrams.writable.getWriter();
+	const conn = {
+		name: "WebTransport",
+		send: (bytes) => writer.write(frame(bytes)),
+		sendDatagram: (bytes) =>
+			bytes.length <= wt.datagrams.maxDatagramSize
+				? datagrams.write(bytes)
+				: writer.write(frame(bytes)),
+		close: () => wt.close(),
+		onmessage: () => {},
+		onclose: () => {},
+	};
+	(async () => {
+		const reader = wt.datagrams.readable.getReader();
+		try {
+			for (;;) {
+				const { value, done } = await reader.read();
+				if (done) {
+					break;
+				}
+				conn.onmessage(value);
+			}
+		} catch {
+			// The session closed; the stream reader reports it.
+		}
+	})();
+	(async () => {
+		const streams = wt.incomingBidirectionalStreams.getReader();
+		try {
+			for (;;) {
+				const { value, done } = await streams.read();
+				if (done) {
+					break;
+				}
+				readBulk(value, conn);
+			}
+		} catch {
+			// The session closed; the chat stream reader reports it.
+		}
+	})();
+	(async () => {
+		const reader = stream.readable.getReader();
+		const unframe = unframer((bytes) => conn.onmessage(bytes));
+		try {
+			for (;;) {
+				const { value, done } = await reader.read();
+				if (done) {
+					break;
+				}
+				unframe(value);
+			}
+		} finally {
+			conn.onclose();
+		}
+	})();
+	return conn;
+}
+
+async function connect() {
+	const config = await fetch("config.json")
+		.then((res) => res.json())
+		.catch(() => ({}));
+	if (config.webTransport && "WebTransport" in window) {
+		try {
+			return await connectWebTransport(
+				config.webTransportPort,
+				config.certificateHash,
+			);
+		} catch (err) {
+			console.warn("WebTransport unavailable, using WebSocket", err);
+		}
+	}
+	return connectWebSocket();
+}
+
+const messages = document.getElementById("messages");
+
+function show(text, notice) {
+	const li = document.createElement("li");
+	li.textContent = text;
+	if (notice) {
+		li.className = "notice";
+	}
+	messages.append(li);
+	messages.scrollTop = messages.scrollHeight;
+	return li;
+}
+
+// shown returns the element of the shown message with the given ID, if it is
+// on screen.
+function shown(id) {
+	for (const li of messages.children) {
+		if (li.dataset.id === id) {
+			return li;
+		}
+	}
+	return null;
+}
+
+// replace updates the text of the shown message with the given ID, keeping
+// its reactions.
+function replace(id, text) {
+	const li = shown(id);
+	if (li) {
+		li.firstChild.textContent = text;
+	}
+}
+
+// showReply shows a reply indented after the last message of its thread, and
+// the thread's reply count on the message that started it.
+function showReply(msg) {
+	const li = document.createElement("li");
+	li.append(`↳ [${msg.sender}]: ${msg.content}`);
+	li.className = "reply";
+	li.dataset.id = msg.id;
+	li.dataset.parent = msg.parentId;
+
+	const root = shown(msg.parentId);
+	if (!root) {
+		messages.append(li);
+		return li;
+	}
+	let last = root;
+	while (last.nextElementSibling?.dataset.parent === msg.parentId) {
+		last = last.nextElementSibling;
+	}
+	last.after(li);
+	let count = root.querySelector(".replies");
+	if (!count) {
+		count = document.createElement("span");
+		count.className = "replies";
+		root.firstChild.after(count);
+	}
+	count.textContent = `${msg.replyCount} ${msg.replyCount === 1 ? "reply" : "replies"}`;
+	return li;
+}
+
+// showReactions replaces the reaction tally shown under a message.
+function showReactions(id, reactions) {
+	const li = shown(id);
+	if (!li) {
+		return;
+	}
+	let tally = li.querySelector(".reactions");
+	if (!tally) {
+		tally = document.createElement("span");
+		tally.className = "reactions";
+		li.append(tally);
+	}
+	tally.textContent = Object.entries(reactions)
+		.sort(([, a], [, b]) => b - a)
+		.map(([emoji, count]) => `${emoji} ${count}`)
+		.join("  ");
+}
+
+// typists maps the users shown as typing to the timer that stops showing
+// them.
+const typists = new Map();
+
+// setTypist shows or stops showing sender as typing.
+function setTypist(sender, typing) {
+	clearTimeout(typists.get(sender));
+	typists.delete(sender);
+	if (typing) {
+		typists.set(
+			sender,
+			setTimeout(() => setTypist(sender, false), TYPING_TIMEOUT_MS),
+		);
+	}
+	const names = [...typists.keys()];
+	document.getElementById("typing").textContent =
+		names.length === 0
+			? ""
+			: `${names.join(", ")} ${names.length === 1 ? "is" : "are"} typing…`;
+}
+
+function render(msg) {
+	switch (msg.type) {
+		case MessageType.TEXT: {
+			setTypist(msg.sender, false);
+			const li = msg.parentId
+				? showReply(msg)
+				: show(`[${msg.sender}]: ${msg.content}`);
+			li.dataset.id = msg.id;
+			if (msg.mentions.includes(username)) {
+				li.classList.add("mention");
+			}
+			break;
+		}
+		case MessageType.DIRECT:
+			setTypist(msg.sender, false);
+			show(`[${msg.sender} → you]: ${msg.content}`);
+			break;
+		case MessageType.MENTION:
+			// Mentions made while we were offline arrive after joining; others
+			// are already highlighted.
+			if (!shown(msg.id)) {
+				const li = show(`*** ${msg.sender} mentioned you: ${msg.content} ***`, true);
+				li.classList.add("mention");
+			}
+			break;
+		case MessageType.EDIT:
+			replace(msg.id, `[${msg.sender}]: ${msg.content} (edited)`);
+			break;
+		case MessageType.DELETE:
+			replace(msg.id, `[${msg.sender}]: [message deleted]`);
+			showReactions(msg.id, {});
+			break;
+		case MessageType.REACTION:
+			showReactions(msg.id, msg.reactions);
+			break;
+		case MessageType.ACK: {
+			// The ACK carries the ID the server gave our message, which later
+			// edits and deletions refer to.
+			const li = sent.get(msg.correlationId);
+			if (li) {
+				li.dataset.id = msg.id;
+			}
+			sent.delete(msg.correlationId);
+			break;
+		}
+		case MessageType.TYPING:
+			setTypist(msg.sender, !msg.remove);
+			break;
+		case MessageType.JOIN:
+			show(`*** ${msg.sender} joined the chat ***`, true);
+			break;
+		case MessageType.LEAVE:
+			setTypist(msg.sender, false);
+			show(`*** ${msg.sender} left the chat ***`, true);
+			break;
+		case MessageType.NACK:
+			sent.delete(msg.correlationId);
+			show(`*** message not delivered: ${msg.content} ***`, true);
+			break;
+	}
+}
+
+let conn;
+let username;
+// nextCorrelationId numbers sent messages so the server's NACK for one can be
+// reported.
+let nextCorrelationId = 0;
+// sent maps the correlation IDs of messages awaiting an ACK to their element.
+const sent = new Map();
+
+// start connects and joins as username, replacing conn.
+async function start() {
+	conn = await connect();
+	conn.onmessage = (bytes) => {
+		const msg = decodeMessage(bytes);
+		if (!msg) {
+			return;
+		}
+		if (msg.type === MessageType.RECONNECT) {
+			reconnect(msg.content);
+			return;
+		}
+		render(msg);
+	};
+	conn.onclose = () => show("*** disconnected from server ***", true);
+	conn.send(encodeMessage({ type: MessageType.JOIN, sender: username }));
+	document.getElementById("status").textContent =
+		`Connected as ${username} via ${conn.name}`;
+}
+
+// reconnect follows the server's request to reconnect while it hands over to
+// a new process, retrying a few times while the new process takes over.
+async function reconnect(notice) {
+	show(`*** ${notice} ***`, true);
+	const old = conn;
+	old.onclose = () => {};
+	old.close();
+	for (let attempt = 1; ; attempt++) {
+		try {
+			await start();
+			show("*** reconnected ***", true);
+			return;
+		} catch (err) {
+			if (attempt === 5) {
+				show(`*** failed to reconnect: ${err.message} ***`, true);
+				return;
+			}
+			await new Promise((resolve) => setTimeout(resolve, 500));
+		}
+	}
+}
+
+document.getElementById("join").addEventListener("submit", async (ev) => {
+	ev.preventDefault();
+	username = document.getElementById("username").value.trim();
+	if (!username) {
+		return;
+	}
+
+	try {
+		await start();
+	} catch (err) {
+		alert(`Failed to connect: ${err.message}`);
+		return;
+	}
+
+	document.getElementById("join").hidden = true;
+	document.getElementById("chat").hidden = false;
+
+	const text = document.getElementById("text");
+	// typingSentAt is when we last said we are typing, or 0 if we have not
+	// since sending a message or clearing the input.
+	let typingSentAt = 0;
+	text.addEventListener("input", () => {
+		const typing = text.value.trim() !== "";
+		if (typing && Date.now() - typingSentAt >= TYPING_TIMEOUT_MS / 2) {
+			typingSentAt = Date.now();
+			conn.sendDatagram(
+				encodeMessage({ type: MessageType.TYPING, sender: username }),
+			);
+		} else if (!typing && typingSentAt) {
+			typingSentAt = 0;
+			conn.sendDatagram(
+				encodeMessage({
+					type: MessageType.TYPING,
+					sender: username,
+					remove: true,
+				}),
+			);
+		}
+	});
+	document.getElementById("compose").addEventListener("submit", (ev) => {
+		ev.preventDefault();
+		const content = text.value.trim();
+		if (!content) {
+			return;
+		}
+		const correlationId = String(++nextCorrelationId);
+		conn.send(
+			encodeMessage({
+				type: MessageType.TEXT,
+				sender: username,
+				content,
+				correlationId,
+			}),
+		);
+		sent.set(correlationId, show(content));
+		text.value = "";
+		// Others take the message as the end of our typing.
+		typingSentAt = 0;
+	});
+
+	window.addEventListener("beforeunload", () => {
+		conn.send(encodeMessage({ type: MessageType.LEAVE, sender: username }));
+		conn.close();
+	});
+	text.focus();
+});
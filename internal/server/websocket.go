@@ -1,7 +1,6 @@
 package server
 
 import (
-	"bufio"
 	"crypto/sha1"
 	"encoding/base64"
 	"fmt"
@@ -10,17 +9,18 @@ import (
 	"strings"
 )
 
-// upgradeWebSocket performs WebSocket handshake and returns WebSocket connection
-func (s *Server) upgradeWebSocket(rawConn net.Conn, reader *bufio.Reader) (Connection, error) {
-	// Parse HTTP request
-	req, err := http.ReadRequest(reader)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read HTTP request: %w", err)
-	}
-
-	// Validate WebSocket upgrade request
-	if !isWebSocketUpgrade(req) {
-		return nil, fmt.Errorf("not a WebSocket upgrade request")
+// upgradeWebSocket performs WebSocket handshake and returns WebSocket connection.
+// req must already have been read from rawConn and satisfy isWebSocketUpgrade.
+func (s *Server) upgradeWebSocket(rawConn net.Conn, req *http.Request) (Connection, error) {
+	// Reject cross-site upgrades before completing the handshake so a browser
+	// sees a real HTTP status rather than a dropped connection.
+	if !s.originAllowed(req) {
+		writeHTTPError(rawConn, http.StatusForbidden)
+		return nil, fmt.Errorf(
+			"origin %q not allowed for host %q",
+			req.Header.Get("Origin"),
+			req.Host,
+		)
 	}
 
 	// Compute accept key
@@ -52,6 +52,25 @@ func isWebSocketUpgrade(req *http.Request) bool {
 		strings.Contains(strings.ToLower(req.Header.Get("Connection")), "upgrade")
 }
 
+// writeHTTPError writes a minimal HTTP/1.1 error response for status. Write
+// errors are ignored because the caller closes the connection right after.
+func writeHTTPError(conn net.Conn, status int) {
+	body := http.StatusText(status) + "\n"
+	response := fmt.Sprintf(
+		"HTTP/1.1 %d %s\r\n"+
+			"Content-Type: text/plain; charset=utf-8\r\n"+
+			"Content-Length: %d\r\n"+
+			"Connection: close\r\n"+
+			"\r\n"+
+			"%s",
+		status,
+		http.StatusText(status),
+		len(body),
+		body,
+	)
+	_, _ = conn.Write([]byte(response))
+}
+
 func computeAcceptKey(key string) string {
 	const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
 	h := sha1.New()
@@ -3,23 +3,69 @@ package server
 import (
 	"crypto/tls"
 	"errors"
-	"fmt"
-	"log"
 	"net"
 	"net/http"
+	"os"
+	"sync"
 	"time"
 
+	"github.com/omochice/toy-socket-chat/pkg/protocol"
+	"github.com/quic-go/quic-go"
 	"github.com/quic-go/quic-go/http3"
 	"github.com/quic-go/webtransport-go"
 )
 
-// WebTransportConnection wraps a WebTransport session and its single
-// bidirectional stream so the chat session can be treated as a byte stream,
-// exactly like TCP. Framing follows the same assumption as TCP: one Read is
-// expected to yield one whole protobuf message.
+// bulkMessageSize is the size above which a message is written to the bulk
+// stream the server opens for a session, so it does not hold up the chat
+// stream.
+const bulkMessageSize = 1024
+
+// maxStreamsPerSession bounds the bidirectional streams a WebTransport client
+// may have open at once, including the chat stream.
+const maxStreamsPerSession = 4
+
+// Stream error codes sent when refusing a stream. They start at 1, since 0
+// means no error.
+const (
+	// streamErrorTooMany refuses a stream beyond maxStreamsPerSession.
+	streamErrorTooMany webtransport.StreamErrorCode = iota + 1
+	// streamErrorUnknownPurpose refuses a stream opened for a purpose the
+	// server does not know.
+	streamErrorUnknownPurpose
+)
+
+// WebTransportConnection wraps a WebTransport session and its bidirectional
+// streams. The first stream the client opens carries the chat. Further
+// streams, opened by either end, start with a frame naming their purpose: the
+// only one known is protocol.StreamPurposeBulk, a stream that large messages
+// are sent on so they do not hold up the chat, and streams the client opens
+// for anything else are refused. The server opens its own bulk stream as the
+// session starts, since the chat stream it takes first may not be the first
+// the client opened if it does not wait. Messages on every stream are framed
+// with protocol.WriteFrame, and those the client sends on any of them are
+// read as coming from the one connection. Ephemeral messages may also travel
+// as session datagrams, one message each.
 type WebTransportConnection struct {
 	session *webtransport.Session
 	stream  *webtransport.Stream
+
+	// reads carries the messages readStream reads from each stream, so
+	// ReadMessage can return them in arrival order.
+	reads chan streamRead
+
+	mu sync.Mutex
+	// streams counts the streams the client has open, and bulk is the
+	// server's bulk stream, or nil.
+	streams  int
+	bulk     *webtransport.Stream
+	deadline time.Time
+}
+
+// streamRead is one message read from a stream of a WebTransport session, or
+// the error that ended the stream.
+type streamRead struct {
+	data []byte
+	err  error
 }
 
 // NewWebTransportConnection creates a new WebTransportConnection from an
@@ -28,22 +74,158 @@ func NewWebTransportConnection(
 	session *webtransport.Session,
 	stream *webtransport.Stream,
 ) *WebTransportConnection {
-	return &WebTransportConnection{
+	c := &WebTransportConnection{
 		session: session,
 		stream:  stream,
+		reads:   make(chan streamRead),
+		streams: 1,
+	}
+	go c.readStream(stream)
+	return c
+}
+
+// readStream passes the messages read from stream to ReadMessage until the
+// stream or the session ends. Only the chat stream ending ends the
+// connection.
+func (c *WebTransportConnection) readStream(stream *webtransport.Stream) {
+	for {
+		data, err := protocol.ReadFrame(stream)
+		if err != nil && stream != c.stream {
+			return
+		}
+		select {
+		case c.reads <- streamRead{data: data, err: err}:
+		case <-c.session.Context().Done():
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// openBulk opens the stream the server writes large messages to. If it cannot,
+// they go on the chat stream.
+func (c *WebTransportConnection) openBulk() error {
+	bulk, err := c.session.OpenStream()
+	if err != nil {
+		return err
+	}
+	if err := protocol.WriteFrame(bulk, []byte(protocol.StreamPurposeBulk)); err != nil {
+		bulk.CancelWrite(0)
+		return err
+	}
+	c.mu.Lock()
+	c.bulk = bulk
+	c.mu.Unlock()
+	return nil
+}
+
+// acceptStreams accepts the further streams the client opens until the
+// session ends. Streams beyond maxStreamsPerSession are refused.
+func (c *WebTransportConnection) acceptStreams() {
+	for {
+		stream, err := c.session.AcceptStream(c.session.Context())
+		if err != nil {
+			return
+		}
+		c.mu.Lock()
+		accepted := c.streams < maxStreamsPerSession
+		if accepted {
+			c.streams++
+		}
+		c.mu.Unlock()
+		if !accepted {
+			refuseStream(stream, streamErrorTooMany)
+			continue
+		}
+		go c.serveStream(stream)
 	}
 }
 
+// serveStream reads the purpose a further stream opens with. The messages on a
+// bulk stream are read like the chat stream's until it ends; a stream for any
+// other purpose is refused. Either way it then no longer counts toward
+// maxStreamsPerSession.
+func (c *WebTransportConnection) serveStream(stream *webtransport.Stream) {
+	purpose, err := protocol.ReadFrame(stream)
+	if err != nil || string(purpose) != protocol.StreamPurposeBulk {
+		c.releaseStream()
+		refuseStream(stream, streamErrorUnknownPurpose)
+		return
+	}
+	c.readStream(stream)
+	c.releaseStream()
+}
+
+// releaseStream stops counting a stream the client opened, which has ended.
+func (c *WebTransportConnection) releaseStream() {
+	c.mu.Lock()
+	c.streams--
+	c.mu.Unlock()
+}
+
+// dropBulk stops writing to stream, a bulk stream that has failed.
+func (c *WebTransportConnection) dropBulk(stream *webtransport.Stream) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.bulk == stream {
+		c.bulk = nil
+	}
+}
+
+// refuseStream aborts both directions of stream with code.
+func refuseStream(stream *webtransport.Stream, code webtransport.StreamErrorCode) {
+	stream.CancelRead(code)
+	stream.CancelWrite(code)
+}
+
 func (c *WebTransportConnection) RemoteAddr() net.Addr {
 	return c.session.RemoteAddr()
 }
 
+// Write writes data to the chat stream, or to the bulk stream if data is
+// larger than bulkMessageSize and the server could open one. If writing to
+// the bulk stream fails, it is dropped and data goes on the chat stream.
 func (c *WebTransportConnection) Write(data []byte) (int, error) {
-	return c.stream.Write(data)
+	if len(data) > bulkMessageSize {
+		c.mu.Lock()
+		bulk := c.bulk
+		c.mu.Unlock()
+		if bulk != nil {
+			if err := protocol.WriteFrame(bulk, data); err == nil {
+				return len(data), nil
+			}
+			c.dropBulk(bulk)
+		}
+	}
+	if err := protocol.WriteFrame(c.stream, data); err != nil {
+		return 0, err
+	}
+	return len(data), nil
 }
 
-func (c *WebTransportConnection) Read(buf []byte) (int, error) {
-	return c.stream.Read(buf)
+// ReadMessage returns the message next read from any of the session's
+// streams.
+func (c *WebTransportConnection) ReadMessage() ([]byte, error) {
+	c.mu.Lock()
+	deadline := c.deadline
+	c.mu.Unlock()
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case r := <-c.reads:
+		return r.data, r.err
+	case <-c.session.Context().Done():
+		return nil, net.ErrClosed
+	case <-timeout:
+		return nil, os.ErrDeadlineExceeded
+	}
 }
 
 // Close closes the stream and the session. The session is closed as well as the
@@ -57,33 +239,54 @@ func (c *WebTransportConnection) Close() error {
 }
 
 func (c *WebTransportConnection) SetReadDeadline(t time.Time) error {
-	return c.stream.SetReadDeadline(t)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.deadline = t
+	return nil
 }
 
-// startWebTransport binds a WebTransport (HTTP/3 over QUIC) endpoint to the same
-// port as the already-listening TCP listener and starts serving in a background
-// goroutine tracked by s.wg.
-//
-// The UDP port is derived from s.listener.Addr() rather than from s.address
-// because the TCP listener may have been created with a wildcard port (":0"),
-// in which case the real port is only known after the listener is bound.
-func (s *Server) startWebTransport() error {
-	tcpAddr, ok := s.listener.Addr().(*net.TCPAddr)
-	if !ok {
-		return fmt.Errorf("listener address is not TCP: %T", s.listener.Addr())
+// WriteDatagram sends data as a session datagram. Datagrams must fit in one
+// QUIC packet; larger messages get ErrNoDatagrams.
+func (c *WebTransportConnection) WriteDatagram(data []byte) error {
+	err := c.session.SendDatagram(data)
+	var tooLarge *quic.DatagramTooLargeError
+	if errors.As(err, &tooLarge) {
+		return ErrNoDatagrams
 	}
+	return err
+}
 
-	udpConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: tcpAddr.IP, Port: tcpAddr.Port})
-	if err != nil {
-		return fmt.Errorf("failed to listen on UDP port %d: %w", tcpAddr.Port, err)
+// ReadDatagram receives the next session datagram. It fails once the session
+// is closed.
+func (c *WebTransportConnection) ReadDatagram() ([]byte, error) {
+	return c.session.ReceiveDatagram(c.session.Context())
+}
+
+// startWebTransport serves WebTransport (HTTP/3 over QUIC) on every bound UDP
+// listener, each in a background goroutine tracked by s.wg. All of them share
+// one webtransport.Server and therefore one TLS configuration.
+func (s *Server) startWebTransport() {
+	var conns []net.PacketConn
+	for _, l := range s.listeners {
+		if l.packet != nil {
+			conns = append(conns, l.packet)
+		}
+	}
+	if len(conns) == 0 {
+		if s.tlsCert.Load() == nil {
+			s.logger.Info("WebTransport disabled (no TLS certificate configured)")
+		} else {
+			s.logger.Info("WebTransport disabled (no UDP listener configured)")
+		}
+		return
 	}
 
 	h3 := &http3.Server{
 		// NextProtos must advertise the HTTP/3 ALPN; webtransport-go passes this
 		// TLSConfig straight to the QUIC listener without adding it.
 		TLSConfig: &tls.Config{
-			Certificates: []tls.Certificate{*s.tlsCert},
-			NextProtos:   []string{http3.NextProtoH3},
+			GetCertificate: s.getCertificate,
+			NextProtos:     []string{http3.NextProtoH3},
 		},
 		Handler: http.HandlerFunc(s.handleWebTransport),
 	}
@@ -91,54 +294,100 @@ func (s *Server) startWebTransport() error {
 	// Server.Upgrade relies on; without it Upgrade cannot find the QUIC
 	// connection and the client's WebTransport negotiation fails.
 	webtransport.ConfigureHTTP3Server(h3)
-	s.wtServer = &webtransport.Server{H3: h3}
-
-	s.wg.Add(1)
-	go func() {
-		defer s.wg.Done()
-		// Serve always returns a non-nil error; a shutdown-triggered error is
-		// expected once Stop closes the server, so only report unexpected ones.
-		if err := s.wtServer.Serve(udpConn); err != nil {
-			select {
-			case <-s.quit:
-			default:
-				log.Printf("WebTransport server error: %v", err)
+	s.wtServer = &webtransport.Server{H3: h3, CheckOrigin: s.originAllowed}
+
+	for _, conn := range conns {
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			// Serve always returns a non-nil error; a shutdown-triggered error is
+			// expected once Stop closes the server, so only report unexpected ones.
+			if err := s.wtServer.Serve(conn); err != nil {
+				select {
+				case <-s.quit:
+				case <-s.draining:
+				default:
+					s.logger.Error("WebTransport server error", "error", err)
+				}
 			}
-		}
-	}()
+		}()
+		s.logger.Info("WebTransport enabled", "addr", conn.LocalAddr().String())
+	}
+}
 
-	log.Printf("WebTransport enabled on udp %s", udpConn.LocalAddr().String())
-	return nil
+// closeWebTransport closes the WebTransport server, if started, ending its
+// sessions and its reads from the UDP listeners.
+func (s *Server) closeWebTransport() {
+	if s.wtServer == nil {
+		return
+	}
+	s.wtClose.Do(func() {
+		if err := s.wtServer.Close(); err != nil {
+			s.logger.Error("Error closing WebTransport server", "error", err)
+		}
+	})
 }
 
 // handleWebTransport upgrades an incoming HTTP/3 request to a WebTransport
-// session, takes over the single bidirectional stream the client opens, and
+// session, takes over the bidirectional stream the client opens first, and
 // registers it as a chat client. It blocks until the session ends because the
 // HTTP/3 request stream is the session's control stream: returning early would
 // tear the session down while the chat is still in progress.
 func (s *Server) handleWebTransport(w http.ResponseWriter, r *http.Request) {
+	// Check the origin here rather than leaving it to Upgrade, which reports a
+	// rejected origin as a generic error we would answer with 400.
+	select {
+	case <-s.draining:
+		// The new process reads from the same UDP sockets; send the client
+		// there on its retry.
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	default:
+	}
+	if !s.originAllowed(r) {
+		s.logger.Warn(
+			"WebTransport origin not allowed",
+			"remote_addr", r.RemoteAddr,
+			"origin", r.Header.Get("Origin"),
+			"host", r.Host,
+		)
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
 	session, err := s.wtServer.Upgrade(w, r)
 	if err != nil {
-		log.Printf("WebTransport upgrade failed: %v", err)
+		s.logger.Warn("WebTransport upgrade failed", "remote_addr", r.RemoteAddr, "error", err)
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
 
 	stream, err := session.AcceptStream(r.Context())
 	if err != nil {
-		log.Printf("Failed to accept WebTransport stream: %v", err)
+		s.logger.Warn(
+			"Failed to accept WebTransport stream",
+			"remote_addr", r.RemoteAddr,
+			"error", err,
+		)
 		if closeErr := session.CloseWithError(0, ""); closeErr != nil {
-			log.Printf("Error closing WebTransport session: %v", closeErr)
+			s.logger.Debug("Error closing WebTransport session", "error", closeErr)
 		}
 		return
 	}
 
 	conn := NewWebTransportConnection(session, stream)
-	log.Printf("WebTransport connection from %s", conn.RemoteAddr())
-	s.register(conn)
+	if err := conn.openBulk(); err != nil {
+		s.logger.Debug(
+			"Failed to open WebTransport bulk stream",
+			"remote_addr", r.RemoteAddr,
+			"error", err,
+		)
+	}
+	s.register(conn, TransportWebTransport)
 
 	// register handles the client in a background goroutine that owns conn.
 	// Keep the request stream alive until the session is closed (by the client
-	// leaving or by Stop) so the session is not torn down prematurely.
-	<-session.Context().Done()
+	// leaving or by Stop) so the session is not torn down prematurely,
+	// meanwhile accepting any further streams the client opens.
+	conn.acceptStreams()
 }
@@ -0,0 +1,160 @@
+// Package systemd implements the parts of the systemd service protocol the
+// chat server uses, socket activation and sd_notify, in pure Go so no cgo or
+// libsystemd is needed.
+package systemd
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// listenFDsStart is the first file descriptor passed by socket activation;
+// 0-2 are stdin, stdout and stderr.
+const listenFDsStart = 3
+
+// Socket is a socket passed to the process by systemd socket activation.
+// Exactly one of Listener and PacketConn is set, depending on whether the
+// socket unit used ListenStream= or ListenDatagram=.
+type Socket struct {
+	// Name is the socket's FileDescriptorName=, or the socket unit's name if
+	// none was set.
+	Name       string
+	Listener   net.Listener
+	PacketConn net.PacketConn
+}
+
+// Sockets returns the sockets passed by systemd, in the order the socket unit
+// lists them. It returns nil if the process was not socket-activated. The
+// activation environment variables are unset so child processes do not
+// mistake the sockets for their own.
+func Sockets() ([]Socket, error) {
+	defer func() {
+		_ = os.Unsetenv("LISTEN_PID")
+		_ = os.Unsetenv("LISTEN_FDS")
+		_ = os.Unsetenv("LISTEN_FDNAMES")
+	}()
+	return sockets(os.Getenv, listenFDsStart)
+}
+
+// sockets implements Sockets, reading the environment through getenv and
+// numbering descriptors from first so tests can pass descriptors of their own.
+func sockets(getenv func(string) string, first int) ([]Socket, error) {
+	// LISTEN_PID guards against acting on variables inherited from a parent
+	// that was itself socket-activated.
+	if getenv("LISTEN_PID") != strconv.Itoa(os.Getpid()) {
+		return nil, nil
+	}
+	count, err := strconv.Atoi(getenv("LISTEN_FDS"))
+	if err != nil || count <= 0 {
+		return nil, nil
+	}
+	var names []string
+	if v := getenv("LISTEN_FDNAMES"); v != "" {
+		names = strings.Split(v, ":")
+	}
+
+	result := make([]Socket, 0, count)
+	for i := range count {
+		var name string
+		if i < len(names) {
+			name = names[i]
+		}
+		socket, err := fileSocket(os.NewFile(uintptr(first+i), name), name)
+		if err != nil {
+			closeSockets(result)
+			return nil, err
+		}
+		result = append(result, socket)
+	}
+	return result, nil
+}
+
+// fileSocket turns f into a Socket and closes f; the net package keeps its own
+// duplicate of the descriptor.
+func fileSocket(f *os.File, name string) (Socket, error) {
+	defer func() { _ = f.Close() }()
+
+	// FileListener rejects datagram sockets, so trying it first tells the two
+	// kinds apart without platform-specific getsockopt calls.
+	if ln, err := net.FileListener(f); err == nil {
+		return Socket{Name: name, Listener: ln}, nil
+	}
+	pc, err := net.FilePacketConn(f)
+	if err != nil {
+		return Socket{}, fmt.Errorf(
+			"inherited descriptor %d (%s) is not a usable socket: %w",
+			f.Fd(),
+			name,
+			err,
+		)
+	}
+	return Socket{Name: name, PacketConn: pc}, nil
+}
+
+func closeSockets(sockets []Socket) {
+	for _, s := range sockets {
+		if s.Listener != nil {
+			_ = s.Listener.Close()
+		} else {
+			_ = s.PacketConn.Close()
+		}
+	}
+}
+
+// Notification states understood by systemd (see sd_notify(3)).
+const (
+	Ready    = "READY=1"
+	Stopping = "STOPPING=1"
+	Watchdog = "WATCHDOG=1"
+)
+
+// MainPID returns the state telling systemd that pid is now the service's
+// main process, as after a binary upgrade that hands over to a new process.
+func MainPID(pid int) string {
+	return "MAINPID=" + strconv.Itoa(pid)
+}
+
+// Notify sends state to the service manager over $NOTIFY_SOCKET. It reports
+// whether the notification was sent; when the process is not running under
+// systemd (no NOTIFY_SOCKET), it does nothing and returns false, nil.
+func Notify(state string) (bool, error) {
+	addr := os.Getenv("NOTIFY_SOCKET")
+	if addr == "" {
+		return false, nil
+	}
+	// The net package maps a leading '@' to Linux's abstract namespace, which
+	// is the form systemd uses, so the address needs no translation.
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: addr, Net: "unixgram"})
+	if err != nil {
+		return false, fmt.Errorf("failed to connect to notify socket: %w", err)
+	}
+	defer func() { _ = conn.Close() }()
+
+	if _, err := conn.Write([]byte(state)); err != nil {
+		return false, fmt.Errorf("failed to notify service manager: %w", err)
+	}
+	return true, nil
+}
+
+// WatchdogInterval returns the service's WatchdogSec=, the interval within
+// which the service must send Watchdog, or 0 if the watchdog is disabled.
+// Notifying at half the interval, as systemd recommends, leaves room for
+// scheduling delays.
+func WatchdogInterval() (time.Duration, error) {
+	usec := os.Getenv("WATCHDOG_USEC")
+	if usec == "" {
+		return 0, nil
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0, nil
+	}
+	n, err := strconv.ParseInt(usec, 10, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid WATCHDOG_USEC %q", usec)
+	}
+	return time.Duration(n) * time.Microsecond, nil
+}
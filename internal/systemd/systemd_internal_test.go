@@ -0,0 +1,73 @@
+package systemd
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"testing"
+)
+
+// socketFile returns a duplicate of the descriptor underlying ln or pc, as
+// systemd would pass it.
+func socketFile(t *testing.T, s interface{ File() (*os.File, error) }) *os.File {
+	t.Helper()
+
+	f, err := s.File()
+	if err != nil {
+		t.Fatalf("Failed to get socket file: %v", err)
+	}
+	return f
+}
+
+func TestSockets(t *testing.T) {
+	ln, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer func() { _ = ln.Close() }()
+	pc, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer func() { _ = pc.Close() }()
+
+	// Socket activation passes consecutive descriptors, so duplicate both
+	// onto a fresh, consecutive pair.
+	tcpFile := socketFile(t, ln)
+	udpFile := socketFile(t, pc)
+	if int(udpFile.Fd()) != int(tcpFile.Fd())+1 {
+		t.Skipf("Descriptors %d and %d are not consecutive", tcpFile.Fd(), udpFile.Fd())
+	}
+	first := int(tcpFile.Fd())
+
+	env := map[string]string{
+		"LISTEN_PID":     strconv.Itoa(os.Getpid()),
+		"LISTEN_FDS":     "2",
+		"LISTEN_FDNAMES": "chat:webtransport",
+	}
+	sockets, err := sockets(func(key string) string { return env[key] }, first)
+	if err != nil {
+		t.Fatalf("sockets() error = %v", err)
+	}
+	defer closeSockets(sockets)
+
+	if len(sockets) != 2 {
+		t.Fatalf("sockets() returned %d sockets, want 2", len(sockets))
+	}
+	if sockets[0].Name != "chat" || sockets[0].Listener == nil {
+		t.Errorf("sockets[0] = %+v, want stream socket named chat", sockets[0])
+	} else if got := sockets[0].Listener.Addr().String(); got != ln.Addr().String() {
+		t.Errorf("sockets[0] address = %s, want %s", got, ln.Addr())
+	}
+	if sockets[1].Name != "webtransport" || sockets[1].PacketConn == nil {
+		t.Errorf("sockets[1] = %+v, want datagram socket named webtransport", sockets[1])
+	}
+}
+
+func TestSockets_OtherProcess(t *testing.T) {
+	env := map[string]string{"LISTEN_PID": "1", "LISTEN_FDS": "1"}
+	sockets, err := sockets(func(key string) string { return env[key] }, 3)
+	if err != nil || sockets != nil {
+		t.Errorf("sockets() = %v, %v, want nil, nil for another process's sockets", sockets, err)
+	}
+}
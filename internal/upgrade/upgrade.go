@@ -0,0 +1,379 @@
+// Package upgrade replaces the running server with a new copy of its binary
+// without closing the listening sockets: the old process starts the new one
+// with the sockets as inherited file descriptors, waits for it to report that
+// it is serving, and then drains its own clients.
+package upgrade
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net"
+	"os"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/omochice/toy-socket-chat/internal/server"
+)
+
+// envSockets describes the inherited sockets to the new process. Its presence
+// is what tells a process it was started by Exec.
+const envSockets = "CHAT_UPGRADE_SOCKETS"
+
+// firstFD is the descriptor of the first inherited socket; 0-2 are stdin,
+// stdout and stderr. The chat listeners come first, then the other sockets,
+// then the readiness pipe and, if the server has a certificate, a pipe
+// carrying it.
+const firstFD = 3
+
+// sockets is the JSON form of the inherited sockets passed in envSockets.
+type sockets struct {
+	Listeners []listenerSpec `json:"listeners"`
+	// Sockets lists the configured addresses of the admin API, metrics and
+	// other sockets.
+	Sockets []string `json:"sockets,omitempty"`
+	// Certificate reports whether the certificate pipe follows the readiness
+	// pipe.
+	Certificate bool `json:"certificate,omitempty"`
+}
+
+// listenerSpec is the JSON form of a server.Listener.
+type listenerSpec struct {
+	Network    string             `json:"network"`
+	Address    string             `json:"address"`
+	Transports []server.Transport `json:"transports,omitempty"`
+	TLS        bool               `json:"tls,omitempty"`
+	Mode       os.FileMode        `json:"mode,omitempty"`
+}
+
+// Exec starts a new copy of the running binary, with the same arguments, and
+// hands it srv's listening sockets together with extra, other TCP listeners
+// keyed by their configured address (such as a cluster node's). It returns
+// once the new process has called Handoff.Ready, after which srv should be
+// drained. srv's certificate is handed over too, so a generated one stays the
+// same across the upgrade. If the new process exits first, or is not ready within timeout, it
+// is killed and an error is returned; srv keeps serving either way.
+func Exec(
+	srv *server.Server,
+	extra map[string]net.Listener,
+	timeout time.Duration,
+) (*os.Process, error) {
+	listeners, files, err := srv.ListenerFiles()
+	if err != nil {
+		return nil, err
+	}
+	defer func() { closeFiles(files) }()
+	socketFiles, err := srv.HTTPListenerFiles()
+	if err != nil {
+		return nil, err
+	}
+	for addr, ln := range extra {
+		tcpListener, ok := ln.(*net.TCPListener)
+		if !ok {
+			closeFiles(slices.Collect(maps.Values(socketFiles)))
+			return nil, fmt.Errorf("listener %s cannot be handed over: %T", addr, ln)
+		}
+		f, err := tcpListener.File()
+		if err != nil {
+			closeFiles(slices.Collect(maps.Values(socketFiles)))
+			return nil, fmt.Errorf("failed to duplicate listener %s: %w", addr, err)
+		}
+		socketFiles[addr] = f
+	}
+
+	var desc sockets
+	for _, l := range listeners {
+		desc.Listeners = append(desc.Listeners, listenerSpec{
+			Network:    l.Network,
+			Address:    l.Address,
+			Transports: l.Transports,
+			TLS:        l.TLS,
+			Mode:       l.Mode,
+		})
+	}
+	for addr, f := range socketFiles {
+		desc.Sockets = append(desc.Sockets, addr)
+		files = append(files, f)
+	}
+	cert := srv.TLSCertificate()
+	desc.Certificate = cert != nil
+	encoded, err := json.Marshal(desc)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode sockets: %w", err)
+	}
+
+	executable, err := os.Executable()
+	if err != nil {
+		return nil, fmt.Errorf("failed to find executable: %w", err)
+	}
+	readyReader, readyWriter, err := os.Pipe()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create readiness pipe: %w", err)
+	}
+	defer func() { _ = readyReader.Close() }()
+	files = append(files, readyWriter)
+	if desc.Certificate {
+		certReader, err := certificatePipe(cert)
+		if err != nil {
+			_ = readyWriter.Close()
+			return nil, err
+		}
+		files = append(files, certReader)
+	}
+
+	fds := []uintptr{os.Stdin.Fd(), os.Stdout.Fd(), os.Stderr.Fd()}
+	for _, f := range files {
+		fd, err := rawFD(f)
+		if err != nil {
+			_ = readyWriter.Close()
+			return nil, err
+		}
+		fds = append(fds, fd)
+	}
+	pid, err := syscall.ForkExec(executable, os.Args, &syscall.ProcAttr{
+		Env:   childEnv(os.Environ(), string(encoded)),
+		Files: fds,
+	})
+	// Only the child may hold the write end, so its exit ends the read below.
+	_ = readyWriter.Close()
+	if err != nil {
+		return nil, fmt.Errorf("failed to start new process: %w", err)
+	}
+	proc, err := os.FindProcess(pid)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find new process: %w", err)
+	}
+
+	if err := waitReady(readyReader, timeout); err != nil {
+		_ = proc.Kill()
+		_, _ = proc.Wait()
+		return nil, err
+	}
+	return proc, nil
+}
+
+// rawFD returns f's descriptor. Unlike f.Fd, it leaves the descriptor in
+// non-blocking mode: a duplicated socket shares that mode with the listener it
+// came from, so switching it to blocking would stall this process's accept
+// loop.
+func rawFD(f *os.File) (uintptr, error) {
+	conn, err := f.SyscallConn()
+	if err != nil {
+		return 0, fmt.Errorf("failed to get descriptor of %s: %w", f.Name(), err)
+	}
+	var fd uintptr
+	if err := conn.Control(func(v uintptr) { fd = v }); err != nil {
+		return 0, fmt.Errorf("failed to get descriptor of %s: %w", f.Name(), err)
+	}
+	return fd, nil
+}
+
+// certificatePipe returns the read end of a pipe holding cert and its key in
+// PEM form. The write end is closed, so the reader sees EOF after them; they
+// fit in the pipe buffer.
+func certificatePipe(cert *tls.Certificate) (*os.File, error) {
+	key, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode certificate key: %w", err)
+	}
+	var encoded []byte
+	for _, der := range cert.Certificate {
+		block := &pem.Block{Type: "CERTIFICATE", Bytes: der}
+		encoded = append(encoded, pem.EncodeToMemory(block)...)
+	}
+	encoded = append(encoded, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: key})...)
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create certificate pipe: %w", err)
+	}
+	_, err = w.Write(encoded)
+	_ = w.Close()
+	if err != nil {
+		_ = r.Close()
+		return nil, fmt.Errorf("failed to write certificate: %w", err)
+	}
+	return r, nil
+}
+
+// closeFiles closes this process's duplicates once the new process has its own.
+func closeFiles(files []*os.File) {
+	for _, f := range files {
+		_ = f.Close()
+	}
+}
+
+// childEnv returns env for the new process with the socket description set.
+// WATCHDOG_PID is dropped since it names this process; without it systemd's
+// watchdog settings apply to whichever process reads them.
+func childEnv(env []string, desc string) []string {
+	result := make([]string, 0, len(env)+1)
+	for _, kv := range env {
+		key, _, _ := strings.Cut(kv, "=")
+		if key == envSockets || key == "WATCHDOG_PID" {
+			continue
+		}
+		result = append(result, kv)
+	}
+	return append(result, envSockets+"="+desc)
+}
+
+// waitReady waits for the new process to write to the readiness pipe.
+func waitReady(r *os.File, timeout time.Duration) error {
+	if err := r.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		return fmt.Errorf("failed to set readiness timeout: %w", err)
+	}
+	buf := make([]byte, 1)
+	_, err := r.Read(buf)
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, io.EOF):
+		return errors.New("new process exited before it was ready")
+	case errors.Is(err, os.ErrDeadlineExceeded):
+		return fmt.Errorf("new process not ready within %s", timeout)
+	default:
+		return fmt.Errorf("failed to wait for new process: %w", err)
+	}
+}
+
+// Handoff is the state passed to a process started by Exec.
+type Handoff struct {
+	// Listeners are the previous process's chat listeners, with their sockets
+	// set as StreamSocket or PacketSocket.
+	Listeners []server.Listener
+	// Sockets are its admin API, metrics and other sockets, keyed by their
+	// configured address.
+	Sockets map[string]net.Listener
+	// Certificate is the certificate the previous process presented, or nil
+	// if it had none.
+	Certificate *tls.Certificate
+
+	ready *os.File
+}
+
+// Inherited returns the sockets handed over by the process that started this
+// one with Exec. It returns nil if this process was not started by Exec. The
+// environment variable describing them is unset so that a later upgrade of
+// this process starts from a clean slate.
+func Inherited() (*Handoff, error) {
+	encoded, ok := os.LookupEnv(envSockets)
+	if !ok {
+		return nil, nil
+	}
+	_ = os.Unsetenv(envSockets)
+	return inherited(encoded, firstFD)
+}
+
+// inherited implements Inherited, numbering descriptors from first so tests
+// can pass descriptors of their own.
+func inherited(encoded string, first int) (*Handoff, error) {
+	var desc sockets
+	if err := json.Unmarshal([]byte(encoded), &desc); err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", envSockets, err)
+	}
+
+	fd := first
+	next := func(name string) *os.File {
+		f := os.NewFile(uintptr(fd), name)
+		fd++
+		return f
+	}
+	h := &Handoff{Sockets: make(map[string]net.Listener)}
+	fail := func(addr string, err error) (*Handoff, error) {
+		h.Close()
+		return nil, fmt.Errorf("inherited listener %s: %w", addr, err)
+	}
+
+	for _, spec := range desc.Listeners {
+		l := server.Listener{
+			Network:    spec.Network,
+			Address:    spec.Address,
+			Transports: spec.Transports,
+			TLS:        spec.TLS,
+			Mode:       spec.Mode,
+		}
+		f := next(spec.Address)
+		var err error
+		if strings.HasPrefix(spec.Network, "udp") {
+			l.PacketSocket, err = net.FilePacketConn(f)
+		} else {
+			l.StreamSocket, err = net.FileListener(f)
+		}
+		_ = f.Close()
+		if err != nil {
+			return fail(spec.Address, err)
+		}
+		h.Listeners = append(h.Listeners, l)
+	}
+	for _, addr := range desc.Sockets {
+		f := next(addr)
+		ln, err := net.FileListener(f)
+		_ = f.Close()
+		if err != nil {
+			return fail(addr, err)
+		}
+		h.Sockets[addr] = ln
+	}
+	h.ready = next("upgrade-ready")
+	if desc.Certificate {
+		f := next("upgrade-certificate")
+		encoded, err := io.ReadAll(f)
+		_ = f.Close()
+		if err != nil {
+			h.Close()
+			return nil, fmt.Errorf("failed to read inherited certificate: %w", err)
+		}
+		cert, err := tls.X509KeyPair(encoded, encoded)
+		if err != nil {
+			h.Close()
+			return nil, fmt.Errorf("invalid inherited certificate: %w", err)
+		}
+		h.Certificate = &cert
+	}
+	return h, nil
+}
+
+// Options returns the server options that make a new server use the
+// inherited sockets. Pass an empty address to server.New alongside them, since
+// the previous process's listeners already include its primary one.
+func (h *Handoff) Options() []server.Option {
+	return []server.Option{
+		server.WithListeners(h.Listeners...),
+		server.WithHTTPSockets(h.Sockets),
+	}
+}
+
+// Ready tells the previous process that this one is serving, so it can start
+// draining its clients.
+func (h *Handoff) Ready() error {
+	defer func() { _ = h.ready.Close() }()
+	if _, err := h.ready.Write([]byte{1}); err != nil {
+		return fmt.Errorf("failed to report readiness: %w", err)
+	}
+	return nil
+}
+
+// Close closes the inherited sockets, for a process that fails to start.
+func (h *Handoff) Close() {
+	for _, l := range h.Listeners {
+		if l.StreamSocket != nil {
+			_ = l.StreamSocket.Close()
+		} else {
+			_ = l.PacketSocket.Close()
+		}
+	}
+	for _, ln := range h.Sockets {
+		_ = ln.Close()
+	}
+	if h.ready != nil {
+		_ = h.ready.Close()
+	}
+}
@@ -0,0 +1,158 @@
+package upgrade_test
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/omochice/toy-socket-chat/internal/devcert"
+	"github.com/omochice/toy-socket-chat/internal/server"
+	"github.com/omochice/toy-socket-chat/internal/upgrade"
+	"github.com/omochice/toy-socket-chat/pkg/protocol"
+)
+
+// newProcessMOTD is the MOTD of the server run by the re-executed test
+// binary, which tells its clients apart from the original server's.
+const newProcessMOTD = "served by the new process"
+
+// envFail makes the re-executed test binary exit before reporting readiness.
+const envFail = "UPGRADE_TEST_FAIL"
+
+// TestMain runs the test binary as the new server process when Exec starts it.
+func TestMain(m *testing.M) {
+	handoff, err := upgrade.Inherited()
+	if handoff == nil && err == nil {
+		os.Exit(m.Run())
+	}
+	if err != nil || os.Getenv(envFail) != "" {
+		os.Exit(1)
+	}
+
+	opts := append(handoff.Options(), server.WithMOTD(newProcessMOTD))
+	if handoff.Certificate != nil {
+		opts = append(opts, server.WithTLS(*handoff.Certificate))
+	}
+	srv := server.New("", opts...)
+	go func() {
+		_ = srv.Start()
+	}()
+	<-srv.Ready()
+	if err := handoff.Ready(); err != nil {
+		os.Exit(1)
+	}
+	// The test kills this process when done; exit on our own in case it
+	// cannot.
+	time.Sleep(10 * time.Second)
+	os.Exit(0)
+}
+
+func TestExec(t *testing.T) {
+	old := server.New("127.0.0.1:0")
+	go func() {
+		_ = old.Start()
+	}()
+	<-old.Ready()
+	addr := old.Addr()
+
+	proc, err := upgrade.Exec(old, nil, 10*time.Second)
+	if err != nil {
+		old.Stop()
+		t.Fatalf("Exec() error = %v", err)
+	}
+	defer func() {
+		_ = proc.Kill()
+		_, _ = proc.Wait()
+	}()
+	old.Drain(time.Second)
+
+	// The old server has stopped, so only the new process can answer.
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Failed to connect after upgrade: %v", err)
+	}
+	defer func() { _ = conn.Close() }()
+	join := protocol.Message{Type: protocol.MessageTypeJoin, Sender: "alice"}
+	data, err := join.Encode()
+	if err != nil {
+		t.Fatalf("Failed to encode join message: %v", err)
+	}
+	if err := protocol.WriteFrame(conn, data); err != nil {
+		t.Fatalf("Failed to send join message: %v", err)
+	}
+
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	data, err = protocol.ReadFrame(conn)
+	if err != nil {
+		t.Fatalf("Failed to read message: %v", err)
+	}
+	var msg protocol.Message
+	if err := msg.Decode(data); err != nil {
+		t.Fatalf("Failed to decode message: %v", err)
+	}
+	if msg.Content != newProcessMOTD {
+		t.Errorf("Received %q, want the new process's MOTD %q", msg.Content, newProcessMOTD)
+	}
+}
+
+func TestExec_HandsOverCertificate(t *testing.T) {
+	cert, _, err := devcert.Generate([]string{"localhost", "127.0.0.1"})
+	if err != nil {
+		t.Fatalf("Failed to generate certificate: %v", err)
+	}
+	old := server.New("",
+		server.WithTLS(cert),
+		server.WithListeners(server.Listener{Address: "127.0.0.1:0", TLS: true}),
+	)
+	go func() {
+		_ = old.Start()
+	}()
+	<-old.Ready()
+	addr := old.Addr()
+
+	proc, err := upgrade.Exec(old, nil, 10*time.Second)
+	if err != nil {
+		old.Stop()
+		t.Fatalf("Exec() error = %v", err)
+	}
+	defer func() {
+		_ = proc.Kill()
+		_, _ = proc.Wait()
+	}()
+	old.Drain(time.Second)
+
+	// Only the old certificate is trusted, so the handshake fails if the new
+	// process presents any other.
+	roots := x509.NewCertPool()
+	roots.AddCert(cert.Leaf)
+	conn, err := tls.Dial("tcp", addr, &tls.Config{RootCAs: roots, ServerName: "localhost"})
+	if err != nil {
+		t.Fatalf("TLS handshake after upgrade failed: %v", err)
+	}
+	_ = conn.Close()
+}
+
+func TestExec_NewProcessFails(t *testing.T) {
+	t.Setenv(envFail, "1")
+	srv := server.New("127.0.0.1:0")
+	go func() {
+		_ = srv.Start()
+	}()
+	<-srv.Ready()
+	defer srv.Stop()
+
+	_, err := upgrade.Exec(srv, nil, 10*time.Second)
+	if err == nil || !strings.Contains(err.Error(), "exited before it was ready") {
+		t.Fatalf("Exec() error = %v, want the new process to have exited", err)
+	}
+
+	// The old server keeps serving.
+	conn, err := net.Dial("tcp", srv.Addr())
+	if err != nil {
+		t.Fatalf("Failed to connect after failed upgrade: %v", err)
+	}
+	_ = conn.Close()
+}
@@ -0,0 +1,60 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// MaxFrameSize bounds the length of one framed message, so a corrupt or
+// hostile length prefix cannot make a reader allocate without limit.
+const MaxFrameSize = 1 << 20
+
+// frameHeaderSize is the length of the prefix written before each message.
+const frameHeaderSize = 4
+
+// StreamPurposeBulk is sent as the first frame on a WebTransport stream
+// opened for large messages, so they do not hold up the chat stream.
+const StreamPurposeBulk = "bulk"
+
+// ErrFrameTooLarge is returned for a frame longer than MaxFrameSize.
+var ErrFrameTooLarge = errors.New("frame too large")
+
+// WriteFrame writes data to w as one frame: its length as a 4-byte big-endian
+// unsigned integer, then data itself. Byte-stream transports (TCP and
+// WebTransport streams) frame every message this way, since one read may
+// return part of a message or several. The frame is written with a single
+// Write, so frames written concurrently to a net.Conn do not interleave.
+func WriteFrame(w io.Writer, data []byte) error {
+	if len(data) > MaxFrameSize {
+		return fmt.Errorf("%w: %d bytes", ErrFrameTooLarge, len(data))
+	}
+	frame := make([]byte, frameHeaderSize+len(data))
+	binary.BigEndian.PutUint32(frame, uint32(len(data)))
+	copy(frame[frameHeaderSize:], data)
+	_, err := w.Write(frame)
+	return err
+}
+
+// ReadFrame reads one frame written by WriteFrame from r and returns its data.
+// It returns io.EOF if r ends before the frame starts, and
+// io.ErrUnexpectedEOF if it ends partway through.
+func ReadFrame(r io.Reader) ([]byte, error) {
+	var header [frameHeaderSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(header[:])
+	if n > MaxFrameSize {
+		return nil, fmt.Errorf("%w: %d bytes", ErrFrameTooLarge, n)
+	}
+	data := make([]byte, n)
+	if _, err := io.ReadFull(r, data); err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return data, nil
+}
@@ -0,0 +1,74 @@
+package protocol_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/omochice/toy-socket-chat/pkg/protocol"
+)
+
+func TestFrame_RoundTrip(t *testing.T) {
+	// Several frames written back to back, as on a stream, come apart again.
+	payloads := [][]byte{
+		[]byte("first"),
+		{},
+		[]byte(strings.Repeat("large ", 2000)),
+		[]byte("last"),
+	}
+	var stream bytes.Buffer
+	for _, p := range payloads {
+		if err := protocol.WriteFrame(&stream, p); err != nil {
+			t.Fatalf("WriteFrame() error = %v", err)
+		}
+	}
+
+	for i, want := range payloads {
+		got, err := protocol.ReadFrame(&stream)
+		if err != nil {
+			t.Fatalf("ReadFrame() #%d error = %v", i, err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("ReadFrame() #%d = %d bytes, want %d", i, len(got), len(want))
+		}
+	}
+	if _, err := protocol.ReadFrame(&stream); !errors.Is(err, io.EOF) {
+		t.Errorf("ReadFrame() at end error = %v, want io.EOF", err)
+	}
+}
+
+func TestReadFrame_Errors(t *testing.T) {
+	tooLarge := binary.BigEndian.AppendUint32(nil, protocol.MaxFrameSize+1)
+	truncated := append(binary.BigEndian.AppendUint32(nil, 10), "short"...)
+
+	tests := []struct {
+		name  string
+		input []byte
+		want  error
+	}{
+		{name: "partial header", input: []byte{0, 0}, want: io.ErrUnexpectedEOF},
+		{name: "truncated data", input: truncated, want: io.ErrUnexpectedEOF},
+		{name: "too large", input: tooLarge, want: protocol.ErrFrameTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := protocol.ReadFrame(bytes.NewReader(tt.input)); !errors.Is(err, tt.want) {
+				t.Errorf("ReadFrame() error = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestWriteFrame_TooLarge(t *testing.T) {
+	var buf bytes.Buffer
+	err := protocol.WriteFrame(&buf, make([]byte, protocol.MaxFrameSize+1))
+	if !errors.Is(err, protocol.ErrFrameTooLarge) {
+		t.Errorf("WriteFrame() error = %v, want ErrFrameTooLarge", err)
+	}
+	if buf.Len() != 0 {
+		t.Errorf("WriteFrame() wrote %d bytes, want none", buf.Len())
+	}
+}
@@ -4,6 +4,7 @@ package protocol
 
 import (
 	"fmt"
+	"time"
 
 	"github.com/omochice/toy-socket-chat/pkg/protocol/pb"
 	"google.golang.org/protobuf/proto"
@@ -16,8 +17,63 @@ const (
 	MessageTypeText MessageType = iota
 	MessageTypeJoin
 	MessageTypeLeave
+	// MessageTypeReconnect is sent by the server before it hands its
+	// listeners to a new process; clients should reconnect to keep chatting.
+	MessageTypeReconnect
+	// MessageTypeFederate is exchanged by servers opening a federation link,
+	// with their names as Sender, nonces as Content and their proofs of the
+	// shared secret as ID.
+	MessageTypeFederate
+	// MessageTypeAck is sent by the server to the sender of a message that
+	// carried a CorrelationID once it has been accepted and broadcast.
+	MessageTypeAck
+	// MessageTypeNack is sent instead of MessageTypeAck when the server
+	// refuses the message, with the reason as Content.
+	MessageTypeNack
+	// MessageTypeEdit replaces the Content of the earlier TEXT message with
+	// the same ID.
+	MessageTypeEdit
+	// MessageTypeDelete removes the earlier TEXT message with the same ID.
+	MessageTypeDelete
+	// MessageTypeReaction adds the Sender's reaction, the emoji in Content,
+	// to the TEXT message with the same ID, or takes it back if Remove is
+	// set. The server passes it on with the message's new Reactions.
+	MessageTypeReaction
+	// MessageTypeThread asks the server for the replies to the message with
+	// the same ID. The ACK carries them in Replies.
+	MessageTypeThread
+	// MessageTypeMention is sent by the server to a user mentioned in the
+	// TEXT message with the same ID, with that message's Sender and Content.
+	// Mentions made while the user was offline are sent when they join.
+	MessageTypeMention
+	// MessageTypeTyping says the Sender is typing, or has stopped if Remove
+	// is set. The server passes it on without storing it; clients treat a
+	// user as stopped once TypingTimeout passes without another.
+	MessageTypeTyping
+	// MessageTypeRead moves the Sender's read marker to the message with the
+	// same ID, the last one they have seen, and is passed on to the others as
+	// a read receipt unless Private is set. Without an ID it only asks for
+	// the marker. The ACK carries the marker in ID and the number of messages
+	// after it in Unread.
+	MessageTypeRead
+	// MessageTypeDirect is a text message for the user named by Recipient
+	// only. The server gives it an ID like a TEXT but does not store it; if
+	// the recipient is offline it is queued until they join, and the ACK
+	// says so with Content "queued".
+	MessageTypeDirect
 )
 
+// TypingTimeout is how long a TYPING message lasts. A client whose user is
+// still typing sends another before it passes.
+const TypingTimeout = 5 * time.Second
+
+// Ephemeral reports whether messages of the type may be lost without harm, so
+// transports that can send them unreliably, such as WebTransport datagrams,
+// do.
+func (mt MessageType) Ephemeral() bool {
+	return mt == MessageTypeTyping
+}
+
 // String returns the string representation of MessageType
 func (mt MessageType) String() string {
 	switch mt {
@@ -27,6 +83,30 @@ func (mt MessageType) String() string {
 		return "JOIN"
 	case MessageTypeLeave:
 		return "LEAVE"
+	case MessageTypeReconnect:
+		return "RECONNECT"
+	case MessageTypeFederate:
+		return "FEDERATE"
+	case MessageTypeAck:
+		return "ACK"
+	case MessageTypeNack:
+		return "NACK"
+	case MessageTypeEdit:
+		return "EDIT"
+	case MessageTypeDelete:
+		return "DELETE"
+	case MessageTypeReaction:
+		return "REACTION"
+	case MessageTypeThread:
+		return "THREAD"
+	case MessageTypeMention:
+		return "MENTION"
+	case MessageTypeTyping:
+		return "TYPING"
+	case MessageTypeRead:
+		return "READ"
+	case MessageTypeDirect:
+		return "DIRECT"
 	default:
 		return "UNKNOWN"
 	}
@@ -37,6 +117,37 @@ type Message struct {
 	Type    MessageType
 	Sender  string
 	Content string
+	// CorrelationID, when set by a client, is echoed in the server's ACK or
+	// NACK for the message.
+	CorrelationID string
+	// ID is assigned by the server to each TEXT message, and names the
+	// message an EDIT, DELETE or REACTION applies to.
+	ID string
+	// Remove is set on a REACTION that takes the reaction back, and on a
+	// TYPING that says the sender stopped.
+	Remove bool
+	// Reactions counts the users per emoji who reacted to the message named
+	// by ID. The server sets it on each REACTION it passes on.
+	Reactions map[string]int
+	// ParentID makes a TEXT message a reply to the message with that ID. The
+	// server points it at the first message of the thread.
+	ParentID string
+	// ReplyCount is the number of replies in a thread, set by the server on
+	// each reply and on the ACK for a THREAD request.
+	ReplyCount int
+	// Replies are the most recent replies of a thread, oldest first, in the
+	// ACK for a THREAD request.
+	Replies []Message
+	// Mentions are the users mentioned as @username in a TEXT message's
+	// Content, as resolved by the server.
+	Mentions []string
+	// Private is set on a READ whose receipt is not shown to other users.
+	Private bool
+	// Unread is the number of messages after the user's read marker, in the
+	// ACK for a READ.
+	Unread int
+	// Recipient is the user a DIRECT message is addressed to.
+	Recipient string
 }
 
 // Encode encodes the message into bytes using protobuf
@@ -62,11 +173,30 @@ func (m *Message) Decode(data []byte) error {
 // toProto converts the Message to protobuf Message.
 // This conversion isolates protobuf implementation details from the public API.
 func (m *Message) toProto() *pb.Message {
-	return &pb.Message{
-		Type:    messageTypeToProto(m.Type),
-		Sender:  m.Sender,
-		Content: m.Content,
+	pbMsg := &pb.Message{
+		Type:          messageTypeToProto(m.Type),
+		Sender:        m.Sender,
+		Content:       m.Content,
+		CorrelationId: m.CorrelationID,
+		Id:            m.ID,
+		Remove:        m.Remove,
+		ParentId:      m.ParentID,
+		ReplyCount:    int32(m.ReplyCount),
+		Mentions:      m.Mentions,
+		Private:       m.Private,
+		Unread:        int32(m.Unread),
+		Recipient:     m.Recipient,
+	}
+	for i := range m.Replies {
+		pbMsg.Replies = append(pbMsg.Replies, m.Replies[i].toProto())
 	}
+	if len(m.Reactions) > 0 {
+		pbMsg.Reactions = make(map[string]int32, len(m.Reactions))
+		for emoji, count := range m.Reactions {
+			pbMsg.Reactions[emoji] = int32(count)
+		}
+	}
+	return pbMsg
 }
 
 // fromProto populates the Message from protobuf Message.
@@ -75,6 +205,28 @@ func (m *Message) fromProto(pbMsg *pb.Message) {
 	m.Type = messageTypeFromProto(pbMsg.Type)
 	m.Sender = pbMsg.Sender
 	m.Content = pbMsg.Content
+	m.CorrelationID = pbMsg.CorrelationId
+	m.ID = pbMsg.Id
+	m.Remove = pbMsg.Remove
+	m.ParentID = pbMsg.ParentId
+	m.ReplyCount = int(pbMsg.ReplyCount)
+	m.Mentions = pbMsg.Mentions
+	m.Private = pbMsg.Private
+	m.Unread = int(pbMsg.Unread)
+	m.Recipient = pbMsg.Recipient
+	m.Replies = nil
+	for _, reply := range pbMsg.Replies {
+		var r Message
+		r.fromProto(reply)
+		m.Replies = append(m.Replies, r)
+	}
+	m.Reactions = nil
+	if len(pbMsg.Reactions) > 0 {
+		m.Reactions = make(map[string]int, len(pbMsg.Reactions))
+		for emoji, count := range pbMsg.Reactions {
+			m.Reactions[emoji] = int(count)
+		}
+	}
 }
 
 // messageTypeToProto converts MessageType to protobuf enum.
@@ -88,6 +240,30 @@ func messageTypeToProto(mt MessageType) pb.MessageType {
 		return pb.MessageType_MESSAGE_TYPE_JOIN
 	case MessageTypeLeave:
 		return pb.MessageType_MESSAGE_TYPE_LEAVE
+	case MessageTypeReconnect:
+		return pb.MessageType_MESSAGE_TYPE_RECONNECT
+	case MessageTypeFederate:
+		return pb.MessageType_MESSAGE_TYPE_FEDERATE
+	case MessageTypeAck:
+		return pb.MessageType_MESSAGE_TYPE_ACK
+	case MessageTypeNack:
+		return pb.MessageType_MESSAGE_TYPE_NACK
+	case MessageTypeEdit:
+		return pb.MessageType_MESSAGE_TYPE_EDIT
+	case MessageTypeDelete:
+		return pb.MessageType_MESSAGE_TYPE_DELETE
+	case MessageTypeReaction:
+		return pb.MessageType_MESSAGE_TYPE_REACTION
+	case MessageTypeThread:
+		return pb.MessageType_MESSAGE_TYPE_THREAD
+	case MessageTypeMention:
+		return pb.MessageType_MESSAGE_TYPE_MENTION
+	case MessageTypeTyping:
+		return pb.MessageType_MESSAGE_TYPE_TYPING
+	case MessageTypeRead:
+		return pb.MessageType_MESSAGE_TYPE_READ
+	case MessageTypeDirect:
+		return pb.MessageType_MESSAGE_TYPE_DIRECT
 	default:
 		return pb.MessageType_MESSAGE_TYPE_TEXT
 	}
@@ -104,6 +280,30 @@ func messageTypeFromProto(pbType pb.MessageType) MessageType {
 		return MessageTypeJoin
 	case pb.MessageType_MESSAGE_TYPE_LEAVE:
 		return MessageTypeLeave
+	case pb.MessageType_MESSAGE_TYPE_RECONNECT:
+		return MessageTypeReconnect
+	case pb.MessageType_MESSAGE_TYPE_FEDERATE:
+		return MessageTypeFederate
+	case pb.MessageType_MESSAGE_TYPE_ACK:
+		return MessageTypeAck
+	case pb.MessageType_MESSAGE_TYPE_NACK:
+		return MessageTypeNack
+	case pb.MessageType_MESSAGE_TYPE_EDIT:
+		return MessageTypeEdit
+	case pb.MessageType_MESSAGE_TYPE_DELETE:
+		return MessageTypeDelete
+	case pb.MessageType_MESSAGE_TYPE_REACTION:
+		return MessageTypeReaction
+	case pb.MessageType_MESSAGE_TYPE_THREAD:
+		return MessageTypeThread
+	case pb.MessageType_MESSAGE_TYPE_MENTION:
+		return MessageTypeMention
+	case pb.MessageType_MESSAGE_TYPE_TYPING:
+		return MessageTypeTyping
+	case pb.MessageType_MESSAGE_TYPE_READ:
+		return MessageTypeRead
+	case pb.MessageType_MESSAGE_TYPE_DIRECT:
+		return MessageTypeDirect
 	default:
 		return MessageTypeText
 	}
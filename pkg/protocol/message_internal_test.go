@@ -142,6 +142,18 @@ func TestMessageTypeConversion(t *testing.T) {
 		{"text type", MessageTypeText, pb.MessageType_MESSAGE_TYPE_TEXT},
 		{"join type", MessageTypeJoin, pb.MessageType_MESSAGE_TYPE_JOIN},
 		{"leave type", MessageTypeLeave, pb.MessageType_MESSAGE_TYPE_LEAVE},
+		{"reconnect type", MessageTypeReconnect, pb.MessageType_MESSAGE_TYPE_RECONNECT},
+		{"federate type", MessageTypeFederate, pb.MessageType_MESSAGE_TYPE_FEDERATE},
+		{"ack type", MessageTypeAck, pb.MessageType_MESSAGE_TYPE_ACK},
+		{"nack type", MessageTypeNack, pb.MessageType_MESSAGE_TYPE_NACK},
+		{"edit type", MessageTypeEdit, pb.MessageType_MESSAGE_TYPE_EDIT},
+		{"delete type", MessageTypeDelete, pb.MessageType_MESSAGE_TYPE_DELETE},
+		{"reaction type", MessageTypeReaction, pb.MessageType_MESSAGE_TYPE_REACTION},
+		{"thread type", MessageTypeThread, pb.MessageType_MESSAGE_TYPE_THREAD},
+		{"mention type", MessageTypeMention, pb.MessageType_MESSAGE_TYPE_MENTION},
+		{"typing type", MessageTypeTyping, pb.MessageType_MESSAGE_TYPE_TYPING},
+		{"read type", MessageTypeRead, pb.MessageType_MESSAGE_TYPE_READ},
+		{"direct type", MessageTypeDirect, pb.MessageType_MESSAGE_TYPE_DIRECT},
 	}
 
 	for _, tt := range tests {
@@ -1,6 +1,7 @@
 package protocol_test
 
 import (
+	"reflect"
 	"testing"
 
 	"github.com/omochice/toy-socket-chat/pkg/protocol"
@@ -106,31 +107,79 @@ func TestMessage_Decode(t *testing.T) {
 }
 
 func TestMessage_EncodeDecodeRoundTrip(t *testing.T) {
-	original := protocol.Message{
-		Type:    protocol.MessageTypeText,
-		Sender:  "testuser",
-		Content: "Test message content",
-	}
-
-	encoded, err := original.Encode()
-	if err != nil {
-		t.Fatalf("Encode failed: %v", err)
-	}
-
-	var decoded protocol.Message
-	err = decoded.Decode(encoded)
-	if err != nil {
-		t.Fatalf("Decode failed: %v", err)
+	tests := []struct {
+		name string
+		msg  protocol.Message
+	}{
+		{
+			name: "text with mentions",
+			msg: protocol.Message{
+				Type:          protocol.MessageTypeText,
+				Sender:        "testuser",
+				Content:       "Test message content",
+				CorrelationID: "42",
+				ID:            "7f3a",
+				Mentions:      []string{"alice", "bob@serverB"},
+			},
+		},
+		{
+			name: "reaction",
+			msg: protocol.Message{
+				Type:      protocol.MessageTypeReaction,
+				Sender:    "bob",
+				Content:   "👍",
+				ID:        "7f3a",
+				Remove:    true,
+				Reactions: map[string]int{"🎉": 2},
+			},
+		},
+		{
+			name: "thread replies",
+			msg: protocol.Message{
+				Type:       protocol.MessageTypeAck,
+				ID:         "7f3a",
+				ReplyCount: 3,
+				Replies: []protocol.Message{
+					{Sender: "bob", Content: "first", ID: "81c0", ParentID: "7f3a"},
+					{Sender: "carol", Content: "second", ID: "9d21", ParentID: "7f3a"},
+				},
+			},
+		},
+		{
+			name: "read marker",
+			msg: protocol.Message{
+				Type:    protocol.MessageTypeRead,
+				Sender:  "bob",
+				ID:      "7f3a",
+				Private: true,
+				Unread:  4,
+			},
+		},
+		{
+			name: "direct",
+			msg: protocol.Message{
+				Type:      protocol.MessageTypeDirect,
+				Sender:    "alice",
+				Content:   "see you at noon",
+				Recipient: "bob",
+			},
+		},
 	}
 
-	if decoded.Type != original.Type {
-		t.Errorf("Type mismatch: got %v, want %v", decoded.Type, original.Type)
-	}
-	if decoded.Sender != original.Sender {
-		t.Errorf("Sender mismatch: got %v, want %v", decoded.Sender, original.Sender)
-	}
-	if decoded.Content != original.Content {
-		t.Errorf("Content mismatch: got %v, want %v", decoded.Content, original.Content)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			encoded, err := tt.msg.Encode()
+			if err != nil {
+				t.Fatalf("Encode failed: %v", err)
+			}
+			var decoded protocol.Message
+			if err := decoded.Decode(encoded); err != nil {
+				t.Fatalf("Decode failed: %v", err)
+			}
+			if !reflect.DeepEqual(decoded, tt.msg) {
+				t.Errorf("Decoded %+v, want %+v", decoded, tt.msg)
+			}
+		})
 	}
 }
 
@@ -143,6 +192,18 @@ func TestMessageType_String(t *testing.T) {
 		{"text type", protocol.MessageTypeText, "TEXT"},
 		{"join type", protocol.MessageTypeJoin, "JOIN"},
 		{"leave type", protocol.MessageTypeLeave, "LEAVE"},
+		{"reconnect type", protocol.MessageTypeReconnect, "RECONNECT"},
+		{"federate type", protocol.MessageTypeFederate, "FEDERATE"},
+		{"ack type", protocol.MessageTypeAck, "ACK"},
+		{"nack type", protocol.MessageTypeNack, "NACK"},
+		{"edit type", protocol.MessageTypeEdit, "EDIT"},
+		{"delete type", protocol.MessageTypeDelete, "DELETE"},
+		{"reaction type", protocol.MessageTypeReaction, "REACTION"},
+		{"thread type", protocol.MessageTypeThread, "THREAD"},
+		{"mention type", protocol.MessageTypeMention, "MENTION"},
+		{"typing type", protocol.MessageTypeTyping, "TYPING"},
+		{"read type", protocol.MessageTypeRead, "READ"},
+		{"direct type", protocol.MessageTypeDirect, "DIRECT"},
 	}
 
 	for _, tt := range tests {
@@ -153,3 +214,19 @@ func TestMessageType_String(t *testing.T) {
 		})
 	}
 }
+
+func TestMessageType_Ephemeral(t *testing.T) {
+	if !protocol.MessageTypeTyping.Ephemeral() {
+		t.Error("TYPING should be ephemeral")
+	}
+	for _, mt := range []protocol.MessageType{
+		protocol.MessageTypeText,
+		protocol.MessageTypeJoin,
+		protocol.MessageTypeReaction,
+		protocol.MessageTypeMention,
+	} {
+		if mt.Ephemeral() {
+			t.Errorf("%s should not be ephemeral", mt)
+		}
+	}
+}
@@ -1,6 +1,6 @@
 // Code generated by protoc-gen-go. DO NOT EDIT.
 // versions:
-// 	protoc-gen-go v1.36.10
+// 	protoc-gen-go v1.36.12
 // 	protoc        v6.32.1
 // source: message.proto
 
@@ -31,19 +31,72 @@ const (
 	MessageType_MESSAGE_TYPE_JOIN MessageType = 1
 	// User left notification
 	MessageType_MESSAGE_TYPE_LEAVE MessageType = 2
+	// Server is handing its connections over to a new process; reconnect
+	MessageType_MESSAGE_TYPE_RECONNECT MessageType = 3
+	// Opens a federation link between servers; sender is the server name
+	MessageType_MESSAGE_TYPE_FEDERATE MessageType = 4
+	// Server accepted the message with the same correlation_id
+	MessageType_MESSAGE_TYPE_ACK MessageType = 5
+	// Server refused the message with the same correlation_id; content is the reason
+	MessageType_MESSAGE_TYPE_NACK MessageType = 6
+	// Replaces the content of the message with the same id
+	MessageType_MESSAGE_TYPE_EDIT MessageType = 7
+	// Removes the message with the same id
+	MessageType_MESSAGE_TYPE_DELETE MessageType = 8
+	// Adds (or with remove, takes back) the sender's reaction, the emoji in
+	// content, to the message with the same id
+	MessageType_MESSAGE_TYPE_REACTION MessageType = 9
+	// Asks for the replies to the message with the same id; the ACK carries
+	// them in replies
+	MessageType_MESSAGE_TYPE_THREAD MessageType = 10
+	// Tells a user they were mentioned in the TEXT message with the same id;
+	// sender and content are the message's
+	MessageType_MESSAGE_TYPE_MENTION MessageType = 11
+	// Says the sender is typing, or with remove, has stopped; never stored
+	MessageType_MESSAGE_TYPE_TYPING MessageType = 12
+	// Moves the sender's read marker to the message with the same id (or with
+	// no id, only asks for it); the ACK carries the marker and unread count
+	MessageType_MESSAGE_TYPE_READ MessageType = 13
+	// A text message for the recipient only, queued by the server while they
+	// are offline
+	MessageType_MESSAGE_TYPE_DIRECT MessageType = 14
 )
 
 // Enum value maps for MessageType.
 var (
 	MessageType_name = map[int32]string{
-		0: "MESSAGE_TYPE_TEXT",
-		1: "MESSAGE_TYPE_JOIN",
-		2: "MESSAGE_TYPE_LEAVE",
+		0:  "MESSAGE_TYPE_TEXT",
+		1:  "MESSAGE_TYPE_JOIN",
+		2:  "MESSAGE_TYPE_LEAVE",
+		3:  "MESSAGE_TYPE_RECONNECT",
+		4:  "MESSAGE_TYPE_FEDERATE",
+		5:  "MESSAGE_TYPE_ACK",
+		6:  "MESSAGE_TYPE_NACK",
+		7:  "MESSAGE_TYPE_EDIT",
+		8:  "MESSAGE_TYPE_DELETE",
+		9:  "MESSAGE_TYPE_REACTION",
+		10: "MESSAGE_TYPE_THREAD",
+		11: "MESSAGE_TYPE_MENTION",
+		12: "MESSAGE_TYPE_TYPING",
+		13: "MESSAGE_TYPE_READ",
+		14: "MESSAGE_TYPE_DIRECT",
 	}
 	MessageType_value = map[string]int32{
-		"MESSAGE_TYPE_TEXT":  0,
-		"MESSAGE_TYPE_JOIN":  1,
-		"MESSAGE_TYPE_LEAVE": 2,
+		"MESSAGE_TYPE_TEXT":      0,
+		"MESSAGE_TYPE_JOIN":      1,
+		"MESSAGE_TYPE_LEAVE":     2,
+		"MESSAGE_TYPE_RECONNECT": 3,
+		"MESSAGE_TYPE_FEDERATE":  4,
+		"MESSAGE_TYPE_ACK":       5,
+		"MESSAGE_TYPE_NACK":      6,
+		"MESSAGE_TYPE_EDIT":      7,
+		"MESSAGE_TYPE_DELETE":    8,
+		"MESSAGE_TYPE_REACTION":  9,
+		"MESSAGE_TYPE_THREAD":    10,
+		"MESSAGE_TYPE_MENTION":   11,
+		"MESSAGE_TYPE_TYPING":    12,
+		"MESSAGE_TYPE_READ":      13,
+		"MESSAGE_TYPE_DIRECT":    14,
 	}
 )
 
@@ -82,7 +135,33 @@ type Message struct {
 	// Username of the sender
 	Sender string `protobuf:"bytes,2,opt,name=sender,proto3" json:"sender,omitempty"`
 	// Content of the message (empty for JOIN/LEAVE)
-	Content       string `protobuf:"bytes,3,opt,name=content,proto3" json:"content,omitempty"`
+	Content string `protobuf:"bytes,3,opt,name=content,proto3" json:"content,omitempty"`
+	// Client-chosen ID echoed in the server's ACK or NACK (empty for none)
+	CorrelationId string `protobuf:"bytes,4,opt,name=correlation_id,json=correlationId,proto3" json:"correlation_id,omitempty"`
+	// Server-assigned ID of a TEXT message, or of the message an EDIT or DELETE
+	// refers to; an ACK for a TEXT message carries the ID it was given
+	Id string `protobuf:"bytes,5,opt,name=id,proto3" json:"id,omitempty"`
+	// Set on a REACTION that takes the reaction back, and on a TYPING that says
+	// the sender stopped
+	Remove bool `protobuf:"varint,6,opt,name=remove,proto3" json:"remove,omitempty"`
+	// Number of users per emoji who reacted to the message, as counted by the
+	// server after a REACTION
+	Reactions map[string]int32 `protobuf:"bytes,7,rep,name=reactions,proto3" json:"reactions,omitempty" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"varint,2,opt,name=value"`
+	// ID of the message a TEXT message replies to (empty for none)
+	ParentId string `protobuf:"bytes,8,opt,name=parent_id,json=parentId,proto3" json:"parent_id,omitempty"`
+	// Number of replies in the thread, set by the server on replies and on the
+	// ACK for a THREAD request
+	ReplyCount int32 `protobuf:"varint,9,opt,name=reply_count,json=replyCount,proto3" json:"reply_count,omitempty"`
+	// The most recent replies of a thread, in the ACK for a THREAD request
+	Replies []*Message `protobuf:"bytes,10,rep,name=replies,proto3" json:"replies,omitempty"`
+	// Usernames mentioned as @username in a TEXT message, resolved by the server
+	Mentions []string `protobuf:"bytes,11,rep,name=mentions,proto3" json:"mentions,omitempty"`
+	// Set on a READ whose receipt is not shown to other users
+	Private bool `protobuf:"varint,12,opt,name=private,proto3" json:"private,omitempty"`
+	// Number of messages after the user's read marker, in the ACK for a READ
+	Unread int32 `protobuf:"varint,13,opt,name=unread,proto3" json:"unread,omitempty"`
+	// Username a DIRECT message is addressed to
+	Recipient     string `protobuf:"bytes,14,opt,name=recipient,proto3" json:"recipient,omitempty"`
 	unknownFields protoimpl.UnknownFields
 	sizeCache     protoimpl.SizeCache
 }
@@ -138,19 +217,125 @@ func (x *Message) GetContent() string {
 	return ""
 }
 
+func (x *Message) GetCorrelationId() string {
+	if x != nil {
+		return x.CorrelationId
+	}
+	return ""
+}
+
+func (x *Message) GetId() string {
+	if x != nil {
+		return x.Id
+	}
+	return ""
+}
+
+func (x *Message) GetRemove() bool {
+	if x != nil {
+		return x.Remove
+	}
+	return false
+}
+
+func (x *Message) GetReactions() map[string]int32 {
+	if x != nil {
+		return x.Reactions
+	}
+	return nil
+}
+
+func (x *Message) GetParentId() string {
+	if x != nil {
+		return x.ParentId
+	}
+	return ""
+}
+
+func (x *Message) GetReplyCount() int32 {
+	if x != nil {
+		return x.ReplyCount
+	}
+	return 0
+}
+
+func (x *Message) GetReplies() []*Message {
+	if x != nil {
+		return x.Replies
+	}
+	return nil
+}
+
+func (x *Message) GetMentions() []string {
+	if x != nil {
+		return x.Mentions
+	}
+	return nil
+}
+
+func (x *Message) GetPrivate() bool {
+	if x != nil {
+		return x.Private
+	}
+	return false
+}
+
+func (x *Message) GetUnread() int32 {
+	if x != nil {
+		return x.Unread
+	}
+	return 0
+}
+
+func (x *Message) GetRecipient() string {
+	if x != nil {
+		return x.Recipient
+	}
+	return ""
+}
+
 var File_message_proto protoreflect.FileDescriptor
 
 const file_message_proto_rawDesc = "" +
 	"\n" +
-	"\rmessage.proto\x12\bprotocol\"f\n" +
+	"\rmessage.proto\x12\bprotocol\"\x8a\x04\n" +
 	"\aMessage\x12)\n" +
 	"\x04type\x18\x01 \x01(\x0e2\x15.protocol.MessageTypeR\x04type\x12\x16\n" +
 	"\x06sender\x18\x02 \x01(\tR\x06sender\x12\x18\n" +
-	"\acontent\x18\x03 \x01(\tR\acontent*S\n" +
+	"\acontent\x18\x03 \x01(\tR\acontent\x12%\n" +
+	"\x0ecorrelation_id\x18\x04 \x01(\tR\rcorrelationId\x12\x0e\n" +
+	"\x02id\x18\x05 \x01(\tR\x02id\x12\x16\n" +
+	"\x06remove\x18\x06 \x01(\bR\x06remove\x12>\n" +
+	"\treactions\x18\a \x03(\v2 .protocol.Message.ReactionsEntryR\treactions\x12\x1b\n" +
+	"\tparent_id\x18\b \x01(\tR\bparentId\x12\x1f\n" +
+	"\vreply_count\x18\t \x01(\x05R\n" +
+	"replyCount\x12+\n" +
+	"\areplies\x18\n" +
+	" \x03(\v2\x11.protocol.MessageR\areplies\x12\x1a\n" +
+	"\bmentions\x18\v \x03(\tR\bmentions\x12\x18\n" +
+	"\aprivate\x18\f \x01(\bR\aprivate\x12\x16\n" +
+	"\x06unread\x18\r \x01(\x05R\x06unread\x12\x1c\n" +
+	"\trecipient\x18\x0e \x01(\tR\trecipient\x1a<\n" +
+	"\x0eReactionsEntry\x12\x10\n" +
+	"\x03key\x18\x01 \x01(\tR\x03key\x12\x14\n" +
+	"\x05value\x18\x02 \x01(\x05R\x05value:\x028\x01*\xfe\x02\n" +
 	"\vMessageType\x12\x15\n" +
 	"\x11MESSAGE_TYPE_TEXT\x10\x00\x12\x15\n" +
 	"\x11MESSAGE_TYPE_JOIN\x10\x01\x12\x16\n" +
-	"\x12MESSAGE_TYPE_LEAVE\x10\x02B5Z3github.com/omochice/toy-socket-chat/pkg/protocol/pbb\x06proto3"
+	"\x12MESSAGE_TYPE_LEAVE\x10\x02\x12\x1a\n" +
+	"\x16MESSAGE_TYPE_RECONNECT\x10\x03\x12\x19\n" +
+	"\x15MESSAGE_TYPE_FEDERATE\x10\x04\x12\x14\n" +
+	"\x10MESSAGE_TYPE_ACK\x10\x05\x12\x15\n" +
+	"\x11MESSAGE_TYPE_NACK\x10\x06\x12\x15\n" +
+	"\x11MESSAGE_TYPE_EDIT\x10\a\x12\x17\n" +
+	"\x13MESSAGE_TYPE_DELETE\x10\b\x12\x19\n" +
+	"\x15MESSAGE_TYPE_REACTION\x10\t\x12\x17\n" +
+	"\x13MESSAGE_TYPE_THREAD\x10\n" +
+	"\x12\x18\n" +
+	"\x14MESSAGE_TYPE_MENTION\x10\v\x12\x17\n" +
+	"\x13MESSAGE_TYPE_TYPING\x10\f\x12\x15\n" +
+	"\x11MESSAGE_TYPE_READ\x10\r\x12\x17\n" +
+	"\x13MESSAGE_TYPE_DIRECT\x10\x0eB5Z3github.com/omochice/toy-socket-chat/pkg/protocol/pbb\x06proto3"
 
 var (
 	file_message_proto_rawDescOnce sync.Once
@@ -165,18 +350,21 @@ func file_message_proto_rawDescGZIP() []byte {
 }
 
 var file_message_proto_enumTypes = make([]protoimpl.EnumInfo, 1)
-var file_message_proto_msgTypes = make([]protoimpl.MessageInfo, 1)
+var file_message_proto_msgTypes = make([]protoimpl.MessageInfo, 2)
 var file_message_proto_goTypes = []any{
 	(MessageType)(0), // 0: protocol.MessageType
 	(*Message)(nil),  // 1: protocol.Message
+	nil,              // 2: protocol.Message.ReactionsEntry
 }
 var file_message_proto_depIdxs = []int32{
 	0, // 0: protocol.Message.type:type_name -> protocol.MessageType
-	1, // [1:1] is the sub-list for method output_type
-	1, // [1:1] is the sub-list for method input_type
-	1, // [1:1] is the sub-list for extension type_name
-	1, // [1:1] is the sub-list for extension extendee
-	0, // [0:1] is the sub-list for field type_name
+	2, // 1: protocol.Message.reactions:type_name -> protocol.Message.ReactionsEntry
+	1, // 2: protocol.Message.replies:type_name -> protocol.Message
+	3, // [3:3] is the sub-list for method output_type
+	3, // [3:3] is the sub-list for method input_type
+	3, // [3:3] is the sub-list for extension type_name
+	3, // [3:3] is the sub-list for extension extendee
+	0, // [0:3] is the sub-list for field type_name
 }
 
 func init() { file_message_proto_init() }
@@ -190,7 +378,7 @@ func file_message_proto_init() {
 			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
 			RawDescriptor: unsafe.Slice(unsafe.StringData(file_message_proto_rawDesc), len(file_message_proto_rawDesc)),
 			NumEnums:      1,
-			NumMessages:   1,
+			NumMessages:   2,
 			NumExtensions: 0,
 			NumServices:   0,
 		},
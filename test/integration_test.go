@@ -1,7 +1,10 @@
 package test
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"path/filepath"
 	"testing"
 	"time"
 
@@ -182,3 +185,86 @@ func TestIntegration_MultipleClients(t *testing.T) {
 		}
 	}
 }
+
+// TestIntegration_UnixSocketClients verifies that TCP and WebSocket clients
+// connecting through a Unix socket listener chat with a client on the TCP
+// listener.
+func TestIntegration_UnixSocketClients(t *testing.T) {
+	socketPath := filepath.Join(t.TempDir(), "chat.sock")
+	srv := server.New(
+		"127.0.0.1:0",
+		server.WithListeners(server.Listener{Network: "unix", Address: socketPath}),
+	)
+	go func() {
+		_ = srv.Start()
+	}()
+	defer srv.Stop()
+
+	time.Sleep(100 * time.Millisecond)
+
+	tcpClient := client.New(srv.Addr(), "tcp-user", "tcp")
+	if err := tcpClient.Connect(); err != nil {
+		t.Fatalf("TCP client failed to connect: %v", err)
+	}
+	defer tcpClient.Disconnect()
+	if err := tcpClient.Join(); err != nil {
+		t.Fatalf("TCP client failed to join: %v", err)
+	}
+
+	for _, proto := range []string{"tcp", "ws"} {
+		t.Run(proto, func(t *testing.T) {
+			unixClient := client.New("unix:"+socketPath, "unix-"+proto, proto)
+			if err := unixClient.Connect(); err != nil {
+				t.Fatalf("Unix socket client failed to connect: %v", err)
+			}
+			defer unixClient.Disconnect()
+			if err := unixClient.Join(); err != nil {
+				t.Fatalf("Unix socket client failed to join: %v", err)
+			}
+
+			time.Sleep(100 * time.Millisecond)
+			drainJoinMessages(t, tcpClient)
+
+			content := "Hello over a Unix socket (" + proto + ")"
+			if err := unixClient.SendMessage(content); err != nil {
+				t.Fatalf("Unix socket client failed to send message: %v", err)
+			}
+			if msg := awaitTextMessage(t, tcpClient); msg.Content != content {
+				t.Errorf("TCP client received %q, want %q", msg.Content, content)
+			}
+		})
+	}
+}
+
+func TestIntegration_DeliveryAcknowledgements(t *testing.T) {
+	srv := server.New("127.0.0.1:0", server.WithLimits(server.Limits{MaxMessageLength: 10}))
+	go func() {
+		_ = srv.Start()
+	}()
+	defer srv.Stop()
+	<-srv.Ready()
+
+	for _, proto := range []string{"tcp", "ws"} {
+		t.Run(proto, func(t *testing.T) {
+			c := client.New(srv.Addr(), "user-"+proto, proto)
+			if err := c.Connect(); err != nil {
+				t.Fatalf("Failed to connect: %v", err)
+			}
+			defer c.Disconnect()
+			if err := c.Join(); err != nil {
+				t.Fatalf("Failed to join: %v", err)
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+			defer cancel()
+			if _, err := c.SendMessageContext(ctx, "short"); err != nil {
+				t.Errorf("SendMessageContext() error = %v, want the message accepted", err)
+			}
+			_, err := c.SendMessageContext(ctx, "much longer than allowed")
+			var rejected *client.RejectedError
+			if !errors.As(err, &rejected) || rejected.Reason != "message too long" {
+				t.Errorf("SendMessageContext() error = %v, want it rejected as too long", err)
+			}
+		})
+	}
+}
@@ -1,20 +1,25 @@
 package test
 
 import (
+	"context"
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
+	"errors"
+	"fmt"
 	"math/big"
 	"net"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/omochice/toy-socket-chat/internal/client"
 	"github.com/omochice/toy-socket-chat/internal/server"
 	"github.com/omochice/toy-socket-chat/pkg/protocol"
+	"github.com/quic-go/webtransport-go"
 )
 
 // generateTestCertificate creates a self-signed ECDSA certificate valid for
@@ -242,3 +247,381 @@ func TestIntegration_TCPAndWebTransportClientsBroadcastBothDirections(t *testing
 		)
 	}
 }
+
+// TestIntegration_TypingTravelsAsDatagrams verifies that TYPING messages,
+// which WebTransport clients and the server send as datagrams, reach clients
+// on either transport, falling back to the stream for TCP.
+func TestIntegration_TypingTravelsAsDatagrams(t *testing.T) {
+	cert, pool := generateTestCertificate(t)
+
+	srv := server.New(":0", server.WithTLS(cert))
+	go func() {
+		_ = srv.Start()
+	}()
+	defer srv.Stop()
+
+	<-srv.Ready()
+
+	serverAddr := loopbackAddr(t, srv.Addr())
+
+	tcpClient := client.New(serverAddr, "tcp-user", "tcp")
+	if err := tcpClient.Connect(); err != nil {
+		t.Fatalf("TCP client failed to connect: %v", err)
+	}
+	defer tcpClient.Disconnect()
+	if err := tcpClient.Join(); err != nil {
+		t.Fatalf("TCP client failed to join: %v", err)
+	}
+
+	wtClient := client.New(serverAddr, "wt-user", "wt", client.WithRootCAs(pool))
+	if err := wtClient.Connect(); err != nil {
+		t.Fatalf("WebTransport client failed to connect: %v", err)
+	}
+	defer wtClient.Disconnect()
+	if err := wtClient.Join(); err != nil {
+		t.Fatalf("WebTransport client failed to join: %v", err)
+	}
+
+	time.Sleep(200 * time.Millisecond)
+
+	drainJoinMessages(t, tcpClient)
+	drainJoinMessages(t, wtClient)
+
+	awaitTyping := func(c *client.Client, sender string) {
+		t.Helper()
+		select {
+		case msg := <-c.Messages():
+			if msg.Type != protocol.MessageTypeTyping || msg.Sender != sender {
+				t.Errorf("Received %s from %q, want TYPING from %q", msg.Type, msg.Sender, sender)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("Timeout waiting for TYPING from %q", sender)
+		}
+	}
+
+	if err := wtClient.SetTyping(true); err != nil {
+		t.Fatalf("WebTransport client failed to send typing: %v", err)
+	}
+	awaitTyping(tcpClient, "wt-user")
+
+	if err := tcpClient.SetTyping(true); err != nil {
+		t.Fatalf("TCP client failed to send typing: %v", err)
+	}
+	awaitTyping(wtClient, "tcp-user")
+}
+
+// TestIntegration_WebTransportBulkStream verifies that large messages, which
+// WebTransport clients and the server each send on a bulk stream of their own,
+// arrive whole, and that the chat stream keeps working alongside them.
+func TestIntegration_WebTransportBulkStream(t *testing.T) {
+	cert, pool := generateTestCertificate(t)
+
+	srv := server.New(":0", server.WithTLS(cert))
+	go func() {
+		_ = srv.Start()
+	}()
+	defer srv.Stop()
+	<-srv.Ready()
+
+	serverAddr := loopbackAddr(t, srv.Addr())
+
+	clients := make([]*client.Client, 2)
+	for i := range clients {
+		c := client.New(serverAddr, fmt.Sprintf("wt-user%d", i+1), "wt", client.WithRootCAs(pool))
+		if err := c.Connect(); err != nil {
+			t.Fatalf("Client %d failed to connect: %v", i+1, err)
+		}
+		defer c.Disconnect()
+		if err := c.Join(); err != nil {
+			t.Fatalf("Client %d failed to join: %v", i+1, err)
+		}
+		clients[i] = c
+	}
+
+	time.Sleep(200 * time.Millisecond)
+
+	drainJoinMessages(t, clients[0])
+	drainJoinMessages(t, clients[1])
+
+	exchange := func(from, to *client.Client, content string) {
+		t.Helper()
+		if err := from.SendMessage(content); err != nil {
+			t.Fatalf("Failed to send message: %v", err)
+		}
+		if msg := awaitTextMessage(t, to); msg.Content != content {
+			t.Errorf("Received %d bytes %.20q..., want %d bytes %.20q...",
+				len(msg.Content), msg.Content, len(content), content)
+		}
+	}
+
+	// Larger than one 4 KiB read, so it arrives in pieces.
+	large := strings.Repeat("bulk ", 2000)
+	exchange(clients[0], clients[1], large)
+	exchange(clients[1], clients[0], large+"back")
+	exchange(clients[0], clients[1], "small talk")
+}
+
+// TestIntegration_WebTransportRefusesUnknownStreams verifies that the server
+// refuses further streams opened for a purpose other than bulk transfers with
+// a nonzero code, stops counting them, and sends large messages on the bulk
+// stream it opened instead.
+func TestIntegration_WebTransportRefusesUnknownStreams(t *testing.T) {
+	cert, pool := generateTestCertificate(t)
+
+	srv := server.New(":0", server.WithTLS(cert))
+	go func() {
+		_ = srv.Start()
+	}()
+	defer srv.Stop()
+	<-srv.Ready()
+
+	serverAddr := loopbackAddr(t, srv.Addr())
+
+	d := &webtransport.Dialer{TLSClientConfig: &tls.Config{RootCAs: pool}}
+	_, session, err := d.Dial(context.Background(), "https://"+serverAddr+"/", nil)
+	if err != nil {
+		t.Fatalf("Failed to dial WebTransport session: %v", err)
+	}
+	defer func() { _ = session.CloseWithError(0, "") }()
+	chat, err := session.OpenStreamSync(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to open chat stream: %v", err)
+	}
+	join := protocol.Message{Type: protocol.MessageTypeJoin, Sender: "raw", CorrelationID: "1"}
+	data, err := join.Encode()
+	if err != nil {
+		t.Fatalf("Failed to encode join message: %v", err)
+	}
+	if err := protocol.WriteFrame(chat, data); err != nil {
+		t.Fatalf("Failed to send join message: %v", err)
+	}
+	// The server takes the first stream it accepts for the chat stream, so
+	// wait for the ACK before opening another.
+	_ = chat.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := protocol.ReadFrame(chat); err != nil {
+		t.Fatalf("Failed to read the JOIN's ACK: %v", err)
+	}
+
+	// More streams than a session may have open at once, one after another:
+	// each refused stream stops counting, so all are refused alike.
+	var code webtransport.StreamErrorCode
+	for i := range 5 {
+		video, err := session.OpenStreamSync(context.Background())
+		if err != nil {
+			t.Fatalf("Failed to open stream: %v", err)
+		}
+		if err := protocol.WriteFrame(video, []byte("video")); err != nil {
+			t.Fatalf("Failed to send stream purpose: %v", err)
+		}
+		_ = video.SetReadDeadline(time.Now().Add(2 * time.Second))
+		var streamErr *webtransport.StreamError
+		_, err = video.Read(make([]byte, 1))
+		if !errors.As(err, &streamErr) || !streamErr.Remote || streamErr.ErrorCode == 0 {
+			t.Fatalf("Read() on stream %d for an unknown purpose error = %v, want it refused",
+				i, err)
+		}
+		if i == 0 {
+			code = streamErr.ErrorCode
+		} else if streamErr.ErrorCode != code {
+			t.Errorf("Stream %d refused with code %d, want %d", i, streamErr.ErrorCode, code)
+		}
+	}
+
+	sender := client.New(serverAddr, "sender", "tcp")
+	if err := sender.Connect(); err != nil {
+		t.Fatalf("Sender failed to connect: %v", err)
+	}
+	defer sender.Disconnect()
+	if err := sender.Join(); err != nil {
+		t.Fatalf("Sender failed to join: %v", err)
+	}
+	large := strings.Repeat("bulk ", 2000)
+	if err := sender.SendMessage(large); err != nil {
+		t.Fatalf("Failed to send message: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	bulk, err := session.AcceptStream(ctx)
+	if err != nil {
+		t.Fatalf("Failed to accept the server's bulk stream: %v", err)
+	}
+	_ = bulk.SetReadDeadline(time.Now().Add(2 * time.Second))
+	purpose, err := protocol.ReadFrame(bulk)
+	if err != nil || string(purpose) != protocol.StreamPurposeBulk {
+		t.Fatalf("Server stream purpose = %q, %v, want %q",
+			purpose, err, protocol.StreamPurposeBulk)
+	}
+	for {
+		data, err := protocol.ReadFrame(bulk)
+		if err != nil {
+			t.Fatalf("Failed to read the large message from the bulk stream: %v", err)
+		}
+		var msg protocol.Message
+		if err := msg.Decode(data); err != nil {
+			t.Fatalf("Failed to decode message: %v", err)
+		}
+		if msg.Type == protocol.MessageTypeText {
+			if msg.Content != large {
+				t.Errorf("Received %d bytes, want %d", len(msg.Content), len(large))
+			}
+			return
+		}
+	}
+}
+
+// TestIntegration_WebTransportOnSeparatePort verifies that a WebTransport
+// listener configured on its own UDP port shares the chat with a TCP listener
+// on a different port.
+func TestIntegration_WebTransportOnSeparatePort(t *testing.T) {
+	cert, pool := generateTestCertificate(t)
+
+	srv := server.New(
+		"",
+		server.WithTLS(cert),
+		server.WithListeners(
+			server.Listener{Address: "127.0.0.1:0"},
+			server.Listener{Network: "udp", Address: "127.0.0.1:0"},
+		),
+	)
+	go func() {
+		_ = srv.Start()
+	}()
+	defer srv.Stop()
+
+	time.Sleep(100 * time.Millisecond)
+
+	addrs := srv.Addrs()
+	if len(addrs) != 2 {
+		t.Fatalf("Addrs() = %v, want 2 addresses", addrs)
+	}
+	if addrs[0] == addrs[1] {
+		t.Fatalf("Listeners share address %s, want separate ports", addrs[0])
+	}
+
+	tcpClient := client.New(addrs[0], "tcp-user", "tcp")
+	if err := tcpClient.Connect(); err != nil {
+		t.Fatalf("TCP client failed to connect: %v", err)
+	}
+	defer tcpClient.Disconnect()
+	if err := tcpClient.Join(); err != nil {
+		t.Fatalf("TCP client failed to join: %v", err)
+	}
+
+	wtClient := client.New(addrs[1], "wt-user", "wt", client.WithRootCAs(pool))
+	if err := wtClient.Connect(); err != nil {
+		t.Fatalf("WebTransport client failed to connect: %v", err)
+	}
+	defer wtClient.Disconnect()
+	if err := wtClient.Join(); err != nil {
+		t.Fatalf("WebTransport client failed to join: %v", err)
+	}
+
+	time.Sleep(200 * time.Millisecond)
+	drainJoinMessages(t, tcpClient)
+
+	if err := wtClient.SendMessage("Hello from another port"); err != nil {
+		t.Fatalf("WebTransport client failed to send message: %v", err)
+	}
+	if msg := awaitTextMessage(t, tcpClient); msg.Sender != "wt-user" {
+		t.Errorf("TCP client received message from %q, want %q", msg.Sender, "wt-user")
+	}
+}
+
+// TestIntegration_WebTransportHandover verifies that a draining server stops
+// reading the UDP socket it shares with the new process once its WebTransport
+// clients have left, so new sessions reach the new process while stream
+// clients are still draining.
+func TestIntegration_WebTransportHandover(t *testing.T) {
+	cert, pool := generateTestCertificate(t)
+
+	old := server.New("127.0.0.1:0", server.WithTLS(cert))
+	go func() {
+		_ = old.Start()
+	}()
+	<-old.Ready()
+	addr := loopbackAddr(t, old.Addr())
+
+	wtClient := client.New(addr, "wt-user", "wt", client.WithRootCAs(pool))
+	if err := wtClient.Connect(); err != nil {
+		t.Fatalf("WebTransport client failed to connect: %v", err)
+	}
+	if err := wtClient.Join(); err != nil {
+		t.Fatalf("WebTransport client failed to join: %v", err)
+	}
+	// This client ignores RECONNECT, keeping the old server draining.
+	tcpClient := client.New(addr, "tcp-user", "tcp")
+	if err := tcpClient.Connect(); err != nil {
+		t.Fatalf("TCP client failed to connect: %v", err)
+	}
+	defer tcpClient.Disconnect()
+	if err := tcpClient.Join(); err != nil {
+		t.Fatalf("TCP client failed to join: %v", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	// Hand the sockets to a second server, as a new process would receive
+	// them.
+	listeners, files, err := old.ListenerFiles()
+	if err != nil {
+		t.Fatalf("ListenerFiles() error = %v", err)
+	}
+	for i, f := range files {
+		if listeners[i].Network == "udp" {
+			listeners[i].PacketSocket, err = net.FilePacketConn(f)
+		} else {
+			listeners[i].StreamSocket, err = net.FileListener(f)
+		}
+		_ = f.Close()
+		if err != nil {
+			t.Fatalf("Failed to open listener file: %v", err)
+		}
+	}
+	next := server.New("", server.WithListeners(listeners...), server.WithTLS(cert))
+	go func() {
+		_ = next.Start()
+	}()
+	defer next.Stop()
+	<-next.Ready()
+
+	drained := make(chan struct{})
+	go func() {
+		old.Drain(5 * time.Second)
+		close(drained)
+	}()
+
+	for reconnect := false; !reconnect; {
+		select {
+		case msg := <-wtClient.Messages():
+			reconnect = msg.Type == protocol.MessageTypeReconnect
+		case <-time.After(2 * time.Second):
+			t.Fatal("Timeout waiting for RECONNECT")
+		}
+	}
+	wtClient.Disconnect()
+	time.Sleep(300 * time.Millisecond)
+
+	const sessions = 5
+	for i := range sessions {
+		c := client.New(addr, fmt.Sprintf("wt-user%d", i), "wt", client.WithRootCAs(pool))
+		if err := c.Connect(); err != nil {
+			t.Fatalf("Session %d failed to connect: %v", i, err)
+		}
+		defer c.Disconnect()
+		if err := c.Join(); err != nil {
+			t.Fatalf("Session %d failed to join: %v", i, err)
+		}
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for next.ClientCount() != sessions && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if count := next.ClientCount(); count != sessions {
+		t.Errorf("New server ClientCount() = %d, want %d", count, sessions)
+	}
+	select {
+	case <-drained:
+		t.Error("Drain returned while a TCP client was still connected")
+	default:
+	}
+}